@@ -3,30 +3,110 @@ package api
 //go:generate go run github.com/Khan/genqlient
 
 import (
+	"crypto/tls"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"net/http/httptrace"
 	"net/http/httputil"
+	"net/url"
 	"os"
 	"time"
 
 	"github.com/Khan/genqlient/graphql"
 )
 
-func NewClient(token, endpoint string) graphql.Client {
+// ClientOptions contains optional settings for the client created by
+// NewClient.
+type ClientOptions struct {
+	// TLSConfig is used for connections to the GraphQL endpoint, for example
+	// to present a client certificate or to trust a particular CA. If nil,
+	// the settings of http.DefaultTransport are used.
+	TLSConfig *tls.Config
+
+	// Proxy returns the proxy to use for a request, in the same way as
+	// http.Transport.Proxy. Proxy credentials can be supplied as user info in
+	// the returned URL. If nil, the settings of http.DefaultTransport are used
+	// (i.e. proxies from the environment).
+	Proxy func(*http.Request) (*url.URL, error)
+
+	// ObserveResponseSize, if set, is called with the number of bytes read
+	// from each response body, when the body is closed.
+	ObserveResponseSize func(bytes int64)
+
+	// ObserveConn, if set, is called when each request gets a connection,
+	// with whether it is an idle connection being reused rather than a new
+	// one.
+	ObserveConn func(reused bool)
+
+	// ObserveDNSLookup, if set, is called when each DNS lookup for a new
+	// connection starts.
+	ObserveDNSLookup func()
+}
+
+// NewClient creates a GraphQL client that authenticates with the token. If
+// more than one ClientOptions is given, fields set in later options take
+// precedence.
+func NewClient(token, endpoint string, opts ...ClientOptions) graphql.Client {
 	if endpoint == "" {
 		endpoint = "https://graphql.buildkite.com/v1"
 	}
+	var o ClientOptions
+	for _, opt := range opts {
+		if opt.TLSConfig != nil {
+			o.TLSConfig = opt.TLSConfig
+		}
+		if opt.Proxy != nil {
+			o.Proxy = opt.Proxy
+		}
+		if opt.ObserveResponseSize != nil {
+			o.ObserveResponseSize = opt.ObserveResponseSize
+		}
+		if opt.ObserveConn != nil {
+			o.ObserveConn = opt.ObserveConn
+		}
+		if opt.ObserveDNSLookup != nil {
+			o.ObserveDNSLookup = opt.ObserveDNSLookup
+		}
+	}
+	transport := o.transport()
+	if o.ObserveResponseSize != nil {
+		transport = &sizeTransport{observe: o.ObserveResponseSize, wrapped: transport}
+	}
+	if o.ObserveConn != nil || o.ObserveDNSLookup != nil {
+		transport = &traceTransport{
+			trace:   connTrace(o.ObserveConn, o.ObserveDNSLookup),
+			wrapped: transport,
+		}
+	}
 	httpClient := http.Client{
 		Timeout: 60 * time.Second,
-		Transport: NewLogger(&authedTransport{
-			key:     token,
-			wrapped: http.DefaultTransport,
-		}),
+		Transport: &statusTransport{
+			wrapped: NewLogger(&authedTransport{
+				key:     token,
+				wrapped: transport,
+			}),
+		},
 	}
 	return graphql.NewClient(endpoint, &httpClient)
 }
 
+// transport returns the transport that requests are ultimately sent with.
+func (o ClientOptions) transport() http.RoundTripper {
+	if o.TLSConfig == nil && o.Proxy == nil {
+		return http.DefaultTransport
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	if o.TLSConfig != nil {
+		t.TLSClientConfig = o.TLSConfig.Clone()
+	}
+	if o.Proxy != nil {
+		t.Proxy = o.Proxy
+	}
+	return t
+}
+
 type authedTransport struct {
 	key     string
 	wrapped http.RoundTripper
@@ -53,6 +133,111 @@ func (t *authedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
 	return t.wrapped.RoundTrip(reqCopy)
 }
 
+// HTTPError is returned (wrapped in a *url.Error) by the client's requests
+// when the GraphQL endpoint responds with a status other than 200 OK.
+type HTTPError struct {
+	StatusCode int
+	Status     string
+
+	// Body is the start of the response body.
+	Body string
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("returned error %s: %s", e.Status, e.Body)
+}
+
+// maxErrorBodySize is the most of a response body kept in an HTTPError.
+const maxErrorBodySize = 1024
+
+// statusTransport turns responses with a status other than 200 OK into an
+// *HTTPError, so that callers can tell them apart without parsing the error
+// message.
+type statusTransport struct {
+	wrapped http.RoundTripper
+}
+
+func (t *statusTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.wrapped.RoundTrip(req)
+	if err != nil || resp.StatusCode == http.StatusOK {
+		return resp, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxErrorBodySize))
+	if err != nil {
+		body = []byte(fmt.Sprintf("<unreadable: %v>", err))
+	}
+	return nil, &HTTPError{
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		Body:       string(body),
+	}
+}
+
+// sizeTransport reports the size of each response body once it is closed.
+type sizeTransport struct {
+	observe func(int64)
+	wrapped http.RoundTripper
+}
+
+func (t *sizeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.wrapped.RoundTrip(req)
+	if err != nil || resp.Body == nil {
+		return resp, err
+	}
+	resp.Body = &countingBody{ReadCloser: resp.Body, observe: t.observe}
+	return resp, nil
+}
+
+// countingBody counts the bytes read from the body, and reports them once
+// when it is closed.
+type countingBody struct {
+	io.ReadCloser
+	observe func(int64)
+	n       int64
+	closed  bool
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
+
+func (b *countingBody) Close() error {
+	if !b.closed {
+		b.closed = true
+		b.observe(b.n)
+	}
+	return b.ReadCloser.Close()
+}
+
+// traceTransport adds a client trace to each request, to observe how its
+// connection was obtained.
+type traceTransport struct {
+	trace   *httptrace.ClientTrace
+	wrapped http.RoundTripper
+}
+
+func (t *traceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := httptrace.WithClientTrace(req.Context(), t.trace)
+	return t.wrapped.RoundTrip(req.WithContext(ctx))
+}
+
+// connTrace returns a client trace that calls observeConn (if not nil) when a
+// request gets a connection, and observeDNS (if not nil) when a DNS lookup
+// starts.
+func connTrace(observeConn func(reused bool), observeDNS func()) *httptrace.ClientTrace {
+	trace := &httptrace.ClientTrace{}
+	if observeConn != nil {
+		trace.GotConn = func(info httptrace.GotConnInfo) { observeConn(info.Reused) }
+	}
+	if observeDNS != nil {
+		trace.DNSStart = func(httptrace.DNSStartInfo) { observeDNS() }
+	}
+	return trace
+}
+
 type logTransport struct {
 	inner http.RoundTripper
 }
@@ -0,0 +1,155 @@
+package api_test
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/Khan/genqlient/graphql"
+	"github.com/buildkite/agent-stack-k8s/v2/api"
+)
+
+func TestNewClient_Proxy(t *testing.T) {
+	t.Parallel()
+
+	type proxied struct {
+		url, auth, proxyAuth string
+	}
+	var (
+		mu   sync.Mutex
+		reqs []proxied
+	)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		reqs = append(reqs, proxied{
+			url:       r.URL.String(),
+			auth:      r.Header.Get("Authorization"),
+			proxyAuth: r.Header.Get("Proxy-Authorization"),
+		})
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"data":{}}`))
+	}))
+	t.Cleanup(proxy.Close)
+
+	proxyURL, err := url.Parse(proxy.URL)
+	if err != nil {
+		t.Fatalf("url.Parse(%q) error = %v", proxy.URL, err)
+	}
+	proxyURL.User = url.UserPassword("user", "hunter2")
+
+	const endpoint = "http://graphql.buildkite.invalid/v1"
+	client := api.NewClient("bk-token", endpoint, api.ClientOptions{
+		Proxy: http.ProxyURL(proxyURL),
+	})
+
+	req := &graphql.Request{Query: "query { viewer { id } }"}
+	if err := client.MakeRequest(context.Background(), req, &graphql.Response{Data: &struct{}{}}); err != nil {
+		t.Fatalf("client.MakeRequest(...) error = %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(reqs) != 1 {
+		t.Fatalf("proxy received %d requests, want 1", len(reqs))
+	}
+	got := reqs[0]
+	if got.url != endpoint {
+		t.Errorf("proxied request URL = %q, want %q", got.url, endpoint)
+	}
+	if want := "Bearer bk-token"; got.auth != want {
+		t.Errorf("proxied request Authorization = %q, want %q", got.auth, want)
+	}
+	if want := "Basic " + base64.StdEncoding.EncodeToString([]byte("user:hunter2")); got.proxyAuth != want {
+		t.Errorf("proxied request Proxy-Authorization = %q, want %q", got.proxyAuth, want)
+	}
+}
+
+func TestNewClient_ObserveResponseSize(t *testing.T) {
+	t.Parallel()
+
+	const body = `{"data":{"viewer":{"id":"abc"}}}`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+
+	var sizes []int64
+	client := api.NewClient("bk-token", server.URL, api.ClientOptions{
+		ObserveResponseSize: func(bytes int64) { sizes = append(sizes, bytes) },
+	})
+
+	for range 2 {
+		req := &graphql.Request{Query: "query { viewer { id } }"}
+		if err := client.MakeRequest(context.Background(), req, &graphql.Response{Data: &struct{}{}}); err != nil {
+			t.Fatalf("client.MakeRequest(...) error = %v", err)
+		}
+	}
+
+	if len(sizes) != 2 {
+		t.Fatalf("observed %d response sizes, want 2", len(sizes))
+	}
+	for _, got := range sizes {
+		if want := int64(len(body)); got != want {
+			t.Errorf("observed response size = %d, want %d", got, want)
+		}
+	}
+}
+
+func TestNewClient_ObserveConn(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"data":{"viewer":{"id":"abc"}}}`))
+	}))
+	t.Cleanup(server.Close)
+
+	var reused []bool
+	client := api.NewClient("bk-token", server.URL, api.ClientOptions{
+		ObserveConn: func(r bool) { reused = append(reused, r) },
+	})
+
+	for range 3 {
+		req := &graphql.Request{Query: "query { viewer { id } }"}
+		if err := client.MakeRequest(context.Background(), req, &graphql.Response{Data: &struct{}{}}); err != nil {
+			t.Fatalf("client.MakeRequest(...) error = %v", err)
+		}
+	}
+
+	// The first request opens a connection, which the others reuse.
+	if want := []bool{false, true, true}; !slices.Equal(reused, want) {
+		t.Errorf("observed connection reuse = %v, want %v", reused, want)
+	}
+}
+
+func TestNewClient_HTTPError(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "token expired", http.StatusUnauthorized)
+	}))
+	t.Cleanup(server.Close)
+
+	client := api.NewClient("bk-token", server.URL)
+	req := &graphql.Request{Query: "query { viewer { id } }"}
+	err := client.MakeRequest(context.Background(), req, &graphql.Response{Data: &struct{}{}})
+
+	var httpErr *api.HTTPError
+	if !errors.As(err, &httpErr) {
+		t.Fatalf("client.MakeRequest(...) error = %v, want an *api.HTTPError", err)
+	}
+	if got, want := httpErr.StatusCode, http.StatusUnauthorized; got != want {
+		t.Errorf("httpErr.StatusCode = %d, want %d", got, want)
+	}
+	if got, want := httpErr.Body, "token expired\n"; got != want {
+		t.Errorf("httpErr.Body = %q, want %q", got, want)
+	}
+}
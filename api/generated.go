@@ -11,6 +11,22 @@ import (
 	"github.com/Khan/genqlient/graphql"
 )
 
+// The visual style of the annotation
+type AnnotationStyle string
+
+const (
+	// The default styling of an annotation
+	AnnotationStyleDefault AnnotationStyle = "DEFAULT"
+	// The annotation has a red border with a cross next to it
+	AnnotationStyleError AnnotationStyle = "ERROR"
+	// The annotation has a blue border with an information icon next to it
+	AnnotationStyleInfo AnnotationStyle = "INFO"
+	// The annotation has a green border with a tick next to it
+	AnnotationStyleSuccess AnnotationStyle = "SUCCESS"
+	// The annotation has an orange border with a warning icon next to it
+	AnnotationStyleWarning AnnotationStyle = "WARNING"
+)
+
 // Build includes the GraphQL fields of Build requested by the fragment Build.
 // The GraphQL type's documentation follows.
 //
@@ -41,6 +57,65 @@ func (v *Build) GetState() BuildStates { return v.State }
 // GetJobs returns Build.Jobs, and is useful for accessing the field via an interface.
 func (v *Build) GetJobs() BuildJobsJobConnection { return v.Jobs }
 
+// BuildAnnotateBuildAnnotateBuildAnnotatePayload includes the requested fields of the GraphQL type BuildAnnotatePayload.
+// The GraphQL type's documentation follows.
+//
+// Autogenerated return type of BuildAnnotate.
+type BuildAnnotateBuildAnnotateBuildAnnotatePayload struct {
+	// A unique identifier for the client performing the mutation.
+	ClientMutationId string `json:"clientMutationId"`
+}
+
+// GetClientMutationId returns BuildAnnotateBuildAnnotateBuildAnnotatePayload.ClientMutationId, and is useful for accessing the field via an interface.
+func (v *BuildAnnotateBuildAnnotateBuildAnnotatePayload) GetClientMutationId() string {
+	return v.ClientMutationId
+}
+
+// Autogenerated input type of BuildAnnotate
+type BuildAnnotateInput struct {
+	// Append to an existing annotation
+	Append bool `json:"append"`
+	// The body of the annotation. Markdown and some limited HTML is supported
+	Body string `json:"body"`
+	// The GraphQL ID of the build you want to annotate
+	BuildID string `json:"buildID"`
+	// A unique identifier for the client performing the mutation.
+	ClientMutationId string `json:"clientMutationId"`
+	// A string label to differentiate this annotation from other annotations. The default is `default`
+	Context string `json:"context"`
+	// The style of the annotation. The default is `DEFAULT`
+	Style AnnotationStyle `json:"style"`
+}
+
+// GetAppend returns BuildAnnotateInput.Append, and is useful for accessing the field via an interface.
+func (v *BuildAnnotateInput) GetAppend() bool { return v.Append }
+
+// GetBody returns BuildAnnotateInput.Body, and is useful for accessing the field via an interface.
+func (v *BuildAnnotateInput) GetBody() string { return v.Body }
+
+// GetBuildID returns BuildAnnotateInput.BuildID, and is useful for accessing the field via an interface.
+func (v *BuildAnnotateInput) GetBuildID() string { return v.BuildID }
+
+// GetClientMutationId returns BuildAnnotateInput.ClientMutationId, and is useful for accessing the field via an interface.
+func (v *BuildAnnotateInput) GetClientMutationId() string { return v.ClientMutationId }
+
+// GetContext returns BuildAnnotateInput.Context, and is useful for accessing the field via an interface.
+func (v *BuildAnnotateInput) GetContext() string { return v.Context }
+
+// GetStyle returns BuildAnnotateInput.Style, and is useful for accessing the field via an interface.
+func (v *BuildAnnotateInput) GetStyle() AnnotationStyle { return v.Style }
+
+// BuildAnnotateResponse is returned by BuildAnnotate on success.
+type BuildAnnotateResponse struct {
+	// Annotate a build with information to appear on the build page.
+	BuildAnnotate BuildAnnotateBuildAnnotateBuildAnnotatePayload `json:"buildAnnotate"`
+}
+
+// GetBuildAnnotate returns BuildAnnotateResponse.BuildAnnotate, and is useful for accessing the field via an interface.
+func (v *BuildAnnotateResponse) GetBuildAnnotate() BuildAnnotateBuildAnnotateBuildAnnotatePayload {
+	return v.BuildAnnotate
+}
+
 // Author for a build
 type BuildAuthorInput struct {
 	// The email for the build author
@@ -397,10 +472,18 @@ type CommandJob struct {
 	Env []string `json:"env"`
 	// The time when the job became scheduled for running
 	ScheduledAt time.Time `json:"scheduledAt"`
+	// The state of the job
+	State JobStates `json:"state"`
 	// The ruleset used to find an agent to run this job
 	AgentQueryRules []string `json:"agentQueryRules"`
 	// The command the job will run
 	Command string `json:"command"`
+	// The cluster queue of this job
+	ClusterQueue *CommandJobClusterQueue `json:"clusterQueue"`
+	// The build that this job is a part of
+	Build *CommandJobBuild `json:"build"`
+	// The priority of this job
+	Priority CommandJobPriority `json:"priority"`
 }
 
 // GetUuid returns CommandJob.Uuid, and is useful for accessing the field via an interface.
@@ -412,12 +495,56 @@ func (v *CommandJob) GetEnv() []string { return v.Env }
 // GetScheduledAt returns CommandJob.ScheduledAt, and is useful for accessing the field via an interface.
 func (v *CommandJob) GetScheduledAt() time.Time { return v.ScheduledAt }
 
+// GetState returns CommandJob.State, and is useful for accessing the field via an interface.
+func (v *CommandJob) GetState() JobStates { return v.State }
+
 // GetAgentQueryRules returns CommandJob.AgentQueryRules, and is useful for accessing the field via an interface.
 func (v *CommandJob) GetAgentQueryRules() []string { return v.AgentQueryRules }
 
 // GetCommand returns CommandJob.Command, and is useful for accessing the field via an interface.
 func (v *CommandJob) GetCommand() string { return v.Command }
 
+// GetClusterQueue returns CommandJob.ClusterQueue, and is useful for accessing the field via an interface.
+func (v *CommandJob) GetClusterQueue() *CommandJobClusterQueue { return v.ClusterQueue }
+
+// GetBuild returns CommandJob.Build, and is useful for accessing the field via an interface.
+func (v *CommandJob) GetBuild() *CommandJobBuild { return v.Build }
+
+// GetPriority returns CommandJob.Priority, and is useful for accessing the field via an interface.
+func (v *CommandJob) GetPriority() CommandJobPriority { return v.Priority }
+
+// CommandJobBuild includes the requested fields of the GraphQL type Build.
+// The GraphQL type's documentation follows.
+//
+// A build from a pipeline
+type CommandJobBuild struct {
+	// The branch for the build
+	Branch string `json:"branch"`
+}
+
+// GetBranch returns CommandJobBuild.Branch, and is useful for accessing the field via an interface.
+func (v *CommandJobBuild) GetBranch() string { return v.Branch }
+
+// CommandJobClusterQueue includes the requested fields of the GraphQL type ClusterQueue.
+type CommandJobClusterQueue struct {
+	// The public UUID for this cluster queue
+	Uuid string `json:"uuid"`
+}
+
+// GetUuid returns CommandJobClusterQueue.Uuid, and is useful for accessing the field via an interface.
+func (v *CommandJobClusterQueue) GetUuid() string { return v.Uuid }
+
+// CommandJobPriority includes the requested fields of the GraphQL type JobPriority.
+// The GraphQL type's documentation follows.
+//
+// The priority with which a job will run
+type CommandJobPriority struct {
+	Number int `json:"number"`
+}
+
+// GetNumber returns CommandJobPriority.Number, and is useful for accessing the field via an interface.
+func (v *CommandJobPriority) GetNumber() int { return v.Number }
+
 // GetBuildBuild includes the requested fields of the GraphQL type Build.
 // The GraphQL type's documentation follows.
 //
@@ -736,80 +863,574 @@ func __marshalGetCommandJobJob(v *GetCommandJobJob) ([]byte, error) {
 	}
 }
 
-// GetCommandJobJobJobTypeBlock includes the requested fields of the GraphQL type JobTypeBlock.
-// The GraphQL type's documentation follows.
-//
-// A type of job that requires a user to unblock it before proceeding in a build pipeline
-type GetCommandJobJobJobTypeBlock struct {
-	Typename string `json:"__typename"`
+// GetCommandJobJobJobTypeBlock includes the requested fields of the GraphQL type JobTypeBlock.
+// The GraphQL type's documentation follows.
+//
+// A type of job that requires a user to unblock it before proceeding in a build pipeline
+type GetCommandJobJobJobTypeBlock struct {
+	Typename string `json:"__typename"`
+}
+
+// GetTypename returns GetCommandJobJobJobTypeBlock.Typename, and is useful for accessing the field via an interface.
+func (v *GetCommandJobJobJobTypeBlock) GetTypename() string { return v.Typename }
+
+// GetCommandJobJobJobTypeCommand includes the requested fields of the GraphQL type JobTypeCommand.
+// The GraphQL type's documentation follows.
+//
+// A type of job that runs a command on an agent
+type GetCommandJobJobJobTypeCommand struct {
+	Typename string `json:"__typename"`
+	Id       string `json:"id"`
+	// The state of the job
+	State JobStates `json:"state"`
+}
+
+// GetTypename returns GetCommandJobJobJobTypeCommand.Typename, and is useful for accessing the field via an interface.
+func (v *GetCommandJobJobJobTypeCommand) GetTypename() string { return v.Typename }
+
+// GetId returns GetCommandJobJobJobTypeCommand.Id, and is useful for accessing the field via an interface.
+func (v *GetCommandJobJobJobTypeCommand) GetId() string { return v.Id }
+
+// GetState returns GetCommandJobJobJobTypeCommand.State, and is useful for accessing the field via an interface.
+func (v *GetCommandJobJobJobTypeCommand) GetState() JobStates { return v.State }
+
+// GetCommandJobJobJobTypeTrigger includes the requested fields of the GraphQL type JobTypeTrigger.
+// The GraphQL type's documentation follows.
+//
+// A type of job that triggers another build on a pipeline
+type GetCommandJobJobJobTypeTrigger struct {
+	Typename string `json:"__typename"`
+}
+
+// GetTypename returns GetCommandJobJobJobTypeTrigger.Typename, and is useful for accessing the field via an interface.
+func (v *GetCommandJobJobJobTypeTrigger) GetTypename() string { return v.Typename }
+
+// GetCommandJobJobJobTypeWait includes the requested fields of the GraphQL type JobTypeWait.
+// The GraphQL type's documentation follows.
+//
+// A type of job that waits for all previous jobs to pass before proceeding the build pipeline
+type GetCommandJobJobJobTypeWait struct {
+	Typename string `json:"__typename"`
+}
+
+// GetTypename returns GetCommandJobJobJobTypeWait.Typename, and is useful for accessing the field via an interface.
+func (v *GetCommandJobJobJobTypeWait) GetTypename() string { return v.Typename }
+
+// GetCommandJobResponse is returned by GetCommandJob on success.
+type GetCommandJobResponse struct {
+	// Find a build job
+	Job GetCommandJobJob `json:"-"`
+}
+
+// GetJob returns GetCommandJobResponse.Job, and is useful for accessing the field via an interface.
+func (v *GetCommandJobResponse) GetJob() GetCommandJobJob { return v.Job }
+
+func (v *GetCommandJobResponse) UnmarshalJSON(b []byte) error {
+
+	if string(b) == "null" {
+		return nil
+	}
+
+	var firstPass struct {
+		*GetCommandJobResponse
+		Job json.RawMessage `json:"job"`
+		graphql.NoUnmarshalJSON
+	}
+	firstPass.GetCommandJobResponse = v
+
+	err := json.Unmarshal(b, &firstPass)
+	if err != nil {
+		return err
+	}
+
+	{
+		dst := &v.Job
+		src := firstPass.Job
+		if len(src) != 0 && string(src) != "null" {
+			err = __unmarshalGetCommandJobJob(
+				src, dst)
+			if err != nil {
+				return fmt.Errorf(
+					"unable to unmarshal GetCommandJobResponse.Job: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+type __premarshalGetCommandJobResponse struct {
+	Job json.RawMessage `json:"job"`
+}
+
+func (v *GetCommandJobResponse) MarshalJSON() ([]byte, error) {
+	premarshaled, err := v.__premarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(premarshaled)
+}
+
+func (v *GetCommandJobResponse) __premarshalJSON() (*__premarshalGetCommandJobResponse, error) {
+	var retval __premarshalGetCommandJobResponse
+
+	{
+
+		dst := &retval.Job
+		src := v.Job
+		var err error
+		*dst, err = __marshalGetCommandJobJob(
+			&src)
+		if err != nil {
+			return nil, fmt.Errorf(
+				"unable to marshal GetCommandJobResponse.Job: %w", err)
+		}
+	}
+	return &retval, nil
+}
+
+// GetJobJob includes the requested fields of the GraphQL interface Job.
+//
+// GetJobJob is implemented by the following types:
+// GetJobJobJobTypeBlock
+// GetJobJobJobTypeCommand
+// GetJobJobJobTypeTrigger
+// GetJobJobJobTypeWait
+// The GraphQL type's documentation follows.
+//
+// Kinds of jobs that can exist on a build
+type GetJobJob interface {
+	implementsGraphQLInterfaceGetJobJob()
+	// GetTypename returns the receiver's concrete GraphQL type-name (see interface doc for possible values).
+	GetTypename() string
+	Job
+}
+
+func (v *GetJobJobJobTypeBlock) implementsGraphQLInterfaceGetJobJob()   {}
+func (v *GetJobJobJobTypeCommand) implementsGraphQLInterfaceGetJobJob() {}
+func (v *GetJobJobJobTypeTrigger) implementsGraphQLInterfaceGetJobJob() {}
+func (v *GetJobJobJobTypeWait) implementsGraphQLInterfaceGetJobJob()    {}
+
+func __unmarshalGetJobJob(b []byte, v *GetJobJob) error {
+	if string(b) == "null" {
+		return nil
+	}
+
+	var tn struct {
+		TypeName string `json:"__typename"`
+	}
+	err := json.Unmarshal(b, &tn)
+	if err != nil {
+		return err
+	}
+
+	switch tn.TypeName {
+	case "JobTypeBlock":
+		*v = new(GetJobJobJobTypeBlock)
+		return json.Unmarshal(b, *v)
+	case "JobTypeCommand":
+		*v = new(GetJobJobJobTypeCommand)
+		return json.Unmarshal(b, *v)
+	case "JobTypeTrigger":
+		*v = new(GetJobJobJobTypeTrigger)
+		return json.Unmarshal(b, *v)
+	case "JobTypeWait":
+		*v = new(GetJobJobJobTypeWait)
+		return json.Unmarshal(b, *v)
+	case "":
+		return fmt.Errorf(
+			"response was missing Job.__typename")
+	default:
+		return fmt.Errorf(
+			`unexpected concrete type for GetJobJob: "%v"`, tn.TypeName)
+	}
+}
+
+func __marshalGetJobJob(v *GetJobJob) ([]byte, error) {
+
+	var typename string
+	switch v := (*v).(type) {
+	case *GetJobJobJobTypeBlock:
+		typename = "JobTypeBlock"
+
+		premarshaled, err := v.__premarshalJSON()
+		if err != nil {
+			return nil, err
+		}
+		result := struct {
+			TypeName string `json:"__typename"`
+			*__premarshalGetJobJobJobTypeBlock
+		}{typename, premarshaled}
+		return json.Marshal(result)
+	case *GetJobJobJobTypeCommand:
+		typename = "JobTypeCommand"
+
+		premarshaled, err := v.__premarshalJSON()
+		if err != nil {
+			return nil, err
+		}
+		result := struct {
+			TypeName string `json:"__typename"`
+			*__premarshalGetJobJobJobTypeCommand
+		}{typename, premarshaled}
+		return json.Marshal(result)
+	case *GetJobJobJobTypeTrigger:
+		typename = "JobTypeTrigger"
+
+		premarshaled, err := v.__premarshalJSON()
+		if err != nil {
+			return nil, err
+		}
+		result := struct {
+			TypeName string `json:"__typename"`
+			*__premarshalGetJobJobJobTypeTrigger
+		}{typename, premarshaled}
+		return json.Marshal(result)
+	case *GetJobJobJobTypeWait:
+		typename = "JobTypeWait"
+
+		premarshaled, err := v.__premarshalJSON()
+		if err != nil {
+			return nil, err
+		}
+		result := struct {
+			TypeName string `json:"__typename"`
+			*__premarshalGetJobJobJobTypeWait
+		}{typename, premarshaled}
+		return json.Marshal(result)
+	case nil:
+		return []byte("null"), nil
+	default:
+		return nil, fmt.Errorf(
+			`unexpected concrete type for GetJobJob: "%T"`, v)
+	}
+}
+
+// GetJobJobJobTypeBlock includes the requested fields of the GraphQL type JobTypeBlock.
+// The GraphQL type's documentation follows.
+//
+// A type of job that requires a user to unblock it before proceeding in a build pipeline
+type GetJobJobJobTypeBlock struct {
+	Typename        string `json:"__typename"`
+	JobJobTypeBlock `json:"-"`
+}
+
+// GetTypename returns GetJobJobJobTypeBlock.Typename, and is useful for accessing the field via an interface.
+func (v *GetJobJobJobTypeBlock) GetTypename() string { return v.Typename }
+
+func (v *GetJobJobJobTypeBlock) UnmarshalJSON(b []byte) error {
+
+	if string(b) == "null" {
+		return nil
+	}
+
+	var firstPass struct {
+		*GetJobJobJobTypeBlock
+		graphql.NoUnmarshalJSON
+	}
+	firstPass.GetJobJobJobTypeBlock = v
+
+	err := json.Unmarshal(b, &firstPass)
+	if err != nil {
+		return err
+	}
+
+	err = json.Unmarshal(
+		b, &v.JobJobTypeBlock)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+type __premarshalGetJobJobJobTypeBlock struct {
+	Typename string `json:"__typename"`
+}
+
+func (v *GetJobJobJobTypeBlock) MarshalJSON() ([]byte, error) {
+	premarshaled, err := v.__premarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(premarshaled)
+}
+
+func (v *GetJobJobJobTypeBlock) __premarshalJSON() (*__premarshalGetJobJobJobTypeBlock, error) {
+	var retval __premarshalGetJobJobJobTypeBlock
+
+	retval.Typename = v.Typename
+	return &retval, nil
+}
+
+// GetJobJobJobTypeCommand includes the requested fields of the GraphQL type JobTypeCommand.
+// The GraphQL type's documentation follows.
+//
+// A type of job that runs a command on an agent
+type GetJobJobJobTypeCommand struct {
+	Typename          string `json:"__typename"`
+	JobJobTypeCommand `json:"-"`
+	// The cluster of this job
+	Cluster *GetJobJobJobTypeCommandCluster `json:"cluster"`
+}
+
+// GetTypename returns GetJobJobJobTypeCommand.Typename, and is useful for accessing the field via an interface.
+func (v *GetJobJobJobTypeCommand) GetTypename() string { return v.Typename }
+
+// GetCluster returns GetJobJobJobTypeCommand.Cluster, and is useful for accessing the field via an interface.
+func (v *GetJobJobJobTypeCommand) GetCluster() *GetJobJobJobTypeCommandCluster { return v.Cluster }
+
+// GetUuid returns GetJobJobJobTypeCommand.Uuid, and is useful for accessing the field via an interface.
+func (v *GetJobJobJobTypeCommand) GetUuid() string { return v.JobJobTypeCommand.CommandJob.Uuid }
+
+// GetEnv returns GetJobJobJobTypeCommand.Env, and is useful for accessing the field via an interface.
+func (v *GetJobJobJobTypeCommand) GetEnv() []string { return v.JobJobTypeCommand.CommandJob.Env }
+
+// GetScheduledAt returns GetJobJobJobTypeCommand.ScheduledAt, and is useful for accessing the field via an interface.
+func (v *GetJobJobJobTypeCommand) GetScheduledAt() time.Time {
+	return v.JobJobTypeCommand.CommandJob.ScheduledAt
+}
+
+// GetState returns GetJobJobJobTypeCommand.State, and is useful for accessing the field via an interface.
+func (v *GetJobJobJobTypeCommand) GetState() JobStates { return v.JobJobTypeCommand.CommandJob.State }
+
+// GetAgentQueryRules returns GetJobJobJobTypeCommand.AgentQueryRules, and is useful for accessing the field via an interface.
+func (v *GetJobJobJobTypeCommand) GetAgentQueryRules() []string {
+	return v.JobJobTypeCommand.CommandJob.AgentQueryRules
+}
+
+// GetCommand returns GetJobJobJobTypeCommand.Command, and is useful for accessing the field via an interface.
+func (v *GetJobJobJobTypeCommand) GetCommand() string { return v.JobJobTypeCommand.CommandJob.Command }
+
+// GetClusterQueue returns GetJobJobJobTypeCommand.ClusterQueue, and is useful for accessing the field via an interface.
+func (v *GetJobJobJobTypeCommand) GetClusterQueue() *CommandJobClusterQueue {
+	return v.JobJobTypeCommand.CommandJob.ClusterQueue
+}
+
+// GetBuild returns GetJobJobJobTypeCommand.Build, and is useful for accessing the field via an interface.
+func (v *GetJobJobJobTypeCommand) GetBuild() *CommandJobBuild {
+	return v.JobJobTypeCommand.CommandJob.Build
+}
+
+// GetPriority returns GetJobJobJobTypeCommand.Priority, and is useful for accessing the field via an interface.
+func (v *GetJobJobJobTypeCommand) GetPriority() CommandJobPriority {
+	return v.JobJobTypeCommand.CommandJob.Priority
+}
+
+func (v *GetJobJobJobTypeCommand) UnmarshalJSON(b []byte) error {
+
+	if string(b) == "null" {
+		return nil
+	}
+
+	var firstPass struct {
+		*GetJobJobJobTypeCommand
+		graphql.NoUnmarshalJSON
+	}
+	firstPass.GetJobJobJobTypeCommand = v
+
+	err := json.Unmarshal(b, &firstPass)
+	if err != nil {
+		return err
+	}
+
+	err = json.Unmarshal(
+		b, &v.JobJobTypeCommand)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+type __premarshalGetJobJobJobTypeCommand struct {
+	Typename string `json:"__typename"`
+
+	Cluster *GetJobJobJobTypeCommandCluster `json:"cluster"`
+
+	Uuid string `json:"uuid"`
+
+	Env []string `json:"env"`
+
+	ScheduledAt time.Time `json:"scheduledAt"`
+
+	State JobStates `json:"state"`
+
+	AgentQueryRules []string `json:"agentQueryRules"`
+
+	Command string `json:"command"`
+
+	ClusterQueue *CommandJobClusterQueue `json:"clusterQueue"`
+
+	Build *CommandJobBuild `json:"build"`
+
+	Priority CommandJobPriority `json:"priority"`
+}
+
+func (v *GetJobJobJobTypeCommand) MarshalJSON() ([]byte, error) {
+	premarshaled, err := v.__premarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(premarshaled)
+}
+
+func (v *GetJobJobJobTypeCommand) __premarshalJSON() (*__premarshalGetJobJobJobTypeCommand, error) {
+	var retval __premarshalGetJobJobJobTypeCommand
+
+	retval.Typename = v.Typename
+	retval.Cluster = v.Cluster
+	retval.Uuid = v.JobJobTypeCommand.CommandJob.Uuid
+	retval.Env = v.JobJobTypeCommand.CommandJob.Env
+	retval.ScheduledAt = v.JobJobTypeCommand.CommandJob.ScheduledAt
+	retval.State = v.JobJobTypeCommand.CommandJob.State
+	retval.AgentQueryRules = v.JobJobTypeCommand.CommandJob.AgentQueryRules
+	retval.Command = v.JobJobTypeCommand.CommandJob.Command
+	retval.ClusterQueue = v.JobJobTypeCommand.CommandJob.ClusterQueue
+	retval.Build = v.JobJobTypeCommand.CommandJob.Build
+	retval.Priority = v.JobJobTypeCommand.CommandJob.Priority
+	return &retval, nil
 }
 
-// GetTypename returns GetCommandJobJobJobTypeBlock.Typename, and is useful for accessing the field via an interface.
-func (v *GetCommandJobJobJobTypeBlock) GetTypename() string { return v.Typename }
+// GetJobJobJobTypeCommandCluster includes the requested fields of the GraphQL type Cluster.
+type GetJobJobJobTypeCommandCluster struct {
+	// The public UUID for this cluster
+	Uuid string `json:"uuid"`
+}
 
-// GetCommandJobJobJobTypeCommand includes the requested fields of the GraphQL type JobTypeCommand.
+// GetUuid returns GetJobJobJobTypeCommandCluster.Uuid, and is useful for accessing the field via an interface.
+func (v *GetJobJobJobTypeCommandCluster) GetUuid() string { return v.Uuid }
+
+// GetJobJobJobTypeTrigger includes the requested fields of the GraphQL type JobTypeTrigger.
 // The GraphQL type's documentation follows.
 //
-// A type of job that runs a command on an agent
-type GetCommandJobJobJobTypeCommand struct {
-	Typename string `json:"__typename"`
-	Id       string `json:"id"`
-	// The state of the job
-	State JobStates `json:"state"`
+// A type of job that triggers another build on a pipeline
+type GetJobJobJobTypeTrigger struct {
+	Typename          string `json:"__typename"`
+	JobJobTypeTrigger `json:"-"`
 }
 
-// GetTypename returns GetCommandJobJobJobTypeCommand.Typename, and is useful for accessing the field via an interface.
-func (v *GetCommandJobJobJobTypeCommand) GetTypename() string { return v.Typename }
+// GetTypename returns GetJobJobJobTypeTrigger.Typename, and is useful for accessing the field via an interface.
+func (v *GetJobJobJobTypeTrigger) GetTypename() string { return v.Typename }
 
-// GetId returns GetCommandJobJobJobTypeCommand.Id, and is useful for accessing the field via an interface.
-func (v *GetCommandJobJobJobTypeCommand) GetId() string { return v.Id }
+func (v *GetJobJobJobTypeTrigger) UnmarshalJSON(b []byte) error {
 
-// GetState returns GetCommandJobJobJobTypeCommand.State, and is useful for accessing the field via an interface.
-func (v *GetCommandJobJobJobTypeCommand) GetState() JobStates { return v.State }
+	if string(b) == "null" {
+		return nil
+	}
 
-// GetCommandJobJobJobTypeTrigger includes the requested fields of the GraphQL type JobTypeTrigger.
-// The GraphQL type's documentation follows.
-//
-// A type of job that triggers another build on a pipeline
-type GetCommandJobJobJobTypeTrigger struct {
+	var firstPass struct {
+		*GetJobJobJobTypeTrigger
+		graphql.NoUnmarshalJSON
+	}
+	firstPass.GetJobJobJobTypeTrigger = v
+
+	err := json.Unmarshal(b, &firstPass)
+	if err != nil {
+		return err
+	}
+
+	err = json.Unmarshal(
+		b, &v.JobJobTypeTrigger)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+type __premarshalGetJobJobJobTypeTrigger struct {
 	Typename string `json:"__typename"`
 }
 
-// GetTypename returns GetCommandJobJobJobTypeTrigger.Typename, and is useful for accessing the field via an interface.
-func (v *GetCommandJobJobJobTypeTrigger) GetTypename() string { return v.Typename }
+func (v *GetJobJobJobTypeTrigger) MarshalJSON() ([]byte, error) {
+	premarshaled, err := v.__premarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(premarshaled)
+}
 
-// GetCommandJobJobJobTypeWait includes the requested fields of the GraphQL type JobTypeWait.
+func (v *GetJobJobJobTypeTrigger) __premarshalJSON() (*__premarshalGetJobJobJobTypeTrigger, error) {
+	var retval __premarshalGetJobJobJobTypeTrigger
+
+	retval.Typename = v.Typename
+	return &retval, nil
+}
+
+// GetJobJobJobTypeWait includes the requested fields of the GraphQL type JobTypeWait.
 // The GraphQL type's documentation follows.
 //
 // A type of job that waits for all previous jobs to pass before proceeding the build pipeline
-type GetCommandJobJobJobTypeWait struct {
+type GetJobJobJobTypeWait struct {
+	Typename       string `json:"__typename"`
+	JobJobTypeWait `json:"-"`
+}
+
+// GetTypename returns GetJobJobJobTypeWait.Typename, and is useful for accessing the field via an interface.
+func (v *GetJobJobJobTypeWait) GetTypename() string { return v.Typename }
+
+func (v *GetJobJobJobTypeWait) UnmarshalJSON(b []byte) error {
+
+	if string(b) == "null" {
+		return nil
+	}
+
+	var firstPass struct {
+		*GetJobJobJobTypeWait
+		graphql.NoUnmarshalJSON
+	}
+	firstPass.GetJobJobJobTypeWait = v
+
+	err := json.Unmarshal(b, &firstPass)
+	if err != nil {
+		return err
+	}
+
+	err = json.Unmarshal(
+		b, &v.JobJobTypeWait)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+type __premarshalGetJobJobJobTypeWait struct {
 	Typename string `json:"__typename"`
 }
 
-// GetTypename returns GetCommandJobJobJobTypeWait.Typename, and is useful for accessing the field via an interface.
-func (v *GetCommandJobJobJobTypeWait) GetTypename() string { return v.Typename }
+func (v *GetJobJobJobTypeWait) MarshalJSON() ([]byte, error) {
+	premarshaled, err := v.__premarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(premarshaled)
+}
 
-// GetCommandJobResponse is returned by GetCommandJob on success.
-type GetCommandJobResponse struct {
+func (v *GetJobJobJobTypeWait) __premarshalJSON() (*__premarshalGetJobJobJobTypeWait, error) {
+	var retval __premarshalGetJobJobJobTypeWait
+
+	retval.Typename = v.Typename
+	return &retval, nil
+}
+
+// GetJobResponse is returned by GetJob on success.
+type GetJobResponse struct {
 	// Find a build job
-	Job GetCommandJobJob `json:"-"`
+	Job GetJobJob `json:"-"`
 }
 
-// GetJob returns GetCommandJobResponse.Job, and is useful for accessing the field via an interface.
-func (v *GetCommandJobResponse) GetJob() GetCommandJobJob { return v.Job }
+// GetJob returns GetJobResponse.Job, and is useful for accessing the field via an interface.
+func (v *GetJobResponse) GetJob() GetJobJob { return v.Job }
 
-func (v *GetCommandJobResponse) UnmarshalJSON(b []byte) error {
+func (v *GetJobResponse) UnmarshalJSON(b []byte) error {
 
 	if string(b) == "null" {
 		return nil
 	}
 
 	var firstPass struct {
-		*GetCommandJobResponse
+		*GetJobResponse
 		Job json.RawMessage `json:"job"`
 		graphql.NoUnmarshalJSON
 	}
-	firstPass.GetCommandJobResponse = v
+	firstPass.GetJobResponse = v
 
 	err := json.Unmarshal(b, &firstPass)
 	if err != nil {
@@ -820,22 +1441,22 @@ func (v *GetCommandJobResponse) UnmarshalJSON(b []byte) error {
 		dst := &v.Job
 		src := firstPass.Job
 		if len(src) != 0 && string(src) != "null" {
-			err = __unmarshalGetCommandJobJob(
+			err = __unmarshalGetJobJob(
 				src, dst)
 			if err != nil {
 				return fmt.Errorf(
-					"unable to unmarshal GetCommandJobResponse.Job: %w", err)
+					"unable to unmarshal GetJobResponse.Job: %w", err)
 			}
 		}
 	}
 	return nil
 }
 
-type __premarshalGetCommandJobResponse struct {
+type __premarshalGetJobResponse struct {
 	Job json.RawMessage `json:"job"`
 }
 
-func (v *GetCommandJobResponse) MarshalJSON() ([]byte, error) {
+func (v *GetJobResponse) MarshalJSON() ([]byte, error) {
 	premarshaled, err := v.__premarshalJSON()
 	if err != nil {
 		return nil, err
@@ -843,19 +1464,19 @@ func (v *GetCommandJobResponse) MarshalJSON() ([]byte, error) {
 	return json.Marshal(premarshaled)
 }
 
-func (v *GetCommandJobResponse) __premarshalJSON() (*__premarshalGetCommandJobResponse, error) {
-	var retval __premarshalGetCommandJobResponse
+func (v *GetJobResponse) __premarshalJSON() (*__premarshalGetJobResponse, error) {
+	var retval __premarshalGetJobResponse
 
 	{
 
 		dst := &retval.Job
 		src := v.Job
 		var err error
-		*dst, err = __marshalGetCommandJobJob(
+		*dst, err = __marshalGetJobJob(
 			&src)
 		if err != nil {
 			return nil, fmt.Errorf(
-				"unable to marshal GetCommandJobResponse.Job: %w", err)
+				"unable to marshal GetJobResponse.Job: %w", err)
 		}
 	}
 	return &retval, nil
@@ -902,8 +1523,9 @@ func (v *GetScheduledJobsClusteredOrganization) GetJobs() GetScheduledJobsCluste
 
 // GetScheduledJobsClusteredOrganizationJobsJobConnection includes the requested fields of the GraphQL type JobConnection.
 type GetScheduledJobsClusteredOrganizationJobsJobConnection struct {
-	Count int                                                                  `json:"count"`
-	Edges []GetScheduledJobsClusteredOrganizationJobsJobConnectionEdgesJobEdge `json:"edges"`
+	Count    int                                                                  `json:"count"`
+	Edges    []GetScheduledJobsClusteredOrganizationJobsJobConnectionEdgesJobEdge `json:"edges"`
+	PageInfo GetScheduledJobsClusteredOrganizationJobsJobConnectionPageInfo       `json:"pageInfo"`
 }
 
 // GetCount returns GetScheduledJobsClusteredOrganizationJobsJobConnection.Count, and is useful for accessing the field via an interface.
@@ -914,6 +1536,11 @@ func (v *GetScheduledJobsClusteredOrganizationJobsJobConnection) GetEdges() []Ge
 	return v.Edges
 }
 
+// GetPageInfo returns GetScheduledJobsClusteredOrganizationJobsJobConnection.PageInfo, and is useful for accessing the field via an interface.
+func (v *GetScheduledJobsClusteredOrganizationJobsJobConnection) GetPageInfo() GetScheduledJobsClusteredOrganizationJobsJobConnectionPageInfo {
+	return v.PageInfo
+}
+
 // GetScheduledJobsClusteredOrganizationJobsJobConnectionEdgesJobEdge includes the requested fields of the GraphQL type JobEdge.
 type GetScheduledJobsClusteredOrganizationJobsJobConnectionEdgesJobEdge struct {
 	Node Job `json:"-"`
@@ -987,6 +1614,27 @@ func (v *GetScheduledJobsClusteredOrganizationJobsJobConnectionEdgesJobEdge) __p
 	return &retval, nil
 }
 
+// GetScheduledJobsClusteredOrganizationJobsJobConnectionPageInfo includes the requested fields of the GraphQL type PageInfo.
+// The GraphQL type's documentation follows.
+//
+// Information about pagination in a connection.
+type GetScheduledJobsClusteredOrganizationJobsJobConnectionPageInfo struct {
+	// When paginating forwards, the cursor to continue.
+	EndCursor string `json:"endCursor"`
+	// When paginating forwards, are there more items?
+	HasNextPage bool `json:"hasNextPage"`
+}
+
+// GetEndCursor returns GetScheduledJobsClusteredOrganizationJobsJobConnectionPageInfo.EndCursor, and is useful for accessing the field via an interface.
+func (v *GetScheduledJobsClusteredOrganizationJobsJobConnectionPageInfo) GetEndCursor() string {
+	return v.EndCursor
+}
+
+// GetHasNextPage returns GetScheduledJobsClusteredOrganizationJobsJobConnectionPageInfo.HasNextPage, and is useful for accessing the field via an interface.
+func (v *GetScheduledJobsClusteredOrganizationJobsJobConnectionPageInfo) GetHasNextPage() bool {
+	return v.HasNextPage
+}
+
 // GetScheduledJobsClusteredResponse is returned by GetScheduledJobsClustered on success.
 type GetScheduledJobsClusteredResponse struct {
 	// Find an organization
@@ -1017,8 +1665,9 @@ func (v *GetScheduledJobsOrganization) GetJobs() GetScheduledJobsOrganizationJob
 
 // GetScheduledJobsOrganizationJobsJobConnection includes the requested fields of the GraphQL type JobConnection.
 type GetScheduledJobsOrganizationJobsJobConnection struct {
-	Count int                                                         `json:"count"`
-	Edges []GetScheduledJobsOrganizationJobsJobConnectionEdgesJobEdge `json:"edges"`
+	Count    int                                                         `json:"count"`
+	Edges    []GetScheduledJobsOrganizationJobsJobConnectionEdgesJobEdge `json:"edges"`
+	PageInfo GetScheduledJobsOrganizationJobsJobConnectionPageInfo       `json:"pageInfo"`
 }
 
 // GetCount returns GetScheduledJobsOrganizationJobsJobConnection.Count, and is useful for accessing the field via an interface.
@@ -1029,6 +1678,11 @@ func (v *GetScheduledJobsOrganizationJobsJobConnection) GetEdges() []GetSchedule
 	return v.Edges
 }
 
+// GetPageInfo returns GetScheduledJobsOrganizationJobsJobConnection.PageInfo, and is useful for accessing the field via an interface.
+func (v *GetScheduledJobsOrganizationJobsJobConnection) GetPageInfo() GetScheduledJobsOrganizationJobsJobConnectionPageInfo {
+	return v.PageInfo
+}
+
 // GetScheduledJobsOrganizationJobsJobConnectionEdgesJobEdge includes the requested fields of the GraphQL type JobEdge.
 type GetScheduledJobsOrganizationJobsJobConnectionEdgesJobEdge struct {
 	Node Job `json:"-"`
@@ -1100,6 +1754,27 @@ func (v *GetScheduledJobsOrganizationJobsJobConnectionEdgesJobEdge) __premarshal
 	return &retval, nil
 }
 
+// GetScheduledJobsOrganizationJobsJobConnectionPageInfo includes the requested fields of the GraphQL type PageInfo.
+// The GraphQL type's documentation follows.
+//
+// Information about pagination in a connection.
+type GetScheduledJobsOrganizationJobsJobConnectionPageInfo struct {
+	// When paginating forwards, the cursor to continue.
+	EndCursor string `json:"endCursor"`
+	// When paginating forwards, are there more items?
+	HasNextPage bool `json:"hasNextPage"`
+}
+
+// GetEndCursor returns GetScheduledJobsOrganizationJobsJobConnectionPageInfo.EndCursor, and is useful for accessing the field via an interface.
+func (v *GetScheduledJobsOrganizationJobsJobConnectionPageInfo) GetEndCursor() string {
+	return v.EndCursor
+}
+
+// GetHasNextPage returns GetScheduledJobsOrganizationJobsJobConnectionPageInfo.HasNextPage, and is useful for accessing the field via an interface.
+func (v *GetScheduledJobsOrganizationJobsJobConnectionPageInfo) GetHasNextPage() bool {
+	return v.HasNextPage
+}
+
 // GetScheduledJobsResponse is returned by GetScheduledJobs on success.
 type GetScheduledJobsResponse struct {
 	// Find an organization
@@ -1237,12 +1912,26 @@ func (v *JobJobTypeCommand) GetEnv() []string { return v.CommandJob.Env }
 // GetScheduledAt returns JobJobTypeCommand.ScheduledAt, and is useful for accessing the field via an interface.
 func (v *JobJobTypeCommand) GetScheduledAt() time.Time { return v.CommandJob.ScheduledAt }
 
+// GetState returns JobJobTypeCommand.State, and is useful for accessing the field via an interface.
+func (v *JobJobTypeCommand) GetState() JobStates { return v.CommandJob.State }
+
 // GetAgentQueryRules returns JobJobTypeCommand.AgentQueryRules, and is useful for accessing the field via an interface.
 func (v *JobJobTypeCommand) GetAgentQueryRules() []string { return v.CommandJob.AgentQueryRules }
 
 // GetCommand returns JobJobTypeCommand.Command, and is useful for accessing the field via an interface.
 func (v *JobJobTypeCommand) GetCommand() string { return v.CommandJob.Command }
 
+// GetClusterQueue returns JobJobTypeCommand.ClusterQueue, and is useful for accessing the field via an interface.
+func (v *JobJobTypeCommand) GetClusterQueue() *CommandJobClusterQueue {
+	return v.CommandJob.ClusterQueue
+}
+
+// GetBuild returns JobJobTypeCommand.Build, and is useful for accessing the field via an interface.
+func (v *JobJobTypeCommand) GetBuild() *CommandJobBuild { return v.CommandJob.Build }
+
+// GetPriority returns JobJobTypeCommand.Priority, and is useful for accessing the field via an interface.
+func (v *JobJobTypeCommand) GetPriority() CommandJobPriority { return v.CommandJob.Priority }
+
 func (v *JobJobTypeCommand) UnmarshalJSON(b []byte) error {
 
 	if string(b) == "null" {
@@ -1275,9 +1964,17 @@ type __premarshalJobJobTypeCommand struct {
 
 	ScheduledAt time.Time `json:"scheduledAt"`
 
+	State JobStates `json:"state"`
+
 	AgentQueryRules []string `json:"agentQueryRules"`
 
 	Command string `json:"command"`
+
+	ClusterQueue *CommandJobClusterQueue `json:"clusterQueue"`
+
+	Build *CommandJobBuild `json:"build"`
+
+	Priority CommandJobPriority `json:"priority"`
 }
 
 func (v *JobJobTypeCommand) MarshalJSON() ([]byte, error) {
@@ -1294,8 +1991,12 @@ func (v *JobJobTypeCommand) __premarshalJSON() (*__premarshalJobJobTypeCommand,
 	retval.Uuid = v.CommandJob.Uuid
 	retval.Env = v.CommandJob.Env
 	retval.ScheduledAt = v.CommandJob.ScheduledAt
+	retval.State = v.CommandJob.State
 	retval.AgentQueryRules = v.CommandJob.AgentQueryRules
 	retval.Command = v.CommandJob.Command
+	retval.ClusterQueue = v.CommandJob.ClusterQueue
+	retval.Build = v.CommandJob.Build
+	retval.Priority = v.CommandJob.Priority
 	return &retval, nil
 }
 
@@ -1477,6 +2178,14 @@ func (v *SearchPipelinesResponse) GetOrganization() SearchPipelinesOrganization
 	return v.Organization
 }
 
+// __BuildAnnotateInput is used internally by genqlient
+type __BuildAnnotateInput struct {
+	Input BuildAnnotateInput `json:"input"`
+}
+
+// GetInput returns __BuildAnnotateInput.Input, and is useful for accessing the field via an interface.
+func (v *__BuildAnnotateInput) GetInput() BuildAnnotateInput { return v.Input }
+
 // __BuildCancelInput is used internally by genqlient
 type __BuildCancelInput struct {
 	Input BuildCancelInput `json:"input"`
@@ -1533,6 +2242,14 @@ type __GetCommandJobInput struct {
 // GetUuid returns __GetCommandJobInput.Uuid, and is useful for accessing the field via an interface.
 func (v *__GetCommandJobInput) GetUuid() string { return v.Uuid }
 
+// __GetJobInput is used internally by genqlient
+type __GetJobInput struct {
+	Uuid string `json:"uuid"`
+}
+
+// GetUuid returns __GetJobInput.Uuid, and is useful for accessing the field via an interface.
+func (v *__GetJobInput) GetUuid() string { return v.Uuid }
+
 // __GetOrganizationInput is used internally by genqlient
 type __GetOrganizationInput struct {
 	Slug string `json:"slug"`
@@ -1546,6 +2263,8 @@ type __GetScheduledJobsClusteredInput struct {
 	Slug            string   `json:"slug"`
 	AgentQueryRules []string `json:"agentQueryRules"`
 	Cluster         string   `json:"cluster"`
+	First           int      `json:"first"`
+	After           string   `json:"after,omitempty"`
 }
 
 // GetSlug returns __GetScheduledJobsClusteredInput.Slug, and is useful for accessing the field via an interface.
@@ -1557,10 +2276,18 @@ func (v *__GetScheduledJobsClusteredInput) GetAgentQueryRules() []string { retur
 // GetCluster returns __GetScheduledJobsClusteredInput.Cluster, and is useful for accessing the field via an interface.
 func (v *__GetScheduledJobsClusteredInput) GetCluster() string { return v.Cluster }
 
+// GetFirst returns __GetScheduledJobsClusteredInput.First, and is useful for accessing the field via an interface.
+func (v *__GetScheduledJobsClusteredInput) GetFirst() int { return v.First }
+
+// GetAfter returns __GetScheduledJobsClusteredInput.After, and is useful for accessing the field via an interface.
+func (v *__GetScheduledJobsClusteredInput) GetAfter() string { return v.After }
+
 // __GetScheduledJobsInput is used internally by genqlient
 type __GetScheduledJobsInput struct {
 	Slug            string   `json:"slug"`
 	AgentQueryRules []string `json:"agentQueryRules"`
+	First           int      `json:"first"`
+	After           string   `json:"after,omitempty"`
 }
 
 // GetSlug returns __GetScheduledJobsInput.Slug, and is useful for accessing the field via an interface.
@@ -1569,6 +2296,12 @@ func (v *__GetScheduledJobsInput) GetSlug() string { return v.Slug }
 // GetAgentQueryRules returns __GetScheduledJobsInput.AgentQueryRules, and is useful for accessing the field via an interface.
 func (v *__GetScheduledJobsInput) GetAgentQueryRules() []string { return v.AgentQueryRules }
 
+// GetFirst returns __GetScheduledJobsInput.First, and is useful for accessing the field via an interface.
+func (v *__GetScheduledJobsInput) GetFirst() int { return v.First }
+
+// GetAfter returns __GetScheduledJobsInput.After, and is useful for accessing the field via an interface.
+func (v *__GetScheduledJobsInput) GetAfter() string { return v.After }
+
 // __PipelineDeleteInput is used internally by genqlient
 type __PipelineDeleteInput struct {
 	Input PipelineDeleteInput `json:"input"`
@@ -1593,6 +2326,41 @@ func (v *__SearchPipelinesInput) GetSearch() string { return v.Search }
 // GetFirst returns __SearchPipelinesInput.First, and is useful for accessing the field via an interface.
 func (v *__SearchPipelinesInput) GetFirst() int { return v.First }
 
+// The query or mutation executed by BuildAnnotate.
+const BuildAnnotate_Operation = `
+mutation BuildAnnotate ($input: BuildAnnotateInput!) {
+	buildAnnotate(input: $input) {
+		clientMutationId
+	}
+}
+`
+
+func BuildAnnotate(
+	ctx_ context.Context,
+	client_ graphql.Client,
+	input BuildAnnotateInput,
+) (*BuildAnnotateResponse, error) {
+	req_ := &graphql.Request{
+		OpName: "BuildAnnotate",
+		Query:  BuildAnnotate_Operation,
+		Variables: &__BuildAnnotateInput{
+			Input: input,
+		},
+	}
+	var err_ error
+
+	var data_ BuildAnnotateResponse
+	resp_ := &graphql.Response{Data: &data_}
+
+	err_ = client_.MakeRequest(
+		ctx_,
+		req_,
+		resp_,
+	)
+
+	return &data_, err_
+}
+
 // The query or mutation executed by BuildCancel.
 const BuildCancel_Operation = `
 mutation BuildCancel ($input: BuildCancelInput!) {
@@ -1660,8 +2428,18 @@ fragment CommandJob on JobTypeCommand {
 	uuid
 	env
 	scheduledAt
+	state
 	agentQueryRules
 	command
+	clusterQueue {
+		uuid
+	}
+	build {
+		branch
+	}
+	priority {
+		number
+	}
 }
 `
 
@@ -1756,8 +2534,18 @@ fragment CommandJob on JobTypeCommand {
 	uuid
 	env
 	scheduledAt
+	state
 	agentQueryRules
 	command
+	clusterQueue {
+		uuid
+	}
+	build {
+		branch
+	}
+	priority {
+		number
+	}
 }
 `
 
@@ -1823,8 +2611,18 @@ fragment CommandJob on JobTypeCommand {
 	uuid
 	env
 	scheduledAt
+	state
 	agentQueryRules
 	command
+	clusterQueue {
+		uuid
+	}
+	build {
+		branch
+	}
+	priority {
+		number
+	}
 }
 `
 
@@ -1897,6 +2695,69 @@ func GetCommandJob(
 	return &data_, err_
 }
 
+// The query or mutation executed by GetJob.
+const GetJob_Operation = `
+query GetJob ($uuid: ID!) {
+	job(uuid: $uuid) {
+		__typename
+		... Job
+		... on JobTypeCommand {
+			cluster {
+				uuid
+			}
+		}
+	}
+}
+fragment Job on Job {
+	... on JobTypeCommand {
+		... CommandJob
+	}
+}
+fragment CommandJob on JobTypeCommand {
+	uuid
+	env
+	scheduledAt
+	state
+	agentQueryRules
+	command
+	clusterQueue {
+		uuid
+	}
+	build {
+		branch
+	}
+	priority {
+		number
+	}
+}
+`
+
+func GetJob(
+	ctx_ context.Context,
+	client_ graphql.Client,
+	uuid string,
+) (*GetJobResponse, error) {
+	req_ := &graphql.Request{
+		OpName: "GetJob",
+		Query:  GetJob_Operation,
+		Variables: &__GetJobInput{
+			Uuid: uuid,
+		},
+	}
+	var err_ error
+
+	var data_ GetJobResponse
+	resp_ := &graphql.Response{Data: &data_}
+
+	err_ = client_.MakeRequest(
+		ctx_,
+		req_,
+		resp_,
+	)
+
+	return &data_, err_
+}
+
 // The query or mutation executed by GetOrganization.
 const GetOrganization_Operation = `
 query GetOrganization ($slug: ID!) {
@@ -1934,10 +2795,10 @@ func GetOrganization(
 
 // The query or mutation executed by GetScheduledJobs.
 const GetScheduledJobs_Operation = `
-query GetScheduledJobs ($slug: ID!, $agentQueryRules: [String!]) {
+query GetScheduledJobs ($slug: ID!, $agentQueryRules: [String!], $first: Int!, $after: String) {
 	organization(slug: $slug) {
 		id
-		jobs(state: [SCHEDULED], type: [COMMAND], first: 100, order: RECENTLY_ASSIGNED, agentQueryRules: $agentQueryRules, clustered: false) {
+		jobs(state: [SCHEDULED], type: [COMMAND], first: $first, after: $after, order: RECENTLY_ASSIGNED, agentQueryRules: $agentQueryRules, clustered: false) {
 			count
 			edges {
 				node {
@@ -1945,6 +2806,10 @@ query GetScheduledJobs ($slug: ID!, $agentQueryRules: [String!]) {
 					... Job
 				}
 			}
+			pageInfo {
+				endCursor
+				hasNextPage
+			}
 		}
 	}
 }
@@ -1957,8 +2822,18 @@ fragment CommandJob on JobTypeCommand {
 	uuid
 	env
 	scheduledAt
+	state
 	agentQueryRules
 	command
+	clusterQueue {
+		uuid
+	}
+	build {
+		branch
+	}
+	priority {
+		number
+	}
 }
 `
 
@@ -1967,6 +2842,8 @@ func GetScheduledJobs(
 	client_ graphql.Client,
 	slug string,
 	agentQueryRules []string,
+	first int,
+	after string,
 ) (*GetScheduledJobsResponse, error) {
 	req_ := &graphql.Request{
 		OpName: "GetScheduledJobs",
@@ -1974,6 +2851,8 @@ func GetScheduledJobs(
 		Variables: &__GetScheduledJobsInput{
 			Slug:            slug,
 			AgentQueryRules: agentQueryRules,
+			First:           first,
+			After:           after,
 		},
 	}
 	var err_ error
@@ -1992,10 +2871,10 @@ func GetScheduledJobs(
 
 // The query or mutation executed by GetScheduledJobsClustered.
 const GetScheduledJobsClustered_Operation = `
-query GetScheduledJobsClustered ($slug: ID!, $agentQueryRules: [String!], $cluster: ID!) {
+query GetScheduledJobsClustered ($slug: ID!, $agentQueryRules: [String!], $cluster: ID!, $first: Int!, $after: String) {
 	organization(slug: $slug) {
 		id
-		jobs(state: [SCHEDULED], type: [COMMAND], first: 100, order: RECENTLY_ASSIGNED, agentQueryRules: $agentQueryRules, cluster: $cluster) {
+		jobs(state: [SCHEDULED], type: [COMMAND], first: $first, after: $after, order: RECENTLY_ASSIGNED, agentQueryRules: $agentQueryRules, cluster: $cluster) {
 			count
 			edges {
 				node {
@@ -2003,6 +2882,10 @@ query GetScheduledJobsClustered ($slug: ID!, $agentQueryRules: [String!], $clust
 					... Job
 				}
 			}
+			pageInfo {
+				endCursor
+				hasNextPage
+			}
 		}
 	}
 }
@@ -2015,8 +2898,18 @@ fragment CommandJob on JobTypeCommand {
 	uuid
 	env
 	scheduledAt
+	state
 	agentQueryRules
 	command
+	clusterQueue {
+		uuid
+	}
+	build {
+		branch
+	}
+	priority {
+		number
+	}
 }
 `
 
@@ -2026,6 +2919,8 @@ func GetScheduledJobsClustered(
 	slug string,
 	agentQueryRules []string,
 	cluster string,
+	first int,
+	after string,
 ) (*GetScheduledJobsClusteredResponse, error) {
 	req_ := &graphql.Request{
 		OpName: "GetScheduledJobsClustered",
@@ -2034,6 +2929,8 @@ func GetScheduledJobsClustered(
 			Slug:            slug,
 			AgentQueryRules: agentQueryRules,
 			Cluster:         cluster,
+			First:           first,
+			After:           after,
 		},
 	}
 	var err_ error
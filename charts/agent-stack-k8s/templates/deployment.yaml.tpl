@@ -27,6 +27,10 @@ spec:
         env:
         - name: CONFIG
           value: /etc/config.yaml
+        - name: POD_NAME
+          valueFrom:
+            fieldRef:
+              fieldPath: metadata.name
         envFrom:
           - secretRef:
               name: {{ if .Values.agentStackSecret }}{{ .Values.agentStackSecret }}{{ else }}{{ .Release.Name }}-secrets{{ end }}
@@ -34,6 +38,13 @@ spec:
           - name: config
             mountPath: /etc/config.yaml
             subPath: config.yaml
+        {{- with index .Values.config "prometheus-port" }}
+        readinessProbe:
+          httpGet:
+            path: /readyz
+            port: {{ . }}
+          periodSeconds: 30
+        {{- end }}
         resources:
           {{- toYaml .Values.resources | nindent 10 }}
         securityContext:
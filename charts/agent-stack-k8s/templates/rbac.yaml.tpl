@@ -13,6 +13,7 @@ rules:
       - watch
       - create
       - update
+      - patch
   - apiGroups:
       - ""
     resources:
@@ -33,6 +34,45 @@ rules:
       - pods/eviction
     verbs:
       - create
+  {{- if index .Values.config "quota-check" }}
+  - apiGroups:
+      - ""
+    resources:
+      - resourcequotas
+    verbs:
+      - list
+      - watch
+  {{- end }}
+  {{- if index .Values.config "emit-events" }}
+  - apiGroups:
+      - ""
+    resources:
+      - events
+    verbs:
+      - create
+      - patch
+  {{- end }}
+  {{- if index .Values.config "warm-pool-sizes" }}
+  - apiGroups:
+      - ""
+    resources:
+      - pods
+    verbs:
+      - create
+      - delete
+  {{- end }}
+  {{- if index .Values.config "schedule-once-lease-duration" }}
+  - apiGroups:
+      - coordination.k8s.io
+    resources:
+      - leases
+    verbs:
+      - get
+      - list
+      - create
+      - update
+      - delete
+  {{- end }}
 ---
 apiVersion: rbac.authorization.k8s.io/v1
 kind: RoleBinding
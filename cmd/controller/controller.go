@@ -4,15 +4,19 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"maps"
 	"os"
 	"reflect"
+	"slices"
 	"strings"
 	"time"
 
 	"github.com/buildkite/agent-stack-k8s/v2/cmd/linter"
 	"github.com/buildkite/agent-stack-k8s/v2/cmd/version"
 	"github.com/buildkite/agent-stack-k8s/v2/internal/controller"
+	"github.com/buildkite/agent-stack-k8s/v2/internal/controller/agenttags"
 	"github.com/buildkite/agent-stack-k8s/v2/internal/controller/config"
+	"github.com/buildkite/agent-stack-k8s/v2/internal/controller/metrics"
 	"github.com/buildkite/agent-stack-k8s/v2/internal/controller/scheduler"
 
 	"github.com/go-playground/locales/en"
@@ -25,6 +29,7 @@ import (
 	"github.com/spf13/viper"
 	"go.uber.org/zap"
 	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/validation"
 	"k8s.io/client-go/kubernetes"
 	restconfig "sigs.k8s.io/controller-runtime/pkg/client/config"
 	"sigs.k8s.io/controller-runtime/pkg/manager/signals"
@@ -73,6 +78,91 @@ func AddConfigFlags(cmd *cobra.Command) {
 		time.Second,
 		"time to wait between polling for new jobs (minimum 1s); note that increasing this causes jobs to be slower to start",
 	)
+	cmd.Flags().Int(
+		"backfill-max-pages",
+		0,
+		"On startup, fetch up to this many pages of scheduled jobs (instead of the usual 100 jobs), to catch up on jobs scheduled while the controller was down; 0 disables it",
+	)
+	cmd.Flags().Int(
+		"backfill-page-size",
+		500,
+		"Number of jobs in each page fetched by the startup backfill (at most 500)",
+	)
+	cmd.Flags().Int(
+		"backfill-page-retries",
+		2,
+		"Number of times to retry a page of the startup backfill (from the same cursor) after its query fails, before keeping the pages already fetched",
+	)
+	cmd.Flags().Int(
+		"requeue-max-attempts",
+		0,
+		"Number of times to retry scheduling a job that failed with a transient error (e.g. the Kubernetes API server was briefly unavailable); 0 disables retries",
+	)
+	cmd.Flags().Duration(
+		"requeue-backoff",
+		time.Second,
+		"Delay before the first retry of a job that failed with a transient error; doubles for each later retry, up to 5m",
+	)
+	cmd.Flags().String(
+		"requeue-order",
+		"back",
+		"Where jobs being retried after a transient error go in the next batch of jobs: back (fairer to other jobs) or front (lower latency for the retried jobs)",
+	)
+	cmd.Flags().String(
+		"duplicate-job-action",
+		"drop",
+		"What to do with a job fetched again while already in flight, if its data (e.g. tags) has changed: drop it, log the changes and drop it, or update the agent tags annotation of its Kubernetes job",
+	)
+	cmd.Flags().Int(
+		"queue-cooldown-failures",
+		0,
+		"Number of consecutive scheduling failures in a queue after which its jobs are not scheduled for queue-cooldown; 0 disables cooldowns",
+	)
+	cmd.Flags().Duration(
+		"queue-cooldown",
+		time.Minute,
+		"How long a queue's jobs are not scheduled for after queue-cooldown-failures consecutive scheduling failures",
+	)
+	cmd.Flags().Duration(
+		"saturated-poll-threshold",
+		0,
+		"Once the limiter has had no available tokens for this long, poll for jobs less often (see saturated-poll-interval); 0 disables it",
+	)
+	cmd.Flags().Duration(
+		"saturated-poll-interval",
+		10*time.Second,
+		"Time to wait between polling for new jobs while the limiter has had no available tokens for saturated-poll-threshold",
+	)
+	cmd.Flags().Duration(
+		"distinct-pipelines-window",
+		24*time.Hour,
+		"How long a pipeline counts towards the monitor_distinct_pipelines metric after a job for it was last fetched",
+	)
+	cmd.Flags().Duration(
+		"token-check-interval",
+		5*time.Minute,
+		"How often to verify the Buildkite token, failing the /readyz check on the metrics port if Buildkite rejects it",
+	)
+	cmd.Flags().Int(
+		"job-create-retries",
+		3,
+		"Number of times to retry creating a Kubernetes job after a conflict or timeout from the API server, with jittered backoff; 0 disables retries",
+	)
+	cmd.Flags().Float64(
+		"job-create-qps",
+		0,
+		"Limit on calls per second to create Kubernetes jobs, to spread out bursts of jobs rather than have the API server throttle them; 0 means no limit",
+	)
+	cmd.Flags().Int(
+		"job-create-burst",
+		10,
+		"Number of calls to create Kubernetes jobs that can be made at once under job-create-qps",
+	)
+	cmd.Flags().Bool(
+		"job-generate-name",
+		false,
+		"Create Kubernetes jobs with a generated name rather than one derived from the Buildkite job UUID, so that a lingering job with the same name can't block creation",
+	)
 	cmd.Flags().String(
 		"cluster-uuid",
 		"",
@@ -83,6 +173,106 @@ func AddConfigFlags(cmd *cobra.Command) {
 		"",
 		"Bind address to expose the pprof profiler (e.g. localhost:6060)",
 	)
+	cmd.Flags().Uint16(
+		"prometheus-port",
+		0,
+		"Bind port to expose Prometheus /metrics; 0 disables it",
+	)
+	cmd.Flags().Bool(
+		"prometheus-exemplars",
+		false,
+		"Attach exemplars with the OpenTelemetry trace ID to duration histograms, and serve /metrics in the OpenMetrics format to scrapers that ask for it",
+	)
+	cmd.Flags().String(
+		"webhook-address",
+		"",
+		"Bind address to receive Buildkite job.scheduled webhooks at /webhook (e.g. :8081), alongside polling; requires webhook-secret, and can't be used with graphql-jobs-query",
+	)
+	cmd.Flags().String(
+		"webhook-secret",
+		"",
+		"Secret that Buildkite signs webhooks with (set the WEBHOOK_SECRET environment variable rather than the flag)",
+	)
+	cmd.Flags().Int(
+		"debug-errors-buffer-size",
+		50,
+		"Number of recent job query and scheduling errors to serve at /debug/errors on the profiler and metrics ports",
+	)
+	cmd.Flags().String(
+		"replay-file",
+		"",
+		"Schedule the jobs recorded in this NDJSON file instead of querying Buildkite for jobs (e.g. for load testing)",
+	)
+	cmd.Flags().Bool(
+		"quota-check",
+		false,
+		"Before creating each job, check that the namespace's resource quotas have room for its pod, and leave the job to be tried again later if not",
+	)
+	cmd.Flags().Bool(
+		"annotate-builds",
+		false,
+		"After creating each Kubernetes job, annotate the Buildkite build with the job's name and how to find its pod (needs the write_builds scope on the Buildkite token)",
+	)
+	cmd.Flags().String(
+		"controller-id",
+		"",
+		"Identifies this controller's Kubernetes jobs, with a label, in a namespace shared with other controllers; if set, the limiter only counts jobs with the label",
+	)
+	cmd.Flags().Bool(
+		"emit-events",
+		false,
+		"Record Kubernetes events for scheduling decisions: jobs created, filtered out, stale, or blocked by a resource quota",
+	)
+	cmd.Flags().Int(
+		"filtered-log-sample-rate",
+		0,
+		"Log 1 in this many jobs that are skipped because they don't match the tags, at info level with the job's tags and why they don't match; 0 disables",
+	)
+	cmd.Flags().String(
+		"record-file",
+		"",
+		"Append every fetched job that matches the tags to this NDJSON file, in the form read by replay-file",
+	)
+	cmd.Flags().Bool(
+		"limiter-queue-metrics",
+		false,
+		"Label the limiter's token wait duration histogram with each job's queue (adds a series per queue per bucket)",
+	)
+	cmd.Flags().Duration(
+		"limiter-token-return-delay",
+		0,
+		"Time to wait after a job finishes before returning its max-in-flight token, so the node can reclaim the pod's resources first; 0 returns it straight away",
+	)
+	cmd.Flags().Duration(
+		"limiter-min-token-hold",
+		0,
+		"Minimum time a job holds its max-in-flight token, even if it finishes sooner, to slow down jobs that fail straight away and are rescheduled; 0 disables it",
+	)
+	cmd.Flags().String(
+		"limiter-mode",
+		"hard",
+		"How max-in-flight is applied: hard blocks jobs beyond it until others finish, soft only logs and counts them (limiter_soft_limit_exceeded_total), to see how often a limit would be hit before enforcing it",
+	)
+	cmd.Flags().Duration(
+		"limiter-ramp-up",
+		0,
+		"Make the max-in-flight tokens available gradually over this long after startup, rather than all at once; 0 makes them all available straight away",
+	)
+	cmd.Flags().Duration(
+		"limiter-hold-warn-after",
+		0,
+		"Periodically report jobs that have held their max-in-flight token for longer than this (e.g. stuck pods); 0 disables it",
+	)
+	cmd.Flags().Duration(
+		"limiter-sweep-interval",
+		time.Minute,
+		"How often to check for jobs that have held their max-in-flight token for longer than limiter-hold-warn-after",
+	)
+	cmd.Flags().Float64(
+		"limiter-sweep-jitter",
+		0.1,
+		"Fraction of limiter-sweep-interval (from 0 up to 1) by which each interval is randomly lengthened or shortened, so that replicas don't check in step; 0 disables jitter",
+	)
 	cmd.Flags().String("graphql-endpoint", "", "Buildkite GraphQL endpoint URL")
 
 	cmd.Flags().Duration(
@@ -95,6 +285,11 @@ func AddConfigFlags(cmd *cobra.Command) {
 		config.DefaultJobCancelCheckerPollInterval,
 		"Controls the interval between job state queries while a pod is still Pending",
 	)
+	cmd.Flags().Duration(
+		"schedule-once-lease-duration",
+		0,
+		"Hold a Kubernetes Lease for this long for each job while scheduling it, so that only one controller watching the same queue schedules it; 0 disables it",
+	)
 	cmd.Flags().Bool(
 		"prohibit-kubernetes-plugin",
 		false,
@@ -197,6 +392,89 @@ func ParseAndValidateConfig(v *viper.Viper) (*config.Config, error) {
 		return nil, fmt.Errorf("failed to validate config: %w", err)
 	}
 
+	if err := cfg.DefaultPodParams.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid default-pod-params: %w", err)
+	}
+	for queue, pp := range cfg.QueuePodParams {
+		// Validate the params that will actually apply to the queue.
+		if err := cfg.DefaultPodParams.WithOverrides(pp).Validate(); err != nil {
+			return nil, fmt.Errorf("invalid queue-pod-params for queue %q: %w", queue, err)
+		}
+	}
+
+	if err := cfg.TagVolumes.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid tag-volumes: %w", err)
+	}
+	if err := cfg.PodTagLabels.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid pod-tag-labels: %w", err)
+	}
+	if err := cfg.BranchFilter.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid branch-filter: %w", err)
+	}
+
+	if err := cfg.AgentCommandWrapper.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid agent-command-wrapper: %w", err)
+	}
+
+	if err := cfg.JobFieldEnv.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid job-field-env: %w", err)
+	}
+
+	if err := cfg.ResourceHints.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid resource-hints: %w", err)
+	}
+
+	if err := metrics.ValidateLabels(cfg.PrometheusLabels); err != nil {
+		return nil, fmt.Errorf("invalid prometheus-labels: %w", err)
+	}
+
+	if err := cfg.DurationHistogramBuckets.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid duration-histogram-buckets: %w", err)
+	}
+
+	for _, msg := range validation.IsValidLabelValue(cfg.ControllerID) {
+		return nil, fmt.Errorf("invalid controller-id %q: %s", cfg.ControllerID, msg)
+	}
+
+	for _, finalizer := range cfg.JobFinalizers {
+		for _, msg := range validation.IsQualifiedName(finalizer) {
+			return nil, fmt.Errorf("invalid job-finalizers: %q: %s", finalizer, msg)
+		}
+	}
+
+	if len(cfg.QueueLimits) > 0 && cfg.MaxInFlight == 0 {
+		return nil, errors.New("queue-limits requires max-in-flight to be set")
+	}
+	for _, queue := range slices.Sorted(maps.Keys(cfg.QueueLimits)) {
+		if limit := cfg.QueueLimits[queue]; limit <= 0 {
+			return nil, fmt.Errorf("invalid queue-limits: limit for queue %q must be positive (got %d)", queue, limit)
+		}
+	}
+
+	if len(cfg.TagLimits) > 0 && cfg.MaxInFlight == 0 {
+		return nil, errors.New("tag-limits requires max-in-flight to be set")
+	}
+	if err := cfg.TagLimits.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid tag-limits: %w", err)
+	}
+
+	if err := cfg.QueueRoutes.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid queue-routes: %w", err)
+	}
+
+	// The controller only fetches jobs in the queue in its tags, so options
+	// keyed by queue can't apply to any other queue.
+	tags, _ := agenttags.TagMapFromTags(cfg.Tags)
+	if err := checkQueueKeys(cfg.QueueRoutes, tags["queue"]); err != nil {
+		return nil, fmt.Errorf("invalid queue-routes: %w", err)
+	}
+	if err := checkQueueKeys(cfg.QueuePodParams, tags["queue"]); err != nil {
+		return nil, fmt.Errorf("invalid queue-pod-params: %w", err)
+	}
+	if err := checkQueueKeys(cfg.WarmPoolSizes, tags["queue"]); err != nil {
+		return nil, fmt.Errorf("invalid warm-pool-sizes: %w", err)
+	}
+
 	if cfg.PodSpecPatch != nil {
 		for _, c := range cfg.PodSpecPatch.Containers {
 			if len(c.Command) != 0 || len(c.Args) != 0 {
@@ -208,6 +486,20 @@ func ParseAndValidateConfig(v *viper.Viper) (*config.Config, error) {
 	return cfg, nil
 }
 
+// checkQueueKeys returns an error if any key of an option keyed by queue is
+// not the controller's queue. Jobs in other queues are never fetched, so
+// entries for them would never apply. Run a controller for each queue
+// instead.
+func checkQueueKeys[V any](m map[string]V, queue string) error {
+	var errs []error
+	for _, key := range slices.Sorted(maps.Keys(m)) {
+		if key != queue {
+			errs = append(errs, fmt.Errorf("queue %q is not this controller's queue (%q), so its jobs are never fetched", key, queue))
+		}
+	}
+	return errors.Join(errs...)
+}
+
 var (
 	english  = en.New()
 	uni      = ut.New(english, english)
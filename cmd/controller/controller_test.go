@@ -29,6 +29,21 @@ func TestReadAndParseConfig(t *testing.T) {
 		PollInterval:                 5 * time.Second,
 		StaleJobDataTimeout:          10 * time.Second,
 		JobCreationConcurrency:       5,
+		RequeueBackoff:               time.Second,
+		RequeueOrder:                 "back",
+		LimiterMode:                  "hard",
+		DuplicateJobAction:           "drop",
+		JobCreateRetries:             3,
+		QueueCooldown:                time.Minute,
+		LimiterSweepInterval:         time.Minute,
+		LimiterSweepJitter:           0.1,
+		JobCreateBurst:               10,
+		SaturatedPollInterval:        10 * time.Second,
+		PipelinesWindow:              24 * time.Hour,
+		TokenCheckInterval:           5 * time.Minute,
+		BackfillPageSize:             500,
+		BackfillPageRetries:          2,
+		DebugErrorsBufferSize:        50,
 		MaxInFlight:                  100,
 		Namespace:                    "my-buildkite-ns",
 		Org:                          "my-buildkite-org",
@@ -100,6 +115,12 @@ func TestReadAndParseConfig(t *testing.T) {
 				"argocd.argoproj.io/tracking-id": "example-id-here",
 			},
 		},
+		DefaultPodParams: &config.PodParams{
+			ServiceAccountName: "buildkite-agent-sa",
+		},
+		QueuePodParams: map[string]*config.PodParams{
+			"my-queue": {ServiceAccountName: "buildkite-deploy-sa"},
+		},
 		PodSpecPatch: &corev1.PodSpec{
 			ServiceAccountName:           "buildkite-agent-sa",
 			AutomountServiceAccountToken: ptr(true),
@@ -158,3 +179,66 @@ func TestReadAndParseConfig(t *testing.T) {
 		t.Errorf("parsed config diff (-got +want):\n%s", diff)
 	}
 }
+
+func TestParseAndValidateConfigQueueKeys(t *testing.T) {
+	tests := []struct {
+		name    string
+		key     string
+		value   any
+		wantErr bool
+	}{
+		{
+			name:  "queue-routes for this queue",
+			key:   "queue-routes",
+			value: map[string]any{"my-queue": map[string]any{"cooldown-failures": 2}},
+		},
+		{
+			name:    "queue-routes for another queue",
+			key:     "queue-routes",
+			value:   map[string]any{"deploy": map[string]any{"cooldown-failures": 2}},
+			wantErr: true,
+		},
+		{
+			name:  "queue-pod-params for this queue",
+			key:   "queue-pod-params",
+			value: map[string]any{"my-queue": map[string]any{"serviceAccountName": "team-a"}},
+		},
+		{
+			name:    "queue-pod-params for another queue",
+			key:     "queue-pod-params",
+			value:   map[string]any{"team-b": map[string]any{"serviceAccountName": "team-b"}},
+			wantErr: true,
+		},
+		{
+			name:  "warm-pool-sizes for this queue",
+			key:   "warm-pool-sizes",
+			value: map[string]any{"my-queue": 2},
+		},
+		{
+			name:    "warm-pool-sizes for another queue",
+			key:     "warm-pool-sizes",
+			value:   map[string]any{"my-queue": 2, "gpu": 1},
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("BUILDKITE_TOKEN", "my-graphql-enabled-token")
+			t.Setenv("IMAGE", "")
+			t.Setenv("NAMESPACE", "")
+
+			cmd := &cobra.Command{}
+			controller.AddConfigFlags(cmd)
+			v, err := controller.ReadConfigFromFileArgsAndEnv(cmd, []string{})
+			require.NoError(t, err)
+			v.Set("org", "my-org")
+			v.Set("tags", []string{"queue=my-queue"})
+			v.Set(test.key, test.value)
+
+			_, err = controller.ParseAndValidateConfig(v)
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Errorf("controller.ParseAndValidateConfig(v) error = %v, want error: %t", err, test.wantErr)
+			}
+		})
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"iter"
+	"slices"
 	"strings"
 
 	"k8s.io/apimachinery/pkg/util/validation"
@@ -27,6 +28,90 @@ func TagMapFromTags(tags []string) (map[string]string, []error) {
 	return m, errs
 }
 
+// ReservedPrefixes are the tag key prefixes reserved for use by the controller.
+// "k8s:" tags are added to the agent by the controller itself, and "bk-" tags
+// are reserved for controlling how the controller schedules a job.
+var ReservedPrefixes = []string{"k8s:", "bk-"}
+
+// Control tags are job tags that control how the controller schedules the
+// job, rather than which agents can run it.
+const (
+	// PriorityClassTag selects the priorityClassName of the job's pod.
+	PriorityClassTag = "bk-priority-class"
+
+	// SpotTag selects whether the job's pod runs on spot nodes ("true") or
+	// avoids them ("false").
+	SpotTag = "bk-spot"
+
+	// RuntimeTag selects the runtimeClassName of the job's pod, through the
+	// runtime-classes config (e.g. bk-runtime=gvisor).
+	RuntimeTag = "bk-runtime"
+
+	// CPUTag and MemoryTag ask for the CPU and memory of the job's command
+	// container, within the bounds of the resource-hints config (e.g.
+	// bk-cpu=2, bk-memory=4Gi).
+	CPUTag    = "bk-cpu"
+	MemoryTag = "bk-memory"
+
+	// EphemeralStorageTag asks for the ephemeral storage of the job's command
+	// container, within the bounds of the resource-hints config (e.g.
+	// bk-ephemeral-storage=20Gi).
+	EphemeralStorageTag = "bk-ephemeral-storage"
+
+	// CacheTag is conventionally used to select volumes to mount with the
+	// tag-volumes config (e.g. bk-cache=go).
+	CacheTag = "bk-cache"
+)
+
+var controlTags = map[string]bool{
+	PriorityClassTag:    true,
+	SpotTag:             true,
+	RuntimeTag:          true,
+	CPUTag:              true,
+	MemoryTag:           true,
+	EphemeralStorageTag: true,
+	CacheTag:            true,
+}
+
+// IsControlTag reports whether the tag key is a control tag.
+func IsControlTag(key string) bool {
+	return controlTags[key]
+}
+
+// ReservedKeys returns the sorted keys of the tags that have a reserved prefix,
+// other than control tags.
+func ReservedKeys(tags iter.Seq2[string, string]) []string {
+	var keys []string
+	for k := range tags {
+		if IsControlTag(k) {
+			continue
+		}
+		for _, prefix := range ReservedPrefixes {
+			if strings.HasPrefix(k, prefix) {
+				keys = append(keys, k)
+				break
+			}
+		}
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// WithoutControlTags returns an iterator over the tags that are not control
+// tags.
+func WithoutControlTags(tags iter.Seq2[string, string]) iter.Seq2[string, string] {
+	return func(yield func(string, string) bool) {
+		for k, v := range tags {
+			if IsControlTag(k) {
+				continue
+			}
+			if !yield(k, v) {
+				return
+			}
+		}
+	}
+}
+
 // labelsFromTagMap converts map[key->value] to map[tag.buildkite.com/key->value],
 // with k8s compatibility checks
 func labelsFromTagMap(m map[string]string) (map[string]string, []error) {
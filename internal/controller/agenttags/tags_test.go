@@ -218,3 +218,39 @@ func TestJobTagsMatchAgentTags(t *testing.T) {
 		})
 	}
 }
+
+func TestReservedKeys(t *testing.T) {
+	t.Parallel()
+
+	for i, test := range []struct {
+		tags     map[string]string
+		expected []string
+	}{
+		{
+			tags:     map[string]string{},
+			expected: nil,
+		},
+		{
+			tags:     map[string]string{"queue": "kubernetes", "os": "linux"},
+			expected: nil,
+		},
+		{
+			tags:     map[string]string{"queue": "kubernetes", "bk-limiter-exempt": "true"},
+			expected: []string{"bk-limiter-exempt"},
+		},
+		{
+			tags:     map[string]string{"k8s:agent-stack-version": "1", "bk-spot": "true", "bk-unknown": "true", "bk": "x"},
+			expected: []string{"bk-unknown", "k8s:agent-stack-version"},
+		},
+		{
+			tags:     map[string]string{"queue": "kubernetes", "bk-priority-class": "high"},
+			expected: nil,
+		},
+	} {
+		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+			t.Parallel()
+			actual := agenttags.ReservedKeys(maps.All(test.tags))
+			assert.Equal(t, test.expected, actual)
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// AgentCommandWrapper is a command that wraps the agent container's command,
+// e.g. to send its output to a log aggregator. The agent's command
+// ("buildkite-agent start") is passed to it as arguments, which it must run
+// (e.g. ["/bin/sh", "-c", "\"$@\" 2>&1 | ship-logs", "--"]).
+//
+// Each element is a text/template, which may only use the fields of
+// AgentCommandWrapperVars.
+type AgentCommandWrapper []string
+
+// AgentCommandWrapperVars are the values that an AgentCommandWrapper's
+// templates can use. They only contain characters that are safe in shell
+// commands.
+type AgentCommandWrapperVars struct {
+	// JobUUID is the Buildkite job UUID.
+	JobUUID string
+
+	// Pipeline is the slug of the job's pipeline.
+	Pipeline string
+}
+
+// Validate checks that each element is a template that only uses the fields of
+// AgentCommandWrapperVars.
+func (w AgentCommandWrapper) Validate() error {
+	_, err := w.Render(AgentCommandWrapperVars{})
+	return err
+}
+
+// Render returns the command with the templates executed with vars.
+func (w AgentCommandWrapper) Render(vars AgentCommandWrapperVars) ([]string, error) {
+	var errs []error
+	cmd := make([]string, 0, len(w))
+	for i, elem := range w {
+		tmpl, err := template.New(fmt.Sprintf("agent-command-wrapper[%d]", i)).
+			Option("missingkey=error").
+			Parse(elem)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		var sb strings.Builder
+		if err := tmpl.Execute(&sb, vars); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		cmd = append(cmd, sb.String())
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return cmd, nil
+}
@@ -0,0 +1,40 @@
+package config
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestAgentCommandWrapperValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		wrapper AgentCommandWrapper
+		wantErr bool
+	}{
+		{name: "nil"},
+		{name: "no templates", wrapper: AgentCommandWrapper{"ship-logs", "--"}},
+		{name: "allowed variables", wrapper: AgentCommandWrapper{"ship-logs", "--job={{.JobUUID}}", "--pipeline={{.Pipeline}}", "--"}},
+		{name: "unknown variable", wrapper: AgentCommandWrapper{"ship-logs", "--token={{.Token}}"}, wantErr: true},
+		{name: "invalid template", wrapper: AgentCommandWrapper{"ship-logs", "--job={{.JobUUID"}, wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.wrapper.Validate()
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Errorf("wrapper.Validate() = %v, want error: %t", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestAgentCommandWrapperRender(t *testing.T) {
+	wrapper := AgentCommandWrapper{"/bin/sh", "-c", `"$@" | ship-logs {{.Pipeline}}/{{.JobUUID}}`, "--"}
+	got, err := wrapper.Render(AgentCommandWrapperVars{JobUUID: "abc", Pipeline: "my-pipeline"})
+	if err != nil {
+		t.Fatalf("wrapper.Render(...) error = %v", err)
+	}
+	want := []string{"/bin/sh", "-c", `"$@" | ship-logs my-pipeline/abc`, "--"}
+	if !slices.Equal(got, want) {
+		t.Errorf("wrapper.Render(...) = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,92 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+)
+
+// BranchFilter restricts the branches whose jobs are scheduled, e.g. to keep
+// builds of pull requests from forks out of the cluster. Patterns are globs,
+// in which "*" matches any run of characters (including "/"), and "?" matches
+// any single character.
+type BranchFilter struct {
+	// Allow, if not empty, is the patterns that a job's branch must match
+	// one of.
+	Allow []string `json:"allow,omitempty"`
+
+	// Deny is patterns that a job's branch must not match any of. Deny takes
+	// precedence over Allow.
+	Deny []string `json:"deny,omitempty"`
+}
+
+// Validate checks that no pattern is empty.
+func (bf *BranchFilter) Validate() error {
+	if bf == nil {
+		return nil
+	}
+	var errs []error
+	for i, pattern := range bf.Allow {
+		if pattern == "" {
+			errs = append(errs, fmt.Errorf("allow[%d] is empty", i))
+		}
+	}
+	for i, pattern := range bf.Deny {
+		if pattern == "" {
+			errs = append(errs, fmt.Errorf("deny[%d] is empty", i))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Allows reports whether jobs on the branch may be scheduled. A nil filter
+// allows every branch. When Allow is not empty, an unknown (empty) branch is
+// not allowed.
+func (bf *BranchFilter) Allows(branch string) bool {
+	if bf == nil {
+		return true
+	}
+	for _, pattern := range bf.Deny {
+		if matchGlob(pattern, branch) {
+			return false
+		}
+	}
+	if len(bf.Allow) == 0 {
+		return true
+	}
+	for _, pattern := range bf.Allow {
+		if matchGlob(pattern, branch) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchGlob reports whether s matches the pattern, in which "*" matches any
+// run of characters and "?" matches any single character.
+func matchGlob(pattern, s string) bool {
+	p, str := []rune(pattern), []rune(s)
+	// Position in p just after the last "*", and the position in str it was
+	// matched up to, for backtracking.
+	star, match := -1, 0
+	i, j := 0, 0
+	for j < len(str) {
+		switch {
+		case i < len(p) && (p[i] == '?' || p[i] == str[j]):
+			i++
+			j++
+		case i < len(p) && p[i] == '*':
+			star, match = i+1, j
+			i++
+		case star >= 0:
+			// Let the last "*" match one more character.
+			match++
+			i, j = star, match
+		default:
+			return false
+		}
+	}
+	for i < len(p) && p[i] == '*' {
+		i++
+	}
+	return i == len(p)
+}
@@ -0,0 +1,73 @@
+package config
+
+import "testing"
+
+func TestBranchFilterValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		filter  *BranchFilter
+		wantErr bool
+	}{
+		{
+			name: "nil",
+		},
+		{
+			name:   "valid",
+			filter: &BranchFilter{Allow: []string{"main", "release/*"}, Deny: []string{"*-wip"}},
+		},
+		{
+			name:    "empty allow pattern",
+			filter:  &BranchFilter{Allow: []string{"main", ""}},
+			wantErr: true,
+		},
+		{
+			name:    "empty deny pattern",
+			filter:  &BranchFilter{Deny: []string{""}},
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.filter.Validate()
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Errorf("filter.Validate() = %v, want error: %t", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestBranchFilterAllows(t *testing.T) {
+	filter := &BranchFilter{
+		Allow: []string{"main", "release/*", "feature/??-*"},
+		Deny:  []string{"release/*-rc?", "*:*"},
+	}
+	tests := []struct {
+		branch string
+		want   bool
+	}{
+		{branch: "main", want: true},
+		{branch: "mainline", want: false},
+		{branch: "release/1.2", want: true},
+		{branch: "release/2024/q3", want: true},
+		{branch: "release/1.2-rc1", want: false},
+		{branch: "feature/ab-thing", want: true},
+		{branch: "feature/abc-thing", want: false},
+		// Fork pull requests have the fork owner's name in the branch.
+		{branch: "someone:main", want: false},
+		{branch: "", want: false},
+	}
+	for _, test := range tests {
+		if got := filter.Allows(test.branch); got != test.want {
+			t.Errorf("filter.Allows(%q) = %t, want %t", test.branch, got, test.want)
+		}
+	}
+
+	var none *BranchFilter
+	if !none.Allows("anything") {
+		t.Error("nil filter.Allows(\"anything\") = false, want true")
+	}
+	denyOnly := &BranchFilter{Deny: []string{"*:*"}}
+	if !denyOnly.Allows("") {
+		t.Error("deny-only filter.Allows(\"\") = false, want true")
+	}
+}
@@ -12,8 +12,14 @@ import (
 
 const (
 	UUIDLabel                           = "buildkite.com/job-uuid"
+	ClusterQueueUUIDLabel               = "buildkite.com/cluster-queue-uuid"
 	BuildURLAnnotation                  = "buildkite.com/build-url"
 	JobURLAnnotation                    = "buildkite.com/job-url"
+	ContentHashAnnotation               = "buildkite.com/job-content-hash"
+	AgentTagsAnnotation                 = "buildkite.com/agent-tags"
+	WarmPoolQueueLabel                  = "buildkite.com/warm-pool-queue"
+	ControllerIDLabel                   = "buildkite.com/controller-id"
+	QueueTagLabel                       = "tag.buildkite.com/queue"
 	DefaultNamespace                    = "default"
 	DefaultImagePullBackOffGracePeriod  = 30 * time.Second
 	DefaultJobCancelCheckerPollInterval = 5 * time.Second
@@ -30,6 +36,23 @@ type Config struct {
 	PollInterval           time.Duration `json:"poll-interval"`
 	StaleJobDataTimeout    time.Duration `json:"stale-job-data-timeout"   validate:"omitempty"`
 	JobCreationConcurrency int           `json:"job-creation-concurrency" validate:"omitempty"`
+	RequeueMaxAttempts     int           `json:"requeue-max-attempts"     validate:"min=0"`
+	RequeueBackoff         time.Duration `json:"requeue-backoff"          validate:"omitempty"`
+	RequeueOrder           string        `json:"requeue-order"            validate:"omitempty,oneof=back front"`
+	DuplicateJobAction     string        `json:"duplicate-job-action"     validate:"omitempty,oneof=drop log update"`
+	JobCreateRetries       int           `json:"job-create-retries"       validate:"min=0"`
+	QueueCooldownFailures  int           `json:"queue-cooldown-failures"  validate:"min=0"`
+	QueueCooldown          time.Duration `json:"queue-cooldown"           validate:"omitempty"`
+	JobCreateQPS           float64       `json:"job-create-qps"           validate:"min=0"`
+	JobCreateBurst         int           `json:"job-create-burst"         validate:"min=0"`
+	JobGenerateName        bool          `json:"job-generate-name"        validate:"omitempty"`
+	SaturatedPollThreshold time.Duration `json:"saturated-poll-threshold" validate:"omitempty"`
+	SaturatedPollInterval  time.Duration `json:"saturated-poll-interval"  validate:"omitempty"`
+	PipelinesWindow        time.Duration `json:"distinct-pipelines-window" validate:"omitempty"`
+	TokenCheckInterval     time.Duration `json:"token-check-interval"     validate:"omitempty"`
+	BackfillMaxPages       int           `json:"backfill-max-pages"       validate:"min=0"`
+	BackfillPageSize       int           `json:"backfill-page-size"       validate:"min=0,max=500"`
+	BackfillPageRetries    int           `json:"backfill-page-retries"    validate:"min=0"`
 	AgentTokenSecret       string        `json:"agent-token-secret"       validate:"required"`
 	BuildkiteToken         string        `json:"buildkite-token"          validate:"required"`
 	Image                  string        `json:"image"                    validate:"required"`
@@ -39,6 +62,25 @@ type Config struct {
 	Tags                   stringSlice   `json:"tags"                     validate:"min=1"`
 	ProfilerAddress        string        `json:"profiler-address"         validate:"omitempty,hostname_port"`
 	GraphQLEndpoint        string        `json:"graphql-endpoint"         validate:"omitempty"`
+	PrometheusPort         uint16        `json:"prometheus-port"          validate:"omitempty"`
+	WebhookAddress         string        `json:"webhook-address"          validate:"omitempty,hostname_port"`
+	WebhookSecret          string        `json:"webhook-secret"           validate:"required_with=WebhookAddress"`
+	LimiterQueueMetrics    bool          `json:"limiter-queue-metrics"    validate:"omitempty"`
+	LimiterMode            string        `json:"limiter-mode"             validate:"omitempty,oneof=hard soft"`
+	LimiterReturnDelay     time.Duration `json:"limiter-token-return-delay" validate:"omitempty"`
+	LimiterMinHold         time.Duration `json:"limiter-min-token-hold"   validate:"omitempty"`
+	LimiterRampUp          time.Duration `json:"limiter-ramp-up"          validate:"omitempty"`
+	LimiterHoldWarnAfter   time.Duration `json:"limiter-hold-warn-after"  validate:"omitempty"`
+	LimiterSweepInterval   time.Duration `json:"limiter-sweep-interval"   validate:"omitempty"`
+	LimiterSweepJitter     float64       `json:"limiter-sweep-jitter"     validate:"min=0,lt=1"`
+	DebugErrorsBufferSize  int           `json:"debug-errors-buffer-size" validate:"min=0"`
+	ReplayFile             string        `json:"replay-file"              validate:"omitempty"`
+	RecordFile             string        `json:"record-file"              validate:"omitempty"`
+	QuotaCheck             bool          `json:"quota-check"              validate:"omitempty"`
+	EmitEvents             bool          `json:"emit-events"              validate:"omitempty"`
+	AnnotateBuilds         bool          `json:"annotate-builds"          validate:"omitempty"`
+	ControllerID           string        `json:"controller-id"            validate:"omitempty"`
+	FilteredLogSampleRate  int           `json:"filtered-log-sample-rate" validate:"min=0"`
 	// Agent endpoint is set in agent-config.
 
 	// ClusterUUID field is mandatory for most new orgs.
@@ -59,6 +101,114 @@ type Config struct {
 	DefaultSidecarParams  *SidecarParams  `json:"default-sidecar-params"  validate:"omitempty"`
 	DefaultMetadata       Metadata        `json:"default-metadata"        validate:"omitempty"`
 
+	// DefaultPodParams applies to the pods of all jobs. QueuePodParams is keyed
+	// by queue name, and applies to the pods of jobs whose queue tag matches,
+	// taking precedence over DefaultPodParams. Only the queue in Tags can have
+	// params, since jobs in other queues are never fetched.
+	DefaultPodParams *PodParams            `json:"default-pod-params" validate:"omitempty"`
+	QueuePodParams   map[string]*PodParams `json:"queue-pod-params"   validate:"omitempty"`
+
+	// AllowedPriorityClasses lists the values that jobs may select with the
+	// bk-priority-class tag, or the kubernetes plugin's podSpec or
+	// podSpecPatch. Other values are ignored.
+	AllowedPriorityClasses stringSlice `json:"allowed-priority-classes" validate:"omitempty"`
+
+	// AgentCommandWrapper, if set, is a command that wraps the agent
+	// container's command (e.g. to stream its logs elsewhere). The agent's
+	// command is passed to it as arguments.
+	AgentCommandWrapper AgentCommandWrapper `json:"agent-command-wrapper" validate:"omitempty"`
+
+	// JobFieldEnv maps Buildkite job fields (e.g. "env.BUILDKITE_BUILD_ID" or
+	// "tag.queue") to the names of environment variables that are set to
+	// their values on the agent container.
+	JobFieldEnv JobFieldEnv `json:"job-field-env" validate:"omitempty"`
+
+	// RuntimeClasses maps the values jobs may select with the bk-runtime tag
+	// to the runtimeClassName of their pods (e.g. "gvisor" to "gvisor" for
+	// untrusted builds). Jobs that select any other value are failed.
+	RuntimeClasses map[string]string `json:"runtime-classes" validate:"omitempty"`
+
+	// AllowedImages, if not empty, restricts the images that job pods may use.
+	// Entries ending in "*" match images by prefix (e.g.
+	// "registry.example.com/*"), other entries must match exactly. The
+	// controller's image is always allowed.
+	AllowedImages stringSlice `json:"allowed-images" validate:"omitempty"`
+
+	// JobFinalizers are added to each Kubernetes job created, so that another
+	// controller (e.g. one that archives logs) can act before the job is
+	// deleted. That controller is responsible for removing them.
+	JobFinalizers stringSlice `json:"job-finalizers" validate:"omitempty"`
+
+	// SpotParams controls the placement of pods of jobs with the bk-spot tag.
+	SpotParams *SpotParams `json:"spot-params" validate:"omitempty"`
+
+	// ResourceHints bounds the CPU, memory and ephemeral storage that jobs may
+	// ask for with the bk-cpu, bk-memory and bk-ephemeral-storage tags.
+	ResourceHints *ResourceHints `json:"resource-hints" validate:"omitempty"`
+
+	// TagVolumes maps job tags (e.g. "bk-cache=go") to volumes that are
+	// mounted into the pods of jobs with the tag.
+	TagVolumes TagVolumes `json:"tag-volumes" validate:"omitempty"`
+
+	// BranchFilter restricts the branches whose jobs are scheduled (e.g. to
+	// keep out builds of pull requests from forks).
+	BranchFilter *BranchFilter `json:"branch-filter" validate:"omitempty"`
+
+	// PodTagLabels maps job tag keys to labels that are set on the pods of
+	// jobs with the tags (e.g. for NetworkPolicies to select them by).
+	PodTagLabels PodTagLabels `json:"pod-tag-labels" validate:"omitempty"`
+
+	// PrometheusLabels are added as constant labels to all the controller's
+	// metrics (e.g. to tell controllers apart when metrics are federated).
+	PrometheusLabels map[string]string `json:"prometheus-labels" validate:"omitempty"`
+
+	// DurationHistogramBuckets configures the buckets of the controller's
+	// duration histograms (e.g. classic buckets for Prometheus servers that
+	// don't support native histograms).
+	DurationHistogramBuckets *HistogramBuckets `json:"duration-histogram-buckets" validate:"omitempty"`
+
+	// PrometheusExemplars attaches exemplars with the OpenTelemetry trace ID
+	// to observations of duration histograms made in a sampled span, and
+	// serves metrics in the OpenMetrics format (which exemplars need) to
+	// scrapers that ask for it.
+	PrometheusExemplars bool `json:"prometheus-exemplars" validate:"omitempty"`
+
+	// QueueLimits limits the number of jobs running concurrently in each
+	// Buildkite cluster queue, keyed by cluster queue UUID. Jobs in these
+	// queues are also subject to MaxInFlight, which must be set.
+	QueueLimits map[string]int `json:"queue-limits" validate:"omitempty"`
+
+	// TagLimits limits the number of jobs running concurrently among jobs
+	// with particular tags. Each job is subject to the first limit whose tags
+	// it has, instead of its queue's limit. Jobs are also subject to
+	// MaxInFlight, which must be set.
+	TagLimits TagLimits `json:"tag-limits" validate:"omitempty"`
+
+	// QueueRoutes gives the jobs in some queues (by queue tag) their own
+	// admission checks, before the deduper, limiter and scheduler that all
+	// jobs share. Only the queue in Tags can have a route, since jobs in other
+	// queues are never fetched.
+	QueueRoutes QueueRoutes `json:"queue-routes" validate:"omitempty"`
+
+	// WarmPoolSizes is the number of idle warm pods to keep running for each
+	// queue. Jobs in the queue claim a warm pod, freeing its node for the
+	// job's pod, which has the agent image already pulled. Warm pods use
+	// the queue's pod params, and request the resource hint defaults. Only
+	// the queue in Tags can have a pool, since jobs in other queues are never
+	// fetched to claim its pods.
+	WarmPoolSizes map[string]int `json:"warm-pool-sizes" validate:"omitempty"`
+
+	// ScheduleOnceLeaseDuration enables holding a Lease for each job while it
+	// is scheduled, so that when several controllers watch the same queue only
+	// one schedules each job. 0 disables it.
+	ScheduleOnceLeaseDuration time.Duration `json:"schedule-once-lease-duration" validate:"omitempty"`
+
+	// GraphQLJobsQuery replaces the built-in query used to find scheduled
+	// jobs. The response must have the same shape as the built-in query.
+	// GraphQLJobsQueryVariables are passed to it as extra variables.
+	GraphQLJobsQuery          string         `json:"graphql-jobs-query"           validate:"omitempty"`
+	GraphQLJobsQueryVariables map[string]any `json:"graphql-jobs-query-variables" validate:"omitempty"`
+
 	// ProhibitKubernetesPlugin can be used to prevent alterations to the pod
 	// from the job (the kubernetes "plugin" in pipeline.yml). If enabled,
 	// jobs with a "kubernetes" plugin will fail.
@@ -82,6 +232,30 @@ func (c Config) MarshalLogObject(enc zapcore.ObjectEncoder) error {
 	enc.AddDuration("poll-interval", c.PollInterval)
 	enc.AddDuration("stale-job-data-timeout", c.StaleJobDataTimeout)
 	enc.AddInt("job-creation-concurrency", c.JobCreationConcurrency)
+	enc.AddInt("requeue-max-attempts", c.RequeueMaxAttempts)
+	enc.AddDuration("requeue-backoff", c.RequeueBackoff)
+	enc.AddString("requeue-order", c.RequeueOrder)
+	enc.AddString("duplicate-job-action", c.DuplicateJobAction)
+	enc.AddInt("job-create-retries", c.JobCreateRetries)
+	enc.AddInt("queue-cooldown-failures", c.QueueCooldownFailures)
+	enc.AddDuration("queue-cooldown", c.QueueCooldown)
+	enc.AddFloat64("job-create-qps", c.JobCreateQPS)
+	enc.AddInt("job-create-burst", c.JobCreateBurst)
+	enc.AddBool("job-generate-name", c.JobGenerateName)
+	enc.AddString("replay-file", c.ReplayFile)
+	enc.AddString("record-file", c.RecordFile)
+	enc.AddBool("quota-check", c.QuotaCheck)
+	enc.AddBool("emit-events", c.EmitEvents)
+	enc.AddBool("annotate-builds", c.AnnotateBuilds)
+	enc.AddString("controller-id", c.ControllerID)
+	enc.AddInt("filtered-log-sample-rate", c.FilteredLogSampleRate)
+	enc.AddDuration("saturated-poll-threshold", c.SaturatedPollThreshold)
+	enc.AddDuration("saturated-poll-interval", c.SaturatedPollInterval)
+	enc.AddDuration("distinct-pipelines-window", c.PipelinesWindow)
+	enc.AddDuration("token-check-interval", c.TokenCheckInterval)
+	enc.AddInt("backfill-max-pages", c.BackfillMaxPages)
+	enc.AddInt("backfill-page-size", c.BackfillPageSize)
+	enc.AddInt("backfill-page-retries", c.BackfillPageRetries)
 	enc.AddInt("max-in-flight", c.MaxInFlight)
 	enc.AddString("namespace", c.Namespace)
 	enc.AddString("org", c.Org)
@@ -89,6 +263,18 @@ func (c Config) MarshalLogObject(enc zapcore.ObjectEncoder) error {
 		return err
 	}
 	enc.AddString("profiler-address", c.ProfilerAddress)
+	enc.AddUint16("prometheus-port", c.PrometheusPort)
+	enc.AddBool("prometheus-exemplars", c.PrometheusExemplars)
+	enc.AddString("webhook-address", c.WebhookAddress)
+	enc.AddBool("limiter-queue-metrics", c.LimiterQueueMetrics)
+	enc.AddString("limiter-mode", c.LimiterMode)
+	enc.AddDuration("limiter-token-return-delay", c.LimiterReturnDelay)
+	enc.AddDuration("limiter-min-token-hold", c.LimiterMinHold)
+	enc.AddDuration("limiter-ramp-up", c.LimiterRampUp)
+	enc.AddDuration("limiter-hold-warn-after", c.LimiterHoldWarnAfter)
+	enc.AddDuration("limiter-sweep-interval", c.LimiterSweepInterval)
+	enc.AddFloat64("limiter-sweep-jitter", c.LimiterSweepJitter)
+	enc.AddInt("debug-errors-buffer-size", c.DebugErrorsBufferSize)
 	enc.AddString("cluster-uuid", c.ClusterUUID)
 	enc.AddBool("prohibit-kubernetes-plugin", c.ProhibitKubernetesPlugin)
 	if err := enc.AddArray("additional-redacted-vars", c.AdditionalRedactedVars); err != nil {
@@ -99,6 +285,7 @@ func (c Config) MarshalLogObject(enc zapcore.ObjectEncoder) error {
 	}
 	enc.AddDuration("image-pull-backoff-grace-period", c.ImagePullBackOffGracePeriod)
 	enc.AddDuration("job-cancel-checker-poll-interval", c.JobCancelCheckerPollInterval)
+	enc.AddDuration("schedule-once-lease-duration", c.ScheduleOnceLeaseDuration)
 	if err := enc.AddReflected("agent-config", c.AgentConfig); err != nil {
 		return err
 	}
@@ -114,6 +301,67 @@ func (c Config) MarshalLogObject(enc zapcore.ObjectEncoder) error {
 	if err := enc.AddReflected("default-metadata", c.DefaultMetadata); err != nil {
 		return err
 	}
+	if err := enc.AddReflected("default-pod-params", c.DefaultPodParams); err != nil {
+		return err
+	}
+	if err := enc.AddReflected("queue-pod-params", c.QueuePodParams); err != nil {
+		return err
+	}
+	if err := enc.AddArray("allowed-priority-classes", c.AllowedPriorityClasses); err != nil {
+		return err
+	}
+	if err := enc.AddReflected("agent-command-wrapper", c.AgentCommandWrapper); err != nil {
+		return err
+	}
+	if err := enc.AddReflected("job-field-env", c.JobFieldEnv); err != nil {
+		return err
+	}
+	if err := enc.AddReflected("runtime-classes", c.RuntimeClasses); err != nil {
+		return err
+	}
+	if err := enc.AddArray("allowed-images", c.AllowedImages); err != nil {
+		return err
+	}
+	if err := enc.AddArray("job-finalizers", c.JobFinalizers); err != nil {
+		return err
+	}
+	if err := enc.AddReflected("spot-params", c.SpotParams); err != nil {
+		return err
+	}
+	if err := enc.AddReflected("resource-hints", c.ResourceHints); err != nil {
+		return err
+	}
+	if err := enc.AddReflected("tag-volumes", c.TagVolumes); err != nil {
+		return err
+	}
+	if err := enc.AddReflected("pod-tag-labels", c.PodTagLabels); err != nil {
+		return err
+	}
+	if err := enc.AddReflected("branch-filter", c.BranchFilter); err != nil {
+		return err
+	}
+	if err := enc.AddReflected("prometheus-labels", c.PrometheusLabels); err != nil {
+		return err
+	}
+	if err := enc.AddReflected("duration-histogram-buckets", c.DurationHistogramBuckets); err != nil {
+		return err
+	}
+	if err := enc.AddReflected("queue-limits", c.QueueLimits); err != nil {
+		return err
+	}
+	if err := enc.AddReflected("tag-limits", c.TagLimits); err != nil {
+		return err
+	}
+	if err := enc.AddReflected("queue-routes", c.QueueRoutes); err != nil {
+		return err
+	}
+	if err := enc.AddReflected("warm-pool-sizes", c.WarmPoolSizes); err != nil {
+		return err
+	}
+	enc.AddString("graphql-jobs-query", c.GraphQLJobsQuery)
+	if err := enc.AddReflected("graphql-jobs-query-variables", c.GraphQLJobsQueryVariables); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -0,0 +1,37 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+)
+
+// HistogramBuckets configures the buckets of the controller's duration
+// histograms. Classic are the upper bounds of classic buckets, in seconds. If
+// NativeFactor is set, the histograms also have native buckets, each this
+// factor wider than the last (e.g. 1.1), for Prometheus servers that support
+// them. If neither is set, the default classic buckets are used.
+type HistogramBuckets struct {
+	Classic      []float64 `json:"classic,omitempty"`
+	NativeFactor float64   `json:"native-factor,omitempty"`
+}
+
+// Validate checks that the classic bounds are positive and increasing, and
+// that the native factor is greater than 1 if set.
+func (hb *HistogramBuckets) Validate() error {
+	if hb == nil {
+		return nil
+	}
+	var errs []error
+	for i, bound := range hb.Classic {
+		switch {
+		case bound <= 0:
+			errs = append(errs, fmt.Errorf("classic[%d]: bound must be positive (got %v)", i, bound))
+		case i > 0 && bound <= hb.Classic[i-1]:
+			errs = append(errs, fmt.Errorf("classic[%d]: bound %v is not greater than the one before (%v)", i, bound, hb.Classic[i-1]))
+		}
+	}
+	if hb.NativeFactor != 0 && hb.NativeFactor <= 1 {
+		errs = append(errs, fmt.Errorf("native-factor must be greater than 1 (got %v)", hb.NativeFactor))
+	}
+	return errors.Join(errs...)
+}
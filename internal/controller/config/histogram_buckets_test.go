@@ -0,0 +1,29 @@
+package config
+
+import "testing"
+
+func TestHistogramBucketsValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		buckets *HistogramBuckets
+		wantErr bool
+	}{
+		{name: "nil"},
+		{name: "empty", buckets: &HistogramBuckets{}},
+		{name: "classic", buckets: &HistogramBuckets{Classic: []float64{0.05, 0.5, 5, 30}}},
+		{name: "native", buckets: &HistogramBuckets{NativeFactor: 1.1}},
+		{name: "both", buckets: &HistogramBuckets{Classic: []float64{1, 10}, NativeFactor: 2}},
+		{name: "zero bound", buckets: &HistogramBuckets{Classic: []float64{0, 1}}, wantErr: true},
+		{name: "not increasing", buckets: &HistogramBuckets{Classic: []float64{1, 5, 5}}, wantErr: true},
+		{name: "native factor 1", buckets: &HistogramBuckets{NativeFactor: 1}, wantErr: true},
+		{name: "negative native factor", buckets: &HistogramBuckets{NativeFactor: -2}, wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.buckets.Validate()
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Errorf("buckets.Validate() = %v, want error: %t", err, test.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,56 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// Buildkite job fields that JobFieldEnv can copy. Tags and job environment
+// variables are copied with the JobFieldTagPrefix and JobFieldEnvPrefix
+// prefixes instead (e.g. "tag.queue" or "env.BUILDKITE_BUILD_ID").
+const (
+	JobFieldUUID             = "uuid"
+	JobFieldCommand          = "command"
+	JobFieldScheduledAt      = "scheduledAt"
+	JobFieldClusterQueueUUID = "clusterQueue.uuid"
+
+	JobFieldTagPrefix = "tag."
+	JobFieldEnvPrefix = "env."
+)
+
+// JobFieldEnv maps Buildkite job fields to the names of environment variables
+// that are set to their values on the agent container (e.g.
+// "env.BUILDKITE_BUILD_ID" to "BUILD_ID").
+type JobFieldEnv map[string]string
+
+// Validate checks that each field is known, and each variable name is valid.
+func (jfe JobFieldEnv) Validate() error {
+	var errs []error
+	for _, field := range slices.Sorted(maps.Keys(jfe)) {
+		if !validJobField(field) {
+			errs = append(errs, fmt.Errorf("unknown job field %q", field))
+		}
+		for _, msg := range validation.IsEnvVarName(jfe[field]) {
+			errs = append(errs, fmt.Errorf("field %q: invalid variable name %q: %s", field, jfe[field], msg))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func validJobField(field string) bool {
+	switch field {
+	case JobFieldUUID, JobFieldCommand, JobFieldScheduledAt, JobFieldClusterQueueUUID:
+		return true
+	}
+	for _, prefix := range []string{JobFieldTagPrefix, JobFieldEnvPrefix} {
+		if name, ok := strings.CutPrefix(field, prefix); ok && name != "" {
+			return true
+		}
+	}
+	return false
+}
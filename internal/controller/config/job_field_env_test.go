@@ -0,0 +1,47 @@
+package config
+
+import "testing"
+
+func TestJobFieldEnvValidate(t *testing.T) {
+	tests := []struct {
+		name        string
+		jobFieldEnv JobFieldEnv
+		wantErr     bool
+	}{
+		{
+			name: "nil",
+		},
+		{
+			name: "valid",
+			jobFieldEnv: JobFieldEnv{
+				"uuid":                   "JOB_UUID",
+				"clusterQueue.uuid":      "CLUSTER_QUEUE",
+				"tag.queue":              "QUEUE",
+				"env.BUILDKITE_BUILD_ID": "BUILD_ID",
+			},
+		},
+		{
+			name:        "unknown field",
+			jobFieldEnv: JobFieldEnv{"pipeline": "PIPELINE"},
+			wantErr:     true,
+		},
+		{
+			name:        "prefix without name",
+			jobFieldEnv: JobFieldEnv{"tag.": "TAG"},
+			wantErr:     true,
+		},
+		{
+			name:        "invalid variable name",
+			jobFieldEnv: JobFieldEnv{"uuid": "JOB=UUID"},
+			wantErr:     true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.jobFieldEnv.Validate()
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Errorf("jobFieldEnv.Validate() = %v, want error: %t", err, test.wantErr)
+			}
+		})
+	}
+}
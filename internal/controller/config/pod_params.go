@@ -0,0 +1,639 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"net/netip"
+	"regexp"
+	"slices"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/utils/ptr"
+)
+
+// PodParams contains parameters that provide additional control over the pod
+// built for each job. They can be set as a default within the config, and for
+// jobs in particular queues.
+type PodParams struct {
+	ServiceAccountName string `json:"serviceAccountName,omitempty"`
+
+	// AgentTokenSecret is the name of the Secret holding the agent token (as
+	// BUILDKITE_AGENT_TOKEN) that pods use, e.g. so that a queue can use its
+	// own Buildkite cluster's token. If unset, agent-token-secret is used.
+	AgentTokenSecret string `json:"agentTokenSecret,omitempty"`
+
+	// PriorityClassName is used for pods of jobs that don't select an allowed
+	// priority class with the bk-priority-class tag.
+	PriorityClassName string `json:"priorityClassName,omitempty"`
+
+	// AgentEnv is added to the environment of the agent container. A queue's
+	// variables replace default variables with the same name. Variables set
+	// by the controller or from the job (such as BUILDKITE_AGENT_TAGS) take
+	// precedence over these, and are left alone.
+	AgentEnv []corev1.EnvVar `json:"agentEnv,omitempty"`
+
+	// AgentLifecycle is the lifecycle of the agent container, e.g. a preStop
+	// hook that flushes logs before the pod is stopped. A queue's preStop and
+	// postStart hooks replace the default ones separately. A preStop hook
+	// runs within the pod's termination grace period, so whatever time it
+	// takes is no longer available for the agent to finish the job.
+	AgentLifecycle *corev1.Lifecycle `json:"agentLifecycle,omitempty"`
+
+	// PodAnnotations are added to the pod (but not the Job), e.g.
+	// sidecar.istio.io/inject: "false" to keep a service mesh from injecting
+	// its sidecar. A queue's annotations replace default annotations with the
+	// same key. They take precedence over default-metadata annotations, but
+	// not over those from the kubernetes plugin.
+	PodAnnotations map[string]string `json:"podAnnotations,omitempty"`
+
+	// SchedulingGates are added to the pod, so that it isn't scheduled until
+	// something else (such as a quota reservation controller) removes them.
+	// The pod's job holds its max-in-flight token while it is gated. A
+	// queue's gates are added to the default gates.
+	SchedulingGates []corev1.PodSchedulingGate `json:"schedulingGates,omitempty"`
+
+	// InitContainers run, in order, before any init containers from the
+	// kubernetes plugin.
+	InitContainers []corev1.Container `json:"initContainers,omitempty"`
+
+	// Sidecars run alongside the job's containers, after any sidecars from the
+	// kubernetes plugin. They share the pod's network and the workspace
+	// volume. Once the agent finishes, the job is given a deadline, so that
+	// sidecars that keep running don't stop it from finishing.
+	Sidecars []corev1.Container `json:"sidecars,omitempty"`
+
+	// TerminationGracePeriodSeconds is how long the pod is given to shut down
+	// (e.g. to upload artifacts when the job is cancelled) before it is
+	// killed. If unset, 60 seconds is used.
+	TerminationGracePeriodSeconds *int64 `json:"terminationGracePeriodSeconds,omitempty"`
+
+	// DNS settings for the pod. See the PodSpec fields of the same names.
+	DNSPolicy   corev1.DNSPolicy     `json:"dnsPolicy,omitempty"`
+	DNSConfig   *corev1.PodDNSConfig `json:"dnsConfig,omitempty"`
+	HostAliases []corev1.HostAlias   `json:"hostAliases,omitempty"`
+
+	// TopologySpreadConstraints are used for pods that don't have any
+	// already. Unlike other lists, constraints for a queue replace the
+	// default constraints rather than being appended to them.
+	TopologySpreadConstraints []corev1.TopologySpreadConstraint `json:"topologySpreadConstraints,omitempty"`
+
+	// MaxPodsPerNode limits how many job pods are placed on each node. 0 (the
+	// default) is unlimited. A limit of 1 is enforced with a required pod
+	// anti-affinity. Larger limits use a topology spread constraint across
+	// nodes, which only caps the number of pods per node while some eligible
+	// node has none (e.g. when the cluster can scale up).
+	MaxPodsPerNode int32 `json:"maxPodsPerNode,omitempty"`
+
+	// MaxPodsPerNodeScope is which pods count towards MaxPodsPerNode: "all"
+	// job pods (the default), or only those in the same "queue".
+	MaxPodsPerNodeScope string `json:"maxPodsPerNodeScope,omitempty"`
+
+	// SecurityContext is used for pods that don't have one already. It is set
+	// before the checkout container is built, so that checkout runs as the
+	// pod's runAsUser and runAsGroup.
+	SecurityContext *corev1.PodSecurityContext `json:"securityContext,omitempty"`
+
+	// ContainerSecurityContext is used for each container and init container
+	// that doesn't have a security context already.
+	ContainerSecurityContext *corev1.SecurityContext `json:"containerSecurityContext,omitempty"`
+
+	// SecurityProfile fills in whatever fields of SecurityContext and
+	// ContainerSecurityContext are unset with those required by a Pod
+	// Security Standard: "restricted", or "none" (the default, which a queue
+	// can use to turn off the default params' profile).
+	SecurityProfile string `json:"securityProfile,omitempty"`
+}
+
+// Values for PodParams.MaxPodsPerNodeScope.
+const (
+	MaxPodsPerNodeScopeAll   = "all"
+	MaxPodsPerNodeScopeQueue = "queue"
+)
+
+// Values for PodParams.SecurityProfile.
+const (
+	SecurityProfileNone       = "none"
+	SecurityProfileRestricted = "restricted"
+)
+
+// WithOverrides returns the params that result from layering override over pp.
+// Fields set in override take precedence over those in pp, and lists from
+// override are appended to those in pp.
+func (pp *PodParams) WithOverrides(override *PodParams) *PodParams {
+	if pp == nil {
+		return override
+	}
+	if override == nil {
+		return pp
+	}
+	merged := *pp
+	if override.ServiceAccountName != "" {
+		merged.ServiceAccountName = override.ServiceAccountName
+	}
+	if override.AgentTokenSecret != "" {
+		merged.AgentTokenSecret = override.AgentTokenSecret
+	}
+	if override.PriorityClassName != "" {
+		merged.PriorityClassName = override.PriorityClassName
+	}
+	if override.TerminationGracePeriodSeconds != nil {
+		merged.TerminationGracePeriodSeconds = override.TerminationGracePeriodSeconds
+	}
+	if override.DNSPolicy != "" {
+		merged.DNSPolicy = override.DNSPolicy
+	}
+	if override.DNSConfig != nil {
+		merged.DNSConfig = override.DNSConfig
+	}
+	if override.MaxPodsPerNode != 0 {
+		merged.MaxPodsPerNode = override.MaxPodsPerNode
+	}
+	if override.MaxPodsPerNodeScope != "" {
+		merged.MaxPodsPerNodeScope = override.MaxPodsPerNodeScope
+	}
+	if len(override.TopologySpreadConstraints) > 0 {
+		merged.TopologySpreadConstraints = override.TopologySpreadConstraints
+	}
+	if override.SecurityContext != nil {
+		merged.SecurityContext = override.SecurityContext
+	}
+	if override.ContainerSecurityContext != nil {
+		merged.ContainerSecurityContext = override.ContainerSecurityContext
+	}
+	if override.SecurityProfile != "" {
+		merged.SecurityProfile = override.SecurityProfile
+	}
+	merged.AgentEnv = mergeEnv(pp.AgentEnv, override.AgentEnv)
+	merged.AgentLifecycle = mergeLifecycle(pp.AgentLifecycle, override.AgentLifecycle)
+	if len(override.PodAnnotations) > 0 {
+		merged.PodAnnotations = maps.Clone(pp.PodAnnotations)
+		if merged.PodAnnotations == nil {
+			merged.PodAnnotations = make(map[string]string, len(override.PodAnnotations))
+		}
+		maps.Copy(merged.PodAnnotations, override.PodAnnotations)
+	}
+	merged.InitContainers = slices.Concat(pp.InitContainers, override.InitContainers)
+	merged.Sidecars = slices.Concat(pp.Sidecars, override.Sidecars)
+	merged.HostAliases = slices.Concat(pp.HostAliases, override.HostAliases)
+	merged.SchedulingGates = slices.Concat(pp.SchedulingGates, override.SchedulingGates)
+	return &merged
+}
+
+// ApplyTo applies the params to the pod spec. Fields that are already set in
+// the pod spec (e.g. from the kubernetes plugin) are left alone.
+func (pp *PodParams) ApplyTo(podSpec *corev1.PodSpec) {
+	if pp == nil || podSpec == nil {
+		return
+	}
+	if podSpec.ServiceAccountName == "" {
+		podSpec.ServiceAccountName = pp.ServiceAccountName
+	}
+	if podSpec.PriorityClassName == "" {
+		podSpec.PriorityClassName = pp.PriorityClassName
+	}
+	if podSpec.TerminationGracePeriodSeconds == nil && pp.TerminationGracePeriodSeconds != nil {
+		podSpec.TerminationGracePeriodSeconds = ptr.To(*pp.TerminationGracePeriodSeconds)
+	}
+	if podSpec.DNSPolicy == "" {
+		podSpec.DNSPolicy = pp.DNSPolicy
+	}
+	if podSpec.DNSConfig == nil && pp.DNSConfig != nil {
+		podSpec.DNSConfig = pp.DNSConfig.DeepCopy()
+	}
+	for _, ha := range pp.HostAliases {
+		podSpec.HostAliases = append(podSpec.HostAliases, *ha.DeepCopy())
+	}
+	for _, gate := range pp.SchedulingGates {
+		if !slices.ContainsFunc(podSpec.SchedulingGates, func(g corev1.PodSchedulingGate) bool {
+			return g.Name == gate.Name
+		}) {
+			podSpec.SchedulingGates = append(podSpec.SchedulingGates, gate)
+		}
+	}
+	if len(podSpec.TopologySpreadConstraints) == 0 {
+		for _, tsc := range pp.TopologySpreadConstraints {
+			podSpec.TopologySpreadConstraints = append(podSpec.TopologySpreadConstraints, *tsc.DeepCopy())
+		}
+	}
+	if csc := pp.containerSecurityContext(); csc != nil {
+		for i := range podSpec.InitContainers {
+			if podSpec.InitContainers[i].SecurityContext == nil {
+				podSpec.InitContainers[i].SecurityContext = csc.DeepCopy()
+			}
+		}
+		for i := range podSpec.Containers {
+			if podSpec.Containers[i].SecurityContext == nil {
+				podSpec.Containers[i].SecurityContext = csc.DeepCopy()
+			}
+		}
+	}
+}
+
+// ApplyAgentEnvTo adds AgentEnv to the agent container's environment, except
+// for variables that the container already has.
+func (pp *PodParams) ApplyAgentEnvTo(ctr *corev1.Container) {
+	if pp == nil || ctr == nil {
+		return
+	}
+	for _, ev := range pp.AgentEnv {
+		set := slices.ContainsFunc(ctr.Env, func(e corev1.EnvVar) bool {
+			return e.Name == ev.Name
+		})
+		if !set {
+			ctr.Env = append(ctr.Env, *ev.DeepCopy())
+		}
+	}
+}
+
+// ApplyPodAnnotationsTo adds PodAnnotations to the pod's annotations, except
+// for those with keys in keep.
+func (pp *PodParams) ApplyPodAnnotationsTo(annotations, keep map[string]string) {
+	if pp == nil || annotations == nil {
+		return
+	}
+	for k, v := range pp.PodAnnotations {
+		if _, ok := keep[k]; !ok {
+			annotations[k] = v
+		}
+	}
+}
+
+// ApplyAgentLifecycleTo sets the agent container's lifecycle, if it doesn't
+// have one already.
+func (pp *PodParams) ApplyAgentLifecycleTo(ctr *corev1.Container) {
+	if pp == nil || ctr == nil || pp.AgentLifecycle == nil || ctr.Lifecycle != nil {
+		return
+	}
+	ctr.Lifecycle = pp.AgentLifecycle.DeepCopy()
+}
+
+// mergeLifecycle returns base, with each hook that is set in override
+// replacing the one in base.
+func mergeLifecycle(base, override *corev1.Lifecycle) *corev1.Lifecycle {
+	if base == nil {
+		return override
+	}
+	if override == nil {
+		return base
+	}
+	merged := *base
+	if override.PostStart != nil {
+		merged.PostStart = override.PostStart
+	}
+	if override.PreStop != nil {
+		merged.PreStop = override.PreStop
+	}
+	return &merged
+}
+
+// validateLifecycleHandler checks that a lifecycle hook has exactly one
+// action.
+func validateLifecycleHandler(name string, h *corev1.LifecycleHandler) error {
+	if h == nil {
+		return nil
+	}
+	actions := 0
+	for _, set := range []bool{h.Exec != nil, h.HTTPGet != nil, h.TCPSocket != nil, h.Sleep != nil} {
+		if set {
+			actions++
+		}
+	}
+	switch {
+	case actions != 1:
+		return fmt.Errorf("agentLifecycle.%s must have exactly one of exec, httpGet, tcpSocket or sleep (got %d)", name, actions)
+	case h.Exec != nil && len(h.Exec.Command) == 0:
+		return fmt.Errorf("agentLifecycle.%s.exec.command must not be empty", name)
+	case h.Sleep != nil && h.Sleep.Seconds <= 0:
+		return fmt.Errorf("agentLifecycle.%s.sleep.seconds must be positive (got %d)", name, h.Sleep.Seconds)
+	}
+	return nil
+}
+
+// mergeEnv returns the variables in base, with those in override replacing
+// any with the same name, and the rest of override appended.
+func mergeEnv(base, override []corev1.EnvVar) []corev1.EnvVar {
+	if len(override) == 0 {
+		return base
+	}
+	merged := slices.Clone(base)
+	for _, ev := range override {
+		i := slices.IndexFunc(merged, func(e corev1.EnvVar) bool {
+			return e.Name == ev.Name
+		})
+		if i >= 0 {
+			merged[i] = ev
+		} else {
+			merged = append(merged, ev)
+		}
+	}
+	return merged
+}
+
+// ApplySecurityContextTo sets the pod's security context, if it doesn't have
+// one already. Unlike ApplyTo, this has to happen before the checkout
+// container is built.
+func (pp *PodParams) ApplySecurityContextTo(podSpec *corev1.PodSpec) {
+	if pp == nil || podSpec == nil || podSpec.SecurityContext != nil {
+		return
+	}
+	podSpec.SecurityContext = pp.podSecurityContext()
+}
+
+// podSecurityContext returns a copy of SecurityContext, with the fields
+// required by the profile filled in.
+func (pp *PodParams) podSecurityContext() *corev1.PodSecurityContext {
+	psc := pp.SecurityContext.DeepCopy()
+	if pp.SecurityProfile != SecurityProfileRestricted {
+		return psc
+	}
+	if psc == nil {
+		psc = &corev1.PodSecurityContext{}
+	}
+	if psc.RunAsNonRoot == nil {
+		psc.RunAsNonRoot = ptr.To(true)
+	}
+	if psc.SeccompProfile == nil {
+		psc.SeccompProfile = &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeRuntimeDefault}
+	}
+	return psc
+}
+
+// containerSecurityContext returns a copy of ContainerSecurityContext, with
+// the fields required by the profile filled in.
+func (pp *PodParams) containerSecurityContext() *corev1.SecurityContext {
+	csc := pp.ContainerSecurityContext.DeepCopy()
+	if pp.SecurityProfile != SecurityProfileRestricted {
+		return csc
+	}
+	if csc == nil {
+		csc = &corev1.SecurityContext{}
+	}
+	if csc.AllowPrivilegeEscalation == nil {
+		csc.AllowPrivilegeEscalation = ptr.To(false)
+	}
+	if csc.Capabilities == nil {
+		csc.Capabilities = &corev1.Capabilities{Drop: []corev1.Capability{"ALL"}}
+	}
+	return csc
+}
+
+// reservedAnnotations are the annotations that the scheduler sets on each
+// pod itself.
+var reservedAnnotations = map[string]bool{
+	UUIDLabel:             true, // also set as an annotation
+	BuildURLAnnotation:    true,
+	JobURLAnnotation:      true,
+	ContentHashAnnotation: true,
+	AgentTagsAnnotation:   true,
+	"cluster-autoscaler.kubernetes.io/safe-to-evict": true,
+}
+
+// reservedContainerName matches the names of containers that the scheduler
+// adds to the pod itself, or names by default.
+var reservedContainerName = regexp.MustCompile(`^(agent|checkout|copy-agent|imagepullcheck-.*|container-\d+|sidecar-\d+)$`)
+
+// Validate checks the params for mistakes that Kubernetes would otherwise
+// only reject when a pod is created.
+func (pp *PodParams) Validate() error {
+	if pp == nil {
+		return nil
+	}
+	var errs []error
+	if pp.AgentTokenSecret != "" {
+		for _, msg := range validation.IsDNS1123Subdomain(pp.AgentTokenSecret) {
+			errs = append(errs, fmt.Errorf("agentTokenSecret %q: %s", pp.AgentTokenSecret, msg))
+		}
+	}
+	if tgps := pp.TerminationGracePeriodSeconds; tgps != nil && *tgps < 0 {
+		errs = append(errs, fmt.Errorf("terminationGracePeriodSeconds must not be negative (got %d)", *tgps))
+	}
+	if lc := pp.AgentLifecycle; lc != nil {
+		errs = append(errs,
+			validateLifecycleHandler("postStart", lc.PostStart),
+			validateLifecycleHandler("preStop", lc.PreStop),
+		)
+	}
+	for k := range pp.PodAnnotations {
+		for _, msg := range validation.IsQualifiedName(k) {
+			errs = append(errs, fmt.Errorf("podAnnotations key %q: %s", k, msg))
+		}
+		if reservedAnnotations[k] {
+			errs = append(errs, fmt.Errorf("podAnnotations key %q is set by the controller", k))
+		}
+	}
+	for _, gate := range pp.SchedulingGates {
+		for _, msg := range validation.IsQualifiedName(gate.Name) {
+			errs = append(errs, fmt.Errorf("schedulingGates name %q: %s", gate.Name, msg))
+		}
+	}
+	switch pp.DNSPolicy {
+	case "", corev1.DNSClusterFirst, corev1.DNSClusterFirstWithHostNet, corev1.DNSDefault:
+	case corev1.DNSNone:
+		if pp.DNSConfig == nil || len(pp.DNSConfig.Nameservers) == 0 {
+			errs = append(errs, errors.New("dnsConfig.nameservers must be set when dnsPolicy is None"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("unknown dnsPolicy %q", pp.DNSPolicy))
+	}
+	if pp.DNSConfig != nil {
+		if len(pp.DNSConfig.Nameservers) > 3 {
+			errs = append(errs, fmt.Errorf("dnsConfig.nameservers has %d entries, at most 3 are allowed", len(pp.DNSConfig.Nameservers)))
+		}
+		for _, ns := range pp.DNSConfig.Nameservers {
+			if _, err := netip.ParseAddr(ns); err != nil {
+				errs = append(errs, fmt.Errorf("dnsConfig.nameservers: %w", err))
+			}
+		}
+	}
+	for _, ha := range pp.HostAliases {
+		if _, err := netip.ParseAddr(ha.IP); err != nil {
+			errs = append(errs, fmt.Errorf("hostAliases: %w", err))
+		}
+		if len(ha.Hostnames) == 0 {
+			errs = append(errs, fmt.Errorf("hostAliases: no hostnames for IP %q", ha.IP))
+		}
+	}
+	if pp.MaxPodsPerNode < 0 {
+		errs = append(errs, fmt.Errorf("maxPodsPerNode must not be negative (got %d)", pp.MaxPodsPerNode))
+	}
+	switch pp.MaxPodsPerNodeScope {
+	case "", MaxPodsPerNodeScopeAll, MaxPodsPerNodeScopeQueue:
+	default:
+		errs = append(errs, fmt.Errorf("unknown maxPodsPerNodeScope %q", pp.MaxPodsPerNodeScope))
+	}
+	switch pp.SecurityProfile {
+	case "", SecurityProfileNone, SecurityProfileRestricted:
+	default:
+		errs = append(errs, fmt.Errorf("unknown securityProfile %q", pp.SecurityProfile))
+	}
+	if psc := pp.podSecurityContext(); psc != nil {
+		if ptr.Deref(psc.RunAsNonRoot, false) && psc.RunAsUser != nil && *psc.RunAsUser == 0 {
+			errs = append(errs, errors.New("securityContext: runAsUser must not be 0 when runAsNonRoot is true"))
+		}
+	}
+	if csc := pp.containerSecurityContext(); csc != nil && !ptr.Deref(csc.AllowPrivilegeEscalation, true) {
+		if ptr.Deref(csc.Privileged, false) {
+			errs = append(errs, errors.New("containerSecurityContext: allowPrivilegeEscalation must not be false when privileged is true"))
+		}
+		if csc.Capabilities != nil && slices.Contains(csc.Capabilities.Add, "SYS_ADMIN") {
+			errs = append(errs, errors.New("containerSecurityContext: allowPrivilegeEscalation must not be false when the SYS_ADMIN capability is added"))
+		}
+	}
+	envNames := make(map[string]bool)
+	for i, ev := range pp.AgentEnv {
+		switch {
+		case ev.Name == "":
+			errs = append(errs, fmt.Errorf("agentEnv[%d]: name must be set", i))
+		case envNames[ev.Name]:
+			errs = append(errs, fmt.Errorf("agentEnv[%d]: duplicate name %q", i, ev.Name))
+		}
+		envNames[ev.Name] = true
+		if ev.Value != "" && ev.ValueFrom != nil {
+			errs = append(errs, fmt.Errorf("agentEnv[%d]: only one of value and valueFrom can be set", i))
+		}
+	}
+	names := make(map[string]bool)
+	for i, c := range pp.Sidecars {
+		switch {
+		case c.Name == "":
+			errs = append(errs, fmt.Errorf("sidecars[%d]: name must be set", i))
+		case reservedContainerName.MatchString(c.Name):
+			errs = append(errs, fmt.Errorf("sidecars[%d]: name %q is reserved for containers added by the controller", i, c.Name))
+		case names[c.Name]:
+			errs = append(errs, fmt.Errorf("sidecars[%d]: duplicate name %q", i, c.Name))
+		}
+		names[c.Name] = true
+		if c.Image == "" {
+			errs = append(errs, fmt.Errorf("sidecars[%d]: image must be set", i))
+		}
+	}
+	type tscKey struct {
+		topologyKey       string
+		whenUnsatisfiable corev1.UnsatisfiableConstraintAction
+	}
+	seen := make(map[tscKey]bool)
+	for i, tsc := range pp.TopologySpreadConstraints {
+		if tsc.MaxSkew < 1 {
+			errs = append(errs, fmt.Errorf("topologySpreadConstraints[%d]: maxSkew must be at least 1 (got %d)", i, tsc.MaxSkew))
+		}
+		if tsc.TopologyKey == "" {
+			errs = append(errs, fmt.Errorf("topologySpreadConstraints[%d]: topologyKey must be set", i))
+		}
+		switch tsc.WhenUnsatisfiable {
+		case corev1.DoNotSchedule:
+		case corev1.ScheduleAnyway:
+			if tsc.MinDomains != nil {
+				errs = append(errs, fmt.Errorf("topologySpreadConstraints[%d]: minDomains can only be set when whenUnsatisfiable is DoNotSchedule", i))
+			}
+		default:
+			errs = append(errs, fmt.Errorf("topologySpreadConstraints[%d]: unknown whenUnsatisfiable %q", i, tsc.WhenUnsatisfiable))
+		}
+		if md := tsc.MinDomains; md != nil && *md < 1 {
+			errs = append(errs, fmt.Errorf("topologySpreadConstraints[%d]: minDomains must be at least 1 (got %d)", i, *md))
+		}
+		if tsc.LabelSelector == nil {
+			errs = append(errs, fmt.Errorf("topologySpreadConstraints[%d]: labelSelector must be set, otherwise no pods are counted", i))
+		} else if _, err := metav1.LabelSelectorAsSelector(tsc.LabelSelector); err != nil {
+			errs = append(errs, fmt.Errorf("topologySpreadConstraints[%d]: labelSelector: %w", i, err))
+		}
+		key := tscKey{tsc.TopologyKey, tsc.WhenUnsatisfiable}
+		if seen[key] {
+			errs = append(errs, fmt.Errorf("topologySpreadConstraints[%d]: duplicate topologyKey %q and whenUnsatisfiable %q", i, tsc.TopologyKey, tsc.WhenUnsatisfiable))
+		}
+		seen[key] = true
+	}
+	return errors.Join(errs...)
+}
+
+// ApplyMaxPodsPerNodeTo adds the anti-affinity or topology spread constraint
+// that enforces MaxPodsPerNode to the pod spec of a pod with the given labels.
+func (pp *PodParams) ApplyMaxPodsPerNodeTo(podSpec *corev1.PodSpec, podLabels map[string]string) {
+	if pp == nil || podSpec == nil || pp.MaxPodsPerNode <= 0 {
+		return
+	}
+	// Every job pod has a UUID label. Warm pool pods don't, so aren't counted.
+	selector := &metav1.LabelSelector{
+		MatchExpressions: []metav1.LabelSelectorRequirement{{
+			Key:      UUIDLabel,
+			Operator: metav1.LabelSelectorOpExists,
+		}},
+	}
+	if queue, ok := podLabels[QueueTagLabel]; ok && pp.MaxPodsPerNodeScope == MaxPodsPerNodeScopeQueue {
+		selector.MatchLabels = map[string]string{QueueTagLabel: queue}
+	}
+
+	if pp.MaxPodsPerNode == 1 {
+		if podSpec.Affinity == nil {
+			podSpec.Affinity = &corev1.Affinity{}
+		}
+		if podSpec.Affinity.PodAntiAffinity == nil {
+			podSpec.Affinity.PodAntiAffinity = &corev1.PodAntiAffinity{}
+		}
+		paa := podSpec.Affinity.PodAntiAffinity
+		paa.RequiredDuringSchedulingIgnoredDuringExecution = append(paa.RequiredDuringSchedulingIgnoredDuringExecution, corev1.PodAffinityTerm{
+			LabelSelector: selector,
+			TopologyKey:   corev1.LabelHostname,
+		})
+		return
+	}
+
+	// Kubernetes rejects pods with two constraints for the same topology key
+	// and whenUnsatisfiable, so leave any existing one alone.
+	exists := slices.ContainsFunc(podSpec.TopologySpreadConstraints, func(tsc corev1.TopologySpreadConstraint) bool {
+		return tsc.TopologyKey == corev1.LabelHostname && tsc.WhenUnsatisfiable == corev1.DoNotSchedule
+	})
+	if exists {
+		return
+	}
+	podSpec.TopologySpreadConstraints = append(podSpec.TopologySpreadConstraints, corev1.TopologySpreadConstraint{
+		MaxSkew:           pp.MaxPodsPerNode,
+		TopologyKey:       corev1.LabelHostname,
+		WhenUnsatisfiable: corev1.DoNotSchedule,
+		LabelSelector:     selector,
+	})
+}
+
+// ApplyInitContainersTo inserts the init containers ahead of those already in
+// the pod spec. Each is given the volumeMounts that it does not already have
+// a mount at the same path for.
+func (pp *PodParams) ApplyInitContainersTo(podSpec *corev1.PodSpec, volumeMounts []corev1.VolumeMount) {
+	if pp == nil || podSpec == nil || len(pp.InitContainers) == 0 {
+		return
+	}
+	initContainers := make([]corev1.Container, 0, len(pp.InitContainers)+len(podSpec.InitContainers))
+	for _, c := range pp.InitContainers {
+		initContainers = append(initContainers, withMounts(c, volumeMounts))
+	}
+	podSpec.InitContainers = append(initContainers, podSpec.InitContainers...)
+}
+
+// SidecarContainers returns copies of the sidecars. Each is given the
+// volumeMounts that it does not already have a mount at the same path for.
+func (pp *PodParams) SidecarContainers(volumeMounts []corev1.VolumeMount) []corev1.Container {
+	if pp == nil {
+		return nil
+	}
+	sidecars := make([]corev1.Container, 0, len(pp.Sidecars))
+	for _, c := range pp.Sidecars {
+		sidecars = append(sidecars, withMounts(c, volumeMounts))
+	}
+	return sidecars
+}
+
+// withMounts returns a copy of the container with the volumeMounts that it
+// does not already have a mount at the same path for.
+func withMounts(c corev1.Container, volumeMounts []corev1.VolumeMount) corev1.Container {
+	ctr := c.DeepCopy()
+	for _, vm := range volumeMounts {
+		hasMount := slices.ContainsFunc(ctr.VolumeMounts, func(m corev1.VolumeMount) bool {
+			return m.MountPath == vm.MountPath
+		})
+		if !hasMount {
+			ctr.VolumeMounts = append(ctr.VolumeMounts, vm)
+		}
+	}
+	return *ctr
+}
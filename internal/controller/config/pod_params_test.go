@@ -0,0 +1,306 @@
+package config
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/ptr"
+)
+
+func TestPodParamsValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		params  *PodParams
+		wantErr bool
+	}{
+		{
+			name:   "nil",
+			params: nil,
+		},
+		{
+			name: "valid",
+			params: &PodParams{
+				DNSPolicy: corev1.DNSNone,
+				DNSConfig: &corev1.PodDNSConfig{
+					Nameservers: []string{"10.0.0.10", "fd00::10"},
+					Searches:    []string{"internal.example.com"},
+				},
+				HostAliases: []corev1.HostAlias{
+					{IP: "10.1.2.3", Hostnames: []string{"buildkite.internal"}},
+				},
+			},
+		},
+		{
+			name:   "valid agentTokenSecret",
+			params: &PodParams{AgentTokenSecret: "team-a-agent-token"},
+		},
+		{
+			name:    "invalid agentTokenSecret",
+			params:  &PodParams{AgentTokenSecret: "Team A"},
+			wantErr: true,
+		},
+		{
+			name: "agent lifecycle",
+			params: &PodParams{AgentLifecycle: &corev1.Lifecycle{
+				PostStart: &corev1.LifecycleHandler{Exec: &corev1.ExecAction{Command: []string{"true"}}},
+				PreStop:   &corev1.LifecycleHandler{Sleep: &corev1.SleepAction{Seconds: 5}},
+			}},
+		},
+		{
+			name: "agent lifecycle hook without action",
+			params: &PodParams{AgentLifecycle: &corev1.Lifecycle{
+				PreStop: &corev1.LifecycleHandler{},
+			}},
+			wantErr: true,
+		},
+		{
+			name: "agent lifecycle hook with two actions",
+			params: &PodParams{AgentLifecycle: &corev1.Lifecycle{
+				PreStop: &corev1.LifecycleHandler{
+					Exec:  &corev1.ExecAction{Command: []string{"true"}},
+					Sleep: &corev1.SleepAction{Seconds: 5},
+				},
+			}},
+			wantErr: true,
+		},
+		{
+			name: "agent lifecycle sleep of zero seconds",
+			params: &PodParams{AgentLifecycle: &corev1.Lifecycle{
+				PreStop: &corev1.LifecycleHandler{Sleep: &corev1.SleepAction{}},
+			}},
+			wantErr: true,
+		},
+		{
+			name:   "pod annotations",
+			params: &PodParams{PodAnnotations: map[string]string{"sidecar.istio.io/inject": "false"}},
+		},
+		{
+			name:    "invalid pod annotation key",
+			params:  &PodParams{PodAnnotations: map[string]string{"not a key": "x"}},
+			wantErr: true,
+		},
+		{
+			name:    "pod annotation set by the controller",
+			params:  &PodParams{PodAnnotations: map[string]string{UUIDLabel: "x"}},
+			wantErr: true,
+		},
+		{
+			name:   "scheduling gates",
+			params: &PodParams{SchedulingGates: []corev1.PodSchedulingGate{{Name: "example.com/quota-reservation"}}},
+		},
+		{
+			name:    "invalid scheduling gate name",
+			params:  &PodParams{SchedulingGates: []corev1.PodSchedulingGate{{Name: "quota reservation"}}},
+			wantErr: true,
+		},
+		{
+			name:    "negative terminationGracePeriodSeconds",
+			params:  &PodParams{TerminationGracePeriodSeconds: ptr.To[int64](-1)},
+			wantErr: true,
+		},
+		{
+			name:    "unknown policy",
+			params:  &PodParams{DNSPolicy: "ClusterFrist"},
+			wantErr: true,
+		},
+		{
+			name:    "None without nameservers",
+			params:  &PodParams{DNSPolicy: corev1.DNSNone},
+			wantErr: true,
+		},
+		{
+			name: "invalid nameserver",
+			params: &PodParams{DNSConfig: &corev1.PodDNSConfig{
+				Nameservers: []string{"dns.example.com"},
+			}},
+			wantErr: true,
+		},
+		{
+			name: "invalid host alias IP",
+			params: &PodParams{HostAliases: []corev1.HostAlias{
+				{IP: "10.1.2", Hostnames: []string{"buildkite.internal"}},
+			}},
+			wantErr: true,
+		},
+		{
+			name: "host alias without hostnames",
+			params: &PodParams{HostAliases: []corev1.HostAlias{
+				{IP: "10.1.2.3"},
+			}},
+			wantErr: true,
+		},
+		{
+			name: "topology spread constraints",
+			params: &PodParams{TopologySpreadConstraints: []corev1.TopologySpreadConstraint{
+				zoneSpread(corev1.DoNotSchedule),
+				{
+					MaxSkew:           2,
+					TopologyKey:       "kubernetes.io/hostname",
+					WhenUnsatisfiable: corev1.ScheduleAnyway,
+					LabelSelector:     &metav1.LabelSelector{MatchLabels: map[string]string{"tag.buildkite.com/queue": "default"}},
+				},
+			}},
+		},
+		{
+			name: "topology spread constraint with zero maxSkew",
+			params: &PodParams{TopologySpreadConstraints: []corev1.TopologySpreadConstraint{
+				func() corev1.TopologySpreadConstraint {
+					tsc := zoneSpread(corev1.DoNotSchedule)
+					tsc.MaxSkew = 0
+					return tsc
+				}(),
+			}},
+			wantErr: true,
+		},
+		{
+			name: "topology spread constraint with unknown whenUnsatisfiable",
+			params: &PodParams{TopologySpreadConstraints: []corev1.TopologySpreadConstraint{
+				zoneSpread("Sometimes"),
+			}},
+			wantErr: true,
+		},
+		{
+			name: "topology spread constraint with minDomains and ScheduleAnyway",
+			params: &PodParams{TopologySpreadConstraints: []corev1.TopologySpreadConstraint{
+				func() corev1.TopologySpreadConstraint {
+					tsc := zoneSpread(corev1.ScheduleAnyway)
+					tsc.MinDomains = ptr.To[int32](3)
+					return tsc
+				}(),
+			}},
+			wantErr: true,
+		},
+		{
+			name: "topology spread constraint without labelSelector",
+			params: &PodParams{TopologySpreadConstraints: []corev1.TopologySpreadConstraint{
+				func() corev1.TopologySpreadConstraint {
+					tsc := zoneSpread(corev1.DoNotSchedule)
+					tsc.LabelSelector = nil
+					return tsc
+				}(),
+			}},
+			wantErr: true,
+		},
+		{
+			name: "duplicate topology spread constraints",
+			params: &PodParams{TopologySpreadConstraints: []corev1.TopologySpreadConstraint{
+				zoneSpread(corev1.DoNotSchedule),
+				zoneSpread(corev1.DoNotSchedule),
+			}},
+			wantErr: true,
+		},
+		{
+			name:   "max pods per node",
+			params: &PodParams{MaxPodsPerNode: 2, MaxPodsPerNodeScope: MaxPodsPerNodeScopeQueue},
+		},
+		{
+			name:    "negative max pods per node",
+			params:  &PodParams{MaxPodsPerNode: -1},
+			wantErr: true,
+		},
+		{
+			name:    "unknown max pods per node scope",
+			params:  &PodParams{MaxPodsPerNode: 2, MaxPodsPerNodeScope: "node"},
+			wantErr: true,
+		},
+		{
+			name: "sidecars",
+			params: &PodParams{Sidecars: []corev1.Container{
+				{Name: "postgres", Image: "postgres:16"},
+				{Name: "proxy", Image: "envoyproxy/envoy:v1.31"},
+			}},
+		},
+		{
+			name:    "sidecar without name",
+			params:  &PodParams{Sidecars: []corev1.Container{{Image: "postgres:16"}}},
+			wantErr: true,
+		},
+		{
+			name:    "sidecar without image",
+			params:  &PodParams{Sidecars: []corev1.Container{{Name: "postgres"}}},
+			wantErr: true,
+		},
+		{
+			name:    "sidecar with reserved name",
+			params:  &PodParams{Sidecars: []corev1.Container{{Name: "container-0", Image: "postgres:16"}}},
+			wantErr: true,
+		},
+		{
+			name: "duplicate sidecar names",
+			params: &PodParams{Sidecars: []corev1.Container{
+				{Name: "postgres", Image: "postgres:16"},
+				{Name: "postgres", Image: "postgres:17"},
+			}},
+			wantErr: true,
+		},
+		{
+			name: "agent env",
+			params: &PodParams{AgentEnv: []corev1.EnvVar{
+				{Name: "HTTPS_PROXY", Value: "http://proxy.internal:3128"},
+				{Name: "DD_AGENT_HOST", ValueFrom: &corev1.EnvVarSource{
+					FieldRef: &corev1.ObjectFieldSelector{FieldPath: "status.hostIP"},
+				}},
+			}},
+		},
+		{
+			name:    "agent env without name",
+			params:  &PodParams{AgentEnv: []corev1.EnvVar{{Value: "http://proxy.internal:3128"}}},
+			wantErr: true,
+		},
+		{
+			name: "duplicate agent env",
+			params: &PodParams{AgentEnv: []corev1.EnvVar{
+				{Name: "HTTPS_PROXY", Value: "http://proxy.internal:3128"},
+				{Name: "HTTPS_PROXY", Value: "http://egress.internal:3128"},
+			}},
+			wantErr: true,
+		},
+		{
+			name: "restricted profile",
+			params: &PodParams{
+				SecurityProfile: SecurityProfileRestricted,
+				SecurityContext: &corev1.PodSecurityContext{RunAsUser: ptr.To[int64](1000)},
+			},
+		},
+		{
+			name:    "unknown securityProfile",
+			params:  &PodParams{SecurityProfile: "baseline"},
+			wantErr: true,
+		},
+		{
+			name: "restricted profile with root user",
+			params: &PodParams{
+				SecurityProfile: SecurityProfileRestricted,
+				SecurityContext: &corev1.PodSecurityContext{RunAsUser: ptr.To[int64](0)},
+			},
+			wantErr: true,
+		},
+		{
+			name: "restricted profile with privileged containers",
+			params: &PodParams{
+				SecurityProfile:          SecurityProfileRestricted,
+				ContainerSecurityContext: &corev1.SecurityContext{Privileged: ptr.To(true)},
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.params.Validate()
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Errorf("%+v.Validate() = %v, want error: %t", test.params, err, test.wantErr)
+			}
+		})
+	}
+}
+
+func zoneSpread(whenUnsatisfiable corev1.UnsatisfiableConstraintAction) corev1.TopologySpreadConstraint {
+	return corev1.TopologySpreadConstraint{
+		MaxSkew:           1,
+		TopologyKey:       "topology.kubernetes.io/zone",
+		WhenUnsatisfiable: whenUnsatisfiable,
+		LabelSelector:     &metav1.LabelSelector{MatchLabels: map[string]string{"tag.buildkite.com/queue": "default"}},
+	}
+}
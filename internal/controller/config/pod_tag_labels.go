@@ -0,0 +1,91 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// PodTagLabels maps job tag keys to the names of labels that are set on the
+// job's pod, but not the Kubernetes job, to the tags' values (e.g. "team" to
+// "example.com/team"), so that NetworkPolicies can select pods by them.
+// Values are sanitized to be valid label values (see SanitizeLabelValue).
+type PodTagLabels map[string]string
+
+// Validate checks that each tag key is set, and each label name is valid,
+// used by only one tag, and not one that the controller sets itself.
+func (ptl PodTagLabels) Validate() error {
+	var errs []error
+	tagFor := make(map[string]string)
+	for _, tag := range slices.Sorted(maps.Keys(ptl)) {
+		label := ptl[tag]
+		if tag == "" {
+			errs = append(errs, errors.New("empty tag key"))
+		}
+		for _, msg := range validation.IsQualifiedName(label) {
+			errs = append(errs, fmt.Errorf("tag %q: invalid label name %q: %s", tag, label, msg))
+		}
+		if reservedLabel(label) {
+			errs = append(errs, fmt.Errorf("tag %q: label %q is reserved for use by the controller", tag, label))
+		}
+		if other, ok := tagFor[label]; ok {
+			errs = append(errs, fmt.Errorf("tags %q and %q both set label %q", other, tag, label))
+		}
+		tagFor[label] = tag
+	}
+	return errors.Join(errs...)
+}
+
+// Labels returns the pod labels for the job's tags. Tags that the job doesn't
+// have, or whose values are empty once sanitized, are skipped.
+func (ptl PodTagLabels) Labels(tags map[string]string) map[string]string {
+	labels := make(map[string]string)
+	for tag, label := range ptl {
+		value, ok := tags[tag]
+		if !ok {
+			continue
+		}
+		if value = SanitizeLabelValue(value); value != "" {
+			labels[label] = value
+		}
+	}
+	return labels
+}
+
+// reservedLabel reports whether the label name is in a namespace that the
+// controller uses for its own labels.
+func reservedLabel(label string) bool {
+	return strings.HasPrefix(label, "buildkite.com/") || strings.HasPrefix(label, "tag.buildkite.com/")
+}
+
+// SanitizeLabelValue returns v made into a valid label value: characters other
+// than alphanumerics, '-', '_' and '.' are replaced with '-', it is truncated
+// to 63 characters, and leading and trailing non-alphanumerics are removed.
+func SanitizeLabelValue(v string) string {
+	b := []byte(v)
+	for i, c := range b {
+		if !isAlphanumeric(c) && c != '-' && c != '_' && c != '.' {
+			b[i] = '-'
+		}
+	}
+	// Multi-byte characters have been replaced byte by byte, so b is ASCII.
+	if len(b) > validation.LabelValueMaxLength {
+		b = b[:validation.LabelValueMaxLength]
+	}
+	start, end := 0, len(b)
+	for start < end && !isAlphanumeric(b[start]) {
+		start++
+	}
+	for end > start && !isAlphanumeric(b[end-1]) {
+		end--
+	}
+	return string(b[start:end])
+}
+
+func isAlphanumeric(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9'
+}
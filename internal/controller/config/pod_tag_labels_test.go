@@ -0,0 +1,104 @@
+package config
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestPodTagLabelsValidate(t *testing.T) {
+	tests := []struct {
+		name         string
+		podTagLabels PodTagLabels
+		wantErr      bool
+	}{
+		{
+			name: "nil",
+		},
+		{
+			name: "valid",
+			podTagLabels: PodTagLabels{
+				"team":     "example.com/team",
+				"pipeline": "pipeline",
+			},
+		},
+		{
+			name:         "empty tag key",
+			podTagLabels: PodTagLabels{"": "team"},
+			wantErr:      true,
+		},
+		{
+			name:         "invalid label name",
+			podTagLabels: PodTagLabels{"team": "example.com/team name"},
+			wantErr:      true,
+		},
+		{
+			name:         "reserved label",
+			podTagLabels: PodTagLabels{"team": "buildkite.com/team"},
+			wantErr:      true,
+		},
+		{
+			name:         "reserved tag label",
+			podTagLabels: PodTagLabels{"team": "tag.buildkite.com/team"},
+			wantErr:      true,
+		},
+		{
+			name: "duplicate label",
+			podTagLabels: PodTagLabels{
+				"team":  "example.com/team",
+				"squad": "example.com/team",
+			},
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.podTagLabels.Validate()
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Errorf("podTagLabels.Validate() = %v, want error: %t", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestPodTagLabelsLabels(t *testing.T) {
+	ptl := PodTagLabels{
+		"team":     "example.com/team",
+		"pipeline": "example.com/pipeline",
+		"missing":  "example.com/missing",
+		"empty":    "example.com/empty",
+	}
+	tags := map[string]string{
+		"team":     "Platform Eng",
+		"pipeline": "agent-stack-k8s",
+		"empty":    "!!!",
+		"queue":    "default",
+	}
+	want := map[string]string{
+		"example.com/team":     "Platform-Eng",
+		"example.com/pipeline": "agent-stack-k8s",
+	}
+	if diff := cmp.Diff(want, ptl.Labels(tags)); diff != "" {
+		t.Errorf("ptl.Labels(tags) diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestSanitizeLabelValue(t *testing.T) {
+	tests := []struct {
+		value, want string
+	}{
+		{value: "", want: ""},
+		{value: "payments", want: "payments"},
+		{value: "team/payments", want: "team-payments"},
+		{value: "_private_", want: "private"},
+		{value: "café", want: "caf"},
+		{value: strings.Repeat("a", 62) + "-b", want: strings.Repeat("a", 62)},
+		{value: strings.Repeat("x", 100), want: strings.Repeat("x", 63)},
+	}
+	for _, test := range tests {
+		if got := SanitizeLabelValue(test.value); got != test.want {
+			t.Errorf("SanitizeLabelValue(%q) = %q, want %q", test.value, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// QueueRoute gives the jobs in one queue their own admission checks, in front
+// of the deduper, limiter and scheduler that every job goes through.
+type QueueRoute struct {
+	// BranchFilter, if set, restricts the branches whose jobs in the queue
+	// are scheduled, as well as the global branch filter.
+	BranchFilter *BranchFilter `json:"branch-filter,omitempty"`
+
+	// CooldownFailures, if positive, gives the queue a cooldown of its own
+	// (see Config.QueueCooldownFailures), which starts after this many
+	// scheduling failures in a row and lasts for Cooldown (or
+	// Config.QueueCooldown if not set).
+	CooldownFailures int           `json:"cooldown-failures,omitempty"`
+	Cooldown         time.Duration `json:"cooldown,omitempty"`
+}
+
+// QueueRoutes are the queues whose jobs take their own handler chain, keyed by
+// queue tag. Jobs in other queues take the default chain. The controller only
+// fetches jobs in its own queue, so that is the only queue that can have a
+// route (see Config.QueueRoutes).
+type QueueRoutes map[string]*QueueRoute
+
+// Validate checks that each route's queue can be used as a metric label value,
+// and that each route has at least one valid admission check.
+func (qr QueueRoutes) Validate() error {
+	var errs []error
+	for _, queue := range slices.Sorted(maps.Keys(qr)) {
+		route := qr[queue]
+		prefix := fmt.Sprintf("route for queue %q", queue)
+		if queue == "" {
+			errs = append(errs, errors.New("route has an empty queue name"))
+		}
+		for _, msg := range validation.IsValidLabelValue(queue) {
+			errs = append(errs, fmt.Errorf("%s: invalid queue name: %s", prefix, msg))
+		}
+		if route == nil || (route.BranchFilter == nil && route.CooldownFailures == 0) {
+			errs = append(errs, fmt.Errorf("%s: must set branch-filter or cooldown-failures", prefix))
+			continue
+		}
+		if err := route.BranchFilter.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: invalid branch-filter: %w", prefix, err))
+		}
+		if route.CooldownFailures < 0 {
+			errs = append(errs, fmt.Errorf("%s: cooldown-failures must not be negative (got %d)", prefix, route.CooldownFailures))
+		}
+		if route.Cooldown < 0 {
+			errs = append(errs, fmt.Errorf("%s: cooldown must not be negative (got %v)", prefix, route.Cooldown))
+		}
+		if route.Cooldown != 0 && route.CooldownFailures == 0 {
+			errs = append(errs, fmt.Errorf("%s: cooldown requires cooldown-failures", prefix))
+		}
+	}
+	return errors.Join(errs...)
+}
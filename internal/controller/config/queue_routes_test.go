@@ -0,0 +1,71 @@
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQueueRoutesValidate(t *testing.T) {
+	tests := []struct {
+		name        string
+		queueRoutes QueueRoutes
+		wantErr     bool
+	}{
+		{
+			name: "nil",
+		},
+		{
+			name: "valid",
+			queueRoutes: QueueRoutes{
+				"deploy": {BranchFilter: &BranchFilter{Allow: []string{"main"}}},
+				"gpu":    {CooldownFailures: 3, Cooldown: 5 * time.Minute},
+			},
+		},
+		{
+			name:        "empty queue",
+			queueRoutes: QueueRoutes{"": {CooldownFailures: 3}},
+			wantErr:     true,
+		},
+		{
+			name:        "queue not a label value",
+			queueRoutes: QueueRoutes{"deploy queue!": {CooldownFailures: 3}},
+			wantErr:     true,
+		},
+		{
+			name:        "nil route",
+			queueRoutes: QueueRoutes{"deploy": nil},
+			wantErr:     true,
+		},
+		{
+			name:        "no checks",
+			queueRoutes: QueueRoutes{"deploy": {}},
+			wantErr:     true,
+		},
+		{
+			name:        "empty branch pattern",
+			queueRoutes: QueueRoutes{"deploy": {BranchFilter: &BranchFilter{Allow: []string{""}}}},
+			wantErr:     true,
+		},
+		{
+			name:        "negative cooldown failures",
+			queueRoutes: QueueRoutes{"deploy": {CooldownFailures: -1}},
+			wantErr:     true,
+		},
+		{
+			name: "cooldown without failures",
+			queueRoutes: QueueRoutes{"deploy": {
+				BranchFilter: &BranchFilter{Allow: []string{"main"}},
+				Cooldown:     time.Minute,
+			}},
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.queueRoutes.Validate()
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Errorf("queueRoutes.Validate() = %v, want error: %t", err, test.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,70 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// ResourceHints bounds the CPU, memory and ephemeral storage that jobs may ask
+// for with the bk-cpu, bk-memory and bk-ephemeral-storage tags. Tags for a
+// resource without bounds are ignored.
+type ResourceHints struct {
+	CPU              *ResourceBounds `json:"cpu,omitempty"`
+	Memory           *ResourceBounds `json:"memory,omitempty"`
+	EphemeralStorage *ResourceBounds `json:"ephemeral-storage,omitempty"`
+}
+
+// ResourceBounds is the range of values allowed for a resource hint. Max must
+// be set. If Min is unset, there is no lower bound. If Default is set, it is
+// used for jobs without the tag.
+type ResourceBounds struct {
+	Min     resource.Quantity  `json:"min,omitempty"`
+	Max     resource.Quantity  `json:"max"`
+	Default *resource.Quantity `json:"default,omitempty"`
+}
+
+// Validate checks that the bounds of each resource are well-formed.
+func (rh *ResourceHints) Validate() error {
+	if rh == nil {
+		return nil
+	}
+	return errors.Join(
+		rh.CPU.validate("cpu"),
+		rh.Memory.validate("memory"),
+		rh.EphemeralStorage.validate("ephemeral-storage"),
+	)
+}
+
+func (rb *ResourceBounds) validate(name string) error {
+	if rb == nil {
+		return nil
+	}
+	switch {
+	case rb.Max.Sign() <= 0:
+		return fmt.Errorf("%s: max must be positive (got %s)", name, rb.Max.String())
+	case rb.Min.Sign() < 0:
+		return fmt.Errorf("%s: min must not be negative (got %s)", name, rb.Min.String())
+	case rb.Min.Cmp(rb.Max) > 0:
+		return fmt.Errorf("%s: min %s is greater than max %s", name, rb.Min.String(), rb.Max.String())
+	case rb.Default != nil && rb.Default.Sign() <= 0:
+		return fmt.Errorf("%s: default must be positive (got %s)", name, rb.Default.String())
+	case rb.Default != nil:
+		if _, changed := rb.Clamp(*rb.Default); changed {
+			return fmt.Errorf("%s: default %s is outside min %s and max %s", name, rb.Default.String(), rb.Min.String(), rb.Max.String())
+		}
+	}
+	return nil
+}
+
+// Clamp returns q limited to the bounds, and whether it had to be changed.
+func (rb *ResourceBounds) Clamp(q resource.Quantity) (resource.Quantity, bool) {
+	switch {
+	case q.Cmp(rb.Max) > 0:
+		return rb.Max.DeepCopy(), true
+	case !rb.Min.IsZero() && q.Cmp(rb.Min) < 0:
+		return rb.Min.DeepCopy(), true
+	}
+	return q, false
+}
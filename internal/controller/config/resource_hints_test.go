@@ -0,0 +1,72 @@
+package config
+
+import (
+	"testing"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/utils/ptr"
+)
+
+func TestResourceHintsValidate(t *testing.T) {
+	bounds := func(min, max string) *ResourceBounds {
+		rb := &ResourceBounds{}
+		if min != "" {
+			rb.Min = resource.MustParse(min)
+		}
+		if max != "" {
+			rb.Max = resource.MustParse(max)
+		}
+		return rb
+	}
+	withDefault := func(rb *ResourceBounds, def string) *ResourceBounds {
+		rb.Default = ptr.To(resource.MustParse(def))
+		return rb
+	}
+
+	tests := []struct {
+		name    string
+		hints   *ResourceHints
+		wantErr bool
+	}{
+		{name: "nil"},
+		{name: "valid", hints: &ResourceHints{CPU: bounds("500m", "4"), Memory: bounds("", "16Gi")}},
+		{name: "no max", hints: &ResourceHints{CPU: bounds("500m", "")}, wantErr: true},
+		{name: "negative min", hints: &ResourceHints{Memory: bounds("-1Gi", "16Gi")}, wantErr: true},
+		{name: "min above max", hints: &ResourceHints{CPU: bounds("8", "4")}, wantErr: true},
+		{name: "ephemeral storage", hints: &ResourceHints{EphemeralStorage: withDefault(bounds("", "100Gi"), "10Gi")}},
+		{name: "ephemeral storage without max", hints: &ResourceHints{EphemeralStorage: bounds("1Gi", "")}, wantErr: true},
+		{name: "default above max", hints: &ResourceHints{EphemeralStorage: withDefault(bounds("", "100Gi"), "200Gi")}, wantErr: true},
+		{name: "default below min", hints: &ResourceHints{CPU: withDefault(bounds("1", "4"), "500m")}, wantErr: true},
+		{name: "zero default", hints: &ResourceHints{Memory: withDefault(bounds("", "16Gi"), "0")}, wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.hints.Validate()
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Errorf("hints.Validate() = %v, want error: %t", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestResourceBoundsClamp(t *testing.T) {
+	rb := &ResourceBounds{Min: resource.MustParse("500m"), Max: resource.MustParse("4")}
+
+	tests := []struct {
+		value       string
+		want        string
+		wantChanged bool
+	}{
+		{value: "2", want: "2"},
+		{value: "500m", want: "500m"},
+		{value: "4000m", want: "4"},
+		{value: "100m", want: "500m", wantChanged: true},
+		{value: "8", want: "4", wantChanged: true},
+	}
+	for _, test := range tests {
+		got, changed := rb.Clamp(resource.MustParse(test.value))
+		if got.Cmp(resource.MustParse(test.want)) != 0 || changed != test.wantChanged {
+			t.Errorf("rb.Clamp(%s) = %s, %t, want %s, %t", test.value, got.String(), changed, test.want, test.wantChanged)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package config
+
+import (
+	"maps"
+	"slices"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// SpotParams controls how the pods of jobs are placed with respect to spot (or
+// preemptible) nodes, using the bk-spot tag. Jobs tagged bk-spot=true can run
+// on spot nodes, and jobs tagged bk-spot=false (e.g. critical jobs) are kept
+// off them. Jobs without the tag are left alone.
+type SpotParams struct {
+	// Tolerations and NodeSelector are added to the pods of jobs tagged
+	// bk-spot=true.
+	Tolerations  []corev1.Toleration `json:"tolerations,omitempty"`
+	NodeSelector map[string]string   `json:"nodeSelector,omitempty"`
+
+	// AvoidExpressions are added as a required node affinity to the pods of
+	// jobs tagged bk-spot=false. If empty, the inverse of NodeSelector is used
+	// (nodes must not have any of its labels with the same values).
+	AvoidExpressions []corev1.NodeSelectorRequirement `json:"avoidExpressions,omitempty"`
+}
+
+// ApplyTo applies the params to the pod spec of a job that is tagged
+// bk-spot=true (spot is true) or bk-spot=false (spot is false).
+func (sp *SpotParams) ApplyTo(podSpec *corev1.PodSpec, spot bool) {
+	if sp == nil || podSpec == nil {
+		return
+	}
+	if spot {
+		podSpec.Tolerations = append(podSpec.Tolerations, sp.Tolerations...)
+		if len(sp.NodeSelector) > 0 && podSpec.NodeSelector == nil {
+			podSpec.NodeSelector = make(map[string]string, len(sp.NodeSelector))
+		}
+		maps.Copy(podSpec.NodeSelector, sp.NodeSelector)
+		return
+	}
+	requireNodeSelectorRequirements(podSpec, sp.avoidExpressions())
+}
+
+func (sp *SpotParams) avoidExpressions() []corev1.NodeSelectorRequirement {
+	if len(sp.AvoidExpressions) > 0 {
+		return sp.AvoidExpressions
+	}
+	exprs := make([]corev1.NodeSelectorRequirement, 0, len(sp.NodeSelector))
+	for _, k := range slices.Sorted(maps.Keys(sp.NodeSelector)) {
+		exprs = append(exprs, corev1.NodeSelectorRequirement{
+			Key:      k,
+			Operator: corev1.NodeSelectorOpNotIn,
+			Values:   []string{sp.NodeSelector[k]},
+		})
+	}
+	return exprs
+}
+
+// requireNodeSelectorRequirements adds the requirements to the pod's required
+// node affinity. Required node selector terms are ORed together, so to keep
+// any existing terms meaningful, the requirements are added to each of them.
+func requireNodeSelectorRequirements(podSpec *corev1.PodSpec, exprs []corev1.NodeSelectorRequirement) {
+	if len(exprs) == 0 {
+		return
+	}
+	if podSpec.Affinity == nil {
+		podSpec.Affinity = &corev1.Affinity{}
+	}
+	if podSpec.Affinity.NodeAffinity == nil {
+		podSpec.Affinity.NodeAffinity = &corev1.NodeAffinity{}
+	}
+	na := podSpec.Affinity.NodeAffinity
+	if na.RequiredDuringSchedulingIgnoredDuringExecution == nil {
+		na.RequiredDuringSchedulingIgnoredDuringExecution = &corev1.NodeSelector{}
+	}
+	terms := na.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms
+	if len(terms) == 0 {
+		terms = []corev1.NodeSelectorTerm{{}}
+	}
+	for i := range terms {
+		terms[i].MatchExpressions = append(terms[i].MatchExpressions, exprs...)
+	}
+	na.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms = terms
+}
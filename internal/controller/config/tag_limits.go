@@ -0,0 +1,59 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/buildkite/agent-stack-k8s/v2/internal/controller/agenttags"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// TagLimit limits the number of jobs running concurrently among the jobs whose
+// tags include all of Tags.
+type TagLimit struct {
+	// Name identifies the limit in logs and metrics.
+	Name string `json:"name"`
+
+	// Tags are key=value pairs that a job's tags must all include for the
+	// limit to apply (e.g. ["pipeline=foo", "branch=main"]).
+	Tags []string `json:"tags"`
+
+	// Limit is the maximum number of matching jobs running at once.
+	Limit int `json:"limit"`
+}
+
+// TagLimits are tag limits in the order they are evaluated: each job is
+// subject to the first limit that matches it, if any.
+type TagLimits []TagLimit
+
+// Validate checks that each limit has a unique name that can be used as a
+// metric label value, at least one tag, well-formed tags, and a positive
+// limit.
+func (tl TagLimits) Validate() error {
+	var errs []error
+	seen := make(map[string]bool, len(tl))
+	for i, limit := range tl {
+		prefix := fmt.Sprintf("tag limit %d (%q)", i, limit.Name)
+		switch {
+		case limit.Name == "":
+			errs = append(errs, fmt.Errorf("tag limit %d: name must not be empty", i))
+		case seen[limit.Name]:
+			errs = append(errs, fmt.Errorf("%s: duplicate name", prefix))
+		}
+		seen[limit.Name] = true
+		for _, msg := range validation.IsValidLabelValue(limit.Name) {
+			errs = append(errs, fmt.Errorf("%s: invalid name: %s", prefix, msg))
+		}
+		if len(limit.Tags) == 0 {
+			errs = append(errs, fmt.Errorf("%s: tags must not be empty", prefix))
+		}
+		if _, tagErrs := agenttags.TagMapFromTags(limit.Tags); len(tagErrs) > 0 {
+			errs = append(errs, fmt.Errorf("%s: invalid tags: %w", prefix, errors.Join(tagErrs...)))
+		}
+		if limit.Limit <= 0 {
+			errs = append(errs, fmt.Errorf("%s: limit must be positive (got %d)", prefix, limit.Limit))
+		}
+	}
+	return errors.Join(errs...)
+}
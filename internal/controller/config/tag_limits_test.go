@@ -0,0 +1,63 @@
+package config
+
+import "testing"
+
+func TestTagLimitsValidate(t *testing.T) {
+	tests := []struct {
+		name      string
+		tagLimits TagLimits
+		wantErr   bool
+	}{
+		{
+			name: "nil",
+		},
+		{
+			name: "valid",
+			tagLimits: TagLimits{
+				{Name: "foo-main", Tags: []string{"pipeline=foo", "branch=main"}, Limit: 2},
+				{Name: "foo", Tags: []string{"pipeline=foo"}, Limit: 5},
+			},
+		},
+		{
+			name:      "no name",
+			tagLimits: TagLimits{{Tags: []string{"pipeline=foo"}, Limit: 1}},
+			wantErr:   true,
+		},
+		{
+			name: "duplicate name",
+			tagLimits: TagLimits{
+				{Name: "foo", Tags: []string{"pipeline=foo"}, Limit: 1},
+				{Name: "foo", Tags: []string{"branch=main"}, Limit: 1},
+			},
+			wantErr: true,
+		},
+		{
+			name:      "name not a label value",
+			tagLimits: TagLimits{{Name: "foo main", Tags: []string{"pipeline=foo"}, Limit: 1}},
+			wantErr:   true,
+		},
+		{
+			name:      "no tags",
+			tagLimits: TagLimits{{Name: "all", Limit: 1}},
+			wantErr:   true,
+		},
+		{
+			name:      "malformed tag",
+			tagLimits: TagLimits{{Name: "foo", Tags: []string{"pipeline"}, Limit: 1}},
+			wantErr:   true,
+		},
+		{
+			name:      "zero limit",
+			tagLimits: TagLimits{{Name: "foo", Tags: []string{"pipeline=foo"}}},
+			wantErr:   true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.tagLimits.Validate()
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Errorf("tagLimits.Validate() = %v, want error: %t", err, test.wantErr)
+			}
+		})
+	}
+}
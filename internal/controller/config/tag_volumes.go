@@ -0,0 +1,133 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"path"
+	"slices"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// TagVolume is a volume that is mounted into the pods of jobs with a
+// particular tag.
+type TagVolume struct {
+	Volume corev1.Volume `json:"volume"`
+
+	// VolumeMount is added to the same containers as the workspace volume.
+	// Its name defaults to the name of the volume.
+	VolumeMount corev1.VolumeMount `json:"volumeMount"`
+}
+
+// mount returns the volume mount, with the name defaulted.
+func (tv *TagVolume) mount() corev1.VolumeMount {
+	vm := tv.VolumeMount
+	if vm.Name == "" {
+		vm.Name = tv.Volume.Name
+	}
+	return vm
+}
+
+// TagVolumes maps job tags, in key=value form (e.g. "bk-cache=go"), to the
+// volumes to mount for jobs with that tag.
+type TagVolumes map[string]*TagVolume
+
+// Validate checks that each entry is well-formed, and that no two entries
+// that could apply to the same job use the same volume name or mount path.
+func (tvs TagVolumes) Validate() error {
+	var errs []error
+	for _, tag := range slices.Sorted(maps.Keys(tvs)) {
+		tv := tvs[tag]
+		key, _, ok := strings.Cut(tag, "=")
+		switch {
+		case !ok || key == "":
+			errs = append(errs, fmt.Errorf("tag %q is not in key=value form", tag))
+			continue
+		case tv == nil:
+			errs = append(errs, fmt.Errorf("tag %q: no volume", tag))
+			continue
+		case tv.Volume.Name == "":
+			errs = append(errs, fmt.Errorf("tag %q: volume.name must be set", tag))
+		}
+		vm := tv.mount()
+		if vm.Name != tv.Volume.Name {
+			errs = append(errs, fmt.Errorf("tag %q: volumeMount.name %q does not match volume.name %q", tag, vm.Name, tv.Volume.Name))
+		}
+		if !path.IsAbs(vm.MountPath) {
+			errs = append(errs, fmt.Errorf("tag %q: volumeMount.mountPath %q must be an absolute path", tag, vm.MountPath))
+		}
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+
+	// A job only has one value for each tag key, so entries for the same key
+	// never apply together.
+	tags := slices.Sorted(maps.Keys(tvs))
+	for i, a := range tags {
+		keyA, _, _ := strings.Cut(a, "=")
+		for _, b := range tags[i+1:] {
+			keyB, _, _ := strings.Cut(b, "=")
+			if keyA == keyB {
+				continue
+			}
+			va, vb := tvs[a], tvs[b]
+			if va.Volume.Name == vb.Volume.Name {
+				errs = append(errs, fmt.Errorf("tags %q and %q both use volume name %q", a, b, va.Volume.Name))
+			}
+			if pa, pb := va.mount().MountPath, vb.mount().MountPath; samePath(pa, pb) {
+				errs = append(errs, fmt.Errorf("tags %q and %q have colliding mount paths %q and %q", a, b, pa, pb))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ApplyTo adds the volumes for the job's tags to the pod spec, and returns
+// volumeMounts with their mounts appended. It returns an error if a volume
+// has the same name as one already in the pod spec, or a mount has the same
+// path as one in volumeMounts or a container of the pod spec.
+func (tvs TagVolumes) ApplyTo(podSpec *corev1.PodSpec, tags map[string]string, volumeMounts []corev1.VolumeMount) ([]corev1.VolumeMount, error) {
+	var errs []error
+	for _, tag := range slices.Sorted(maps.Keys(tvs)) {
+		key, value, _ := strings.Cut(tag, "=")
+		if v, ok := tags[key]; !ok || v != value {
+			continue
+		}
+		tv := tvs[tag]
+		if slices.ContainsFunc(podSpec.Volumes, func(v corev1.Volume) bool { return v.Name == tv.Volume.Name }) {
+			errs = append(errs, fmt.Errorf("volume %q for tag %q: the pod already has a volume with that name", tv.Volume.Name, tag))
+			continue
+		}
+		vm := tv.mount()
+		if m, ok := mountAtPath(volumeMounts, vm.MountPath); ok {
+			errs = append(errs, fmt.Errorf("volume %q for tag %q: mount path %q is already used by volume %q", vm.Name, tag, vm.MountPath, m.Name))
+			continue
+		}
+		for _, c := range podSpec.Containers {
+			if m, ok := mountAtPath(c.VolumeMounts, vm.MountPath); ok {
+				errs = append(errs, fmt.Errorf("volume %q for tag %q: mount path %q is already used by volume %q in container %q", vm.Name, tag, vm.MountPath, m.Name, c.Name))
+			}
+		}
+		podSpec.Volumes = append(podSpec.Volumes, tv.Volume)
+		volumeMounts = append(volumeMounts, vm)
+	}
+	return volumeMounts, errors.Join(errs...)
+}
+
+// mountAtPath returns the mount with the same path, if there is one.
+func mountAtPath(mounts []corev1.VolumeMount, mountPath string) (corev1.VolumeMount, bool) {
+	i := slices.IndexFunc(mounts, func(m corev1.VolumeMount) bool { return samePath(m.MountPath, mountPath) })
+	if i < 0 {
+		return corev1.VolumeMount{}, false
+	}
+	return mounts[i], true
+}
+
+// samePath reports whether the paths are the same, once cleaned. Kubernetes
+// rejects pods with a container that mounts two volumes at the same path.
+func samePath(a, b string) bool {
+	return path.Clean(a) == path.Clean(b)
+}
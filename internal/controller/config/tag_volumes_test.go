@@ -0,0 +1,82 @@
+package config
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestTagVolumesValidate(t *testing.T) {
+	tagVolume := func(name, mountPath string) *TagVolume {
+		return &TagVolume{
+			Volume:      corev1.Volume{Name: name},
+			VolumeMount: corev1.VolumeMount{MountPath: mountPath},
+		}
+	}
+
+	tests := []struct {
+		name       string
+		tagVolumes TagVolumes
+		wantErr    bool
+	}{
+		{
+			name: "nil",
+		},
+		{
+			name: "valid",
+			tagVolumes: TagVolumes{
+				"bk-cache=go":  tagVolume("go-build-cache", "/cache"),
+				"bk-cache=npm": tagVolume("npm-cache", "/cache"),
+				"tools=true":   tagVolume("tools", "/opt/tools"),
+			},
+		},
+		{
+			name:       "tag without value",
+			tagVolumes: TagVolumes{"bk-cache": tagVolume("go-build-cache", "/cache")},
+			wantErr:    true,
+		},
+		{
+			name:       "no volume name",
+			tagVolumes: TagVolumes{"bk-cache=go": tagVolume("", "/cache")},
+			wantErr:    true,
+		},
+		{
+			name:       "relative mount path",
+			tagVolumes: TagVolumes{"bk-cache=go": tagVolume("go-build-cache", "cache")},
+			wantErr:    true,
+		},
+		{
+			name: "mismatched mount name",
+			tagVolumes: TagVolumes{"bk-cache=go": {
+				Volume:      corev1.Volume{Name: "go-build-cache"},
+				VolumeMount: corev1.VolumeMount{Name: "other", MountPath: "/cache"},
+			}},
+			wantErr: true,
+		},
+		{
+			name: "mount path collision",
+			tagVolumes: TagVolumes{
+				"bk-cache=go": tagVolume("go-build-cache", "/cache"),
+				"tools=true":  tagVolume("tools", "/cache/"),
+			},
+			wantErr: true,
+		},
+		{
+			name: "volume name collision",
+			tagVolumes: TagVolumes{
+				"bk-cache=go": tagVolume("cache", "/cache/go"),
+				"tools=true":  tagVolume("cache", "/opt/tools"),
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.tagVolumes.Validate()
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Errorf("%+v.Validate() = %v, want error: %t", test.tagVolumes, err, test.wantErr)
+			}
+		})
+	}
+}
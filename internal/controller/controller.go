@@ -4,18 +4,31 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	_ "net/http/pprof"
+	"os"
 	"time"
 
+	"github.com/buildkite/agent-stack-k8s/v2/api"
 	"github.com/buildkite/agent-stack-k8s/v2/internal/controller/agenttags"
 	"github.com/buildkite/agent-stack-k8s/v2/internal/controller/config"
+	"github.com/buildkite/agent-stack-k8s/v2/internal/controller/cooldown"
 	"github.com/buildkite/agent-stack-k8s/v2/internal/controller/deduper"
+	"github.com/buildkite/agent-stack-k8s/v2/internal/controller/events"
+	"github.com/buildkite/agent-stack-k8s/v2/internal/controller/joblock"
 	"github.com/buildkite/agent-stack-k8s/v2/internal/controller/limiter"
+	"github.com/buildkite/agent-stack-k8s/v2/internal/controller/metrics"
 	"github.com/buildkite/agent-stack-k8s/v2/internal/controller/model"
 	"github.com/buildkite/agent-stack-k8s/v2/internal/controller/monitor"
+	"github.com/buildkite/agent-stack-k8s/v2/internal/controller/router"
 	"github.com/buildkite/agent-stack-k8s/v2/internal/controller/scheduler"
+	"github.com/buildkite/agent-stack-k8s/v2/internal/controller/warmpool"
 
+	"github.com/Khan/genqlient/graphql"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.uber.org/zap"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
@@ -40,8 +53,72 @@ func Run(
 		}()
 	}
 
-	// Monitor polls Buildkite GraphQL for jobs. It passes them to Deduper.
-	// Job flow: monitor -> deduper -> limiter -> scheduler.
+	// Register the controller's metrics, with the constant labels and
+	// duration histogram buckets from the config.
+	if b := cfg.DurationHistogramBuckets; b != nil {
+		metrics.SetDurationBuckets(b.Classic, b.NativeFactor)
+	}
+	metrics.SetExemplars(cfg.PrometheusExemplars)
+	if err := metrics.Register(prometheus.DefaultRegisterer, cfg.PrometheusLabels); err != nil {
+		logger.Fatal("failed to register metrics", zap.Error(err))
+	}
+
+	// metricsMux is also used for /debug/errors, /debug/inflight and /readyz,
+	// once the monitor and limiter exist.
+	metricsMux := http.NewServeMux()
+	if cfg.PrometheusPort > 0 {
+		logger.Info("metrics listening for requests", zap.Uint16("port", cfg.PrometheusPort))
+		metricsMux.Handle("/metrics", promhttp.InstrumentMetricHandler(
+			prometheus.DefaultRegisterer,
+			promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{
+				EnableOpenMetrics: cfg.PrometheusExemplars,
+			}),
+		))
+		go func() {
+			srv := http.Server{
+				Addr:              fmt.Sprintf(":%d", cfg.PrometheusPort),
+				Handler:           metricsMux,
+				ReadHeaderTimeout: 2 * time.Second,
+			}
+			if err := srv.ListenAndServe(); err != nil {
+				logger.Error("problem running metrics server", zap.Error(err))
+			}
+		}()
+	}
+
+	// Fetched jobs can be recorded for later replay.
+	var recordTo io.Writer
+	if cfg.RecordFile != "" {
+		f, err := os.OpenFile(cfg.RecordFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+		if err != nil {
+			logger.Fatal("failed to open record file", zap.Error(err))
+		}
+		defer f.Close()
+		recordTo = f
+	}
+
+	// Event recorder records Kubernetes events for scheduling decisions (if
+	// configured). Events without a Job refer to the controller's pod.
+	var eventRecorder *events.Recorder
+	if cfg.EmitEvents {
+		podName := os.Getenv("POD_NAME")
+		if podName == "" {
+			// A pod's hostname is its name, unless set in the pod spec.
+			hostname, err := os.Hostname()
+			if err != nil {
+				logger.Fatal("failed to get hostname for events", zap.Error(err))
+			}
+			podName = hostname
+		}
+		rec, stop := events.New(ctx, logger.Named("events"), k8sClient, cfg.Namespace, podName)
+		defer stop()
+		eventRecorder = rec
+	}
+
+	// Monitor polls Buildkite GraphQL for jobs. It passes them to Router,
+	// which passes each job to its queue's handler chain.
+	// Job flow: monitor -> router -> [branch filter] -> cooldown -> deduper ->
+	// limiter -> locker -> scheduler.
 	m, err := monitor.New(logger.Named("monitor"), k8sClient, monitor.Config{
 		GraphQLEndpoint:        cfg.GraphQLEndpoint,
 		Namespace:              cfg.Namespace,
@@ -53,10 +130,96 @@ func Run(
 		JobCreationConcurrency: cfg.JobCreationConcurrency,
 		Tags:                   cfg.Tags,
 		Token:                  cfg.BuildkiteToken,
+		CustomQuery:            cfg.GraphQLJobsQuery,
+		CustomQueryVariables:   cfg.GraphQLJobsQueryVariables,
+		RequeueMaxAttempts:     cfg.RequeueMaxAttempts,
+		RequeueBackoff:         cfg.RequeueBackoff,
+		RequeueOrder:           cfg.RequeueOrder,
+		ErrorBufferSize:        cfg.DebugErrorsBufferSize,
+		SaturatedPollThreshold: cfg.SaturatedPollThreshold,
+		SaturatedPollInterval:  cfg.SaturatedPollInterval,
+		PipelinesWindow:        cfg.PipelinesWindow,
+		TokenCheckInterval:     cfg.TokenCheckInterval,
+		BackfillMaxPages:       cfg.BackfillMaxPages,
+		BackfillPageSize:       cfg.BackfillPageSize,
+		BackfillPageRetries:    cfg.BackfillPageRetries,
+		WebhookSecret:          cfg.WebhookSecret,
+		FilteredLogSampleRate:  cfg.FilteredLogSampleRate,
+		RecordTo:               recordTo,
+		Events:                 eventRecorder,
+		BranchFilter:           cfg.BranchFilter,
 	})
 	if err != nil {
 		logger.Fatal("failed to create monitor", zap.Error(err))
 	}
+	if err := m.RegisterMetrics(ctx); err != nil {
+		logger.Fatal("failed to register monitor metrics", zap.Error(err))
+	}
+
+	// Serve recent errors alongside the profiler (which uses the default mux)
+	// and metrics.
+	http.Handle("/debug/errors", m.ErrorsHandler())
+	metricsMux.Handle("/debug/errors", m.ErrorsHandler())
+
+	// Serve a readiness check that fails if the Buildkite token is rejected.
+	http.Handle("/readyz", m.ReadyHandler())
+	metricsMux.Handle("/readyz", m.ReadyHandler())
+
+	// Receive job.scheduled webhooks from Buildkite (if configured), as well
+	// as polling.
+	if cfg.WebhookAddress != "" {
+		logger.Info("webhook listening for requests", zap.String("address", cfg.WebhookAddress))
+		webhookMux := http.NewServeMux()
+		webhookMux.Handle("/webhook", m.WebhookHandler())
+		go func() {
+			srv := http.Server{
+				Addr:              cfg.WebhookAddress,
+				Handler:           webhookMux,
+				ReadHeaderTimeout: 2 * time.Second,
+			}
+			if err := srv.ListenAndServe(); err != nil {
+				logger.Error("problem running webhook server", zap.Error(err))
+			}
+		}()
+	}
+
+	// Warm pool keeps idle pods running for some queues (if configured), which
+	// jobs claim to get a node with capacity and the agent image pulled.
+	var warmPool scheduler.WarmPool
+	if len(cfg.WarmPoolSizes) > 0 {
+		pool, err := warmpool.New(logger.Named("warmpool"), k8sClient, warmpool.Config{
+			Namespace:        cfg.Namespace,
+			Image:            cfg.Image,
+			Sizes:            cfg.WarmPoolSizes,
+			DefaultPodParams: cfg.DefaultPodParams,
+			QueuePodParams:   cfg.QueuePodParams,
+			ResourceHints:    cfg.ResourceHints,
+		})
+		if err != nil {
+			logger.Fatal("failed to create warm pool", zap.Error(err))
+		}
+		go pool.Run(ctx)
+		warmPool = pool
+	}
+
+	// Quota checker stops jobs being created while a resource quota is full
+	// (if configured). Quotas don't have the labels of job pods, so they are
+	// watched with their own informer.
+	var quota *scheduler.QuotaChecker
+	if cfg.QuotaCheck {
+		quota = scheduler.NewQuotaChecker(cfg.Namespace)
+		quotaFactory := informers.NewSharedInformerFactoryWithOptions(k8sClient, 0, informers.WithNamespace(cfg.Namespace))
+		if err := quota.RegisterInformer(ctx, quotaFactory); err != nil {
+			logger.Fatal("failed to register quota informer", zap.Error(err))
+		}
+	}
+
+	// Builds are annotated with the names of the Kubernetes jobs created for
+	// them (if configured).
+	var annotationClient graphql.Client
+	if cfg.AnnotateBuilds {
+		annotationClient = api.NewClient(cfg.BuildkiteToken, cfg.GraphQLEndpoint)
+	}
 
 	// Scheduler does the complicated work of converting a Buildkite job into
 	// a pod to run that job. It talks to the k8s API to create pods.
@@ -72,8 +235,29 @@ func Run(
 		DefaultCommandParams:   cfg.DefaultCommandParams,
 		DefaultSidecarParams:   cfg.DefaultSidecarParams,
 		DefaultMetadata:        cfg.DefaultMetadata,
+		DefaultPodParams:       cfg.DefaultPodParams,
+		QueuePodParams:         cfg.QueuePodParams,
 		PodSpecPatch:           cfg.PodSpecPatch,
 		ProhibitK8sPlugin:      cfg.ProhibitKubernetesPlugin,
+		AllowedPriorityClasses: cfg.AllowedPriorityClasses,
+		ControllerID:           cfg.ControllerID,
+		RuntimeClasses:         cfg.RuntimeClasses,
+		JobFieldEnv:            cfg.JobFieldEnv,
+		AgentCommandWrapper:    cfg.AgentCommandWrapper,
+		SpotParams:             cfg.SpotParams,
+		ResourceHints:          cfg.ResourceHints,
+		TagVolumes:             cfg.TagVolumes,
+		PodTagLabels:           cfg.PodTagLabels,
+		AllowedImages:          cfg.AllowedImages,
+		Finalizers:             cfg.JobFinalizers,
+		WarmPool:               warmPool,
+		CreateRetries:          cfg.JobCreateRetries,
+		CreateQPS:              cfg.JobCreateQPS,
+		CreateBurst:            cfg.JobCreateBurst,
+		GenerateJobNames:       cfg.JobGenerateName,
+		Quota:                  quota,
+		Events:                 eventRecorder,
+		AnnotationClient:       annotationClient,
 	})
 
 	informerFactory, err := NewInformerFactory(k8sClient, cfg.Namespace, cfg.Tags)
@@ -82,14 +266,53 @@ func Run(
 	}
 
 	nextHandler := model.JobHandler(sched)
+	if cfg.ScheduleOnceLeaseDuration > 0 {
+		// Locker ensures only one controller schedules each job (if
+		// configured), by holding a Lease for the job while scheduling it.
+		hostname, err := os.Hostname()
+		if err != nil {
+			logger.Fatal("failed to get hostname for lease holder identity", zap.Error(err))
+		}
+		holder := hostname + "-" + uuid.NewString()
+		locker := joblock.New(logger.Named("joblock"), sched, k8sClient, cfg.Namespace, holder, cfg.ScheduleOnceLeaseDuration)
+		go locker.Run(ctx)
+		nextHandler = locker
+	}
+
 	if cfg.MaxInFlight > 0 {
 		// Limiter prevents scheduling more than cfg.MaxInFlight jobs at once
 		//    (if configured)
-		// Once it figures out a job can be scheduled, it passes to the scheduler.
-		limiter := limiter.New(logger.Named("limiter"), sched, cfg.MaxInFlight)
+		// Once it figures out a job can be scheduled, it passes to the locker
+		// or scheduler.
+		limiter := limiter.New(logger.Named("limiter"), nextHandler, cfg.MaxInFlight)
+		limiter.QueueMetrics = cfg.LimiterQueueMetrics
+		limiter.ReturnDelay = cfg.LimiterReturnDelay
+		limiter.MinHold = cfg.LimiterMinHold
+		limiter.RampUp = cfg.LimiterRampUp
+		limiter.Mode = cfg.LimiterMode
+		limiter.HoldWarnAfter = cfg.LimiterHoldWarnAfter
+		limiter.SweepInterval = cfg.LimiterSweepInterval
+		limiter.SweepJitter = cfg.LimiterSweepJitter
+		limiter.ControllerID = cfg.ControllerID
+		limiter.SetQueueLimits(cfg.QueueLimits)
+		limiter.SetTagLimits(cfg.TagLimits)
+		// NewInformerFactory has already checked the tags.
+		selector, _ := jobLabelSelector(cfg.Tags)
+		limiter.SetLiveClient(k8sClient, cfg.Namespace, selector)
+		m.SetCapacity(limiter)
+
+		// Serve the jobs holding tokens alongside recent errors. Reconciling
+		// them with the API server changes state and lists every job, so it
+		// is only served on the profiler address, not the metrics port.
+		http.Handle("/debug/inflight", limiter.InFlightHandler())
+		metricsMux.Handle("/debug/inflight", limiter.InFlightHandler())
+		http.Handle("/debug/reconcile", limiter.ReconcileHandler())
 		if err := limiter.RegisterInformer(ctx, informerFactory); err != nil {
 			logger.Fatal("failed to register limiter informer", zap.Error(err))
 		}
+		if err := limiter.RegisterMetrics(ctx); err != nil {
+			logger.Fatal("failed to register limiter metrics", zap.Error(err))
+		}
 		nextHandler = limiter
 	}
 
@@ -97,9 +320,32 @@ func Run(
 	// It passes jobs to the limiter if there is a limit, or directly to the
 	// scheduler if there is no limit.
 	deduper := deduper.New(logger.Named("deduper"), nextHandler)
+	deduper.SetDuplicateAction(cfg.DuplicateJobAction, k8sClient)
 	if err := deduper.RegisterInformer(ctx, informerFactory); err != nil {
 		logger.Fatal("failed to register deduper informer", zap.Error(err))
 	}
+	if err := deduper.RegisterMetrics(ctx); err != nil {
+		logger.Fatal("failed to register deduper metrics", zap.Error(err))
+	}
+
+	// Cooldown stops passing on jobs in queues that keep failing to be
+	// scheduled for a while (if configured).
+	queueHandler := model.JobHandler(deduper)
+	if cfg.QueueCooldownFailures > 0 {
+		queueHandler = cooldown.New(logger.Named("cooldown"), deduper, cfg.QueueCooldownFailures, cfg.QueueCooldown)
+	}
+
+	// Router passes jobs in queues with a route to their own handler chain,
+	// which has the route's admission checks in front of the deduper, and
+	// other jobs to the chain above.
+	routes := make(map[string]model.JobHandler, len(cfg.QueueRoutes))
+	for queue, route := range cfg.QueueRoutes {
+		routes[queue] = newRouteHandler(logger, cfg, queue, route, deduper, queueHandler)
+	}
+	router, err := router.New(logger.Named("router"), queueHandler, routes)
+	if err != nil {
+		logger.Fatal("failed to create router", zap.Error(err))
+	}
 
 	// PodCompletionWatcher watches k8s for pods where the agent has terminated,
 	// in order to clean up the pod. This is necessary because "sidecars" are
@@ -122,14 +368,63 @@ func Run(
 		logger.Fatal("failed to register podWatcher informer", zap.Error(err))
 	}
 
+	// Jobs normally come from the monitor, but can be replayed from a
+	// recording instead.
+	var source interface {
+		Start(context.Context, model.JobHandler) <-chan error
+	} = m
+	if cfg.ReplayFile != "" {
+		source = newReplay(logger, cfg)
+	}
+
 	select {
 	case <-ctx.Done():
 		logger.Info("controller exiting", zap.Error(ctx.Err()))
-	case err := <-m.Start(ctx, deduper):
+	case err := <-source.Start(ctx, router):
 		logger.Info("monitor failed", zap.Error(err))
 	}
 }
 
+// newRouteHandler returns the handler chain for jobs in the queue: the
+// route's branch filter (if any), then its own cooldown (if any, otherwise the
+// default chain's), then the deduper.
+func newRouteHandler(
+	logger *zap.Logger,
+	cfg *config.Config,
+	queue string,
+	route *config.QueueRoute,
+	deduper model.JobHandler,
+	defaultHandler model.JobHandler,
+) model.JobHandler {
+	// ParseAndValidateConfig has already checked that route is not nil.
+	handler := defaultHandler
+	if route.CooldownFailures > 0 {
+		duration := route.Cooldown
+		if duration == 0 {
+			duration = cfg.QueueCooldown
+		}
+		handler = cooldown.New(logger.Named("cooldown").With(zap.String("route", queue)), deduper, route.CooldownFailures, duration)
+	}
+	if route.BranchFilter != nil {
+		handler = router.NewBranchFilter(logger.Named("router"), handler, queue, route.BranchFilter)
+	}
+	return handler
+}
+
+// newReplay reads the recording in cfg.ReplayFile, and returns a Replay of it.
+func newReplay(logger *zap.Logger, cfg *config.Config) *monitor.Replay {
+	f, err := os.Open(cfg.ReplayFile)
+	if err != nil {
+		logger.Fatal("failed to open replay file", zap.Error(err))
+	}
+	defer f.Close()
+	events, err := monitor.ReadReplay(f)
+	if err != nil {
+		logger.Fatal("failed to read replay file", zap.String("path", cfg.ReplayFile), zap.Error(err))
+	}
+	return monitor.NewReplay(logger.Named("replay"), events, cfg.Tags, cfg.StaleJobDataTimeout)
+}
+
 // NewInformerFactory returns an informer factory configured to watch resources
 // (pods, jobs) created by the scheduler. It matches pods that are labeled with
 // a job uuid and the agent tags that the scheduler was configured with.
@@ -138,32 +433,42 @@ func NewInformerFactory(
 	namespace string,
 	tags []string,
 ) (informers.SharedInformerFactory, error) {
+	selector, err := jobLabelSelector(tags)
+	if err != nil {
+		return nil, err
+	}
+	return informers.NewSharedInformerFactoryWithOptions(
+		k8s,
+		0,
+		informers.WithNamespace(namespace),
+		informers.WithTweakListOptions(func(opt *metav1.ListOptions) {
+			opt.LabelSelector = selector
+		}),
+	), nil
+}
+
+// jobLabelSelector returns the label selector for the Kubernetes jobs that the
+// controller watches: those with the UUID label and a label for each of the
+// controller's tags.
+func jobLabelSelector(tags []string) (string, error) {
 	labelsFromTags, errs := agenttags.LabelsFromTags(tags)
 	if len(errs) != 0 {
-		return nil, errors.Join(errs...)
+		return "", errors.Join(errs...)
 	}
 
 	requirements := make(labels.Requirements, 0, len(labelsFromTags)+1)
 	hasUUID, err := labels.NewRequirement(config.UUIDLabel, selection.Exists, nil)
 	if err != nil {
-		return nil, fmt.Errorf("failed to build uuid label selector for job manager: %w", err)
+		return "", fmt.Errorf("failed to build uuid label selector for job manager: %w", err)
 	}
 	requirements = append(requirements, *hasUUID)
 
 	for l, v := range labelsFromTags {
 		hasLabel, err := labels.NewRequirement(l, selection.Equals, []string{v})
 		if err != nil {
-			return nil, fmt.Errorf("failed create label selector agent tag: %w", err)
+			return "", fmt.Errorf("failed create label selector agent tag: %w", err)
 		}
 		requirements = append(requirements, *hasLabel)
 	}
-
-	return informers.NewSharedInformerFactoryWithOptions(
-		k8s,
-		0,
-		informers.WithNamespace(namespace),
-		informers.WithTweakListOptions(func(opt *metav1.ListOptions) {
-			opt.LabelSelector = labels.NewSelector().Add(requirements...).String()
-		}),
-	), nil
+	return labels.NewSelector().Add(requirements...).String(), nil
 }
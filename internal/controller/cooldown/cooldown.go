@@ -0,0 +1,168 @@
+package cooldown
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/buildkite/agent-stack-k8s/v2/internal/controller/agenttags"
+	"github.com/buildkite/agent-stack-k8s/v2/internal/controller/model"
+
+	"go.uber.org/zap"
+)
+
+// Cooldown is a job handler that wraps another job handler (typically
+// Deduper). Once scheduling jobs in a queue has failed Failures times in a
+// row (e.g. because the queue's node pool is full), it stops passing on jobs
+// in that queue for Duration, returning [model.ErrCoolingDown] for them
+// instead, so that a broken queue doesn't dominate the handler chain. Jobs in
+// other queues are passed on as usual.
+type Cooldown struct {
+	// Failures is the number of consecutive scheduling failures in a queue
+	// that start a cooldown.
+	Failures int
+
+	// Duration is how long a cooldown lasts. Once it is over, the queue needs
+	// another Failures failures in a row to start a new one.
+	Duration time.Duration
+
+	// Next handler in the chain.
+	handler model.JobHandler
+
+	// Logs go here
+	logger *zap.Logger
+
+	// State of queues with failures or a cooldown, by queue tag, and mutex to
+	// protect it.
+	mu     sync.Mutex
+	queues map[string]*queueState
+}
+
+// queueState tracks a queue's consecutive failures and cooldown.
+type queueState struct {
+	// Number of failures in a row since the last success or cooldown.
+	failures int
+
+	// When the current cooldown ends, or zero if there is none.
+	until time.Time
+}
+
+// New creates a Cooldown.
+func New(logger *zap.Logger, handler model.JobHandler, failures int, duration time.Duration) *Cooldown {
+	return &Cooldown{
+		Failures: failures,
+		Duration: duration,
+		handler:  handler,
+		logger:   logger,
+		queues:   make(map[string]*queueState),
+	}
+}
+
+// Handle passes the job to the next handler, unless the job's queue is
+// cooling down, in which case it returns [model.ErrCoolingDown].
+func (c *Cooldown) Handle(ctx context.Context, job model.Job) error {
+	queue := queueOf(job)
+	if c.coolingDown(queue) {
+		jobsSkippedCounter.WithLabelValues(queue).Inc()
+		return model.ErrCoolingDown
+	}
+
+	c.logger.Debug("passing job to next handler",
+		zap.Stringer("handler", reflect.TypeOf(c.handler)),
+		zap.String("uuid", job.Uuid),
+	)
+	err := c.handler.Handle(ctx, job)
+	switch {
+	case err == nil:
+		c.succeeded(queue)
+	case isFailure(ctx, err):
+		c.failed(queue, err)
+	}
+	return err
+}
+
+// coolingDown reports whether the queue is cooling down.
+func (c *Cooldown) coolingDown(queue string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.queues[queue]
+	return s != nil && time.Now().Before(s.until)
+}
+
+// succeeded resets the queue's failures.
+func (c *Cooldown) succeeded(queue string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if s := c.queues[queue]; s != nil && s.until.IsZero() {
+		delete(c.queues, queue)
+	}
+}
+
+// failed records a failure in the queue, and starts a cooldown if it is the
+// Failures-th in a row.
+func (c *Cooldown) failed(queue string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.queues[queue]
+	if s == nil {
+		s = &queueState{}
+		c.queues[queue] = s
+	}
+	if !s.until.IsZero() {
+		// Already cooling down (the job was passed on before it started).
+		return
+	}
+	s.failures++
+	if s.failures < c.Failures {
+		return
+	}
+	s.failures = 0
+	s.until = time.Now().Add(c.Duration)
+	cooldownActiveGauge.WithLabelValues(queue).Set(1)
+	cooldownsCounter.WithLabelValues(queue).Inc()
+	c.logger.Warn("jobs in queue keep failing to be scheduled, cooling down",
+		zap.String("queue", queue),
+		zap.Int("failures", c.Failures),
+		zap.Duration("duration", c.Duration),
+		zap.Error(err),
+	)
+	time.AfterFunc(c.Duration, func() { c.endCooldown(queue) })
+}
+
+// endCooldown ends the queue's cooldown.
+func (c *Cooldown) endCooldown(queue string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.queues, queue)
+	cooldownActiveGauge.WithLabelValues(queue).Set(0)
+	c.logger.Info("queue cooldown ended", zap.String("queue", queue))
+}
+
+// isFailure reports whether err from the next handler counts as a failure to
+// schedule the job. Errors that say nothing about the queue (the job was
+// already scheduled, its data became stale, its cluster queue is draining, or
+// the controller is shutting down) don't count.
+func isFailure(ctx context.Context, err error) bool {
+	switch {
+	case ctx.Err() != nil,
+		errors.Is(err, model.ErrDuplicateJob),
+		errors.Is(err, model.ErrStaleJob),
+		errors.Is(err, model.ErrDraining),
+		errors.Is(err, model.ErrCoolingDown),
+		errors.Is(err, model.ErrBranchDenied):
+		return false
+	}
+	return true
+}
+
+// queueOf returns the job's queue tag.
+func queueOf(job model.Job) string {
+	if job.CommandJob == nil {
+		return ""
+	}
+	// Tag parsing errors are logged by the monitor, so ignore them here.
+	tags, _ := agenttags.TagMapFromTags(job.AgentQueryRules)
+	return tags["queue"]
+}
@@ -0,0 +1,93 @@
+package cooldown_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent-stack-k8s/v2/api"
+	"github.com/buildkite/agent-stack-k8s/v2/internal/controller/cooldown"
+	"github.com/buildkite/agent-stack-k8s/v2/internal/controller/model"
+
+	"go.uber.org/zap/zaptest"
+)
+
+// errHandler returns the error set for each queue, and counts its calls.
+type errHandler struct {
+	mu    sync.Mutex
+	errs  map[string]error
+	calls int
+}
+
+func (h *errHandler) Handle(_ context.Context, job model.Job) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.calls++
+	return h.errs[job.AgentQueryRules[0]]
+}
+
+func (h *errHandler) setErr(rule string, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.errs[rule] = err
+}
+
+func (h *errHandler) numCalls() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.calls
+}
+
+func queueJob(queue string) model.Job {
+	return model.Job{CommandJob: &api.CommandJob{
+		Uuid:            "abc",
+		AgentQueryRules: []string{"queue=" + queue},
+	}}
+}
+
+func TestCooldown(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	errFull := errors.New("node pool is full")
+	handler := &errHandler{errs: map[string]error{"queue=broken": errFull}}
+	const duration = 200 * time.Millisecond
+	c := cooldown.New(zaptest.NewLogger(t), handler, 3, duration)
+
+	// Errors that say nothing about the queue don't count.
+	handler.setErr("queue=broken", model.ErrDuplicateJob)
+	for range 5 {
+		if err := c.Handle(ctx, queueJob("broken")); !errors.Is(err, model.ErrDuplicateJob) {
+			t.Fatalf("c.Handle(ctx, broken job) = %v, want %v", err, model.ErrDuplicateJob)
+		}
+	}
+
+	// Failures in a row start a cooldown, unless a success resets them.
+	for _, want := range []error{errFull, errFull, nil, errFull, errFull, errFull} {
+		handler.setErr("queue=broken", want)
+		if err := c.Handle(ctx, queueJob("broken")); !errors.Is(err, want) {
+			t.Fatalf("c.Handle(ctx, broken job) = %v, want %v", err, want)
+		}
+	}
+
+	calls := handler.numCalls()
+	if err := c.Handle(ctx, queueJob("broken")); !errors.Is(err, model.ErrCoolingDown) {
+		t.Errorf("c.Handle(ctx, broken job) during cooldown = %v, want %v", err, model.ErrCoolingDown)
+	}
+	if got := handler.numCalls(); got != calls {
+		t.Errorf("next handler calls during cooldown = %d, want %d", got, calls)
+	}
+
+	// Other queues are unaffected.
+	if err := c.Handle(ctx, queueJob("healthy")); err != nil {
+		t.Errorf("c.Handle(ctx, healthy job) during cooldown = %v, want nil", err)
+	}
+
+	// Once the cooldown is over, jobs are passed on again.
+	time.Sleep(duration + 50*time.Millisecond)
+	if err := c.Handle(ctx, queueJob("broken")); !errors.Is(err, errFull) {
+		t.Errorf("c.Handle(ctx, broken job) after cooldown = %v, want %v", err, errFull)
+	}
+}
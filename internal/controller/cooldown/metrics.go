@@ -0,0 +1,29 @@
+package cooldown
+
+import (
+	"github.com/buildkite/agent-stack-k8s/v2/internal/controller/metrics"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const promSubsystem = "cooldown"
+
+var (
+	cooldownActiveGauge = metrics.Factory.NewGaugeVec(prometheus.GaugeOpts{
+		Subsystem: promSubsystem,
+		Name:      "active",
+		Help:      "Whether the queue is cooling down after repeated scheduling failures (1) or not (0)",
+	}, []string{"queue"})
+
+	cooldownsCounter = metrics.Factory.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: promSubsystem,
+		Name:      "started_total",
+		Help:      "Count of cooldowns started after repeated scheduling failures in the queue",
+	}, []string{"queue"})
+
+	jobsSkippedCounter = metrics.Factory.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: promSubsystem,
+		Name:      "jobs_skipped_total",
+		Help:      "Count of jobs not passed on to be scheduled because their queue was cooling down",
+	}, []string{"queue"})
+)
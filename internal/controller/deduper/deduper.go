@@ -2,8 +2,11 @@ package deduper
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"reflect"
+	"slices"
+	"strings"
 	"sync"
 
 	"github.com/buildkite/agent-stack-k8s/v2/internal/controller/config"
@@ -12,10 +15,25 @@ import (
 	"github.com/google/uuid"
 	"go.uber.org/zap"
 	batchv1 "k8s.io/api/batch/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/cache"
 )
 
+// What to do with a duplicate of an in-flight job whose data differs from the
+// in-flight job's (see SetDuplicateAction). Duplicates are never scheduled.
+const (
+	// DuplicateDrop drops the duplicate, as for any other duplicate.
+	DuplicateDrop = "drop"
+	// DuplicateLog drops the duplicate, logging how it differs.
+	DuplicateLog = "log"
+	// DuplicateUpdate drops the duplicate, updating the agent tags annotation
+	// of the in-flight job's Kubernetes job to match the duplicate.
+	DuplicateUpdate = "update"
+)
+
 // Deduper is a job handler that wraps another job handler (typically Limiter)
 // and only creates a new job if an existing job does not already exist.
 type Deduper struct {
@@ -28,18 +46,59 @@ type Deduper struct {
 	// Map to track in-flight jobs, and mutex to protect it.
 	inFlightMu sync.Mutex
 	inFlight   map[uuid.UUID]bool
+
+	// Unfinished Kubernetes jobs for each Buildkite job, by UID. There can be
+	// more than one Kubernetes job with the same UUID label if job names are
+	// generated (e.g. a lingering job from an earlier attempt), so a job is
+	// only complete when none of them are unfinished. Protected by inFlightMu.
+	unfinished map[uuid.UUID]map[types.UID]struct{}
+
+	// Content hash of each in-flight job (see model.ContentHash), and the
+	// Kubernetes job for it once the informer has seen it. Protected by
+	// inFlightMu.
+	hashes  map[uuid.UUID]string
+	k8sJobs map[uuid.UUID]types.NamespacedName
+
+	// Agent query rules of each in-flight job, for logging how those of a
+	// duplicate differ. Protected by inFlightMu.
+	tags map[uuid.UUID][]string
+
+	// What to do with duplicates whose data differs, and the client used to
+	// update their Kubernetes jobs.
+	duplicateAction string
+	k8s             kubernetes.Interface
 }
 
 // New creates a Deduper.
 func New(logger *zap.Logger, handler model.JobHandler) *Deduper {
 	l := &Deduper{
-		handler:  handler,
-		logger:   logger,
-		inFlight: make(map[uuid.UUID]bool),
+		handler:    handler,
+		logger:     logger,
+		inFlight:   make(map[uuid.UUID]bool),
+		unfinished: make(map[uuid.UUID]map[types.UID]struct{}),
+		hashes:     make(map[uuid.UUID]string),
+		k8sJobs:    make(map[uuid.UUID]types.NamespacedName),
+		tags:       make(map[uuid.UUID][]string),
 	}
 	return l
 }
 
+// SetDuplicateAction sets what to do with duplicates of in-flight jobs whose
+// data differs from the in-flight job's: DuplicateDrop (the default),
+// DuplicateLog or DuplicateUpdate. k8s is used to update Kubernetes jobs for
+// DuplicateUpdate. It must be called before the deduper is used.
+func (d *Deduper) SetDuplicateAction(action string, k8s kubernetes.Interface) {
+	d.duplicateAction = action
+	d.k8s = k8s
+}
+
+// NumInFlight returns the number of jobs currently considered in flight.
+func (d *Deduper) NumInFlight() int {
+	d.inFlightMu.Lock()
+	defer d.inFlightMu.Unlock()
+	return len(d.inFlight)
+}
+
 // RegisterInformer registers the limiter to listen for Kubernetes job events,
 // and waits for cache sync.
 func (d *Deduper) RegisterInformer(ctx context.Context, factory informers.SharedInformerFactory) error {
@@ -58,20 +117,23 @@ func (d *Deduper) RegisterInformer(ctx context.Context, factory informers.Shared
 }
 
 // Handle passes the job to the next handler if the job is not already
-// scheduled. Otherwise, it returns [model.ErrDuplicateJob].
+// scheduled. Otherwise, it handles the duplicate according to the duplicate
+// action, and returns [model.ErrDuplicateJob].
 func (d *Deduper) Handle(ctx context.Context, job model.Job) error {
 	uuid, err := uuid.Parse(job.Uuid)
 	if err != nil {
 		d.logger.Error("invalid UUID in CommandJob", zap.Error(err))
 		return err
 	}
+	hash := model.ContentHash(job.CommandJob)
 	if numInFlight, ok := d.casa(uuid, true); !ok {
-		d.logger.Debug("job is already in-flight",
-			zap.String("uuid", job.Uuid),
-			zap.Int("num-in-flight", numInFlight),
-		)
+		d.handleDuplicate(ctx, uuid, job, hash, numInFlight)
 		return model.ErrDuplicateJob
 	}
+	d.inFlightMu.Lock()
+	d.hashes[uuid] = hash
+	d.tags[uuid] = job.AgentQueryRules
+	d.inFlightMu.Unlock()
 
 	// Not a duplicate: pass to the next handler, which could be either the
 	// limiter or the scheudler.
@@ -124,7 +186,9 @@ func (d *Deduper) OnDelete(obj any) {
 		d.logger.Error("invalid UUID in job label", zap.Error(err))
 		return
 	}
-	d.markComplete(id)
+	if d.setUnfinished(id, job.UID, false) {
+		d.markComplete(id)
+	}
 }
 
 // trackJob is called by the k8s informer callbacks to update job state.
@@ -135,10 +199,162 @@ func (d *Deduper) trackJob(job *batchv1.Job) {
 		return
 	}
 	if model.JobFinished(job) {
-		d.markComplete(id)
+		if d.setUnfinished(id, job.UID, false) {
+			d.markComplete(id)
+		}
 	} else {
+		d.setUnfinished(id, job.UID, true)
 		d.markRunning(id)
+		d.recordK8sJob(id, job)
+	}
+}
+
+// recordK8sJob records the unfinished Kubernetes job for the in-flight job,
+// and its content hash and tags, if it has them (jobs created by older
+// versions of the controller don't). A hash or tags that are already recorded
+// are kept, since they are either the same or, after updateK8sJob, newer.
+func (d *Deduper) recordK8sJob(id uuid.UUID, job *batchv1.Job) {
+	d.inFlightMu.Lock()
+	defer d.inFlightMu.Unlock()
+	if !d.inFlight[id] {
+		return
+	}
+	d.k8sJobs[id] = types.NamespacedName{Namespace: job.Namespace, Name: job.Name}
+	if _, ok := d.hashes[id]; !ok {
+		if hash := job.Annotations[config.ContentHashAnnotation]; hash != "" {
+			d.hashes[id] = hash
+		}
+	}
+	if _, ok := d.tags[id]; !ok {
+		if tags := job.Annotations[config.AgentTagsAnnotation]; tags != "" {
+			d.tags[id] = strings.Split(tags, ",")
+		}
+	}
+}
+
+// handleDuplicate counts a duplicate of an in-flight job, and if its data
+// differs from the in-flight job's, acts according to the duplicate action.
+func (d *Deduper) handleDuplicate(ctx context.Context, id uuid.UUID, job model.Job, hash string, numInFlight int) {
+	d.inFlightMu.Lock()
+	inFlightHash, inFlightTags, k8sJob := d.hashes[id], d.tags[id], d.k8sJobs[id]
+	d.inFlightMu.Unlock()
+
+	log := d.logger.With(
+		zap.String("uuid", job.Uuid),
+		zap.Int("num-in-flight", numInFlight),
+	)
+	if inFlightHash == "" || inFlightHash == hash {
+		// Either the same data, or there's nothing to compare it with.
+		duplicatesCounter.WithLabelValues("same").Inc()
+		log.Debug("job is already in-flight")
+		return
+	}
+	duplicatesCounter.WithLabelValues("changed").Inc()
+	log = log.With(
+		zap.String("in-flight-hash", inFlightHash),
+		zap.String("duplicate-hash", hash),
+		zap.String("kubernetes-job", k8sJob.Name),
+	)
+
+	switch d.duplicateAction {
+	case DuplicateLog:
+		// The command and environment can contain secrets, so only how the
+		// tags differ is logged.
+		added, removed := tagDiff(inFlightTags, job.AgentQueryRules)
+		log.Info("dropping duplicate of in-flight job with different data",
+			zap.Strings("tags-added", added),
+			zap.Strings("tags-removed", removed),
+		)
+
+	case DuplicateUpdate:
+		d.updateK8sJob(ctx, log, id, job, hash, k8sJob)
+
+	default:
+		log.Debug("job is already in-flight, with different data")
+	}
+}
+
+// tagDiff returns the tags in dup that aren't in inFlight, and those in
+// inFlight that aren't in dup.
+func tagDiff(inFlight, dup []string) (added, removed []string) {
+	for _, tag := range dup {
+		if !slices.Contains(inFlight, tag) {
+			added = append(added, tag)
+		}
+	}
+	for _, tag := range inFlight {
+		if !slices.Contains(dup, tag) {
+			removed = append(removed, tag)
+		}
+	}
+	return added, removed
+}
+
+// updateK8sJob updates the agent tags annotation of the in-flight job's
+// Kubernetes job to match a duplicate with different data. The content hash
+// annotation is left alone, as it describes what the pod runs, which isn't
+// changed. The duplicate's hash is recorded in memory, so that further
+// duplicates with the same data don't patch the Kubernetes job again.
+func (d *Deduper) updateK8sJob(ctx context.Context, log *zap.Logger, id uuid.UUID, job model.Job, hash string, k8sJob types.NamespacedName) {
+	if d.k8s == nil || k8sJob.Name == "" {
+		// The informer hasn't seen the Kubernetes job yet. The duplicate is
+		// likely to be fetched again, so try again then.
+		duplicateUpdatesCounter.WithLabelValues("skipped").Inc()
+		log.Debug("not updating the Kubernetes job for a duplicate with different data, as it hasn't been seen yet")
+		return
+	}
+	patch, err := json.Marshal(map[string]any{
+		"metadata": map[string]any{
+			"annotations": map[string]string{
+				config.AgentTagsAnnotation: strings.Join(job.AgentQueryRules, ","),
+			},
+		},
+	})
+	if err != nil {
+		duplicateUpdatesCounter.WithLabelValues("error").Inc()
+		log.Error("couldn't build the patch for the Kubernetes job", zap.Error(err))
+		return
+	}
+	_, err = d.k8s.BatchV1().Jobs(k8sJob.Namespace).Patch(ctx, k8sJob.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+	if err != nil {
+		duplicateUpdatesCounter.WithLabelValues("error").Inc()
+		log.Warn("couldn't update the Kubernetes job for a duplicate with different data", zap.Error(err))
+		return
+	}
+	duplicateUpdatesCounter.WithLabelValues("updated").Inc()
+	log.Info("updated the Kubernetes job's agent tags for a duplicate with different data")
+
+	d.inFlightMu.Lock()
+	if d.inFlight[id] {
+		d.hashes[id] = hash
+		d.tags[id] = job.AgentQueryRules
+	}
+	d.inFlightMu.Unlock()
+}
+
+// setUnfinished records whether the Kubernetes job with the given UID is
+// unfinished, and reports whether there are no unfinished Kubernetes jobs left
+// for the Buildkite job.
+func (d *Deduper) setUnfinished(id uuid.UUID, uid types.UID, unfinished bool) bool {
+	d.inFlightMu.Lock()
+	defer d.inFlightMu.Unlock()
+	if unfinished {
+		if d.unfinished[id] == nil {
+			d.unfinished[id] = make(map[types.UID]struct{})
+		}
+		d.unfinished[id][uid] = struct{}{}
+		return false
+	}
+	delete(d.unfinished[id], uid)
+	if len(d.unfinished[id]) > 0 {
+		d.logger.Debug("Kubernetes job finished, but another with the same UUID label is unfinished",
+			zap.String("uuid", id.String()),
+			zap.String("uid", string(uid)),
+		)
+		return false
 	}
+	delete(d.unfinished, id)
+	return true
 }
 
 // markRunning records a job as in-flight.
@@ -194,6 +410,9 @@ func (d *Deduper) casa(id uuid.UUID, x bool) (int, bool) {
 		d.inFlight[id] = true
 	} else {
 		delete(d.inFlight, id)
+		delete(d.hashes, id)
+		delete(d.k8sJobs, id)
+		delete(d.tags, id)
 	}
 	return len(d.inFlight), true
 }
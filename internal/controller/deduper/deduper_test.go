@@ -2,13 +2,22 @@ package deduper_test
 
 import (
 	"context"
+	"errors"
 	"testing"
 
 	"github.com/buildkite/agent-stack-k8s/v2/api"
+	"github.com/buildkite/agent-stack-k8s/v2/internal/controller/config"
 	"github.com/buildkite/agent-stack-k8s/v2/internal/controller/deduper"
 	"github.com/buildkite/agent-stack-k8s/v2/internal/controller/model"
+	"github.com/google/go-cmp/cmp"
 	"github.com/google/uuid"
+	"go.uber.org/zap"
 	"go.uber.org/zap/zaptest"
+	"go.uber.org/zap/zaptest/observer"
+	batchv1 "k8s.io/api/batch/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
 )
 
 func TestDeduper_SkipsDuplicateJobs(t *testing.T) {
@@ -45,4 +54,203 @@ func TestDeduper_SkipsDuplicateJobs(t *testing.T) {
 	if got, want := handler.Errors, 0; got != want {
 		t.Errorf("handler.Errors = %d, want %d", got, want)
 	}
+	if got, want := dd.NumInFlight(), 1; got != want {
+		t.Errorf("dd.NumInFlight() = %d, want %d", got, want)
+	}
+}
+
+func TestDeduper_GeneratedNames(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	handler := &model.FakeScheduler{}
+	dd := deduper.New(zaptest.NewLogger(t), handler)
+
+	id := uuid.New().String()
+	k8sJob := func(uid types.UID, finished bool) *batchv1.Job {
+		job := &batchv1.Job{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:   "buildkite-" + id + "-" + string(uid),
+				UID:    uid,
+				Labels: map[string]string{config.UUIDLabel: id},
+			},
+		}
+		if finished {
+			job.Status.Conditions = []batchv1.JobCondition{{Type: batchv1.JobComplete}}
+		}
+		return job
+	}
+	handle := func() error {
+		return dd.Handle(ctx, model.Job{CommandJob: &api.CommandJob{Uuid: id}})
+	}
+
+	// Two Kubernetes jobs with generated names for the same Buildkite job:
+	// one lingering from an earlier attempt, and a current one.
+	dd.OnAdd(k8sJob("old", false), true)
+	dd.OnAdd(k8sJob("new", false), false)
+	if err := handle(); err != model.ErrDuplicateJob {
+		t.Errorf("dd.Handle(ctx, job) = %v, want %v", err, model.ErrDuplicateJob)
+	}
+
+	// The lingering job finishing doesn't make the job schedulable while
+	// the current one is unfinished.
+	dd.OnUpdate(k8sJob("old", false), k8sJob("old", true))
+	if err := handle(); err != model.ErrDuplicateJob {
+		t.Errorf("after old job finished: dd.Handle(ctx, job) = %v, want %v", err, model.ErrDuplicateJob)
+	}
+
+	// Once every job with the label is finished, it can be scheduled again.
+	dd.OnDelete(k8sJob("new", false))
+	if err := handle(); err != nil {
+		t.Errorf("after new job deleted: dd.Handle(ctx, job) = %v", err)
+	}
+}
+
+func TestDeduper_DuplicateAction(t *testing.T) {
+	t.Parallel()
+
+	id := uuid.New().String()
+	original := &api.CommandJob{
+		Uuid:            id,
+		Command:         "make test",
+		AgentQueryRules: []string{"queue=default"},
+	}
+	retagged := &api.CommandJob{
+		Uuid:            id,
+		Command:         "make test",
+		AgentQueryRules: []string{"queue=default", "os=linux"},
+	}
+	k8sJob := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "buildkite-" + id,
+			Namespace: "buildkite",
+			UID:       "uid",
+			Labels:    map[string]string{config.UUIDLabel: id},
+			Annotations: map[string]string{
+				config.ContentHashAnnotation: model.ContentHash(original),
+				config.AgentTagsAnnotation:   "queue=default",
+			},
+		},
+	}
+
+	tests := []struct {
+		action          string
+		wantLogs        int
+		wantPatches     int
+		wantAnnotations map[string]string
+	}{
+		{
+			action:          deduper.DuplicateDrop,
+			wantAnnotations: k8sJob.Annotations,
+		},
+		{
+			action:          deduper.DuplicateLog,
+			wantLogs:        3,
+			wantAnnotations: k8sJob.Annotations,
+		},
+		{
+			action:      deduper.DuplicateUpdate,
+			wantPatches: 1,
+			wantAnnotations: map[string]string{
+				// The pod still runs the original job.
+				config.ContentHashAnnotation: model.ContentHash(original),
+				config.AgentTagsAnnotation:   "queue=default,os=linux",
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.action, func(t *testing.T) {
+			t.Parallel()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			core, logs := observer.New(zap.InfoLevel)
+			client := fake.NewClientset(k8sJob.DeepCopy())
+			dd := deduper.New(zap.New(core), &model.FakeScheduler{})
+			dd.SetDuplicateAction(test.action, client)
+
+			if err := dd.Handle(ctx, model.Job{CommandJob: original}); err != nil {
+				t.Fatalf("dd.Handle(ctx, original) = %v", err)
+			}
+			dd.OnAdd(k8sJob.DeepCopy(), false)
+
+			// Duplicates are dropped whatever the action. Only those with
+			// different data are acted on, and only until the Kubernetes
+			// job is updated.
+			for _, job := range []*api.CommandJob{original, retagged, retagged} {
+				if err := dd.Handle(ctx, model.Job{CommandJob: job}); !errors.Is(err, model.ErrDuplicateJob) {
+					t.Errorf("dd.Handle(ctx, duplicate) = %v, want %v", err, model.ErrDuplicateJob)
+				}
+			}
+
+			// Nor after the informer sees the update.
+			got, err := client.BatchV1().Jobs("buildkite").Get(ctx, k8sJob.Name, metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("Get(ctx, %q) error = %v", k8sJob.Name, err)
+			}
+			dd.OnUpdate(k8sJob.DeepCopy(), got.DeepCopy())
+			if err := dd.Handle(ctx, model.Job{CommandJob: retagged}); !errors.Is(err, model.ErrDuplicateJob) {
+				t.Errorf("dd.Handle(ctx, duplicate) = %v, want %v", err, model.ErrDuplicateJob)
+			}
+
+			dupLogs := logs.FilterMessage("dropping duplicate of in-flight job with different data").All()
+			if got := len(dupLogs); got != test.wantLogs {
+				t.Errorf("duplicate logs = %d, want %d", got, test.wantLogs)
+			}
+			for _, entry := range dupLogs {
+				fields := entry.ContextMap()
+				if _, ok := fields["command"]; ok {
+					t.Errorf("duplicate log has the command, want it left out")
+				}
+				if diff := cmp.Diff([]any{"os=linux"}, fields["tags-added"]); diff != "" {
+					t.Errorf("duplicate log tags-added diff (-want +got):\n%s", diff)
+				}
+			}
+			patches := 0
+			for _, action := range client.Actions() {
+				if action.GetVerb() == "patch" {
+					patches++
+				}
+			}
+			if patches != test.wantPatches {
+				t.Errorf("patches = %d, want %d", patches, test.wantPatches)
+			}
+			if diff := cmp.Diff(test.wantAnnotations, got.Annotations); diff != "" {
+				t.Errorf("Kubernetes job annotations diff (-want +got):\n%s", diff)
+			}
+			if got, want := dd.NumInFlight(), 1; got != want {
+				t.Errorf("dd.NumInFlight() = %d, want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestDeduper_DuplicateUpdateBeforeJobSeen(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client := fake.NewClientset()
+	dd := deduper.New(zaptest.NewLogger(t), &model.FakeScheduler{})
+	dd.SetDuplicateAction(deduper.DuplicateUpdate, client)
+
+	id := uuid.New().String()
+	if err := dd.Handle(ctx, model.Job{CommandJob: &api.CommandJob{Uuid: id, Command: "make"}}); err != nil {
+		t.Fatalf("dd.Handle(ctx, original) = %v", err)
+	}
+
+	// The Kubernetes job hasn't been seen yet, so there's nothing to update.
+	err := dd.Handle(ctx, model.Job{CommandJob: &api.CommandJob{Uuid: id, Command: "make test"}})
+	if !errors.Is(err, model.ErrDuplicateJob) {
+		t.Errorf("dd.Handle(ctx, duplicate) = %v, want %v", err, model.ErrDuplicateJob)
+	}
+	for _, action := range client.Actions() {
+		if action.GetVerb() == "patch" {
+			t.Errorf("client action = %v, want no patches", action)
+		}
+	}
 }
@@ -0,0 +1,41 @@
+package deduper
+
+import (
+	"context"
+
+	"github.com/buildkite/agent-stack-k8s/v2/internal/controller/metrics"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const promSubsystem = "deduper"
+
+var (
+	duplicatesCounter = metrics.Factory.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: promSubsystem,
+		Name:      "duplicates_total",
+		Help:      "Number of jobs dropped because they were already in flight, by whether their data was the same as the in-flight job's or changed",
+	}, []string{"content"})
+	duplicateUpdatesCounter = metrics.Factory.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: promSubsystem,
+		Name:      "duplicate_updates_total",
+		Help:      "Number of attempts to update a Kubernetes job's annotations for a duplicate with different data (with duplicate-job-action: update), by result: updated, skipped (the Kubernetes job hadn't been seen yet) or error",
+	}, []string{"result"})
+)
+
+// RegisterMetrics registers the gauge that reports on the deduper's state
+// (see [metrics.RegisterInstance]) until ctx is done. The monitor doesn't keep
+// a set of the jobs it has passed on: the deduper does, so the gauge is
+// reported from here. Compare it with the limiter's tokens to spot accounting
+// drift between the two.
+func (d *Deduper) RegisterMetrics(ctx context.Context) error {
+	return metrics.RegisterInstance(ctx,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Subsystem: promSubsystem,
+			Name:      "inflight_jobs",
+			Help:      "Number of jobs the deduper currently considers in flight (passed on to be scheduled, or with an unfinished Kubernetes job)",
+		}, func() float64 {
+			return float64(d.NumInFlight())
+		}),
+	)
+}
@@ -0,0 +1,105 @@
+// Package events records Kubernetes events for the controller's scheduling
+// decisions, so they show up in `kubectl get events` and `kubectl describe`.
+package events
+
+import (
+	"context"
+	"fmt"
+
+	"go.uber.org/zap"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// Component is the source component of recorded events.
+const Component = "agent-stack-k8s"
+
+// Reasons given for recorded events.
+const (
+	ReasonScheduled    = "Scheduled"
+	ReasonFilteredOut  = "FilteredOut"
+	ReasonStale        = "Stale"
+	ReasonQuotaBlocked = "QuotaBlocked"
+)
+
+// Recorder records events for scheduling decisions. Events about a created
+// Kubernetes Job refer to that Job. Decisions where no Job is created (the job
+// was filtered out, became stale, or was blocked by a quota) have nothing else
+// to refer to, so they refer to the controller's own pod instead.
+//
+// A nil *Recorder records nothing, so callers needn't check whether events
+// are enabled.
+type Recorder struct {
+	rec        record.EventRecorder
+	controller *corev1.ObjectReference
+}
+
+// New returns a Recorder that records events in the namespace, along with a
+// func that stops recording. podName is the name of the controller's pod.
+func New(ctx context.Context, logger *zap.Logger, k8s kubernetes.Interface, namespace, podName string) (*Recorder, func()) {
+	controller := &corev1.ObjectReference{
+		APIVersion: "v1",
+		Kind:       "Pod",
+		Namespace:  namespace,
+		Name:       podName,
+	}
+	// The UID lets `kubectl describe pod` find the events, but events can be
+	// recorded without it.
+	pod, err := k8s.CoreV1().Pods(namespace).Get(ctx, podName, metav1.GetOptions{})
+	if err != nil {
+		logger.Warn("failed to get controller pod for events", zap.String("pod", podName), zap.Error(err))
+	} else {
+		controller.UID = pod.UID
+	}
+
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: k8s.CoreV1().Events(namespace)})
+	rec := broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: Component})
+	return NewFromRecorder(rec, controller), broadcaster.Shutdown
+}
+
+// NewFromRecorder returns a Recorder that records events with rec. Events
+// without a Job refer to controller.
+func NewFromRecorder(rec record.EventRecorder, controller *corev1.ObjectReference) *Recorder {
+	return &Recorder{rec: rec, controller: controller}
+}
+
+// Scheduled records that kjob was created for the Buildkite job uuid.
+func (r *Recorder) Scheduled(kjob *batchv1.Job, uuid string) {
+	if r == nil {
+		return
+	}
+	r.rec.Eventf(kjob, corev1.EventTypeNormal, ReasonScheduled, "Created job for Buildkite job %s", uuid)
+}
+
+// FilteredOut records that the Buildkite job uuid was not scheduled because
+// it doesn't match the controller's tags.
+func (r *Recorder) FilteredOut(uuid string) {
+	if r == nil {
+		return
+	}
+	r.rec.Eventf(r.controller, corev1.EventTypeNormal, ReasonFilteredOut, "Buildkite job %s does not match the controller's tags", uuid)
+}
+
+// Stale records that the Buildkite job uuid was not scheduled because its
+// data became stale first.
+func (r *Recorder) Stale(uuid string) {
+	if r == nil {
+		return
+	}
+	r.rec.Eventf(r.controller, corev1.EventTypeNormal, ReasonStale, "Buildkite job %s became stale before it could be scheduled", uuid)
+}
+
+// QuotaBlocked records that the Buildkite job uuid was not scheduled because
+// of a resource quota.
+func (r *Recorder) QuotaBlocked(uuid string, err error) {
+	if r == nil {
+		return
+	}
+	r.rec.Event(r.controller, corev1.EventTypeWarning, ReasonQuotaBlocked, fmt.Sprintf("Buildkite job %s was not scheduled: %v", uuid, err))
+}
@@ -0,0 +1,63 @@
+package events_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/buildkite/agent-stack-k8s/v2/internal/controller/events"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestRecorder(t *testing.T) {
+	t.Parallel()
+
+	fake := record.NewFakeRecorder(10)
+	fake.IncludeObject = true
+	rec := events.NewFromRecorder(fake, &corev1.ObjectReference{
+		APIVersion: "v1",
+		Kind:       "Pod",
+		Namespace:  "buildkite",
+		Name:       "agent-stack-k8s-abc123",
+	})
+
+	kjob := &batchv1.Job{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "batch/v1", Kind: "Job"},
+		ObjectMeta: metav1.ObjectMeta{Name: "buildkite-abc", Namespace: "buildkite"},
+	}
+	rec.Scheduled(kjob, "abc")
+	rec.FilteredOut("def")
+	rec.Stale("ghi")
+	rec.QuotaBlocked("jkl", errors.New("exceeded quota"))
+
+	want := []string{
+		"Normal Scheduled Created job for Buildkite job abc involvedObject{kind=Job,apiVersion=batch/v1}",
+		"Normal FilteredOut Buildkite job def does not match the controller's tags involvedObject{kind=Pod,apiVersion=v1}",
+		"Normal Stale Buildkite job ghi became stale before it could be scheduled involvedObject{kind=Pod,apiVersion=v1}",
+		"Warning QuotaBlocked Buildkite job jkl was not scheduled: exceeded quota involvedObject{kind=Pod,apiVersion=v1}",
+	}
+	for _, w := range want {
+		select {
+		case got := <-fake.Events:
+			if got != w {
+				t.Errorf("event = %q, want %q", got, w)
+			}
+		default:
+			t.Fatalf("no event, want %q", w)
+		}
+	}
+}
+
+func TestRecorder_Nil(t *testing.T) {
+	t.Parallel()
+
+	// A nil Recorder (events not enabled) records nothing, and doesn't panic.
+	var rec *events.Recorder
+	rec.Scheduled(&batchv1.Job{}, "abc")
+	rec.FilteredOut("def")
+	rec.Stale("ghi")
+	rec.QuotaBlocked("jkl", errors.New("exceeded quota"))
+}
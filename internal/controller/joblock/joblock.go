@@ -0,0 +1,225 @@
+package joblock
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/buildkite/agent-stack-k8s/v2/internal/controller/config"
+	"github.com/buildkite/agent-stack-k8s/v2/internal/controller/model"
+
+	"go.uber.org/zap"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/utils/ptr"
+)
+
+// Locker is a job handler that wraps another job handler (typically the
+// scheduler) and only passes on a job if it holds a Kubernetes Lease for the
+// job. When several controllers watch the same queue (e.g. during a rolling
+// update), this ensures only one of them creates a Kubernetes job for a given
+// Buildkite job, even before their informers see each other's jobs.
+type Locker struct {
+	// Next handler in the chain.
+	handler model.JobHandler
+
+	// Logs go here
+	logger *zap.Logger
+
+	client    kubernetes.Interface
+	namespace string
+
+	// Identifies this controller as the lease holder.
+	holder string
+
+	// How long a lease is held for.
+	duration time.Duration
+}
+
+// New creates a Locker. holder identifies this controller, and must be
+// different for each controller. Leases are held for duration after they are
+// acquired, and then deleted by Run.
+func New(logger *zap.Logger, handler model.JobHandler, client kubernetes.Interface, namespace, holder string, duration time.Duration) *Locker {
+	return &Locker{
+		handler:   handler,
+		logger:    logger,
+		client:    client,
+		namespace: namespace,
+		holder:    holder,
+		duration:  duration,
+	}
+}
+
+// Handle passes the job to the next handler if it can acquire the lease for
+// the job. Otherwise it returns [model.ErrDuplicateJob].
+func (l *Locker) Handle(ctx context.Context, job model.Job) error {
+	acquired, err := l.acquire(ctx, job.Uuid)
+	if err != nil {
+		return fmt.Errorf("acquiring lease for job %s: %w", job.Uuid, err)
+	}
+	if !acquired {
+		lockContentionLostCounter.Inc()
+		l.logger.Debug("another controller holds the lease for the job",
+			zap.String("uuid", job.Uuid),
+		)
+		return model.ErrDuplicateJob
+	}
+
+	l.logger.Debug("passing job to next handler",
+		zap.Stringer("handler", reflect.TypeOf(l.handler)),
+		zap.String("uuid", job.Uuid),
+	)
+	if err := l.handler.Handle(ctx, job); err != nil {
+		// Let another controller (or this one, later) try.
+		l.release(context.WithoutCancel(ctx), job.Uuid)
+		return err
+	}
+
+	// Keep the lease until the other controllers have had time to notice the
+	// job. Run deletes it once it has expired.
+	return nil
+}
+
+// Run deletes expired leases every lease duration until ctx is done. These
+// are the leases of jobs that were scheduled, by this controller or by others
+// (including controllers that were stopped before they could clean up), so
+// leases don't pile up across restarts.
+func (l *Locker) Run(ctx context.Context) {
+	ticker := time.NewTicker(l.duration)
+	defer ticker.Stop()
+	for {
+		if err := l.deleteExpired(ctx); err != nil && ctx.Err() == nil {
+			l.logger.Warn("failed to delete expired leases", zap.Error(err))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// deleteExpired deletes the job leases that have expired.
+func (l *Locker) deleteExpired(ctx context.Context) error {
+	leases := l.client.CoordinationV1().Leases(l.namespace)
+	list, err := leases.List(ctx, metav1.ListOptions{LabelSelector: config.UUIDLabel})
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, lease := range list.Items {
+		if !strings.HasPrefix(lease.Name, leaseNamePrefix) || !expired(&lease, now) {
+			continue
+		}
+		// If the lease is taken over in the meantime, the delete fails with a
+		// conflict, and the lease is left for its new holder.
+		err := leases.Delete(ctx, lease.Name, metav1.DeleteOptions{
+			Preconditions: &metav1.Preconditions{ResourceVersion: &lease.ResourceVersion},
+		})
+		switch {
+		case err == nil:
+			expiredLeasesDeletedCounter.Inc()
+		case kerrors.IsNotFound(err), kerrors.IsConflict(err):
+			// Already gone, or taken over by another holder.
+		default:
+			return fmt.Errorf("deleting lease %s: %w", lease.Name, err)
+		}
+	}
+	return nil
+}
+
+// acquire tries to create or take over the lease for the job. It reports
+// whether this controller now holds the lease.
+func (l *Locker) acquire(ctx context.Context, uuid string) (bool, error) {
+	now := metav1.NewMicroTime(time.Now())
+	lease := &coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   leaseName(uuid),
+			Labels: map[string]string{config.UUIDLabel: uuid},
+		},
+		Spec: coordinationv1.LeaseSpec{
+			HolderIdentity:       ptr.To(l.holder),
+			LeaseDurationSeconds: ptr.To(int32(l.duration.Seconds())),
+			AcquireTime:          &now,
+			RenewTime:            &now,
+		},
+	}
+	leases := l.client.CoordinationV1().Leases(l.namespace)
+	_, err := leases.Create(ctx, lease, metav1.CreateOptions{})
+	if err == nil {
+		return true, nil
+	}
+	if !kerrors.IsAlreadyExists(err) {
+		return false, err
+	}
+
+	existing, err := leases.Get(ctx, lease.Name, metav1.GetOptions{})
+	if err != nil {
+		return false, err
+	}
+	if ptr.Deref(existing.Spec.HolderIdentity, "") == l.holder {
+		return true, nil
+	}
+	if !expired(existing, now.Time) {
+		return false, nil
+	}
+
+	// The holder didn't clean up the lease in time (maybe it was stopped).
+	// Take it over. If someone else updates it first, the update fails with a
+	// conflict because the resource version is stale.
+	existing.Spec = lease.Spec
+	_, err = leases.Update(ctx, existing, metav1.UpdateOptions{})
+	switch {
+	case err == nil:
+		return true, nil
+	case kerrors.IsConflict(err):
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// release deletes the lease for the job, if this controller still holds it.
+func (l *Locker) release(ctx context.Context, uuid string) {
+	leases := l.client.CoordinationV1().Leases(l.namespace)
+	lease, err := leases.Get(ctx, leaseName(uuid), metav1.GetOptions{})
+	if err != nil {
+		if !kerrors.IsNotFound(err) {
+			l.logger.Warn("failed to get lease", zap.String("uuid", uuid), zap.Error(err))
+		}
+		return
+	}
+	if ptr.Deref(lease.Spec.HolderIdentity, "") != l.holder {
+		return
+	}
+	err = leases.Delete(ctx, lease.Name, metav1.DeleteOptions{
+		Preconditions: &metav1.Preconditions{ResourceVersion: &lease.ResourceVersion},
+	})
+	if err != nil && !kerrors.IsNotFound(err) && !kerrors.IsConflict(err) {
+		l.logger.Warn("failed to delete lease", zap.String("uuid", uuid), zap.Error(err))
+	}
+}
+
+// expired reports whether the lease has not been renewed within its duration.
+func expired(lease *coordinationv1.Lease, now time.Time) bool {
+	renewed := lease.Spec.RenewTime
+	if renewed == nil {
+		renewed = lease.Spec.AcquireTime
+	}
+	if renewed == nil || lease.Spec.LeaseDurationSeconds == nil {
+		return true
+	}
+	d := time.Duration(*lease.Spec.LeaseDurationSeconds) * time.Second
+	return now.After(renewed.Add(d))
+}
+
+// leaseNamePrefix is the prefix of the name of each job's lease.
+const leaseNamePrefix = "buildkite-job-lock-"
+
+func leaseName(uuid string) string {
+	return leaseNamePrefix + uuid
+}
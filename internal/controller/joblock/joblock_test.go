@@ -0,0 +1,161 @@
+package joblock_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent-stack-k8s/v2/api"
+	"github.com/buildkite/agent-stack-k8s/v2/internal/controller/config"
+	"github.com/buildkite/agent-stack-k8s/v2/internal/controller/joblock"
+	"github.com/buildkite/agent-stack-k8s/v2/internal/controller/model"
+	"github.com/google/uuid"
+	"go.uber.org/zap/zaptest"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/utils/ptr"
+)
+
+func TestLocker_OnlyOneControllerSchedules(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client := fake.NewClientset()
+	handlerA, handlerB := &model.FakeScheduler{}, &model.FakeScheduler{}
+	lockerA := joblock.New(zaptest.NewLogger(t), handlerA, client, "buildkite", "a", time.Minute)
+	lockerB := joblock.New(zaptest.NewLogger(t), handlerB, client, "buildkite", "b", time.Minute)
+
+	job := model.Job{CommandJob: &api.CommandJob{Uuid: uuid.New().String()}}
+	if err := lockerA.Handle(ctx, job); err != nil {
+		t.Fatalf("lockerA.Handle(ctx, job) = %v", err)
+	}
+	if err := lockerB.Handle(ctx, job); !errors.Is(err, model.ErrDuplicateJob) {
+		t.Errorf("lockerB.Handle(ctx, job) = %v, want %v", err, model.ErrDuplicateJob)
+	}
+
+	if got, want := len(handlerA.Running), 1; got != want {
+		t.Errorf("len(handlerA.Running) = %d, want %d", got, want)
+	}
+	if got, want := len(handlerB.Running), 0; got != want {
+		t.Errorf("len(handlerB.Running) = %d, want %d", got, want)
+	}
+}
+
+func TestLocker_ReleasesLeaseOnFailure(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client := fake.NewClientset()
+	failing := &model.FakeScheduler{Err: errors.New("nope")}
+	handlerB := &model.FakeScheduler{}
+	lockerA := joblock.New(zaptest.NewLogger(t), failing, client, "buildkite", "a", time.Minute)
+	lockerB := joblock.New(zaptest.NewLogger(t), handlerB, client, "buildkite", "b", time.Minute)
+
+	job := model.Job{CommandJob: &api.CommandJob{Uuid: uuid.New().String()}}
+	if err := lockerA.Handle(ctx, job); err == nil {
+		t.Fatalf("lockerA.Handle(ctx, job) = %v, want an error", err)
+	}
+	if err := lockerB.Handle(ctx, job); err != nil {
+		t.Errorf("lockerB.Handle(ctx, job) = %v", err)
+	}
+	if got, want := len(handlerB.Running), 1; got != want {
+		t.Errorf("len(handlerB.Running) = %d, want %d", got, want)
+	}
+}
+
+func TestLocker_TakesOverExpiredLease(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	id := uuid.New().String()
+	acquired := metav1.NewMicroTime(time.Now().Add(-time.Hour))
+	client := fake.NewClientset(&coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "buildkite-job-lock-" + id,
+			Namespace: "buildkite",
+		},
+		Spec: coordinationv1.LeaseSpec{
+			HolderIdentity:       ptr.To("gone"),
+			LeaseDurationSeconds: ptr.To[int32](60),
+			AcquireTime:          &acquired,
+			RenewTime:            &acquired,
+		},
+	})
+	handler := &model.FakeScheduler{}
+	locker := joblock.New(zaptest.NewLogger(t), handler, client, "buildkite", "a", time.Minute)
+
+	if err := locker.Handle(ctx, model.Job{CommandJob: &api.CommandJob{Uuid: id}}); err != nil {
+		t.Fatalf("locker.Handle(ctx, job) = %v", err)
+	}
+	if got, want := len(handler.Running), 1; got != want {
+		t.Errorf("len(handler.Running) = %d, want %d", got, want)
+	}
+}
+
+func TestLocker_RunDeletesExpiredLeases(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	lease := func(name string, labels map[string]string, acquiredAgo time.Duration) *coordinationv1.Lease {
+		acquired := metav1.NewMicroTime(time.Now().Add(-acquiredAgo))
+		return &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: "buildkite",
+				Labels:    labels,
+			},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       ptr.To("gone"),
+				LeaseDurationSeconds: ptr.To[int32](60),
+				AcquireTime:          &acquired,
+				RenewTime:            &acquired,
+			},
+		}
+	}
+	expiredID, heldID := uuid.New().String(), uuid.New().String()
+	client := fake.NewClientset(
+		// Left behind by a controller that was stopped.
+		lease("buildkite-job-lock-"+expiredID, map[string]string{config.UUIDLabel: expiredID}, time.Hour),
+		// Still held.
+		lease("buildkite-job-lock-"+heldID, map[string]string{config.UUIDLabel: heldID}, 0),
+		// Not a job lease.
+		lease("leader-election", nil, time.Hour),
+	)
+	locker := joblock.New(zaptest.NewLogger(t), &model.FakeScheduler{}, client, "buildkite", "a", time.Minute)
+
+	done := make(chan struct{})
+	go func() {
+		locker.Run(ctx)
+		close(done)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err := client.CoordinationV1().Leases("buildkite").Get(ctx, "buildkite-job-lock-"+expiredID, metav1.GetOptions{})
+		if kerrors.IsNotFound(err) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expired lease still exists (get error = %v)", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	for _, name := range []string{"buildkite-job-lock-" + heldID, "leader-election"} {
+		if _, err := client.CoordinationV1().Leases("buildkite").Get(context.Background(), name, metav1.GetOptions{}); err != nil {
+			t.Errorf("Get(ctx, %q) error = %v, want it kept", name, err)
+		}
+	}
+}
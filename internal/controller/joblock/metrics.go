@@ -0,0 +1,22 @@
+package joblock
+
+import (
+	"github.com/buildkite/agent-stack-k8s/v2/internal/controller/metrics"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const promSubsystem = "joblock"
+
+var (
+	lockContentionLostCounter = metrics.Factory.NewCounter(prometheus.CounterOpts{
+		Subsystem: promSubsystem,
+		Name:      "contention_lost_total",
+		Help:      "Count of jobs not scheduled because another controller held the job's lease",
+	})
+	expiredLeasesDeletedCounter = metrics.Factory.NewCounter(prometheus.CounterOpts{
+		Subsystem: promSubsystem,
+		Name:      "expired_leases_deleted_total",
+		Help:      "Count of expired job leases deleted",
+	})
+)
@@ -0,0 +1,82 @@
+package limiter
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// InFlightJob describes a job that the limiter counts as in flight.
+type InFlightJob struct {
+	// UUID is the Buildkite job UUID.
+	UUID string `json:"uuid"`
+
+	// Queue is the job's queue tag.
+	Queue string `json:"queue,omitempty"`
+
+	// TagLimit is the name of the tag limit rule the job counts towards, if
+	// any.
+	TagLimit string `json:"tag_limit,omitempty"`
+
+	// ClusterQueue is the UUID of the cluster queue whose limit the job
+	// counts towards, if any.
+	ClusterQueue string `json:"cluster_queue,omitempty"`
+
+	// Since is when the job took its token (or, for jobs found running when
+	// the limiter started, when it found them).
+	Since time.Time `json:"since"`
+
+	// HeldFor is how long the job has been in flight.
+	HeldFor time.Duration `json:"-"`
+
+	// Overcommitted is true if the job was found running when the limiter
+	// started, but there was no token left for it (see Overcommit).
+	Overcommitted bool `json:"overcommitted,omitempty"`
+}
+
+// MarshalJSON encodes HeldFor in seconds, as held_for_seconds.
+func (j InFlightJob) MarshalJSON() ([]byte, error) {
+	type plain InFlightJob
+	return json.Marshal(struct {
+		plain
+		HeldForSeconds float64 `json:"held_for_seconds"`
+	}{plain(j), j.HeldFor.Seconds()})
+}
+
+// InFlightJobs returns a snapshot of the jobs currently in flight, those that
+// have held their token the longest first.
+func (l *MaxInFlight) InFlightJobs() []InFlightJob {
+	l.inFlightMu.Lock()
+	defer l.inFlightMu.Unlock()
+	now := time.Now()
+	jobs := make([]InFlightJob, 0, len(l.inFlight))
+	for uuid, held := range l.inFlight {
+		jobs = append(jobs, InFlightJob{
+			UUID:          uuid,
+			Queue:         held.queue,
+			TagLimit:      held.sub.rule,
+			ClusterQueue:  held.sub.queue,
+			Since:         held.since,
+			HeldFor:       now.Sub(held.since),
+			Overcommitted: held.overcommitted,
+		})
+	}
+	slices.SortFunc(jobs, func(a, b InFlightJob) int {
+		return a.Since.Compare(b.Since)
+	})
+	return jobs
+}
+
+// InFlightHandler returns an HTTP handler that serves InFlightJobs as a JSON
+// array.
+func (l *MaxInFlight) InFlightHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(l.InFlightJobs()); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
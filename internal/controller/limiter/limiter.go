@@ -3,26 +3,95 @@ package limiter
 import (
 	"context"
 	"fmt"
+	"iter"
+	"maps"
 	"reflect"
+	"sync"
+	"time"
 
+	"github.com/buildkite/agent-stack-k8s/v2/internal/controller/agenttags"
 	"github.com/buildkite/agent-stack-k8s/v2/internal/controller/config"
+	"github.com/buildkite/agent-stack-k8s/v2/internal/controller/metrics"
 	"github.com/buildkite/agent-stack-k8s/v2/internal/controller/model"
 
 	"github.com/google/uuid"
 	"go.uber.org/zap"
 	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/utils/ptr"
 )
 
 // MaxInFlight is a job handler that wraps another job handler
 // (typically the actual job scheduler) and only creates new jobs if the total
 // number of jobs currently running is below a limit.
+//
+// Tokens are counted per Kubernetes job rather than per pod. The scheduler
+// builds every Kubernetes job to run exactly one pod (no parallelism or
+// completions, a backoffLimit of 0, and restartPolicy Never), so the two
+// counts are the same.
+//
+// A controller watches a single Buildkite organization, so its limiter has no
+// per-organization buckets: each organization's controller has its own
+// MaxInFlight, and tokens can't be borrowed between them.
 type MaxInFlight struct {
 	// MaxInFlight sets the upper limit on number of jobs running concurrently
 	// in the cluster. 0 means no limit.
 	MaxInFlight int
 
+	// Mode is how MaxInFlight is applied: ModeHard (the default) blocks jobs
+	// until there is a token, while ModeSoft passes on jobs beyond the limit
+	// straight away, logging and counting them. Queue and tag limits are
+	// always hard.
+	Mode string
+
+	// QueueMetrics enables the queue label on the token wait duration
+	// histogram. It is opt-in, because each queue adds a series per bucket.
+	QueueMetrics bool
+
+	// ReturnDelay is how long to wait after a job finishes before returning
+	// its token, to give the node time to reclaim the pod's resources before
+	// another job is scheduled. Tokens waiting for the delay are returned
+	// straight away when the informer's context is cancelled.
+	ReturnDelay time.Duration
+
+	// MinHold is the minimum time a job holds its token, counted from when it
+	// was taken. If a job finishes sooner (e.g. its pod fails straight away),
+	// its token is returned when MinHold has passed rather than after
+	// ReturnDelay, which dampens tight failure loops. Like ReturnDelay, tokens
+	// waiting for it are returned straight away on shutdown.
+	MinHold time.Duration
+
+	// ControllerID, if set, limits the Kubernetes jobs that are counted to
+	// those labelled with it (see [config.ControllerIDLabel]), so that jobs
+	// of other controllers in the same namespace don't take tokens.
+	ControllerID string
+
+	// RampUp is how long after the informer first syncs it takes for all the
+	// tokens to become available. Tokens not held by already-running jobs are
+	// withheld, and returned one at a time evenly over RampUp, so that a newly
+	// started controller doesn't create MaxInFlight jobs all at once. 0 makes
+	// them all available straight away.
+	RampUp time.Duration
+
+	// HoldWarnAfter enables a periodic sweep of the jobs holding tokens, which
+	// reports those that have held theirs for longer than this (e.g. because
+	// the pod is stuck, or the informer missed the job finishing). 0 disables
+	// the sweep.
+	HoldWarnAfter time.Duration
+
+	// SweepInterval is how often the sweep runs (1 minute if unset).
+	// SweepJitter is the fraction of SweepInterval (from 0 up to 1) by which
+	// each interval is randomly lengthened or shortened, so that replicas
+	// don't sweep in step. 0 disables jitter.
+	SweepInterval time.Duration
+	SweepJitter   float64
+
+	// Closed when the informer's context is cancelled.
+	done <-chan struct{}
+
 	// Next handler in the chain.
 	handler model.JobHandler
 
@@ -32,8 +101,126 @@ type MaxInFlight struct {
 	// When a job starts, it takes a token from the bucket.
 	// When a job ends, it puts a token back in the bucket.
 	tokenBucket chan struct{}
+
+	// Signalled (without blocking) when a token is returned to an empty
+	// tokenBucket. See CapacityAvailable.
+	capacityAvailable chan struct{}
+
+	// Token buckets for cluster queues with their own limits, by cluster
+	// queue UUID. Jobs in these queues take a token from their queue's bucket
+	// before taking one from tokenBucket.
+	queueBuckets map[string]chan struct{}
+
+	// Tag limit rules, in the order they are evaluated. Jobs that match a
+	// rule take a token from its bucket instead of their queue's, before
+	// taking one from tokenBucket.
+	tagRules []*tagRule
+
+	// Map of the jobs (by Buildkite job UUID) currently holding a token to
+	// the token they hold, and mutex to protect it. Tokens are returned to the
+	// buckets while holding the mutex, so that the map agrees with the
+	// buckets.
+	inFlightMu sync.Mutex
+	inFlight   map[string]heldToken
+
+	// Number of jobs in inFlight beyond MaxInFlight (see OnAdd), protected
+	// by inFlightMu. While it is positive, tokens released by finishing jobs
+	// pay it off rather than being returned to the bucket.
+	overcommit int
+
+	// Cluster queue UUIDs of queues that are draining, and mutex to protect
+	// it.
+	drainingMu sync.Mutex
+	draining   map[string]bool
+
+	// Held while Reconcile runs, so that only one runs at a time.
+	reconcileMu sync.Mutex
+
+	// Used by Reconcile to list jobs from the API server (see SetLiveClient).
+	liveClient    kubernetes.Interface
+	liveNamespace string
+	liveSelector  string
 }
 
+// Values for MaxInFlight.Mode.
+const (
+	ModeHard = "hard"
+	ModeSoft = "soft"
+)
+
+// heldToken records a token held by a job.
+type heldToken struct {
+	// When the token was taken.
+	since time.Time
+
+	// The job's queue tag.
+	queue string
+
+	// The bucket the job also took a token from, if any.
+	sub subLimit
+
+	// The job was already running when the limiter started, or was passed on
+	// beyond the limit in ModeSoft, but there was no token left for it (it
+	// counts towards overcommit instead).
+	overcommitted bool
+
+	// When the next handler finished with the job (so its Kubernetes job
+	// should exist), or the job was found running. Zero until then.
+	// Reconcile only returns tokens of jobs created before it listed them.
+	createdAt time.Time
+
+	// The job is done, and its token is waiting for ReturnDelay or MinHold.
+	returning bool
+}
+
+// subLimit identifies the bucket that a job takes a token from before taking
+// one from tokenBucket: that of the first tag limit rule that matches the job,
+// or else that of its cluster queue, if the queue has a limit. The zero value
+// means neither.
+type subLimit struct {
+	// Name of the tag limit rule.
+	rule string
+
+	// Cluster queue UUID.
+	queue string
+}
+
+// tagRule is a compiled config.TagLimit.
+type tagRule struct {
+	name   string
+	tags   map[string]string
+	bucket chan struct{}
+}
+
+// matches reports whether the job tags include all of the rule's tags.
+func (r *tagRule) matches(jobTags iter.Seq2[string, string]) bool {
+	found := 0
+	for k, v := range jobTags {
+		if want, ok := r.tags[k]; ok && want == v {
+			found++
+		}
+	}
+	return found == len(r.tags)
+}
+
+// InterruptedError is returned by Handle when the context was cancelled while
+// the next handler was handling the job. The next handler may have created a
+// Kubernetes job for the Buildkite job before it noticed the cancellation, so
+// callers that need to clean up can use the UUID to find it.
+type InterruptedError struct {
+	// UUID is the Buildkite job UUID.
+	UUID string
+
+	// Err is the error returned by the next handler.
+	Err error
+}
+
+func (e *InterruptedError) Error() string {
+	return fmt.Sprintf("handling job %s was interrupted: %v", e.UUID, e.Err)
+}
+
+func (e *InterruptedError) Unwrap() error { return e.Err }
+
 // New creates a MaxInFlight limiter. maxInFlight must be at least 1.
 func New(logger *zap.Logger, scheduler model.JobHandler, maxInFlight int) *MaxInFlight {
 	if maxInFlight <= 0 {
@@ -42,10 +229,13 @@ func New(logger *zap.Logger, scheduler model.JobHandler, maxInFlight int) *MaxIn
 		panic(fmt.Sprintf("maxInFlight <= 0 (got %d)", maxInFlight))
 	}
 	l := &MaxInFlight{
-		handler:     scheduler,
-		MaxInFlight: maxInFlight,
-		logger:      logger,
-		tokenBucket: make(chan struct{}, maxInFlight),
+		handler:           scheduler,
+		MaxInFlight:       maxInFlight,
+		logger:            logger,
+		tokenBucket:       make(chan struct{}, maxInFlight),
+		capacityAvailable: make(chan struct{}, 1),
+		inFlight:          make(map[string]heldToken),
+		draining:          make(map[string]bool),
 	}
 	for range maxInFlight {
 		// Fill the bucket with tokens.
@@ -54,11 +244,91 @@ func New(logger *zap.Logger, scheduler model.JobHandler, maxInFlight int) *MaxIn
 	return l
 }
 
+// SetQueueLimits sets limits on the number of jobs running concurrently in
+// each Buildkite cluster queue, keyed by cluster queue UUID. Jobs in these
+// queues are also subject to the overall MaxInFlight limit, so the total
+// across all queues never exceeds MaxInFlight, however the queue limits add
+// up. It must be called before the limiter is used.
+func (l *MaxInFlight) SetQueueLimits(limits map[string]int) {
+	l.queueBuckets = make(map[string]chan struct{}, len(limits))
+	for queue, limit := range limits {
+		if limit <= 0 {
+			panic(fmt.Sprintf("limit for queue %s <= 0 (got %d)", queue, limit))
+		}
+		bucket := make(chan struct{}, limit)
+		for range limit {
+			bucket <- struct{}{}
+		}
+		l.queueBuckets[queue] = bucket
+		queueLimitGauge.WithLabelValues(queue).Set(float64(limit))
+		queueTokensAvailableGauge.WithLabelValues(queue).Set(float64(limit))
+	}
+}
+
+// SetTagLimits sets limits on the number of jobs running concurrently among
+// jobs with particular tags. Each job is subject to the first limit whose
+// tags it has, instead of its queue's limit. Jobs are also subject to the
+// overall MaxInFlight limit. The limits must have been validated. It must be
+// called before the limiter is used.
+func (l *MaxInFlight) SetTagLimits(limits config.TagLimits) {
+	l.tagRules = make([]*tagRule, 0, len(limits))
+	for _, limit := range limits {
+		tags, errs := agenttags.TagMapFromTags(limit.Tags)
+		if len(errs) > 0 || limit.Limit <= 0 {
+			panic(fmt.Sprintf("tag limit %s was not validated: tag errors %v, limit %d", limit.Name, errs, limit.Limit))
+		}
+		bucket := make(chan struct{}, limit.Limit)
+		for range limit.Limit {
+			bucket <- struct{}{}
+		}
+		l.tagRules = append(l.tagRules, &tagRule{name: limit.Name, tags: tags, bucket: bucket})
+		tagLimitGauge.WithLabelValues(limit.Name).Set(float64(limit.Limit))
+		tagLimitTokensAvailableGauge.WithLabelValues(limit.Name).Set(float64(limit.Limit))
+	}
+}
+
+// DrainQueue stops new jobs in the cluster queue (by UUID) from being
+// scheduled: Handle returns [model.ErrDraining] for them. Jobs that are
+// already waiting for a token return it once they get one. Jobs already
+// scheduled are unaffected, and jobs in other queues are scheduled as usual.
+// The queue needn't have a limit.
+func (l *MaxInFlight) DrainQueue(queue string) {
+	l.drainingMu.Lock()
+	defer l.drainingMu.Unlock()
+	if l.draining[queue] {
+		return
+	}
+	l.draining[queue] = true
+	queueDrainingGauge.WithLabelValues(queue).Set(1)
+	l.logger.Info("draining queue", zap.String("cluster-queue", queue))
+}
+
+// ResumeQueue undoes DrainQueue, so that jobs in the cluster queue are
+// scheduled again.
+func (l *MaxInFlight) ResumeQueue(queue string) {
+	l.drainingMu.Lock()
+	defer l.drainingMu.Unlock()
+	if !l.draining[queue] {
+		return
+	}
+	delete(l.draining, queue)
+	queueDrainingGauge.WithLabelValues(queue).Set(0)
+	l.logger.Info("resuming queue", zap.String("cluster-queue", queue))
+}
+
+// IsQueueDraining reports whether the cluster queue (by UUID) is draining.
+func (l *MaxInFlight) IsQueueDraining(queue string) bool {
+	l.drainingMu.Lock()
+	defer l.drainingMu.Unlock()
+	return l.draining[queue]
+}
+
 // RegisterInformer registers the limiter to listen for Kubernetes job events,
 // and waits for cache sync.
 func (l *MaxInFlight) RegisterInformer(ctx context.Context, factory informers.SharedInformerFactory) error {
 	informer := factory.Batch().V1().Jobs()
 	jobInformer := informer.Informer()
+	l.done = ctx.Done()
 	if _, err := jobInformer.AddEventHandler(l); err != nil {
 		return err
 	}
@@ -68,28 +338,94 @@ func (l *MaxInFlight) RegisterInformer(ctx context.Context, factory informers.Sh
 		return fmt.Errorf("failed to sync informer cache")
 	}
 
+	if overcommit := l.Overcommit(); overcommit > 0 {
+		l.logger.Warn("more unfinished jobs than max-in-flight, new jobs will wait until enough of them finish",
+			zap.Int("max-in-flight", l.MaxInFlight),
+			zap.Int("overcommit", overcommit),
+		)
+	}
+
+	// Ramp up after the initial list, so that jobs that are already running
+	// keep their tokens.
+	if l.RampUp > 0 {
+		l.startRampUp()
+	}
+	if l.HoldWarnAfter > 0 {
+		go l.runSweep()
+	}
 	return nil
 }
 
+// startRampUp withholds the tokens in the bucket, and returns them one at a
+// time evenly over RampUp, the first straight away. Withheld tokens are all
+// returned when the informer's context is cancelled.
+func (l *MaxInFlight) startRampUp() {
+	withheld := 0
+	for l.tryTakeToken() {
+		withheld++
+	}
+	if withheld == 0 {
+		return
+	}
+	rampCapacityGauge.Set(float64(l.MaxInFlight - withheld))
+	interval := max(l.RampUp/time.Duration(withheld), time.Millisecond)
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			l.inFlightMu.Lock()
+			l.tryReturnToken()
+			l.inFlightMu.Unlock()
+			withheld--
+			rampCapacityGauge.Set(float64(l.MaxInFlight - withheld))
+			if withheld == 0 {
+				return
+			}
+			select {
+			case <-ticker.C:
+			case <-l.done:
+				// Return the rest straight away.
+			}
+		}
+	}()
+}
+
 // Handle either passes the job onto the next handler immediately, or blocks
 // until there is capacity. It returns [model.ErrStaleJob] if the job data
-// becomes too stale while waiting for capacity.
+// becomes too stale while waiting for capacity, [model.ErrDuplicateJob] if the
+// job already holds a token, [model.ErrDraining] if the job's queue is
+// draining, and [*InterruptedError] if ctx is cancelled while the next handler
+// is handling the job.
 func (l *MaxInFlight) Handle(ctx context.Context, job model.Job) error {
-	// Block until there's a token in the bucket, or cancel if the job
-	// information becomes too stale.
-	select {
-	case <-ctx.Done():
-		return context.Cause(ctx)
+	handleCallsCounter.Inc()
 
-	case <-job.StaleCh:
-		return model.ErrStaleJob
+	if l.isDraining(job) {
+		return model.ErrDraining
+	}
 
-	case <-l.tokenBucket:
-		l.logger.Debug("token acquired",
-			zap.String("uuid", job.Uuid),
-			zap.Int("available-tokens", len(l.tokenBucket)),
-		)
+	// Block until there's a token in the bucket (unless the limit is soft),
+	// or cancel if the job information becomes too stale.
+	sub := l.subLimitOf(job)
+	overLimit, err := l.waitForToken(ctx, job, sub)
+	if err != nil {
+		return err
+	}
+	hold := l.hold
+	if overLimit {
+		// Passed on without a token, so it counts towards overcommit.
+		hold = l.holdOvercommitted
+	}
+	if !hold(job.Uuid, queueTag(job), sub) {
+		// The job already holds a token (the deduper should have caught this).
+		return model.ErrDuplicateJob
 	}
+	if l.isDraining(job) {
+		// The queue started draining while the job waited for a token.
+		l.release(job.Uuid)
+		return model.ErrDraining
+	}
+	job.TokenAcquiredAt = time.Now()
 
 	// We got a token from the bucket above! Proceed to schedule the pod.
 	// The next handler should be Scheduler (except in some tests).
@@ -97,9 +433,27 @@ func (l *MaxInFlight) Handle(ctx context.Context, job model.Job) error {
 		zap.Stringer("handler", reflect.TypeOf(l.handler)),
 		zap.String("uuid", job.Uuid),
 	)
-	if err := l.handler.Handle(ctx, job); err != nil {
-		// Oh well. Return the token and un-record the job.
-		l.tryReturnToken()
+	handlerStart := time.Now()
+	inHandlerGauge.Inc()
+	err = l.handler.Handle(ctx, job)
+	inHandlerGauge.Dec()
+	nextHandlerDurationHistogram.WithLabelValues(handlerResult(ctx, err)).Observe(time.Since(handlerStart).Seconds())
+	if err != nil {
+		if ctx.Err() != nil {
+			// The context was cancelled while the next handler was working.
+			// It may have created the Kubernetes job before noticing, so keep
+			// the token: if the job exists, the token is returned when the
+			// informer sees it finish. If it doesn't exist, the controller is
+			// shutting down anyway.
+			l.logger.Warn("next handler interrupted, a Kubernetes job may have been created",
+				zap.String("uuid", job.Uuid),
+				zap.Error(err),
+			)
+			return &InterruptedError{UUID: job.Uuid, Err: err}
+		}
+
+		// Oh well. Return the token.
+		l.release(job.Uuid)
 
 		l.logger.Debug("next handler failed",
 			zap.String("uuid", job.Uuid),
@@ -107,74 +461,539 @@ func (l *MaxInFlight) Handle(ctx context.Context, job model.Job) error {
 		)
 		return err
 	}
+	l.setHeld(job.Uuid, func(held *heldToken) { held.createdAt = time.Now() })
+	handleSuccessCounter.Inc()
 	return nil
 }
 
+// handlerResult returns the value of the result label for the next handler's
+// duration: "success", "interrupted" (ctx was cancelled while it was handling
+// the job), or "error".
+func handlerResult(ctx context.Context, err error) string {
+	switch {
+	case err == nil:
+		return "success"
+	case ctx.Err() != nil:
+		return "interrupted"
+	default:
+		return "error"
+	}
+}
+
+// waitForToken blocks until it takes a token from the bucket, ctx is done, or
+// the job becomes stale. If sub is not the zero value, it first takes a token
+// from the tag limit rule's or queue's bucket. Tokens are always taken in this
+// order, so that jobs waiting for tokens can't deadlock. In ModeSoft, it
+// doesn't wait for a token from the bucket, and reports whether the job is
+// over the limit because there wasn't one.
+func (l *MaxInFlight) waitForToken(ctx context.Context, job model.Job, sub subLimit) (overLimit bool, err error) {
+	start := time.Now()
+	if bucket := l.subBucket(sub); bucket != nil {
+		if sub.rule != "" && len(bucket) == 0 {
+			tagLimitSaturatedCounter.WithLabelValues(sub.rule).Inc()
+		}
+		if err := takeToken(ctx, job, bucket); err != nil {
+			return false, err
+		}
+		l.updateSubGauge(sub)
+
+		// The rule's or queue's limit allows the job, so if the bucket is
+		// empty, it's the overall limit holding it up.
+		if len(l.tokenBucket) == 0 {
+			globalCapBlockedCounter.Inc()
+		}
+	}
+	switch {
+	case l.Mode == ModeSoft:
+		if !l.tryTakeToken() {
+			softLimitExceededCounter.Inc()
+			l.logger.Warn("job is over max-in-flight, passing it on anyway (soft limit)",
+				zap.String("uuid", job.Uuid),
+				zap.String("queue", queueTag(job)),
+				zap.Int("max-in-flight", l.MaxInFlight),
+				zap.Int("overcommit", l.Overcommit()),
+			)
+			overLimit = true
+		}
+	default:
+		if err := takeToken(ctx, job, l.tokenBucket); err != nil {
+			l.returnSubToken(sub)
+			return false, err
+		}
+	}
+	metrics.ObserveDuration(ctx, tokenWaitDurationHistogram.WithLabelValues(l.queueLabel(job), priorityLabel(job)), time.Since(start).Seconds())
+	l.logger.Debug("token acquired",
+		zap.String("uuid", job.Uuid),
+		zap.String("tag-limit", sub.rule),
+		zap.String("cluster-queue", sub.queue),
+		zap.Int("available-tokens", len(l.tokenBucket)),
+	)
+	return overLimit, nil
+}
+
+// takeToken blocks until it takes a token from the bucket, ctx is done, or the
+// job becomes stale. It counts towards waiters and blocked_on_token only if the
+// bucket is empty to begin with.
+func takeToken(ctx context.Context, job model.Job, bucket chan struct{}) error {
+	if tryTake(bucket) {
+		return nil
+	}
+	waitersGauge.Inc()
+	defer waitersGauge.Dec()
+	blockedOnTokenGauge.Inc()
+	defer blockedOnTokenGauge.Dec()
+	select {
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	case <-job.StaleCh:
+		return model.ErrStaleJob
+	case <-bucket:
+		return nil
+	}
+}
+
+// subLimitOf returns the first tag limit rule that matches the job, or else
+// its cluster queue UUID, if the queue has a limit.
+func (l *MaxInFlight) subLimitOf(job model.Job) subLimit {
+	if job.CommandJob == nil {
+		return subLimit{}
+	}
+	if len(l.tagRules) > 0 {
+		tags, _ := agenttags.TagMapFromTags(job.AgentQueryRules)
+		if rule := l.matchTagRule(maps.All(tags)); rule != "" {
+			return subLimit{rule: rule}
+		}
+	}
+	if job.ClusterQueue == nil {
+		return subLimit{}
+	}
+	if _, ok := l.queueBuckets[job.ClusterQueue.Uuid]; !ok {
+		return subLimit{}
+	}
+	return subLimit{queue: job.ClusterQueue.Uuid}
+}
+
+// matchTagRule returns the name of the first tag limit rule that matches the
+// job tags, or "" if none do.
+func (l *MaxInFlight) matchTagRule(jobTags iter.Seq2[string, string]) string {
+	for _, rule := range l.tagRules {
+		if rule.matches(jobTags) {
+			return rule.name
+		}
+	}
+	return ""
+}
+
+// isDraining reports whether the job's cluster queue is draining.
+func (l *MaxInFlight) isDraining(job model.Job) bool {
+	if job.CommandJob == nil || job.ClusterQueue == nil {
+		return false
+	}
+	return l.IsQueueDraining(job.ClusterQueue.Uuid)
+}
+
+// queueLabel returns the value of the queue label for the job's metrics: the
+// job's queue tag if QueueMetrics is enabled, otherwise "".
+func (l *MaxInFlight) queueLabel(job model.Job) string {
+	if !l.QueueMetrics {
+		return ""
+	}
+	return queueTag(job)
+}
+
+// queueTag returns the job's queue tag.
+func queueTag(job model.Job) string {
+	if job.CommandJob == nil {
+		return ""
+	}
+	tags, _ := agenttags.TagMapFromTags(job.AgentQueryRules)
+	return tags["queue"]
+}
+
+// priorityLabel returns the value of the priority label for the job's metrics.
+// Buildkite job priorities are arbitrary integers (0 by default), so they are
+// reduced to "high", "normal" or "low" to keep the number of series small.
+func priorityLabel(job model.Job) string {
+	if job.CommandJob == nil {
+		return "normal"
+	}
+	switch p := job.Priority.Number; {
+	case p > 0:
+		return "high"
+	case p < 0:
+		return "low"
+	default:
+		return "normal"
+	}
+}
+
 // OnAdd is called by k8s to inform us a resource is added.
-func (l *MaxInFlight) OnAdd(obj any, _ bool) {
+func (l *MaxInFlight) OnAdd(obj any, inInitialList bool) {
 	job, _ := obj.(*batchv1.Job)
-	if job == nil {
+	if job == nil || !l.isTracked(job) {
+		return
+	}
+	if jobDone(job) {
 		return
 	}
-	l.trackJob(job)
+	// Handle takes a token for each job it creates before creating it, so
+	// those are already in flight. Other unfinished jobs were started by a
+	// previous controller (during the initial list), or by another replica
+	// or controller in the namespace, so take tokens for them.
+	if !inInitialList && l.IsInFlight(job.Labels[config.UUIDLabel]) {
+		return
+	}
+	l.adopt(job)
 	l.logger.Debug("at end of OnAdd", zap.Int("tokens-available", len(l.tokenBucket)))
 }
 
+// adopt takes a token for an unfinished job that the limiter found running,
+// rather than one it took a token for in Handle.
+func (l *MaxInFlight) adopt(job *batchv1.Job) {
+	if !l.tryTakeToken() {
+		// The stack was restarted with a lower limit than there are
+		// unfinished jobs. Don't block: track the job as overcommitted, so
+		// that new jobs wait until enough jobs finish to bring the count
+		// below the new limit.
+		l.holdOvercommitted(job.Labels[config.UUIDLabel], job.Labels[config.QueueTagLabel], subLimit{})
+		l.setHeld(job.Labels[config.UUIDLabel], func(held *heldToken) { held.createdAt = time.Now() })
+		return
+	}
+	// Take a token from the job's tag limit rule's or queue's bucket too, if
+	// it has one and there is one.
+	sub := subLimit{rule: l.matchTagRule(agenttags.ScanLabels(job.Labels))}
+	if sub.rule == "" {
+		if queue := job.Labels[config.ClusterQueueUUIDLabel]; l.queueBuckets[queue] != nil {
+			sub.queue = queue
+		}
+	}
+	if bucket := l.subBucket(sub); bucket == nil || !tryTake(bucket) {
+		sub = subLimit{}
+	}
+	l.updateSubGauge(sub)
+	l.hold(job.Labels[config.UUIDLabel], job.Labels[config.QueueTagLabel], sub)
+	l.setHeld(job.Labels[config.UUIDLabel], func(held *heldToken) { held.createdAt = time.Now() })
+}
+
 // OnUpdate is called by k8s to inform us a resource is updated.
-func (l *MaxInFlight) OnUpdate(_, obj any) {
-	job, _ := obj.(*batchv1.Job)
-	if job == nil {
+func (l *MaxInFlight) OnUpdate(prev, curr any) {
+	prevJob, _ := prev.(*batchv1.Job)
+	currJob, _ := curr.(*batchv1.Job)
+	if currJob == nil || !l.isTracked(currJob) {
 		return
 	}
-	l.trackJob(job)
+	// Only return a token when the job transitions to done. Jobs are
+	// updated many times while running, and a done job can be updated
+	// again before it is cleaned up.
+	if jobDone(prevJob) || !jobDone(currJob) {
+		return
+	}
+	if !model.JobFinished(currJob) {
+		// The job's pod is gone (e.g. evicted, or its node was deleted) but
+		// the job isn't finished yet.
+		doneUnfinishedJobsCounter.Inc()
+		l.logger.Debug("job has no pods left but is not finished, returning token",
+			zap.String("uuid", currJob.Labels[config.UUIDLabel]),
+		)
+	}
+	l.releaseAfterDelay(currJob.Labels[config.UUIDLabel])
 	l.logger.Debug("at end of OnUpdate", zap.Int("tokens-available", len(l.tokenBucket)))
 }
 
 // OnDelete is called by k8s to inform us a resource is deleted.
 func (l *MaxInFlight) OnDelete(obj any) {
-	// The job condition at the point of deletion could be non-terminal, but
-	// it is being deleted, so ignore it and skip to marking complete.
-	// If buildkite.com/job-uuid label is missing or malformed, don't track it.
+	// If the informer missed the delete event (e.g. during a watch
+	// disconnection), it delivers a tombstone containing the last known state
+	// of the job. That state may be stale, so don't rely on it to tell whether
+	// the job was done: release only returns a token if the job still holds
+	// one.
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		tombstoneDeletesCounter.Inc()
+		job, _ := tombstone.Obj.(*batchv1.Job)
+		if job == nil || !l.isTracked(job) {
+			l.logger.Warn("informer delivered a tombstone for an unknown object", zap.String("key", tombstone.Key))
+			return
+		}
+		l.logger.Warn("informer delivered a tombstone for a job",
+			zap.String("key", tombstone.Key),
+			zap.String("uuid", job.Labels[config.UUIDLabel]),
+		)
+		l.releaseAfterDelay(job.Labels[config.UUIDLabel])
+		l.logger.Debug("at end of OnDelete", zap.Int("tokens-available", len(l.tokenBucket)))
+		return
+	}
+
 	job, _ := obj.(*batchv1.Job)
-	if job == nil {
+	if job == nil || !l.isTracked(job) {
 		return
 	}
-	l.trackJob(job)
-	if _, err := uuid.Parse(job.Labels[config.UUIDLabel]); err != nil {
+	// If the job was done before it was deleted, the token was returned when
+	// it became done. Otherwise it is being deleted while unfinished, so
+	// return the token now.
+	if jobDone(job) {
 		return
 	}
-	l.tryReturnToken()
+	l.releaseAfterDelay(job.Labels[config.UUIDLabel])
 	l.logger.Debug("at end of OnDelete", zap.Int("tokens-available", len(l.tokenBucket)))
 }
 
-// trackJob is called by the k8s informer callbacks to update job state and
-// take/return tokens. It does the same thing for all three callbacks.
-func (l *MaxInFlight) trackJob(job *batchv1.Job) {
-	// If buildkite.com/job-uuid label is missing or malformed, don't track it.
-	if _, err := uuid.Parse(job.Labels[config.UUIDLabel]); err != nil {
+// releaseAfterDelay returns the job's token after ReturnDelay, or once it has
+// been held for MinHold if that is later, or straight away if there is no
+// delay or the informer's context is cancelled while waiting. The job counts
+// as in flight until then.
+func (l *MaxInFlight) releaseAfterDelay(uuid string) {
+	delay := l.ReturnDelay
+	if heldFor, ok := l.heldFor(uuid); ok && l.MinHold-heldFor > delay {
+		minHoldExtendedCounter.Inc()
+		delay = l.MinHold - heldFor
+	}
+	if delay <= 0 {
+		l.release(uuid)
 		return
 	}
+	l.setHeld(uuid, func(held *heldToken) { held.returning = true })
+	delayedReturnsGauge.Inc()
+	go func() {
+		defer delayedReturnsGauge.Dec()
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-l.done:
+		}
+		l.release(uuid)
+	}()
+}
 
+// isTracked reports whether the job has a valid buildkite.com/job-uuid label
+// and, if ControllerID is set, the controller ID label with its value. Jobs
+// without them weren't created by this controller, and aren't tracked.
+func (l *MaxInFlight) isTracked(job *batchv1.Job) bool {
+	if l.ControllerID != "" && job.Labels[config.ControllerIDLabel] != l.ControllerID {
+		return false
+	}
+	_, err := uuid.Parse(job.Labels[config.UUIDLabel])
+	return err == nil
+}
+
+// jobDone reports whether the job will not run any more pods. This is the
+// case when the job is finished, but also when its pod has failed (e.g. it was
+// evicted, or its node was deleted) and the Job controller hasn't yet marked
+// the job as finished. Scheduled jobs have a backoff limit of 0, so a failed
+// pod is never retried. It reports false for nil jobs.
+func jobDone(job *batchv1.Job) bool {
+	if job == nil {
+		return false
+	}
 	if model.JobFinished(job) {
+		return true
+	}
+	for _, cond := range job.Status.Conditions {
+		if cond.Type == batchv1.JobFailureTarget && cond.Status == corev1.ConditionTrue {
+			return true
+		}
+	}
+	return job.Status.Failed > 0 && job.Status.Active == 0 && ptr.Deref(job.Status.Ready, 0) == 0
+}
+
+// IsInFlight reports whether the job with the given Buildkite job UUID is
+// currently holding a token.
+func (l *MaxInFlight) IsInFlight(uuid string) bool {
+	l.inFlightMu.Lock()
+	defer l.inFlightMu.Unlock()
+	_, ok := l.inFlight[uuid]
+	return ok
+}
+
+// AvailableTokens returns the number of tokens currently in the bucket.
+func (l *MaxInFlight) AvailableTokens() int {
+	return len(l.tokenBucket)
+}
+
+// CapacityAvailable returns a channel that receives a value when a token is
+// returned to the bucket while it was empty, i.e. when the limiter goes from
+// saturated to having a free token. Signals are coalesced: if nothing is
+// receiving, at most one is kept until something does, and further
+// transitions until then are dropped. So after receiving, check
+// AvailableTokens for the current state.
+func (l *MaxInFlight) CapacityAvailable() <-chan struct{} {
+	return l.capacityAvailable
+}
+
+// OldestInFlightAge returns how long the job that has held a token the longest
+// has held it, or 0 if no job holds a token.
+func (l *MaxInFlight) OldestInFlightAge() time.Duration {
+	l.inFlightMu.Lock()
+	defer l.inFlightMu.Unlock()
+	var oldest time.Time
+	for _, held := range l.inFlight {
+		if oldest.IsZero() || held.since.Before(oldest) {
+			oldest = held.since
+		}
+	}
+	if oldest.IsZero() {
+		return 0
+	}
+	return time.Since(oldest)
+}
+
+// hold records that the job (in the queue) has taken a token from the bucket
+// (and from the bucket for sub, if not the zero value). If the job already
+// holds a token, it returns the extra tokens and reports false.
+func (l *MaxInFlight) hold(uuid, queue string, sub subLimit) bool {
+	l.inFlightMu.Lock()
+	defer l.inFlightMu.Unlock()
+	if _, ok := l.inFlight[uuid]; ok {
 		l.tryReturnToken()
-	} else {
-		l.tryTakeToken()
+		l.returnSubToken(sub)
+		return false
+	}
+	l.inFlight[uuid] = heldToken{since: time.Now(), queue: queue, sub: sub}
+	return true
+}
+
+// holdOvercommitted records that the job is in flight without a token, since
+// the bucket was empty (but with a token from the bucket for sub, if not the
+// zero value). If the job already holds a token, it returns the token for sub
+// and reports false.
+func (l *MaxInFlight) holdOvercommitted(uuid, queue string, sub subLimit) bool {
+	l.inFlightMu.Lock()
+	defer l.inFlightMu.Unlock()
+	if _, ok := l.inFlight[uuid]; ok {
+		l.returnSubToken(sub)
+		return false
+	}
+	l.inFlight[uuid] = heldToken{since: time.Now(), queue: queue, sub: sub, overcommitted: true}
+	l.overcommit++
+	overcommitGauge.Set(float64(l.overcommit))
+	return true
+}
+
+// setHeld updates the job's held token with f, if the job holds one.
+func (l *MaxInFlight) setHeld(uuid string, f func(*heldToken)) {
+	l.inFlightMu.Lock()
+	defer l.inFlightMu.Unlock()
+	held, ok := l.inFlight[uuid]
+	if !ok {
+		return
+	}
+	f(&held)
+	l.inFlight[uuid] = held
+}
+
+// Overcommit returns the number of jobs in flight beyond MaxInFlight. This is
+// only positive after a restart with a lower limit than there were unfinished
+// jobs, until enough of them finish.
+func (l *MaxInFlight) Overcommit() int {
+	l.inFlightMu.Lock()
+	defer l.inFlightMu.Unlock()
+	return l.overcommit
+}
+
+// heldFor returns how long the job has held its token, and whether it holds
+// one.
+func (l *MaxInFlight) heldFor(uuid string) (time.Duration, bool) {
+	l.inFlightMu.Lock()
+	defer l.inFlightMu.Unlock()
+	held, ok := l.inFlight[uuid]
+	if !ok {
+		return 0, false
+	}
+	return time.Since(held.since), true
+}
+
+// release returns the job's tokens to the buckets, if it holds them. While
+// there is overcommit, the token pays off one job of it instead, so that the
+// bucket stays empty until the number of jobs in flight is below MaxInFlight.
+func (l *MaxInFlight) release(uuid string) {
+	l.inFlightMu.Lock()
+	defer l.inFlightMu.Unlock()
+	held, ok := l.inFlight[uuid]
+	if !ok {
+		return
+	}
+	delete(l.inFlight, uuid)
+	l.returnSubToken(held.sub)
+	if l.overcommit > 0 {
+		l.overcommit--
+		overcommitGauge.Set(float64(l.overcommit))
+		return
 	}
+	l.tryReturnToken()
 }
 
 // tryTakeToken takes a token from the bucket, if one is available. It does not
-// block.
-func (l *MaxInFlight) tryTakeToken() {
+// block. It reports whether it took a token.
+func (l *MaxInFlight) tryTakeToken() bool {
+	return tryTake(l.tokenBucket)
+}
+
+// tryReturnToken returns a token to the bucket, if not full. It does not block.
+// If the bucket was empty, it signals capacityAvailable.
+func (l *MaxInFlight) tryReturnToken() {
+	wasEmpty := len(l.tokenBucket) == 0
+	if tryReturn(l.tokenBucket) && wasEmpty {
+		select {
+		case l.capacityAvailable <- struct{}{}:
+		default:
+			// A signal is already pending.
+		}
+	}
+}
+
+// subBucket returns the tag limit rule's or queue's bucket, or nil for the
+// zero subLimit.
+func (l *MaxInFlight) subBucket(sub subLimit) chan struct{} {
+	if sub.rule != "" {
+		for _, rule := range l.tagRules {
+			if rule.name == sub.rule {
+				return rule.bucket
+			}
+		}
+		return nil
+	}
+	if sub.queue != "" {
+		return l.queueBuckets[sub.queue]
+	}
+	return nil
+}
+
+// returnSubToken returns a token to the tag limit rule's or queue's bucket, if
+// sub is not the zero value and the bucket is not full. It does not block.
+func (l *MaxInFlight) returnSubToken(sub subLimit) {
+	if bucket := l.subBucket(sub); bucket != nil {
+		tryReturn(bucket)
+		l.updateSubGauge(sub)
+	}
+}
+
+// updateSubGauge updates the available tokens gauge for the tag limit rule or
+// queue.
+func (l *MaxInFlight) updateSubGauge(sub subLimit) {
+	bucket := l.subBucket(sub)
+	switch {
+	case bucket == nil:
+	case sub.rule != "":
+		tagLimitTokensAvailableGauge.WithLabelValues(sub.rule).Set(float64(len(bucket)))
+	default:
+		queueTokensAvailableGauge.WithLabelValues(sub.queue).Set(float64(len(bucket)))
+	}
+}
+
+func tryTake(bucket chan struct{}) bool {
 	select {
-	case <-l.tokenBucket:
+	case <-bucket:
+		return true
 	default:
+		return false
 	}
 }
 
-// tryReturnToken returns a token to the bucket, if not full. It does not block.
-func (l *MaxInFlight) tryReturnToken() {
+func tryReturn(bucket chan struct{}) bool {
 	select {
-	case l.tokenBucket <- struct{}{}:
+	case bucket <- struct{}{}:
+		return true
 	default:
+		return false
 	}
 }
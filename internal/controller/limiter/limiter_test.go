@@ -2,16 +2,36 @@ package limiter_test
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/buildkite/agent-stack-k8s/v2/api"
+	"github.com/buildkite/agent-stack-k8s/v2/internal/controller/config"
 	"github.com/buildkite/agent-stack-k8s/v2/internal/controller/limiter"
+	"github.com/buildkite/agent-stack-k8s/v2/internal/controller/metrics"
 	"github.com/buildkite/agent-stack-k8s/v2/internal/controller/model"
 
+	"github.com/google/go-cmp/cmp"
 	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
 	"go.uber.org/zap/zaptest"
+	"go.uber.org/zap/zaptest/observer"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/utils/ptr"
 )
 
 func TestLimiter(t *testing.T) {
@@ -83,3 +103,1644 @@ func TestLimiter_SkipsCreateErrors(t *testing.T) {
 		t.Errorf("handler.errors = %d, want %d", got, want)
 	}
 }
+
+// jobRecorder records the job it is handed.
+type jobRecorder struct {
+	job model.Job
+}
+
+func (h *jobRecorder) Handle(_ context.Context, job model.Job) error {
+	h.job = job
+	return nil
+}
+
+func TestLimiter_SetsTokenAcquiredAt(t *testing.T) {
+	t.Parallel()
+
+	handler := &jobRecorder{}
+	l := limiter.New(zaptest.NewLogger(t), handler, 1)
+
+	before := time.Now()
+	if err := l.Handle(context.Background(), model.Job{CommandJob: &api.CommandJob{Uuid: uuid.New().String()}}); err != nil {
+		t.Fatalf("limiter.Handle(ctx, some-job) error = %v", err)
+	}
+	if got := handler.job.TokenAcquiredAt; got.Before(before) || got.After(time.Now()) {
+		t.Errorf("handled job's TokenAcquiredAt = %v, want between %v and now", got, before)
+	}
+}
+
+// interruptibleHandler blocks in its first Handle call until the context is
+// cancelled, as though the scheduler was interrupted while creating the
+// Kubernetes job. Subsequent calls succeed immediately.
+type interruptibleHandler struct {
+	entered chan struct{}
+	once    sync.Once
+}
+
+func (h *interruptibleHandler) Handle(ctx context.Context, _ model.Job) error {
+	first := false
+	h.once.Do(func() { first = true })
+	if !first {
+		return nil
+	}
+	close(h.entered)
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestLimiter_CancelDuringHandoff(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	handler := &interruptibleHandler{entered: make(chan struct{})}
+	l := limiter.New(zaptest.NewLogger(t), handler, 1)
+
+	// Cancel the first job's context while the next handler is handling it.
+	firstUUID := uuid.New().String()
+	handleCtx, cancelHandle := context.WithCancel(ctx)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- l.Handle(handleCtx, model.Job{CommandJob: &api.CommandJob{Uuid: firstUUID}})
+	}()
+	<-handler.entered
+	cancelHandle()
+
+	var interrupted *limiter.InterruptedError
+	if err := <-errCh; !errors.As(err, &interrupted) {
+		t.Fatalf("limiter.Handle(cancelled ctx, first-job) error = %v, want *limiter.InterruptedError", err)
+	}
+	if got, want := interrupted.UUID, firstUUID; got != want {
+		t.Errorf("InterruptedError.UUID = %q, want %q", got, want)
+	}
+	if !errors.Is(interrupted, context.Canceled) {
+		t.Errorf("errors.Is(%v, context.Canceled) = false, want true", interrupted)
+	}
+
+	// The Kubernetes job might exist, so the token should still be held.
+	waitCtx, cancelWait := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancelWait()
+	err := l.Handle(waitCtx, model.Job{CommandJob: &api.CommandJob{Uuid: uuid.New().String()}})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("limiter.Handle(ctx, second-job) error = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// Once the job is seen to finish, the token is returned.
+	l.OnUpdate(k8sJob(firstUUID, false), k8sJob(firstUUID, true))
+	if err := l.Handle(ctx, model.Job{CommandJob: &api.CommandJob{Uuid: uuid.New().String()}}); err != nil {
+		t.Errorf("limiter.Handle(ctx, third-job) = %v", err)
+	}
+}
+
+func TestLimiter_CountsJobsAddedByOthers(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	l := limiter.New(zaptest.NewLogger(t), &model.FakeScheduler{}, 2)
+
+	// A job is scheduled, and the informer sees its Kubernetes job. It
+	// already holds a token, so doesn't take another.
+	ours := uuid.New().String()
+	if err := l.Handle(ctx, model.Job{CommandJob: &api.CommandJob{Uuid: ours}}); err != nil {
+		t.Fatalf("limiter.Handle(ctx, ours) = %v", err)
+	}
+	l.OnAdd(k8sJob(ours, false), false)
+
+	// After the initial list, another controller (e.g. the other replica
+	// during a rolling update) creates a job, which takes the last token.
+	theirs := uuid.New().String()
+	l.OnAdd(k8sJob(theirs, false), false)
+	if !l.IsInFlight(theirs) {
+		t.Errorf("limiter.IsInFlight(theirs) = false, want true")
+	}
+	if got := l.AvailableTokens(); got != 0 {
+		t.Errorf("limiter.AvailableTokens() = %d, want 0", got)
+	}
+
+	// Finished jobs added by others don't take tokens.
+	l.OnUpdate(k8sJob(theirs, false), k8sJob(theirs, true))
+	l.OnAdd(k8sJob(uuid.New().String(), true), false)
+	if got := l.AvailableTokens(); got != 1 {
+		t.Errorf("limiter.AvailableTokens() = %d, want 1", got)
+	}
+}
+
+func TestLimiter_OnlyReturnsTokensOnFinish(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	l := limiter.New(zaptest.NewLogger(t), &model.FakeScheduler{}, 2)
+
+	// A job from a previous controller is still running.
+	running := uuid.New().String()
+	l.OnAdd(k8sJob(running, false), true)
+
+	// Another job is scheduled, and then updated a few times while running.
+	id := uuid.New().String()
+	if err := l.Handle(ctx, model.Job{CommandJob: &api.CommandJob{Uuid: id}}); err != nil {
+		t.Fatalf("limiter.Handle(ctx, job) = %v", err)
+	}
+	l.OnAdd(k8sJob(id, false), false)
+	for range 3 {
+		l.OnUpdate(k8sJob(id, false), k8sJob(id, false))
+	}
+
+	// The job finishes, and is updated again after finishing.
+	l.OnUpdate(k8sJob(id, false), k8sJob(id, true))
+	l.OnUpdate(k8sJob(id, true), k8sJob(id, true))
+	l.OnDelete(k8sJob(id, true))
+
+	// Exactly one token should be available.
+	if err := l.Handle(ctx, model.Job{CommandJob: &api.CommandJob{Uuid: uuid.New().String()}}); err != nil {
+		t.Fatalf("limiter.Handle(ctx, another-job) = %v", err)
+	}
+	waitCtx, cancelWait := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancelWait()
+	err := l.Handle(waitCtx, model.Job{CommandJob: &api.CommandJob{Uuid: uuid.New().String()}})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("limiter.Handle(ctx, yet-another-job) error = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestLimiter_CapacityAvailable(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	l := limiter.New(zaptest.NewLogger(t), &model.FakeScheduler{}, 2)
+	signalled := func() bool {
+		select {
+		case <-l.CapacityAvailable():
+			return true
+		default:
+			return false
+		}
+	}
+	// start takes a token for each of n new jobs.
+	start := func(n int) []string {
+		var ids []string
+		for range n {
+			id := uuid.New().String()
+			if err := l.Handle(ctx, model.Job{CommandJob: &api.CommandJob{Uuid: id}}); err != nil {
+				t.Fatalf("limiter.Handle(ctx, %s) = %v", id, err)
+			}
+			ids = append(ids, id)
+		}
+		return ids
+	}
+	finish := func(id string) {
+		l.OnUpdate(k8sJob(id, false), k8sJob(id, true))
+	}
+
+	ids := start(2)
+	if signalled() {
+		t.Error("CapacityAvailable() signalled before any token was returned")
+	}
+
+	// Returning a token to the empty bucket signals.
+	finish(ids[0])
+	if !signalled() {
+		t.Error("CapacityAvailable() not signalled after a token returned to the empty bucket")
+	}
+
+	// Returning a token to a bucket that isn't empty doesn't.
+	finish(ids[1])
+	if signalled() {
+		t.Error("CapacityAvailable() signalled after a token returned to a non-empty bucket")
+	}
+
+	// Signals are coalesced while nothing is receiving.
+	for range 2 {
+		ids := start(2)
+		finish(ids[0])
+		finish(ids[1])
+	}
+	if !signalled() {
+		t.Error("CapacityAvailable() not signalled after tokens returned to the empty bucket")
+	}
+	if signalled() {
+		t.Error("CapacityAvailable() signalled again, want signals coalesced")
+	}
+}
+
+func TestLimiter_IsInFlight(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	handler := &model.FakeScheduler{}
+	l := limiter.New(zaptest.NewLogger(t), handler, 3)
+
+	// A job from a previous controller is still running, and another is done.
+	running, finished := uuid.New().String(), uuid.New().String()
+	l.OnAdd(k8sJob(running, false), true)
+	l.OnAdd(k8sJob(finished, true), true)
+
+	// A job is scheduled, and another fails to schedule.
+	scheduled, failed := uuid.New().String(), uuid.New().String()
+	if err := l.Handle(ctx, model.Job{CommandJob: &api.CommandJob{Uuid: scheduled}}); err != nil {
+		t.Fatalf("limiter.Handle(ctx, scheduled) = %v", err)
+	}
+	handler.Err = errors.New("nope")
+	if err := l.Handle(ctx, model.Job{CommandJob: &api.CommandJob{Uuid: failed}}); err == nil {
+		t.Fatalf("limiter.Handle(ctx, failed) = %v, want an error", err)
+	}
+
+	for id, want := range map[string]bool{
+		running:   true,
+		finished:  false,
+		scheduled: true,
+		failed:    false,
+	} {
+		if got := l.IsInFlight(id); got != want {
+			t.Errorf("limiter.IsInFlight(%q) = %t, want %t", id, got, want)
+		}
+	}
+
+	// Handling a job that is already in flight doesn't take another token.
+	if err := l.Handle(ctx, model.Job{CommandJob: &api.CommandJob{Uuid: scheduled}}); !errors.Is(err, model.ErrDuplicateJob) {
+		t.Errorf("limiter.Handle(ctx, scheduled) = %v, want %v", err, model.ErrDuplicateJob)
+	}
+
+	// When the jobs finish, they no longer hold tokens.
+	l.OnUpdate(k8sJob(running, false), k8sJob(running, true))
+	l.OnDelete(k8sJob(scheduled, false))
+	for _, id := range []string{running, scheduled} {
+		if l.IsInFlight(id) {
+			t.Errorf("after finishing: limiter.IsInFlight(%q) = true, want false", id)
+		}
+	}
+}
+
+func TestLimiter_OldestInFlightAge(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	l := limiter.New(zaptest.NewLogger(t), &model.FakeScheduler{}, 2)
+	if got := l.OldestInFlightAge(); got != 0 {
+		t.Errorf("with nothing in flight: limiter.OldestInFlightAge() = %v, want 0", got)
+	}
+
+	oldest := uuid.New().String()
+	l.OnAdd(k8sJob(oldest, false), true)
+	time.Sleep(100 * time.Millisecond)
+	if err := l.Handle(ctx, model.Job{CommandJob: &api.CommandJob{Uuid: uuid.New().String()}}); err != nil {
+		t.Fatalf("limiter.Handle(ctx, job) = %v", err)
+	}
+	before := l.OldestInFlightAge()
+	if before < 100*time.Millisecond {
+		t.Errorf("limiter.OldestInFlightAge() = %v, want at least 100ms", before)
+	}
+
+	// Once the oldest job finishes, the age is that of the newer job.
+	l.OnUpdate(k8sJob(oldest, false), k8sJob(oldest, true))
+	if got := l.OldestInFlightAge(); got <= 0 || got >= before {
+		t.Errorf("after the oldest finished: limiter.OldestInFlightAge() = %v, want between 0 and %v", got, before)
+	}
+}
+
+func TestLimiter_ReturnsTokensForEvictedJobs(t *testing.T) {
+	t.Parallel()
+
+	// evicted returns a job whose only pod has failed, in the shapes seen
+	// before the Job controller adds the Failed condition.
+	tests := []struct {
+		name    string
+		evicted func(id string) *batchv1.Job
+	}{
+		{
+			name: "FailureTarget condition",
+			evicted: func(id string) *batchv1.Job {
+				job := k8sJob(id, false)
+				job.Status.Conditions = []batchv1.JobCondition{{
+					Type:   batchv1.JobFailureTarget,
+					Status: corev1.ConditionTrue,
+					Reason: "BackoffLimitExceeded",
+				}}
+				return job
+			},
+		},
+		{
+			name: "failed with no active pods",
+			evicted: func(id string) *batchv1.Job {
+				job := k8sJob(id, false)
+				job.Status.Failed = 1
+				job.Status.Active = 0
+				job.Status.Ready = ptr.To[int32](0)
+				return job
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			l := limiter.New(zaptest.NewLogger(t), &model.FakeScheduler{}, 1)
+
+			id := uuid.New().String()
+			if err := l.Handle(ctx, model.Job{CommandJob: &api.CommandJob{Uuid: id}}); err != nil {
+				t.Fatalf("limiter.Handle(ctx, job) = %v", err)
+			}
+			running := k8sJob(id, false)
+			running.Status.Active = 1
+			l.OnAdd(running, false)
+
+			// The pod is evicted. Later, the Job controller marks the job
+			// failed, and then the job is deleted.
+			l.OnUpdate(running, test.evicted(id))
+			if l.IsInFlight(id) {
+				t.Errorf("after eviction: limiter.IsInFlight(%q) = true, want false", id)
+			}
+			failed := test.evicted(id)
+			failed.Status.Conditions = append(failed.Status.Conditions, batchv1.JobCondition{
+				Type:   batchv1.JobFailed,
+				Status: corev1.ConditionTrue,
+			})
+			l.OnUpdate(test.evicted(id), failed)
+			l.OnDelete(failed)
+
+			// Exactly one token should be available.
+			if err := l.Handle(ctx, model.Job{CommandJob: &api.CommandJob{Uuid: uuid.New().String()}}); err != nil {
+				t.Fatalf("limiter.Handle(ctx, another-job) = %v", err)
+			}
+			waitCtx, cancelWait := context.WithTimeout(ctx, 50*time.Millisecond)
+			defer cancelWait()
+			err := l.Handle(waitCtx, model.Job{CommandJob: &api.CommandJob{Uuid: uuid.New().String()}})
+			if !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("limiter.Handle(ctx, yet-another-job) error = %v, want %v", err, context.DeadlineExceeded)
+			}
+		})
+	}
+}
+
+func TestLimiter_ReturnsTokensForTombstones(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	l := limiter.New(zaptest.NewLogger(t), &model.FakeScheduler{}, 1)
+
+	id := uuid.New().String()
+	if err := l.Handle(ctx, model.Job{CommandJob: &api.CommandJob{Uuid: id}}); err != nil {
+		t.Fatalf("limiter.Handle(ctx, job) = %v", err)
+	}
+
+	// The informer missed the job finishing and being deleted. The tombstone
+	// may contain any prior state of the job, even one that looks finished.
+	// Delivering it twice must not return two tokens.
+	tombstone := cache.DeletedFinalStateUnknown{Key: "buildkite/" + id, Obj: k8sJob(id, true)}
+	l.OnDelete(tombstone)
+	l.OnDelete(tombstone)
+	if l.IsInFlight(id) {
+		t.Errorf("after tombstone: limiter.IsInFlight(%q) = true, want false", id)
+	}
+
+	// Exactly one token should be available.
+	if err := l.Handle(ctx, model.Job{CommandJob: &api.CommandJob{Uuid: uuid.New().String()}}); err != nil {
+		t.Fatalf("limiter.Handle(ctx, another-job) = %v", err)
+	}
+	waitCtx, cancelWait := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancelWait()
+	err := l.Handle(waitCtx, model.Job{CommandJob: &api.CommandJob{Uuid: uuid.New().String()}})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("limiter.Handle(ctx, yet-another-job) error = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestLimiter_QueueLimits(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	l := limiter.New(zaptest.NewLogger(t), &model.FakeScheduler{}, 3)
+	l.SetQueueLimits(map[string]int{"limited": 1})
+
+	queueJob := func(queue string) model.Job {
+		return model.Job{CommandJob: &api.CommandJob{
+			Uuid:         uuid.New().String(),
+			ClusterQueue: &api.CommandJobClusterQueue{Uuid: queue},
+		}}
+	}
+	wantBlocked := func(job model.Job) {
+		t.Helper()
+		waitCtx, cancelWait := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer cancelWait()
+		if err := l.Handle(waitCtx, job); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("limiter.Handle(ctx, job) error = %v, want %v", err, context.DeadlineExceeded)
+		}
+	}
+
+	// A job from a previous controller is still running in the limited queue.
+	running := k8sJob(uuid.New().String(), false)
+	running.Labels[config.ClusterQueueUUIDLabel] = "limited"
+	l.OnAdd(running, true)
+
+	// So another job in the limited queue has to wait...
+	wantBlocked(queueJob("limited"))
+
+	// ...but jobs in other queues don't, up to the overall limit.
+	for _, queue := range []string{"unlimited", ""} {
+		if err := l.Handle(ctx, queueJob(queue)); err != nil {
+			t.Fatalf("limiter.Handle(ctx, %q-job) = %v", queue, err)
+		}
+	}
+	wantBlocked(queueJob("unlimited"))
+
+	// Once the running job finishes, a limited queue job can run, and the
+	// blocked jobs didn't leave behind tokens.
+	l.OnUpdate(running, k8sJob(running.Labels[config.UUIDLabel], true))
+	if err := l.Handle(ctx, queueJob("limited")); err != nil {
+		t.Fatalf("limiter.Handle(ctx, limited-job) = %v", err)
+	}
+	wantBlocked(queueJob("limited"))
+}
+
+func TestLimiter_ControllerID(t *testing.T) {
+	t.Parallel()
+
+	l := limiter.New(zaptest.NewLogger(t), &model.FakeScheduler{}, 3)
+	l.ControllerID = "ours"
+
+	labelled := func(id, controllerID string, finished bool) *batchv1.Job {
+		job := k8sJob(id, finished)
+		if controllerID != "" {
+			job.Labels[config.ControllerIDLabel] = controllerID
+		}
+		return job
+	}
+
+	// Jobs of this controller, another controller, and one without the label
+	// are all running.
+	owned, foreign, unlabelled := uuid.New().String(), uuid.New().String(), uuid.New().String()
+	l.OnAdd(labelled(owned, "ours", false), true)
+	l.OnAdd(labelled(foreign, "theirs", false), true)
+	l.OnAdd(labelled(unlabelled, "", false), true)
+
+	if got, want := l.AvailableTokens(), 2; got != want {
+		t.Errorf("l.AvailableTokens() = %d, want %d", got, want)
+	}
+	for id, want := range map[string]bool{
+		owned:      true,
+		foreign:    false,
+		unlabelled: false,
+	} {
+		if got := l.IsInFlight(id); got != want {
+			t.Errorf("l.IsInFlight(%q) = %t, want %t", id, got, want)
+		}
+	}
+
+	// Foreign jobs finishing or being deleted don't return tokens.
+	l.OnUpdate(labelled(foreign, "theirs", false), labelled(foreign, "theirs", true))
+	l.OnDelete(labelled(unlabelled, "", false))
+	if got, want := l.AvailableTokens(), 2; got != want {
+		t.Errorf("after foreign jobs finish: l.AvailableTokens() = %d, want %d", got, want)
+	}
+
+	// The owned job finishing does.
+	l.OnUpdate(labelled(owned, "ours", false), labelled(owned, "ours", true))
+	if got, want := l.AvailableTokens(), 3; got != want {
+		t.Errorf("after owned job finishes: l.AvailableTokens() = %d, want %d", got, want)
+	}
+}
+
+func k8sJob(id string, finished bool) *batchv1.Job {
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Labels: map[string]string{config.UUIDLabel: id},
+		},
+	}
+	if finished {
+		job.Status.Conditions = []batchv1.JobCondition{{Type: batchv1.JobComplete}}
+	}
+	return job
+}
+
+// deleting returns a copy of the job that has been marked for deletion, but
+// is held back by a finalizer.
+func deleting(job *batchv1.Job) *batchv1.Job {
+	job = job.DeepCopy()
+	job.DeletionTimestamp = &metav1.Time{Time: time.Now()}
+	job.Finalizers = []string{"example.com/archive-logs"}
+	return job
+}
+
+func TestLimiter_FinalizerDelaysDeletion(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	l := limiter.New(zaptest.NewLogger(t), &jobRecorder{}, 2)
+	if err := l.RegisterInformer(ctx, informers.NewSharedInformerFactory(fake.NewClientset(), 0)); err != nil {
+		t.Fatalf("l.RegisterInformer(ctx, factory) error = %v", err)
+	}
+
+	finished, unfinished := uuid.New().String(), uuid.New().String()
+	for _, id := range []string{finished, unfinished} {
+		if err := l.Handle(ctx, model.Job{CommandJob: &api.CommandJob{Uuid: id}}); err != nil {
+			t.Fatalf("limiter.Handle(ctx, %s) = %v", id, err)
+		}
+	}
+
+	// A job that finishes returns its token straight away, even though a
+	// finalizer keeps it around after it is deleted. Being marked for
+	// deletion and finally removed don't return it again.
+	l.OnUpdate(k8sJob(finished, false), k8sJob(finished, true))
+	if l.IsInFlight(finished) {
+		t.Errorf("l.IsInFlight(finished) = true after finishing, want false")
+	}
+	l.OnUpdate(k8sJob(finished, true), deleting(k8sJob(finished, true)))
+	l.OnDelete(deleting(k8sJob(finished, true)))
+	if got, want := l.AvailableTokens(), 1; got != want {
+		t.Errorf("after finished job removed: l.AvailableTokens() = %d, want %d", got, want)
+	}
+
+	// A job marked for deletion while unfinished keeps its token until it
+	// finishes, not until the finalizer is removed.
+	l.OnUpdate(k8sJob(unfinished, false), deleting(k8sJob(unfinished, false)))
+	if !l.IsInFlight(unfinished) {
+		t.Errorf("l.IsInFlight(unfinished) = false after being marked for deletion, want true")
+	}
+	l.OnUpdate(deleting(k8sJob(unfinished, false)), deleting(k8sJob(unfinished, true)))
+	if l.IsInFlight(unfinished) {
+		t.Errorf("l.IsInFlight(unfinished) = true after finishing, want false")
+	}
+	l.OnDelete(deleting(k8sJob(unfinished, true)))
+	if got, want := l.AvailableTokens(), 2; got != want {
+		t.Errorf("after both jobs removed: l.AvailableTokens() = %d, want %d", got, want)
+	}
+}
+
+func TestLimiter_QueueLimitsWithinOverallLimit(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The queue limits add up to more than the overall limit.
+	l := limiter.New(zaptest.NewLogger(t), &model.FakeScheduler{}, 2)
+	l.SetQueueLimits(map[string]int{"a": 2, "b": 2})
+
+	queueJob := func(queue string) model.Job {
+		return model.Job{CommandJob: &api.CommandJob{
+			Uuid:         uuid.New().String(),
+			ClusterQueue: &api.CommandJobClusterQueue{Uuid: queue},
+		}}
+	}
+	for _, queue := range []string{"a", "b"} {
+		if err := l.Handle(ctx, queueJob(queue)); err != nil {
+			t.Fatalf("limiter.Handle(ctx, %s-job) = %v", queue, err)
+		}
+	}
+
+	// Both queues have room, but the overall limit is reached.
+	for _, queue := range []string{"a", "b"} {
+		waitCtx, cancelWait := context.WithTimeout(ctx, 50*time.Millisecond)
+		err := l.Handle(waitCtx, queueJob(queue))
+		cancelWait()
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("limiter.Handle(ctx, %s-job) error = %v, want %v", queue, err, context.DeadlineExceeded)
+		}
+	}
+	if got := l.AvailableTokens(); got != 0 {
+		t.Errorf("l.AvailableTokens() = %d, want 0", got)
+	}
+}
+
+func TestLimiter_TagLimits(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	l := limiter.New(zaptest.NewLogger(t), &model.FakeScheduler{}, 10)
+	l.SetQueueLimits(map[string]int{"q": 1})
+	l.SetTagLimits(config.TagLimits{
+		{Name: "foo-main", Tags: []string{"pipeline=foo", "branch=main"}, Limit: 1},
+		{Name: "foo", Tags: []string{"pipeline=foo"}, Limit: 2},
+	})
+
+	tagJob := func(tags ...string) model.Job {
+		return model.Job{CommandJob: &api.CommandJob{
+			Uuid:            uuid.New().String(),
+			AgentQueryRules: tags,
+			ClusterQueue:    &api.CommandJobClusterQueue{Uuid: "q"},
+		}}
+	}
+	blocked := func(job model.Job) bool {
+		t.Helper()
+		waitCtx, cancelWait := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer cancelWait()
+		err := l.Handle(waitCtx, job)
+		if err != nil && !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("limiter.Handle(ctx, %v) error = %v", job.AgentQueryRules, err)
+		}
+		return err != nil
+	}
+
+	// The first matching rule is used: foo-main for jobs with both tags.
+	mainJob := tagJob("pipeline=foo", "branch=main", "queue=kubernetes")
+	if blocked(mainJob) {
+		t.Errorf("first foo main job blocked, want scheduled")
+	}
+	if !blocked(tagJob("pipeline=foo", "branch=main")) {
+		t.Errorf("second foo main job scheduled, want blocked by foo-main")
+	}
+
+	// Other foo jobs use the foo rule, which replaces the queue limit.
+	for i := range 2 {
+		if blocked(tagJob("pipeline=foo", "branch=other")) {
+			t.Errorf("foo job %d blocked, want scheduled", i)
+		}
+	}
+	if !blocked(tagJob("pipeline=foo")) {
+		t.Errorf("third foo job scheduled, want blocked by foo")
+	}
+
+	// Jobs that match no rule use their queue's limit.
+	if blocked(tagJob("pipeline=bar")) {
+		t.Errorf("first bar job blocked, want scheduled")
+	}
+	if !blocked(tagJob("pipeline=bar")) {
+		t.Errorf("second bar job scheduled, want blocked by the queue limit")
+	}
+
+	// When a job finishes, its token goes back to its rule's bucket.
+	l.OnUpdate(k8sJob(mainJob.Uuid, false), k8sJob(mainJob.Uuid, true))
+	if blocked(tagJob("pipeline=foo", "branch=main")) {
+		t.Errorf("foo main job blocked after the first finished, want scheduled")
+	}
+}
+
+func TestLimiter_DrainQueue(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	handler := &model.FakeScheduler{}
+	l := limiter.New(zaptest.NewLogger(t), handler, 1)
+
+	queueJob := func(queue string) model.Job {
+		return model.Job{CommandJob: &api.CommandJob{
+			Uuid:         uuid.New().String(),
+			ClusterQueue: &api.CommandJobClusterQueue{Uuid: queue},
+		}}
+	}
+
+	l.DrainQueue("a")
+	if err := l.Handle(ctx, queueJob("a")); !errors.Is(err, model.ErrDraining) {
+		t.Errorf("limiter.Handle(ctx, a-job) = %v, want %v", err, model.ErrDraining)
+	}
+	if got := l.AvailableTokens(); got != 1 {
+		t.Errorf("after draining a: l.AvailableTokens() = %d, want 1", got)
+	}
+
+	// Other queues are unaffected.
+	bJob := queueJob("b")
+	if err := l.Handle(ctx, bJob); err != nil {
+		t.Fatalf("limiter.Handle(ctx, b-job) = %v", err)
+	}
+
+	// A job in a that is waiting for a token when a is drained gives it back.
+	l.ResumeQueue("a")
+	errCh := make(chan error)
+	go func() { errCh <- l.Handle(ctx, queueJob("a")) }()
+	l.DrainQueue("a")
+	l.OnUpdate(k8sJob(bJob.Uuid, false), k8sJob(bJob.Uuid, true))
+	if err := <-errCh; !errors.Is(err, model.ErrDraining) {
+		t.Errorf("limiter.Handle(ctx, waiting a-job) = %v, want %v", err, model.ErrDraining)
+	}
+	if got := l.AvailableTokens(); got != 1 {
+		t.Errorf("after waiting a-job: l.AvailableTokens() = %d, want 1", got)
+	}
+
+	// Once resumed, jobs in a are scheduled again.
+	l.ResumeQueue("a")
+	if l.IsQueueDraining("a") {
+		t.Error("l.IsQueueDraining(a) = true after resuming, want false")
+	}
+	if err := l.Handle(ctx, queueJob("a")); err != nil {
+		t.Errorf("limiter.Handle(ctx, a-job) after resuming = %v", err)
+	}
+	if got, want := len(handler.Running), 2; got != want {
+		t.Errorf("len(handler.Running) = %d, want %d", got, want)
+	}
+}
+
+func TestLimiter_RampUp(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	l := limiter.New(zaptest.NewLogger(t), &model.FakeScheduler{}, 4)
+	l.RampUp = 200 * time.Millisecond
+
+	// A job from a previous controller is still running, so keeps its token.
+	client := fake.NewClientset(k8sJob(uuid.New().String(), false))
+	start := time.Now()
+	if err := l.RegisterInformer(ctx, informers.NewSharedInformerFactory(client, 0)); err != nil {
+		t.Fatalf("l.RegisterInformer(ctx, factory) error = %v", err)
+	}
+	if got := l.AvailableTokens(); got > 1 {
+		t.Errorf("l.AvailableTokens() = %d straight after registering, want at most 1", got)
+	}
+
+	// The other 3 tokens become available over the ramp-up.
+	for l.AvailableTokens() < 3 {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("timed out waiting for the ramp-up to finish")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if elapsed := time.Since(start); elapsed < l.RampUp/2 {
+		t.Errorf("ramp-up finished after %v, want at least %v", elapsed, l.RampUp/2)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if got, want := l.AvailableTokens(), 3; got != want {
+		t.Errorf("l.AvailableTokens() = %d after the ramp-up, want %d", got, want)
+	}
+}
+
+func TestLimiter_ReturnDelay(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	l := limiter.New(zaptest.NewLogger(t), &jobRecorder{}, 2)
+	l.ReturnDelay = 100 * time.Millisecond
+	if err := l.RegisterInformer(ctx, informers.NewSharedInformerFactory(fake.NewClientset(), 0)); err != nil {
+		t.Fatalf("l.RegisterInformer(ctx, factory) error = %v", err)
+	}
+
+	first, second := uuid.New().String(), uuid.New().String()
+	for _, id := range []string{first, second} {
+		if err := l.Handle(ctx, model.Job{CommandJob: &api.CommandJob{Uuid: id}}); err != nil {
+			t.Fatalf("limiter.Handle(ctx, %s) = %v", id, err)
+		}
+	}
+
+	// The first job finishes, but its token isn't returned until the delay
+	// has passed.
+	finished := time.Now()
+	l.OnUpdate(k8sJob(first, false), k8sJob(first, true))
+	if !l.IsInFlight(first) {
+		t.Errorf("l.IsInFlight(first) = false straight after finishing, want true")
+	}
+	for l.IsInFlight(first) {
+		if time.Since(finished) > 5*time.Second {
+			t.Fatal("timed out waiting for the first job's token to be returned")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if elapsed := time.Since(finished); elapsed < l.ReturnDelay {
+		t.Errorf("first job's token returned after %v, want at least %v", elapsed, l.ReturnDelay)
+	}
+
+	// The second job finishes while the delay is long, and then the
+	// controller shuts down. The token is returned rather than lost.
+	l.ReturnDelay = time.Hour
+	l.OnUpdate(k8sJob(second, false), k8sJob(second, true))
+	cancel()
+	for start := time.Now(); l.IsInFlight(second); time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("timed out waiting for the second job's token to be returned on shutdown")
+		}
+	}
+	if got, want := l.AvailableTokens(), 2; got != want {
+		t.Errorf("l.AvailableTokens() = %d, want %d", got, want)
+	}
+}
+
+func TestLimiter_MinHold(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	l := limiter.New(zaptest.NewLogger(t), &jobRecorder{}, 2)
+	l.MinHold = 100 * time.Millisecond
+	if err := l.RegisterInformer(ctx, informers.NewSharedInformerFactory(fake.NewClientset(), 0)); err != nil {
+		t.Fatalf("l.RegisterInformer(ctx, factory) error = %v", err)
+	}
+
+	first, second := uuid.New().String(), uuid.New().String()
+	start := time.Now()
+	for _, id := range []string{first, second} {
+		if err := l.Handle(ctx, model.Job{CommandJob: &api.CommandJob{Uuid: id}}); err != nil {
+			t.Fatalf("limiter.Handle(ctx, %s) = %v", id, err)
+		}
+	}
+
+	// The first job fails straight away, but its token is held until
+	// MinHold has passed since it was taken.
+	l.OnUpdate(k8sJob(first, false), k8sJob(first, true))
+	if !l.IsInFlight(first) {
+		t.Errorf("l.IsInFlight(first) = false straight after finishing, want true")
+	}
+	for l.IsInFlight(first) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("timed out waiting for the first job's token to be returned")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if elapsed := time.Since(start); elapsed < l.MinHold {
+		t.Errorf("first job's token returned after %v, want at least %v", elapsed, l.MinHold)
+	}
+
+	// The second job has held its token for longer than MinHold by now, so
+	// its token is returned straight away.
+	l.OnUpdate(k8sJob(second, false), k8sJob(second, true))
+	if l.IsInFlight(second) {
+		t.Errorf("l.IsInFlight(second) = true after finishing, want false")
+	}
+
+	// A job that fails straight away while MinHold is long, and then the
+	// controller shuts down. The token is returned rather than lost.
+	l.MinHold = time.Hour
+	third := uuid.New().String()
+	if err := l.Handle(ctx, model.Job{CommandJob: &api.CommandJob{Uuid: third}}); err != nil {
+		t.Fatalf("limiter.Handle(ctx, %s) = %v", third, err)
+	}
+	l.OnUpdate(k8sJob(third, false), k8sJob(third, true))
+	cancel()
+	for start := time.Now(); l.IsInFlight(third); time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("timed out waiting for the third job's token to be returned on shutdown")
+		}
+	}
+	if got, want := l.AvailableTokens(), 2; got != want {
+		t.Errorf("l.AvailableTokens() = %d, want %d", got, want)
+	}
+}
+
+func TestLimiter_RestartWithLowerLimit(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// A previous controller with a higher limit left 4 unfinished jobs (and
+	// a finished one) running, but the limit is now 2.
+	var running []string
+	var objs []runtime.Object
+	for range 4 {
+		id := uuid.New().String()
+		running = append(running, id)
+		objs = append(objs, k8sJob(id, false))
+	}
+	objs = append(objs, k8sJob(uuid.New().String(), true))
+	for i, obj := range objs {
+		obj.(*batchv1.Job).Name = fmt.Sprintf("job-%d", i)
+	}
+
+	handler := &jobRecorder{}
+	l := limiter.New(zaptest.NewLogger(t), handler, 2)
+	if err := l.RegisterInformer(ctx, informers.NewSharedInformerFactory(fake.NewClientset(objs...), 0)); err != nil {
+		t.Fatalf("l.RegisterInformer(ctx, factory) error = %v", err)
+	}
+
+	if got, want := l.Overcommit(), 2; got != want {
+		t.Errorf("l.Overcommit() = %d, want %d", got, want)
+	}
+	if got, want := l.AvailableTokens(), 0; got != want {
+		t.Errorf("l.AvailableTokens() = %d, want %d", got, want)
+	}
+	for _, id := range running {
+		if !l.IsInFlight(id) {
+			t.Errorf("l.IsInFlight(%q) = false, want true", id)
+		}
+	}
+
+	// A new job has to wait, and becomes stale.
+	staleCh := make(chan struct{})
+	close(staleCh)
+	newJob := model.Job{CommandJob: &api.CommandJob{Uuid: uuid.New().String()}, StaleCh: staleCh}
+	if err := l.Handle(ctx, newJob); !errors.Is(err, model.ErrStaleJob) {
+		t.Errorf("l.Handle(ctx, newJob) = %v, want %v", err, model.ErrStaleJob)
+	}
+
+	// As the old jobs finish, the overcommit is paid off before any tokens
+	// are returned.
+	for i, want := range []struct{ overcommit, tokens int }{
+		{overcommit: 1, tokens: 0},
+		{overcommit: 0, tokens: 0},
+		{overcommit: 0, tokens: 1},
+		{overcommit: 0, tokens: 2},
+	} {
+		l.OnUpdate(k8sJob(running[i], false), k8sJob(running[i], true))
+		if got := l.Overcommit(); got != want.overcommit {
+			t.Errorf("after %d jobs finish: l.Overcommit() = %d, want %d", i+1, got, want.overcommit)
+		}
+		if got := l.AvailableTokens(); got != want.tokens {
+			t.Errorf("after %d jobs finish: l.AvailableTokens() = %d, want %d", i+1, got, want.tokens)
+		}
+	}
+
+	// Now the new job can be handled.
+	newJob.StaleCh = nil
+	if err := l.Handle(ctx, newJob); err != nil {
+		t.Errorf("l.Handle(ctx, newJob) = %v", err)
+	}
+}
+
+func TestLimiter_InFlightJobs(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	handler := &model.FakeScheduler{}
+	l := limiter.New(zaptest.NewLogger(t), handler, 3)
+
+	// A job from a previous controller is still running.
+	running := uuid.New().String()
+	job := k8sJob(running, false)
+	job.Labels[config.QueueTagLabel] = "old"
+	l.OnAdd(job, true)
+
+	// A job is scheduled after it.
+	time.Sleep(10 * time.Millisecond)
+	scheduled := uuid.New().String()
+	if err := l.Handle(ctx, model.Job{CommandJob: &api.CommandJob{
+		Uuid:            scheduled,
+		AgentQueryRules: []string{"queue=new"},
+	}}); err != nil {
+		t.Fatalf("limiter.Handle(ctx, scheduled) = %v", err)
+	}
+
+	jobs := l.InFlightJobs()
+	if len(jobs) != 2 {
+		t.Fatalf("len(l.InFlightJobs()) = %d, want 2", len(jobs))
+	}
+	for i, want := range []struct{ uuid, queue string }{
+		{uuid: running, queue: "old"},
+		{uuid: scheduled, queue: "new"},
+	} {
+		if jobs[i].UUID != want.uuid || jobs[i].Queue != want.queue {
+			t.Errorf("l.InFlightJobs()[%d] = {UUID: %q, Queue: %q}, want {UUID: %q, Queue: %q}", i, jobs[i].UUID, jobs[i].Queue, want.uuid, want.queue)
+		}
+	}
+	if jobs[0].HeldFor < 10*time.Millisecond {
+		t.Errorf("l.InFlightJobs()[0].HeldFor = %v, want at least 10ms", jobs[0].HeldFor)
+	}
+
+	// The handler serves the same jobs as JSON.
+	rec := httptest.NewRecorder()
+	l.InFlightHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/inflight", nil))
+	var served []struct {
+		UUID           string  `json:"uuid"`
+		Queue          string  `json:"queue"`
+		HeldForSeconds float64 `json:"held_for_seconds"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &served); err != nil {
+		t.Fatalf("json.Unmarshal(/debug/inflight body) error = %v", err)
+	}
+	if len(served) != 2 || served[0].UUID != running || served[0].Queue != "old" || served[0].HeldForSeconds <= 0 {
+		t.Errorf("/debug/inflight = %s, want %s first with a positive held_for_seconds", rec.Body.String(), running)
+	}
+
+	// Finished jobs are no longer listed.
+	l.OnUpdate(k8sJob(running, false), k8sJob(running, true))
+	if jobs := l.InFlightJobs(); len(jobs) != 1 || jobs[0].UUID != scheduled {
+		t.Errorf("after finishing: l.InFlightJobs() = %v, want only %s", jobs, scheduled)
+	}
+}
+
+func TestLimiter_HoldSweep(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// A job from a previous controller is still running.
+	running := uuid.New().String()
+	job := k8sJob(running, false)
+	job.Name = "running"
+
+	core, logs := observer.New(zap.WarnLevel)
+	l := limiter.New(zap.New(core), &model.FakeScheduler{}, 2)
+	l.HoldWarnAfter = 20 * time.Millisecond
+	l.SweepInterval = 5 * time.Millisecond
+	l.SweepJitter = 0.5
+	if err := l.RegisterInformer(ctx, informers.NewSharedInformerFactory(fake.NewClientset(job), 0)); err != nil {
+		t.Fatalf("l.RegisterInformer(ctx, factory) error = %v", err)
+	}
+
+	stuckLogs := func() []observer.LoggedEntry {
+		return logs.FilterMessageSnippet("held its token").AllUntimed()
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(stuckLogs()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	// Let several more sweeps run: the job is only reported once.
+	time.Sleep(50 * time.Millisecond)
+	entries := stuckLogs()
+	if len(entries) != 1 {
+		t.Fatalf("stuck job warnings = %d, want 1", len(entries))
+	}
+	if got := entries[0].ContextMap()["uuid"]; got != running {
+		t.Errorf("stuck job warning uuid = %v, want %q", got, running)
+	}
+}
+
+// BenchmarkLimiter_HandleDuringSweep measures Handle's latency while many
+// jobs hold tokens, with and without a sweep running as often as it can.
+func BenchmarkLimiter_HandleDuringSweep(b *testing.B) {
+	const held = 5000
+	for _, bench := range []struct {
+		name          string
+		holdWarnAfter time.Duration
+	}{
+		{name: "no sweep"},
+		{name: "sweep", holdWarnAfter: time.Nanosecond},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			l := limiter.New(zap.NewNop(), &model.FakeScheduler{}, held+1000)
+			l.HoldWarnAfter = bench.holdWarnAfter
+			l.SweepInterval = time.Millisecond
+			if err := l.RegisterInformer(ctx, informers.NewSharedInformerFactory(fake.NewClientset(), 0)); err != nil {
+				b.Fatalf("l.RegisterInformer(ctx, factory) error = %v", err)
+			}
+			for range held {
+				l.OnAdd(k8sJob(uuid.New().String(), false), true)
+			}
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					id := uuid.New().String()
+					if err := l.Handle(ctx, model.Job{CommandJob: &api.CommandJob{Uuid: id}}); err != nil {
+						b.Errorf("l.Handle(ctx, job) = %v", err)
+						return
+					}
+					l.OnDelete(k8sJob(id, false))
+				}
+			})
+		})
+	}
+}
+
+// registerMetrics registers the metrics with a registry, the first time it's
+// called, since metrics.Register only has an effect once. Tests using it
+// shouldn't be parallel, so that other tests don't change the metrics.
+var registerMetrics = sync.OnceValues(func() (*prometheus.Registry, error) {
+	reg := prometheus.NewRegistry()
+	return reg, metrics.Register(reg, nil)
+})
+
+func metricsRegistry(t *testing.T) *prometheus.Registry {
+	t.Helper()
+	reg, err := registerMetrics()
+	if err != nil {
+		t.Fatalf("metrics.Register(reg, nil) = %v", err)
+	}
+	return reg
+}
+
+func TestLimiter_TokenWaitPriorityLabel(t *testing.T) {
+	reg := metricsRegistry(t)
+	countByPriority := func() map[string]uint64 {
+		families, err := reg.Gather()
+		if err != nil {
+			t.Fatalf("reg.Gather() error = %v", err)
+		}
+		got := make(map[string]uint64)
+		for _, mf := range families {
+			if mf.GetName() != "limiter_token_wait_duration_seconds" {
+				continue
+			}
+			for _, m := range mf.GetMetric() {
+				for _, lp := range m.GetLabel() {
+					if lp.GetName() == "priority" {
+						got[lp.GetValue()] += m.GetHistogram().GetSampleCount()
+					}
+				}
+			}
+		}
+		return got
+	}
+	before := countByPriority()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	handler := &model.FakeScheduler{MaxRunning: 3}
+	limiter := limiter.New(zaptest.NewLogger(t), handler, 3)
+	handler.EventHandler = limiter
+
+	for _, priority := range []int{5, 0, -1} {
+		job := model.Job{CommandJob: &api.CommandJob{
+			Uuid:     uuid.New().String(),
+			Priority: api.CommandJobPriority{Number: priority},
+		}}
+		if err := limiter.Handle(ctx, job); err != nil {
+			t.Fatalf("limiter.Handle(ctx, job) = %v", err)
+		}
+	}
+	handler.Wait()
+
+	got := countByPriority()
+	for priority, n := range before {
+		got[priority] -= n
+	}
+	want := map[string]uint64{"high": 1, "normal": 1, "low": 1}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("token wait observations by priority diff (-want +got):\n%s", diff)
+	}
+}
+
+// waitForGauges waits for the gauges in reg to have the values in want.
+// Gauges that aren't registered count as 0.
+func waitForGauges(t *testing.T, reg *prometheus.Registry, want map[string]float64) {
+	t.Helper()
+	gauges := func() map[string]float64 {
+		families, err := reg.Gather()
+		if err != nil {
+			t.Fatalf("reg.Gather() error = %v", err)
+		}
+		got := make(map[string]float64)
+		for name := range want {
+			got[name] = 0
+		}
+		for _, mf := range families {
+			if _, ok := got[mf.GetName()]; ok {
+				got[mf.GetName()] = mf.GetMetric()[0].GetGauge().GetValue()
+			}
+		}
+		return got
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		diff := cmp.Diff(want, gauges())
+		if diff == "" {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("gauges diff (-want +got):\n%s", diff)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestLimiter_BlockedOnTokenAndInHandlerGauges(t *testing.T) {
+	reg := metricsRegistry(t)
+	waitFor := func(want map[string]float64) {
+		t.Helper()
+		waitForGauges(t, reg, want)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	handler := &blockingHandler{started: make(chan struct{}), release: make(chan struct{})}
+	l := limiter.New(zaptest.NewLogger(t), handler, 1)
+
+	// The first job takes the only token and waits in the next handler.
+	firstErr := make(chan error, 1)
+	go func() {
+		firstErr <- l.Handle(ctx, model.Job{CommandJob: &api.CommandJob{Uuid: uuid.NewString()}})
+	}()
+	<-handler.started
+
+	// The second job waits for the token.
+	waitCtx, cancelWait := context.WithCancel(ctx)
+	defer cancelWait()
+	secondErr := make(chan error, 1)
+	go func() {
+		secondErr <- l.Handle(waitCtx, model.Job{CommandJob: &api.CommandJob{Uuid: uuid.NewString()}})
+	}()
+	waitFor(map[string]float64{"limiter_blocked_on_token": 1, "limiter_waiters": 1, "limiter_in_handler": 1})
+
+	close(handler.release)
+	if err := <-firstErr; err != nil {
+		t.Fatalf("l.Handle(ctx, first) = %v", err)
+	}
+	waitFor(map[string]float64{"limiter_blocked_on_token": 1, "limiter_waiters": 1, "limiter_in_handler": 0})
+
+	cancelWait()
+	if err := <-secondErr; !errors.Is(err, context.Canceled) {
+		t.Fatalf("l.Handle(waitCtx, second) = %v, want %v", err, context.Canceled)
+	}
+	waitFor(map[string]float64{"limiter_blocked_on_token": 0, "limiter_waiters": 0, "limiter_in_handler": 0})
+}
+
+func TestLimiter_SoftModeNotBlockedOnToken(t *testing.T) {
+	reg := metricsRegistry(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	handler := &heldHandler{started: make(chan struct{}, 2), release: make(chan struct{})}
+	l := limiter.New(zaptest.NewLogger(t), handler, 1)
+	l.Mode = limiter.ModeSoft
+
+	// Both jobs are passed on straight away, the second without a token, so
+	// neither is blocked on a token.
+	errs := make(chan error, 2)
+	for range 2 {
+		go func() {
+			errs <- l.Handle(ctx, model.Job{CommandJob: &api.CommandJob{Uuid: uuid.NewString()}})
+		}()
+		<-handler.started
+	}
+	waitForGauges(t, reg, map[string]float64{"limiter_blocked_on_token": 0, "limiter_waiters": 0, "limiter_in_handler": 2})
+
+	close(handler.release)
+	for range 2 {
+		if err := <-errs; err != nil {
+			t.Errorf("l.Handle(ctx, job) = %v", err)
+		}
+	}
+}
+
+func TestLimiter_Reconcile(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	liveJob := func(id string, finished bool) *batchv1.Job {
+		job := k8sJob(id, finished)
+		job.Name = "buildkite-" + id
+		job.Namespace = "buildkite"
+		return job
+	}
+	running, missed, gone, done, leaked := uuid.NewString(), uuid.NewString(), uuid.NewString(), uuid.NewString(), uuid.NewString()
+
+	// The API server has running and missed (which the informer never saw),
+	// and done, which finished.
+	client := fake.NewClientset(liveJob(running, false), liveJob(missed, false), liveJob(done, true))
+
+	// The next handler "creates" jobs without creating Kubernetes jobs, like
+	// a job that the scheduler failed in Buildkite instead.
+	handler := &model.FakeScheduler{}
+	l := limiter.New(zaptest.NewLogger(t), handler, 5)
+	l.SetLiveClient(client, "buildkite", "")
+
+	// The informer's view: running and gone (which was deleted without the
+	// informer noticing) are running, and leaked was handled.
+	l.OnAdd(liveJob(running, false), true)
+	l.OnAdd(liveJob(gone, false), true)
+	if err := l.Handle(ctx, model.Job{CommandJob: &api.CommandJob{Uuid: leaked}}); err != nil {
+		t.Fatalf("l.Handle(ctx, leaked) = %v", err)
+	}
+	if got, want := l.AvailableTokens(), 2; got != want {
+		t.Fatalf("l.AvailableTokens() before Reconcile = %d, want %d", got, want)
+	}
+
+	corrected, err := l.Reconcile(ctx)
+	if err != nil {
+		t.Fatalf("l.Reconcile(ctx) error = %v", err)
+	}
+	if got, want := corrected, 3; got != want {
+		t.Errorf("l.Reconcile(ctx) = %d, want %d", got, want)
+	}
+	if got, want := l.AvailableTokens(), 3; got != want {
+		t.Errorf("l.AvailableTokens() after Reconcile = %d, want %d", got, want)
+	}
+	for _, test := range []struct {
+		name string
+		uuid string
+		want bool
+	}{
+		{name: "running", uuid: running, want: true},
+		{name: "missed", uuid: missed, want: true},
+		{name: "gone", uuid: gone, want: false},
+		{name: "done", uuid: done, want: false},
+		{name: "leaked", uuid: leaked, want: false},
+	} {
+		if got := l.IsInFlight(test.uuid); got != test.want {
+			t.Errorf("l.IsInFlight(%s) = %t, want %t", test.name, got, test.want)
+		}
+	}
+
+	// Once corrected, there is nothing more to do.
+	if corrected, err := l.Reconcile(ctx); err != nil || corrected != 0 {
+		t.Errorf("l.Reconcile(ctx) again = (%d, %v), want (0, nil)", corrected, err)
+	}
+}
+
+func TestLimiter_ReconcileSkipsJobsBeingCreated(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	handler := &blockingHandler{started: make(chan struct{}), release: make(chan struct{})}
+	l := limiter.New(zaptest.NewLogger(t), handler, 1)
+	l.SetLiveClient(fake.NewClientset(), "buildkite", "")
+
+	id := uuid.NewString()
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- l.Handle(ctx, model.Job{CommandJob: &api.CommandJob{Uuid: id}})
+	}()
+	<-handler.started
+
+	// The job holds a token, but its Kubernetes job isn't created yet.
+	if corrected, err := l.Reconcile(ctx); err != nil || corrected != 0 {
+		t.Errorf("l.Reconcile(ctx) = (%d, %v), want (0, nil)", corrected, err)
+	}
+	if !l.IsInFlight(id) {
+		t.Errorf("l.IsInFlight(id) = false while the job was being created, want true")
+	}
+	close(handler.release)
+	if err := <-errCh; err != nil {
+		t.Errorf("l.Handle(ctx, job) = %v", err)
+	}
+}
+
+func TestLimiter_ReconcileHandler(t *testing.T) {
+	t.Parallel()
+
+	l := limiter.New(zaptest.NewLogger(t), &model.FakeScheduler{}, 2)
+	l.SetLiveClient(fake.NewClientset(), "buildkite", "")
+	srv := httptest.NewServer(l.ReconcileHandler())
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("http.Get(srv.URL) error = %v", err)
+	}
+	resp.Body.Close()
+	if got, want := resp.StatusCode, http.StatusMethodNotAllowed; got != want {
+		t.Errorf("GET status = %d, want %d", got, want)
+	}
+
+	resp, err = http.Post(srv.URL, "", nil)
+	if err != nil {
+		t.Fatalf("http.Post(srv.URL) error = %v", err)
+	}
+	defer resp.Body.Close()
+	var got struct {
+		Corrected       int `json:"corrected"`
+		TokensAvailable int `json:"tokens_available"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+	if got.Corrected != 0 || got.TokensAvailable != 2 {
+		t.Errorf("POST response = %+v, want 0 corrected and 2 tokens available", got)
+	}
+}
+
+// blockingHandler signals started when Handle is called, then blocks until
+// release is closed.
+type blockingHandler struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (h *blockingHandler) Handle(ctx context.Context, _ model.Job) error {
+	close(h.started)
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-h.release:
+		return nil
+	}
+}
+
+// heldHandler is like blockingHandler, but can handle more than one job.
+// started must be buffered for the number of jobs.
+type heldHandler struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (h *heldHandler) Handle(ctx context.Context, _ model.Job) error {
+	h.started <- struct{}{}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-h.release:
+		return nil
+	}
+}
+
+func TestLimiter_GatedJobHoldsToken(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	id := uuid.NewString()
+	gated := k8sJob(id, false)
+	gated.Name = "buildkite-" + id
+	gated.Namespace = "buildkite"
+	gated.Spec.Template.Spec.SchedulingGates = []corev1.PodSchedulingGate{{Name: "example.com/quota-reservation"}}
+	gated.Status.Active = 1
+	gated.Status.Ready = ptr.To[int32](0)
+
+	client := fake.NewClientset(gated)
+	l := limiter.New(zaptest.NewLogger(t), &model.FakeScheduler{}, 1)
+	l.SetLiveClient(client, "buildkite", "")
+
+	if err := l.Handle(ctx, model.Job{CommandJob: &api.CommandJob{Uuid: id}}); err != nil {
+		t.Fatalf("l.Handle(ctx, gated) = %v", err)
+	}
+	l.OnAdd(gated, false)
+
+	// While the pod is gated, the job holds its token, so another job waits.
+	waitCtx, cancelWait := context.WithTimeout(ctx, 50*time.Millisecond)
+	err := l.Handle(waitCtx, model.Job{CommandJob: &api.CommandJob{Uuid: uuid.NewString()}})
+	cancelWait()
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("l.Handle(waitCtx, other) = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if !l.IsInFlight(id) {
+		t.Errorf("l.IsInFlight(gated) = false, want true")
+	}
+
+	// Reconciling doesn't take the gated job for done either.
+	if corrected, err := l.Reconcile(ctx); err != nil || corrected != 0 {
+		t.Errorf("l.Reconcile(ctx) = (%d, %v), want (0, nil)", corrected, err)
+	}
+
+	// Once the gate is removed, the pod runs, still holding the token.
+	ungated := gated.DeepCopy()
+	ungated.Spec.Template.Spec.SchedulingGates = nil
+	ungated.Status.Ready = ptr.To[int32](1)
+	l.OnUpdate(gated, ungated)
+	if !l.IsInFlight(id) {
+		t.Errorf("l.IsInFlight(ungated) = false, want true")
+	}
+
+	// The token is returned when the job finishes, as usual.
+	finished := ungated.DeepCopy()
+	finished.Status.Active = 0
+	finished.Status.Ready = ptr.To[int32](0)
+	finished.Status.Conditions = []batchv1.JobCondition{{Type: batchv1.JobComplete}}
+	l.OnUpdate(ungated, finished)
+	if l.IsInFlight(id) {
+		t.Errorf("l.IsInFlight(finished) = true, want false")
+	}
+	if got, want := l.AvailableTokens(), 1; got != want {
+		t.Errorf("l.AvailableTokens() = %d, want %d", got, want)
+	}
+}
+
+func TestLimiter_SoftLimit(t *testing.T) {
+	reg := metricsRegistry(t)
+	exceeded := func() float64 {
+		families, err := reg.Gather()
+		if err != nil {
+			t.Fatalf("reg.Gather() error = %v", err)
+		}
+		for _, mf := range families {
+			if mf.GetName() == "limiter_soft_limit_exceeded_total" {
+				return mf.GetMetric()[0].GetCounter().GetValue()
+			}
+		}
+		return 0
+	}
+	before := exceeded()
+
+	// Jobs beyond the limit would block forever with a hard limit.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	l := limiter.New(zaptest.NewLogger(t), &model.FakeScheduler{}, 2)
+	l.Mode = limiter.ModeSoft
+
+	ids := make([]string, 4)
+	for i := range ids {
+		ids[i] = uuid.NewString()
+		if err := l.Handle(ctx, model.Job{CommandJob: &api.CommandJob{Uuid: ids[i]}}); err != nil {
+			t.Fatalf("l.Handle(ctx, job %d) = %v", i, err)
+		}
+	}
+	if got, want := exceeded()-before, 2.0; got != want {
+		t.Errorf("limiter_soft_limit_exceeded_total increased by %v, want %v", got, want)
+	}
+	if got, want := l.Overcommit(), 2; got != want {
+		t.Errorf("l.Overcommit() = %d, want %d", got, want)
+	}
+
+	// Tokens are only returned to the bucket once the number of jobs in
+	// flight is below the limit again.
+	for i, id := range ids[:3] {
+		l.OnUpdate(k8sJob(id, false), k8sJob(id, true))
+		if got, want := l.AvailableTokens(), max(0, i-1); got != want {
+			t.Errorf("after %d jobs finished: l.AvailableTokens() = %d, want %d", i+1, got, want)
+		}
+	}
+	if got, want := l.Overcommit(), 0; got != want {
+		t.Errorf("l.Overcommit() = %d, want %d", got, want)
+	}
+}
+
+func TestLimiter_ReconcileOneAtATime(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Hold the first reconcile's list call until release is closed.
+	listing, release := make(chan struct{}), make(chan struct{})
+	client := fake.NewClientset()
+	client.PrependReactor("list", "jobs", func(k8stesting.Action) (bool, runtime.Object, error) {
+		close(listing)
+		<-release
+		return false, nil, nil
+	})
+	l := limiter.New(zaptest.NewLogger(t), &model.FakeScheduler{}, 1)
+	l.SetLiveClient(client, "buildkite", "")
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := l.Reconcile(ctx)
+		errCh <- err
+	}()
+	<-listing
+
+	if _, err := l.Reconcile(ctx); !errors.Is(err, limiter.ErrReconcileInProgress) {
+		t.Errorf("l.Reconcile(ctx) during another = %v, want %v", err, limiter.ErrReconcileInProgress)
+	}
+	srv := httptest.NewServer(l.ReconcileHandler())
+	defer srv.Close()
+	resp, err := http.Post(srv.URL, "", nil)
+	if err != nil {
+		t.Fatalf("http.Post(srv.URL) error = %v", err)
+	}
+	resp.Body.Close()
+	if got, want := resp.StatusCode, http.StatusConflict; got != want {
+		t.Errorf("POST during another reconcile: status = %d, want %d", got, want)
+	}
+
+	close(release)
+	if err := <-errCh; err != nil {
+		t.Errorf("first l.Reconcile(ctx) = %v", err)
+	}
+}
+
+func TestLimiter_RegisterMetrics(t *testing.T) {
+	reg := metricsRegistry(t)
+	gauge := func(name string) (float64, bool) {
+		t.Helper()
+		families, err := reg.Gather()
+		if err != nil {
+			t.Fatalf("reg.Gather() error = %v", err)
+		}
+		for _, mf := range families {
+			if mf.GetName() == name {
+				return mf.GetMetric()[0].GetGauge().GetValue(), true
+			}
+		}
+		return 0, false
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	registered := limiter.New(zaptest.NewLogger(t), &model.FakeScheduler{}, 3)
+	if err := registered.Handle(ctx, model.Job{CommandJob: &api.CommandJob{Uuid: uuid.NewString()}}); err != nil {
+		t.Fatalf("registered.Handle(ctx, job) = %v", err)
+	}
+	regCtx, unregister := context.WithCancel(ctx)
+	if err := registered.RegisterMetrics(regCtx); err != nil {
+		t.Fatalf("registered.RegisterMetrics(ctx) = %v", err)
+	}
+
+	// Creating another limiter (e.g. in another test) doesn't change what
+	// the gauges report on.
+	_ = limiter.New(zaptest.NewLogger(t), &model.FakeScheduler{}, 10)
+	if got, ok := gauge("limiter_tokens_available"); !ok || got != 2 {
+		t.Errorf("limiter_tokens_available = (%v, %t), want (2, true)", got, ok)
+	}
+
+	// The gauges go away with the limiter.
+	unregister()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, ok := gauge("limiter_tokens_available"); !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("limiter_tokens_available is still registered after ctx is done")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,175 @@
+package limiter
+
+import (
+	"context"
+
+	"github.com/buildkite/agent-stack-k8s/v2/internal/controller/metrics"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const promSubsystem = "limiter"
+
+var (
+	overcommitGauge = metrics.Factory.NewGauge(prometheus.GaugeOpts{
+		Subsystem: promSubsystem,
+		Name:      "overcommit",
+		Help:      "Number of unfinished jobs beyond max-in-flight, found when the limiter started (e.g. after a restart with a lower limit) or passed on with a soft limit; new jobs wait until it is 0 (unless the limit is soft)",
+	})
+
+	softLimitExceededCounter = metrics.Factory.NewCounter(prometheus.CounterOpts{
+		Subsystem: promSubsystem,
+		Name:      "soft_limit_exceeded_total",
+		Help:      "Number of jobs passed on beyond max-in-flight because the limiter mode is soft (they would have waited for a token with a hard limit)",
+	})
+
+	waitersGauge = metrics.Factory.NewGauge(prometheus.GaugeOpts{
+		Subsystem: promSubsystem,
+		Name:      "waiters",
+		Help:      "Number of calls to Handle currently waiting in a blocking select for a token, because the bucket was empty when they tried to take one",
+	})
+
+	blockedOnTokenGauge = metrics.Factory.NewGauge(prometheus.GaugeOpts{
+		Subsystem: promSubsystem,
+		Name:      "blocked_on_token",
+		Help:      "Number of calls to Handle currently blocked on an empty token bucket (max-in-flight, a queue limit or a tag limit). Jobs passed on over a soft limit never block",
+	})
+	inHandlerGauge = metrics.Factory.NewGauge(prometheus.GaugeOpts{
+		Subsystem: promSubsystem,
+		Name:      "in_handler",
+		Help:      "Number of calls to Handle that hold a token and are currently waiting for the next handler (i.e. the scheduler creating the Kubernetes job)",
+	})
+
+	queueLimitGauge = metrics.Factory.NewGaugeVec(prometheus.GaugeOpts{
+		Subsystem: promSubsystem,
+		Name:      "queue_limit",
+		Help:      "Configured limit on concurrent jobs for each cluster queue with a limit, by cluster queue UUID",
+	}, []string{"queue"})
+	queueTokensAvailableGauge = metrics.Factory.NewGaugeVec(prometheus.GaugeOpts{
+		Subsystem: promSubsystem,
+		Name:      "queue_tokens_available",
+		Help:      "Number of tokens available for each cluster queue with a limit, by cluster queue UUID (0 means the queue is saturated)",
+	}, []string{"queue"})
+	tagLimitGauge = metrics.Factory.NewGaugeVec(prometheus.GaugeOpts{
+		Subsystem: promSubsystem,
+		Name:      "tag_limit",
+		Help:      "Configured limit on concurrent jobs for each tag limit rule, by rule name",
+	}, []string{"rule"})
+	tagLimitTokensAvailableGauge = metrics.Factory.NewGaugeVec(prometheus.GaugeOpts{
+		Subsystem: promSubsystem,
+		Name:      "tag_limit_tokens_available",
+		Help:      "Number of tokens available for each tag limit rule, by rule name (0 means the rule is saturated)",
+	}, []string{"rule"})
+	tagLimitSaturatedCounter = metrics.Factory.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: promSubsystem,
+		Name:      "tag_limit_saturated_total",
+		Help:      "Count of jobs that had to wait for a token because their tag limit rule was saturated, by rule name",
+	}, []string{"rule"})
+	queueDrainingGauge = metrics.Factory.NewGaugeVec(prometheus.GaugeOpts{
+		Subsystem: promSubsystem,
+		Name:      "queue_draining",
+		Help:      "Whether each cluster queue that has been drained is draining (1) or has been resumed (0), by cluster queue UUID",
+	}, []string{"queue"})
+	globalCapBlockedCounter = metrics.Factory.NewCounter(prometheus.CounterOpts{
+		Subsystem: promSubsystem,
+		Name:      "global_cap_blocked_total",
+		Help:      "Count of jobs that had to wait for the overall max-in-flight limit after their cluster queue's or tag limit rule's limit allowed them",
+	})
+
+	tokenWaitDurationHistogram = metrics.NewDurationHistogramVec(prometheus.HistogramOpts{
+		Subsystem: promSubsystem,
+		Name:      "token_wait_duration_seconds",
+		Help:      "Time that calls to Handle waited to take a token, by queue (if the limiter's queue metrics are enabled, otherwise the queue is empty) and job priority (high, normal, or low)",
+	}, []string{"queue", "priority"})
+
+	nextHandlerDurationHistogram = metrics.NewDurationHistogramVec(prometheus.HistogramOpts{
+		Subsystem: promSubsystem,
+		Name:      "next_handler_duration_seconds",
+		Help:      "Time that the next handler (typically the scheduler) took to handle jobs that took a token, by result (success, error, or interrupted)",
+	}, []string{"result"})
+
+	rampCapacityGauge = metrics.Factory.NewGauge(prometheus.GaugeOpts{
+		Subsystem: promSubsystem,
+		Name:      "ramp_capacity",
+		Help:      "Number of tokens made available so far by the limiter's ramp-up after startup (including tokens of jobs already running)",
+	})
+	delayedReturnsGauge = metrics.Factory.NewGauge(prometheus.GaugeOpts{
+		Subsystem: promSubsystem,
+		Name:      "delayed_token_returns",
+		Help:      "Number of tokens of finished jobs waiting for the token return delay or minimum hold time before being returned",
+	})
+	minHoldExtendedCounter = metrics.Factory.NewCounter(prometheus.CounterOpts{
+		Subsystem: promSubsystem,
+		Name:      "min_hold_extended_total",
+		Help:      "Count of tokens held for longer than their job ran because the job finished before the minimum hold time",
+	})
+
+	doneUnfinishedJobsCounter = metrics.Factory.NewCounter(prometheus.CounterOpts{
+		Subsystem: promSubsystem,
+		Name:      "done_unfinished_jobs_total",
+		Help:      "Count of jobs whose tokens were returned because their pod failed (e.g. was evicted) before the job was marked finished",
+	})
+	tombstoneDeletesCounter = metrics.Factory.NewCounter(prometheus.CounterOpts{
+		Subsystem: promSubsystem,
+		Name:      "tombstone_deletes_total",
+		Help:      "Count of job deletions the informer reported as a DeletedFinalStateUnknown tombstone",
+	})
+	handleCallsCounter = metrics.Factory.NewCounter(prometheus.CounterOpts{
+		Subsystem: promSubsystem,
+		Name:      "handle_calls_total",
+		Help:      "Count of calls to the limiter's Handle",
+	})
+	handleSuccessCounter = metrics.Factory.NewCounter(prometheus.CounterOpts{
+		Subsystem: promSubsystem,
+		Name:      "handle_success_total",
+		Help:      "Count of calls to the limiter's Handle where the next handler succeeded",
+	})
+
+	sweepsCounter = metrics.Factory.NewCounter(prometheus.CounterOpts{
+		Subsystem: promSubsystem,
+		Name:      "hold_sweeps_total",
+		Help:      "Count of sweeps of the jobs holding tokens for those held longer than limiter-hold-warn-after",
+	})
+
+	heldTooLongGauge = metrics.Factory.NewGauge(prometheus.GaugeOpts{
+		Subsystem: promSubsystem,
+		Name:      "tokens_held_too_long",
+		Help:      "Number of jobs that had held their token for longer than limiter-hold-warn-after at the last sweep",
+	})
+	reconcilesCounter = metrics.Factory.NewCounter(prometheus.CounterOpts{
+		Subsystem: promSubsystem,
+		Name:      "reconciles_total",
+		Help:      "Count of reconciliations of the tokens with the jobs listed from the API server",
+	})
+	reconcileCorrectionsCounter = metrics.Factory.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: promSubsystem,
+		Name:      "reconcile_corrections_total",
+		Help:      "Count of jobs whose tokens were corrected by reconciliation with the API server, by correction (returned or taken)",
+	}, []string{"correction"})
+	reconcileCorrectedGauge = metrics.Factory.NewGauge(prometheus.GaugeOpts{
+		Subsystem: promSubsystem,
+		Name:      "reconcile_last_corrected",
+		Help:      "Number of jobs whose tokens were corrected by the last reconciliation with the API server",
+	})
+)
+
+// RegisterMetrics registers the gauges that report on the limiter's state
+// (see [metrics.RegisterInstance]) until ctx is done.
+func (l *MaxInFlight) RegisterMetrics(ctx context.Context) error {
+	return metrics.RegisterInstance(ctx,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Subsystem: promSubsystem,
+			Name:      "tokens_available",
+			Help:      "Number of tokens currently available in the limiter's token bucket",
+		}, func() float64 {
+			return float64(l.AvailableTokens())
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Subsystem: promSubsystem,
+			Name:      "oldest_inflight_age_seconds",
+			Help:      "How long the job that has held a token the longest has held it (0 if no job holds a token)",
+		}, func() float64 {
+			return l.OldestInFlightAge().Seconds()
+		}),
+	)
+}
@@ -0,0 +1,176 @@
+package limiter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/buildkite/agent-stack-k8s/v2/internal/controller/config"
+
+	"go.uber.org/zap"
+	batchv1 "k8s.io/api/batch/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// reconcilePageSize is the number of jobs in each page listed by Reconcile.
+const reconcilePageSize = 500
+
+// errNoLiveClient is returned by Reconcile if SetLiveClient wasn't called.
+var errNoLiveClient = errors.New("the limiter has no client to list jobs with")
+
+// ErrReconcileInProgress is returned by Reconcile if another call is still
+// running.
+var ErrReconcileInProgress = errors.New("a reconcile is already in progress")
+
+// SetLiveClient sets the client used by Reconcile to list Kubernetes jobs in
+// the namespace directly from the API server. labelSelector should select the
+// same jobs as the informer. It must be called before the limiter is used.
+func (l *MaxInFlight) SetLiveClient(client kubernetes.Interface, namespace, labelSelector string) {
+	l.liveClient = client
+	l.liveNamespace = namespace
+	l.liveSelector = labelSelector
+}
+
+// Reconcile lists the Kubernetes jobs directly from the API server, bypassing
+// the informer cache, and corrects the tokens to match, for when the informer
+// is suspected of having missed events. Tokens held by jobs that no longer
+// exist, or are done, are returned. Unfinished jobs that don't hold a token
+// take one (or count towards overcommit, if there is none left). It returns
+// the number of jobs corrected. Only one call runs at a time: others return
+// [ErrReconcileInProgress] straight away.
+//
+// Tokens taken by Handle are only returned if the next handler had finished
+// with the job before the list, so that jobs that are still being created are
+// left alone, as are tokens waiting for ReturnDelay or MinHold.
+func (l *MaxInFlight) Reconcile(ctx context.Context) (corrected int, err error) {
+	if l.liveClient == nil {
+		return 0, errNoLiveClient
+	}
+	if !l.reconcileMu.TryLock() {
+		return 0, ErrReconcileInProgress
+	}
+	defer l.reconcileMu.Unlock()
+	reconcilesCounter.Inc()
+
+	listedAt := time.Now()
+	live, err := l.listLiveJobs(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	// Jobs holding tokens that they shouldn't.
+	var stale []string
+	l.inFlightMu.Lock()
+	for uuid, held := range l.inFlight {
+		if held.createdAt.IsZero() || !held.createdAt.Before(listedAt) || held.returning {
+			continue
+		}
+		if job, ok := live[uuid]; ok && !jobDone(job) {
+			continue
+		}
+		stale = append(stale, uuid)
+	}
+	l.inFlightMu.Unlock()
+	for _, uuid := range stale {
+		l.logger.Warn("reconcile: returning token of a job that is done or gone",
+			zap.String("uuid", uuid),
+		)
+		l.release(uuid)
+		reconcileCorrectionsCounter.WithLabelValues("returned").Inc()
+		corrected++
+	}
+
+	// Unfinished jobs without tokens.
+	for uuid, job := range live {
+		if jobDone(job) || l.IsInFlight(uuid) {
+			continue
+		}
+		l.logger.Warn("reconcile: taking a token for an unfinished job without one",
+			zap.String("uuid", uuid),
+			zap.String("name", job.Name),
+		)
+		l.adopt(job)
+		reconcileCorrectionsCounter.WithLabelValues("taken").Inc()
+		corrected++
+
+		// The job may have finished since it was listed, and if the informer
+		// saw that before the token was taken, nothing else would return it.
+		// Any later change is seen by the informer as usual.
+		current, err := l.liveClient.BatchV1().Jobs(l.liveNamespace).Get(ctx, job.Name, metav1.GetOptions{})
+		switch {
+		case kerrors.IsNotFound(err), err == nil && jobDone(current):
+			l.release(uuid)
+		case err != nil:
+			l.logger.Warn("reconcile: couldn't check the job after taking a token for it",
+				zap.String("uuid", uuid),
+				zap.Error(err),
+			)
+		}
+	}
+
+	reconcileCorrectedGauge.Set(float64(corrected))
+	l.logger.Info("reconciled tokens with the jobs from the API server",
+		zap.Int("jobs", len(live)),
+		zap.Int("corrected", corrected),
+		zap.Int("tokens-available", len(l.tokenBucket)),
+	)
+	return corrected, nil
+}
+
+// listLiveJobs lists the tracked Kubernetes jobs from the API server, by
+// Buildkite job UUID.
+func (l *MaxInFlight) listLiveJobs(ctx context.Context) (map[string]*batchv1.Job, error) {
+	live := make(map[string]*batchv1.Job)
+	opts := metav1.ListOptions{LabelSelector: l.liveSelector, Limit: reconcilePageSize}
+	for {
+		list, err := l.liveClient.BatchV1().Jobs(l.liveNamespace).List(ctx, opts)
+		if err != nil {
+			return nil, fmt.Errorf("listing jobs: %w", err)
+		}
+		for i := range list.Items {
+			job := &list.Items[i]
+			if l.isTracked(job) {
+				live[job.Labels[config.UUIDLabel]] = job
+			}
+		}
+		if list.Continue == "" {
+			return live, nil
+		}
+		opts.Continue = list.Continue
+	}
+}
+
+// ReconcileHandler returns an HTTP handler that runs Reconcile on POST
+// requests, and responds with the number of jobs corrected as JSON, or 409
+// Conflict if a reconcile is already in progress.
+func (l *MaxInFlight) ReconcileHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "use POST to reconcile tokens", http.StatusMethodNotAllowed)
+			return
+		}
+		corrected, err := l.Reconcile(r.Context())
+		if errors.Is(err, ErrReconcileInProgress) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(struct {
+			Corrected       int `json:"corrected"`
+			TokensAvailable int `json:"tokens_available"`
+		}{corrected, l.AvailableTokens()})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
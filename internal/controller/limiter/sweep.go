@@ -0,0 +1,84 @@
+package limiter
+
+import (
+	"math/rand/v2"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// defaultSweepInterval is how often held tokens are swept if SweepInterval is
+// not set.
+const defaultSweepInterval = time.Minute
+
+// runSweep sweeps the held tokens every SweepInterval (with jitter) until the
+// informer's context is cancelled.
+func (l *MaxInFlight) runSweep() {
+	// Jobs already reported as holding their token too long, so that each is
+	// only logged once. Only used by this goroutine.
+	reported := make(map[string]bool)
+	for {
+		timer := time.NewTimer(l.sweepDelay())
+		select {
+		case <-l.done:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		l.sweep(reported)
+	}
+}
+
+// sweepDelay returns SweepInterval, randomly lengthened or shortened by up to
+// SweepJitter of it, so that replicas started together don't sweep in step.
+func (l *MaxInFlight) sweepDelay() time.Duration {
+	interval := l.SweepInterval
+	if interval <= 0 {
+		interval = defaultSweepInterval
+	}
+	if l.SweepJitter <= 0 {
+		return interval
+	}
+	jitter := l.SweepJitter * (2*rand.Float64() - 1)
+	return max(time.Duration(float64(interval)*(1+jitter)), time.Millisecond)
+}
+
+// sweep finds the jobs that have held their token for longer than
+// HoldWarnAfter, sets the gauge, and logs those not already in reported. The
+// tracking map is only locked while it is scanned, so logging doesn't hold up
+// Handle or the informer handlers.
+func (l *MaxInFlight) sweep(reported map[string]bool) {
+	type stuckJob struct {
+		uuid    string
+		heldFor time.Duration
+	}
+	var stuck []stuckJob
+	now := time.Now()
+	l.inFlightMu.Lock()
+	for uuid, held := range l.inFlight {
+		if heldFor := now.Sub(held.since); heldFor > l.HoldWarnAfter {
+			stuck = append(stuck, stuckJob{uuid: uuid, heldFor: heldFor})
+		}
+	}
+	l.inFlightMu.Unlock()
+
+	sweepsCounter.Inc()
+	heldTooLongGauge.Set(float64(len(stuck)))
+	stillStuck := make(map[string]bool, len(stuck))
+	for _, job := range stuck {
+		stillStuck[job.uuid] = true
+		if reported[job.uuid] {
+			continue
+		}
+		reported[job.uuid] = true
+		l.logger.Warn("job has held its token for a long time, its pod may be stuck or its end missed",
+			zap.String("uuid", job.uuid),
+			zap.Duration("held-for", job.heldFor),
+		)
+	}
+	for uuid := range reported {
+		if !stillStuck[uuid] {
+			delete(reported, uuid)
+		}
+	}
+}
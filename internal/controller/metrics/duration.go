@@ -0,0 +1,141 @@
+package metrics
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DefaultDurationBuckets are the classic bucket bounds of duration histograms,
+// unless SetDurationBuckets is called: 1ms to about 4 minutes, each 4 times
+// the last.
+var DefaultDurationBuckets = prometheus.ExponentialBuckets(0.001, 4, 10)
+
+// Limits on native histograms, so that a wide spread of observations can't use
+// unbounded memory.
+const (
+	nativeMaxBucketNumber  = 160
+	nativeMinResetDuration = time.Hour
+)
+
+var (
+	durationsMu sync.Mutex
+
+	// durationClassic and durationNativeFactor are the bucket config set
+	// by SetDurationBuckets.
+	durationClassic      = DefaultDurationBuckets
+	durationNativeFactor float64
+
+	// durations are the duration histograms, which are rebuilt by
+	// SetDurationBuckets.
+	durations []interface{ rebuild() }
+)
+
+// SetDurationBuckets sets the buckets of the duration histograms created by
+// NewDurationHistogram and NewDurationHistogramVec. classic are the upper
+// bounds of classic buckets; if nativeFactor is greater than 1, the
+// histograms also have native buckets with that growth factor. If classic is
+// empty and nativeFactor is not greater than 1, DefaultDurationBuckets are
+// used.
+//
+// It should be called before any durations are observed, since they are
+// discarded.
+func SetDurationBuckets(classic []float64, nativeFactor float64) {
+	durationsMu.Lock()
+	defer durationsMu.Unlock()
+	if len(classic) == 0 && nativeFactor <= 1 {
+		classic = DefaultDurationBuckets
+	}
+	durationClassic = classic
+	durationNativeFactor = nativeFactor
+	for _, d := range durations {
+		d.rebuild()
+	}
+}
+
+// durationOpts returns opts with the configured buckets. durationsMu must be
+// held.
+func durationOpts(opts prometheus.HistogramOpts) prometheus.HistogramOpts {
+	opts.Buckets = durationClassic
+	if durationNativeFactor > 1 {
+		opts.NativeHistogramBucketFactor = durationNativeFactor
+		opts.NativeHistogramMaxBucketNumber = nativeMaxBucketNumber
+		opts.NativeHistogramMinResetDuration = nativeMinResetDuration
+	}
+	return opts
+}
+
+// DurationHistogram is a histogram of durations in seconds, with the buckets
+// set by SetDurationBuckets.
+type DurationHistogram struct {
+	opts    prometheus.HistogramOpts
+	current atomic.Pointer[prometheus.Histogram]
+}
+
+// NewDurationHistogram creates a DurationHistogram that is registered by
+// Register, like the metrics created by Factory. opts.Buckets is ignored.
+func NewDurationHistogram(opts prometheus.HistogramOpts) *DurationHistogram {
+	durationsMu.Lock()
+	defer durationsMu.Unlock()
+	h := &DurationHistogram{opts: opts}
+	h.rebuild()
+	durations = append(durations, h)
+	pending.MustRegister(h)
+	return h
+}
+
+func (h *DurationHistogram) rebuild() {
+	hist := prometheus.NewHistogram(durationOpts(h.opts))
+	h.current.Store(&hist)
+}
+
+// Observe adds a duration in seconds.
+func (h *DurationHistogram) Observe(seconds float64) { (*h.current.Load()).Observe(seconds) }
+
+// ObserveWithExemplar adds a duration in seconds, with an exemplar.
+func (h *DurationHistogram) ObserveWithExemplar(seconds float64, exemplar prometheus.Labels) {
+	(*h.current.Load()).(prometheus.ExemplarObserver).ObserveWithExemplar(seconds, exemplar)
+}
+
+// Describe implements prometheus.Collector.
+func (h *DurationHistogram) Describe(ch chan<- *prometheus.Desc) { (*h.current.Load()).Describe(ch) }
+
+// Collect implements prometheus.Collector.
+func (h *DurationHistogram) Collect(ch chan<- prometheus.Metric) { (*h.current.Load()).Collect(ch) }
+
+// DurationHistogramVec is a histogram of durations in seconds partitioned by
+// labels, with the buckets set by SetDurationBuckets.
+type DurationHistogramVec struct {
+	opts    prometheus.HistogramOpts
+	labels  []string
+	current atomic.Pointer[prometheus.HistogramVec]
+}
+
+// NewDurationHistogramVec creates a DurationHistogramVec that is registered
+// by Register, like the metrics created by Factory. opts.Buckets is ignored.
+func NewDurationHistogramVec(opts prometheus.HistogramOpts, labels []string) *DurationHistogramVec {
+	durationsMu.Lock()
+	defer durationsMu.Unlock()
+	v := &DurationHistogramVec{opts: opts, labels: labels}
+	v.rebuild()
+	durations = append(durations, v)
+	pending.MustRegister(v)
+	return v
+}
+
+func (v *DurationHistogramVec) rebuild() {
+	v.current.Store(prometheus.NewHistogramVec(durationOpts(v.opts), v.labels))
+}
+
+// WithLabelValues returns the histogram for the label values.
+func (v *DurationHistogramVec) WithLabelValues(lvs ...string) prometheus.Observer {
+	return v.current.Load().WithLabelValues(lvs...)
+}
+
+// Describe implements prometheus.Collector.
+func (v *DurationHistogramVec) Describe(ch chan<- *prometheus.Desc) { v.current.Load().Describe(ch) }
+
+// Collect implements prometheus.Collector.
+func (v *DurationHistogramVec) Collect(ch chan<- prometheus.Metric) { v.current.Load().Collect(ch) }
@@ -0,0 +1,37 @@
+package metrics
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ExemplarTraceIDLabel is the label of duration exemplars that holds the
+// OpenTelemetry trace ID.
+const ExemplarTraceIDLabel = "trace_id"
+
+// exemplars is set by SetExemplars.
+var exemplars atomic.Bool
+
+// SetExemplars sets whether ObserveDuration attaches exemplars. Exemplars are
+// only exposed in the OpenMetrics format, so the /metrics handler should
+// offer it when they are enabled.
+func SetExemplars(enabled bool) { exemplars.Store(enabled) }
+
+// ExemplarsEnabled reports whether exemplars are attached to observations.
+func ExemplarsEnabled() bool { return exemplars.Load() }
+
+// ObserveDuration adds a duration in seconds to o, with an exemplar holding
+// the trace ID of the span in ctx if exemplars are enabled and ctx has a
+// sampled span.
+func ObserveDuration(ctx context.Context, o prometheus.Observer, seconds float64) {
+	eo, ok := o.(prometheus.ExemplarObserver)
+	sc := trace.SpanContextFromContext(ctx)
+	if !ok || !sc.IsSampled() || !exemplars.Load() {
+		o.Observe(seconds)
+		return
+	}
+	eo.ObserveWithExemplar(seconds, prometheus.Labels{ExemplarTraceIDLabel: sc.TraceID().String()})
+}
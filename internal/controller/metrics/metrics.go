@@ -0,0 +1,141 @@
+// Package metrics collects the controller's Prometheus metrics, so that they
+// can be registered together once the config is known.
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Factory creates metrics that are registered by Register, rather than when
+// they are created. Packages define their metrics with it at init time, before
+// the constant labels from the config are known.
+var Factory = promauto.With(pending)
+
+var (
+	// pending holds the collectors created by Factory.
+	pending = &deferredRegisterer{}
+
+	registerOnce sync.Once
+	registerErr  error
+
+	// registered is the registerer, with the constant labels, that Register
+	// registered the metrics with. Protected by registeredMu.
+	registeredMu sync.Mutex
+	registered   prometheus.Registerer
+)
+
+// labelNameRE matches valid Prometheus label names.
+var labelNameRE = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// Register registers the metrics created by Factory with reg, adding the
+// constant labels to each. Only the first call has any effect; later calls
+// return the same result.
+func Register(reg prometheus.Registerer, constLabels map[string]string) error {
+	registerOnce.Do(func() {
+		if err := ValidateLabels(constLabels); err != nil {
+			registerErr = err
+			return
+		}
+		wrapped := prometheus.WrapRegistererWith(constLabels, reg)
+		var errs []error
+		for _, c := range pending.collectors() {
+			if err := wrapped.Register(c); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		registerErr = errors.Join(errs...)
+		if registerErr == nil {
+			registeredMu.Lock()
+			registered = wrapped
+			registeredMu.Unlock()
+		}
+	})
+	return registerErr
+}
+
+// RegisterInstance registers collectors that report on one instance of a
+// component (e.g. the limiter that the controller runs), with the registerer
+// and constant labels given to Register, until ctx is done. Unlike metrics
+// created by Factory, they can't be created at init time, since they read
+// the instance's state. It does nothing if Register hasn't been called (e.g.
+// in tests that don't read metrics).
+func RegisterInstance(ctx context.Context, cs ...prometheus.Collector) error {
+	registeredMu.Lock()
+	reg := registered
+	registeredMu.Unlock()
+	if reg == nil {
+		return nil
+	}
+	for i, c := range cs {
+		if err := reg.Register(c); err != nil {
+			for _, c := range cs[:i] {
+				reg.Unregister(c)
+			}
+			return err
+		}
+	}
+	go func() {
+		<-ctx.Done()
+		for _, c := range cs {
+			reg.Unregister(c)
+		}
+	}()
+	return nil
+}
+
+// ValidateLabels checks that the label names are valid and not reserved.
+func ValidateLabels(labels map[string]string) error {
+	var errs []error
+	for _, name := range slices.Sorted(maps.Keys(labels)) {
+		if !labelNameRE.MatchString(name) || strings.HasPrefix(name, "__") {
+			errs = append(errs, fmt.Errorf("invalid metric label name %q", name))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// deferredRegisterer records collectors so they can be registered later.
+type deferredRegisterer struct {
+	mu   sync.Mutex
+	list []prometheus.Collector
+}
+
+func (d *deferredRegisterer) Register(c prometheus.Collector) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.list = append(d.list, c)
+	return nil
+}
+
+func (d *deferredRegisterer) MustRegister(cs ...prometheus.Collector) {
+	for _, c := range cs {
+		_ = d.Register(c)
+	}
+}
+
+func (d *deferredRegisterer) Unregister(c prometheus.Collector) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	i := slices.Index(d.list, c)
+	if i < 0 {
+		return false
+	}
+	d.list = slices.Delete(d.list, i, i+1)
+	return true
+}
+
+func (d *deferredRegisterer) collectors() []prometheus.Collector {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return slices.Clone(d.list)
+}
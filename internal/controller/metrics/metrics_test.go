@@ -0,0 +1,192 @@
+package metrics_test
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/buildkite/agent-stack-k8s/v2/internal/controller/metrics"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestRegister(t *testing.T) {
+	counter := metrics.Factory.NewCounter(prometheus.CounterOpts{
+		Subsystem: "test",
+		Name:      "things_total",
+		Help:      "Count of things",
+	})
+	counter.Inc()
+
+	reg := prometheus.NewRegistry()
+	labels := map[string]string{"region": "us-east-1"}
+	if err := metrics.Register(reg, labels); err != nil {
+		t.Fatalf("metrics.Register(reg, %v) = %v", labels, err)
+	}
+	// Later calls have no effect.
+	if err := metrics.Register(prometheus.NewRegistry(), nil); err != nil {
+		t.Errorf("second metrics.Register(...) = %v", err)
+	}
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("reg.Gather() error = %v", err)
+	}
+	if len(families) != 1 || families[0].GetName() != "test_things_total" {
+		t.Fatalf("reg.Gather() = %v, want only test_things_total", families)
+	}
+	m := families[0].GetMetric()[0]
+	if got := m.GetCounter().GetValue(); got != 1 {
+		t.Errorf("test_things_total = %v, want 1", got)
+	}
+	gotLabels := make(map[string]string)
+	for _, lp := range m.GetLabel() {
+		gotLabels[lp.GetName()] = lp.GetValue()
+	}
+	if gotLabels["region"] != "us-east-1" || len(gotLabels) != 1 {
+		t.Errorf("test_things_total labels = %v, want %v", gotLabels, labels)
+	}
+}
+
+func TestValidateLabels(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		labels  map[string]string
+		wantErr bool
+	}{
+		{labels: nil},
+		{labels: map[string]string{"region": "us-east-1", "controller_instance": "blue"}},
+		{labels: map[string]string{"controller-instance": "blue"}, wantErr: true},
+		{labels: map[string]string{"1region": "us-east-1"}, wantErr: true},
+		{labels: map[string]string{"__name__": "foo"}, wantErr: true},
+	}
+	for _, test := range tests {
+		err := metrics.ValidateLabels(test.labels)
+		if gotErr := err != nil; gotErr != test.wantErr {
+			t.Errorf("metrics.ValidateLabels(%v) = %v, want error: %t", test.labels, err, test.wantErr)
+		}
+	}
+}
+
+func TestDurationHistogramBuckets(t *testing.T) {
+	// Restore the default buckets for other tests.
+	t.Cleanup(func() { metrics.SetDurationBuckets(nil, 0) })
+
+	vec := metrics.NewDurationHistogramVec(prometheus.HistogramOpts{
+		Subsystem: "test",
+		Name:      "wait_seconds",
+		Help:      "Time spent waiting",
+	}, []string{"result"})
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(vec)
+
+	observe := func() *dto.Histogram {
+		t.Helper()
+		vec.WithLabelValues("ok").Observe(2)
+		families, err := reg.Gather()
+		if err != nil {
+			t.Fatalf("reg.Gather() error = %v", err)
+		}
+		if len(families) != 1 {
+			t.Fatalf("reg.Gather() = %v, want only test_wait_seconds", families)
+		}
+		return families[0].GetMetric()[0].GetHistogram()
+	}
+	bounds := func(h *dto.Histogram) []float64 {
+		var bs []float64
+		for _, b := range h.GetBucket() {
+			bs = append(bs, b.GetUpperBound())
+		}
+		return bs
+	}
+
+	h := observe()
+	if got, want := bounds(h), metrics.DefaultDurationBuckets; !slices.Equal(got, want) {
+		t.Errorf("default bucket bounds = %v, want %v", got, want)
+	}
+
+	metrics.SetDurationBuckets([]float64{1, 10}, 0)
+	h = observe()
+	if got, want := bounds(h), []float64{1, 10}; !slices.Equal(got, want) {
+		t.Errorf("classic bucket bounds = %v, want %v", got, want)
+	}
+	if got := h.GetSampleCount(); got != 1 {
+		t.Errorf("sample count after SetDurationBuckets = %d, want 1", got)
+	}
+
+	metrics.SetDurationBuckets(nil, 1.1)
+	h = observe()
+	if got := bounds(h); len(got) != 0 {
+		t.Errorf("native-only bucket bounds = %v, want none", got)
+	}
+	if h.Schema == nil {
+		t.Error("native-only histogram has no schema, want native buckets")
+	}
+}
+
+func TestObserveDurationExemplars(t *testing.T) {
+	t.Cleanup(func() { metrics.SetExemplars(false) })
+
+	hist := metrics.NewDurationHistogram(prometheus.HistogramOpts{
+		Subsystem: "test",
+		Name:      "exemplar_seconds",
+		Help:      "Time spent on things with exemplars",
+	})
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(hist)
+
+	// exemplars returns the trace IDs of the histogram's bucket exemplars.
+	exemplars := func() []string {
+		t.Helper()
+		families, err := reg.Gather()
+		if err != nil {
+			t.Fatalf("reg.Gather() error = %v", err)
+		}
+		var ids []string
+		for _, b := range families[0].GetMetric()[0].GetHistogram().GetBucket() {
+			for _, lp := range b.GetExemplar().GetLabel() {
+				if lp.GetName() == metrics.ExemplarTraceIDLabel {
+					ids = append(ids, lp.GetValue())
+				}
+			}
+		}
+		return ids
+	}
+
+	// spanContext returns a context with a sampled span with the trace ID.
+	spanContext := func(traceID string) context.Context {
+		t.Helper()
+		id, err := trace.TraceIDFromHex(traceID)
+		if err != nil {
+			t.Fatalf("trace.TraceIDFromHex(%q) error = %v", traceID, err)
+		}
+		return trace.ContextWithSpanContext(context.Background(), trace.NewSpanContext(trace.SpanContextConfig{
+			TraceID:    id,
+			SpanID:     trace.SpanID{1},
+			TraceFlags: trace.FlagsSampled,
+		}))
+	}
+	const (
+		trace1 = "0102030405060708090a0b0c0d0e0f10"
+		trace2 = "1112131415161718191a1b1c1d1e1f20"
+	)
+
+	metrics.ObserveDuration(spanContext(trace1), hist, 0.5)
+	if got := exemplars(); len(got) != 0 {
+		t.Errorf("exemplars while disabled = %v, want none", got)
+	}
+
+	metrics.SetExemplars(true)
+	metrics.ObserveDuration(context.Background(), hist, 0.5)
+	if got := exemplars(); len(got) != 0 {
+		t.Errorf("exemplars without a span = %v, want none", got)
+	}
+
+	metrics.ObserveDuration(spanContext(trace2), hist, 0.5)
+	if got, want := exemplars(), []string{trace2}; !slices.Equal(got, want) {
+		t.Errorf("exemplars while enabled = %v, want %v", got, want)
+	}
+}
@@ -3,7 +3,11 @@ package model
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"time"
 
 	"github.com/buildkite/agent-stack-k8s/v2/api"
 
@@ -18,6 +22,24 @@ var ErrDuplicateJob = errors.New("job already scheduled")
 // begin scheduling.
 var ErrStaleJob = errors.New("job data stale")
 
+// ErrQuotaExceeded is a sentinel error returned when a resource quota doesn't
+// have room for the job's pod. The job is tried again when it is next fetched.
+var ErrQuotaExceeded = errors.New("resource quota exceeded")
+
+// ErrDraining is a sentinel error returned when the job's queue is draining, so
+// new jobs in it aren't scheduled. The job is tried again when it is next
+// fetched.
+var ErrDraining = errors.New("queue is draining")
+
+// ErrCoolingDown is a sentinel error returned when the job's queue is cooling
+// down after repeated scheduling failures. The job is tried again when it is
+// next fetched.
+var ErrCoolingDown = errors.New("queue is cooling down")
+
+// ErrBranchDenied is a sentinel error returned when the job's branch is not
+// allowed by its queue's route. The job is left in Buildkite.
+var ErrBranchDenied = errors.New("branch not allowed in queue")
+
 // JobHandler implementations can handle a job.
 type JobHandler interface {
 	Handle(context.Context, Job) error
@@ -30,6 +52,9 @@ type Job struct {
 
 	// Closed when the job information becomes stale.
 	StaleCh <-chan struct{}
+
+	// When the limiter gave the job a token, or zero if there is no limiter.
+	TokenAcquiredAt time.Time
 }
 
 // JobFinished reports if the job has a Complete or Failed status condition.
@@ -43,3 +68,29 @@ func JobFinished(job *batchv1.Job) bool {
 	}
 	return false
 }
+
+// ContentHash returns a hash of the parts of the job that affect how it is
+// scheduled: its agent query rules, command, environment, cluster queue and
+// priority. Two copies of a job with the same UUID but different hashes have
+// different data, e.g. new tags after the job was re-triggered.
+func ContentHash(job *api.CommandJob) string {
+	content := struct {
+		AgentQueryRules []string
+		Command         string
+		Env             []string
+		ClusterQueue    string
+		Priority        int
+	}{
+		AgentQueryRules: job.AgentQueryRules,
+		Command:         job.Command,
+		Env:             job.Env,
+		Priority:        job.Priority.Number,
+	}
+	if job.ClusterQueue != nil {
+		content.ClusterQueue = job.ClusterQueue.Uuid
+	}
+	// Marshalling a struct of strings and ints can't fail.
+	b, _ := json.Marshal(content)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:8])
+}
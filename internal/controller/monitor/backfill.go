@@ -0,0 +1,113 @@
+package monitor
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/buildkite/agent-stack-k8s/v2/api"
+	"github.com/buildkite/agent-stack-k8s/v2/internal/controller/model"
+	"go.uber.org/zap"
+)
+
+// maxBackfillPageSize is the most jobs Buildkite returns in one page.
+const maxBackfillPageSize = 500
+
+// backfill catches up on jobs that were scheduled while the controller was not
+// running, by fetching up to BackfillMaxPages pages of scheduled jobs (rather
+// than the single page of 100 that a poll fetches), and passing them to the
+// handler in the same way as polled jobs. It reports whether it fetched the
+// jobs, in which case the first poll can wait for the poll interval. It returns
+// an error only if the organization doesn't exist.
+//
+// The limiter's informer has synced before the monitor starts, so its
+// available tokens already account for jobs that were running before the
+// controller started. The backfill stops fetching pages once it has at least
+// as many jobs as there are available tokens: the rest would only wait for a
+// token until they became stale, and polling finds them once there is
+// capacity.
+func (m *Monitor) backfill(ctx context.Context, logger *zap.Logger, handler model.JobHandler, agentTags map[string]string, queue string) (bool, error) {
+	if m.cfg.BackfillMaxPages <= 0 {
+		return false, nil
+	}
+	logger = logger.Named("backfill")
+	start := time.Now()
+
+	jobs, pages, err := m.fetchBackfill(ctx, logger, queue)
+	fetchedAt := time.Now()
+	switch {
+	case ctx.Err() != nil:
+		return false, nil
+	case errors.Is(err, errInvalidOrganization):
+		return false, err
+	case err != nil:
+		m.queryFailed(logger, err)
+	}
+	logger.Info("fetched scheduled jobs",
+		zap.Int("pages", pages),
+		zap.Int("jobs", len(jobs)),
+		zap.Duration("duration", fetchedAt.Sub(start)),
+	)
+	if len(jobs) > 0 {
+		m.passJobsToNextHandler(ctx, logger, handler, agentTags, jobs, fetchedAt)
+	}
+	return err == nil, nil
+}
+
+// fetchBackfill fetches pages of scheduled jobs until there are no more, it
+// has fetched BackfillMaxPages, it has enough jobs for the available capacity,
+// or a query fails. It returns the jobs fetched (even if a later query
+// failed), and the number of pages fetched.
+func (m *Monitor) fetchBackfill(ctx context.Context, logger *zap.Logger, queue string) ([]*api.JobJobTypeCommand, int, error) {
+	var jobs []*api.JobJobTypeCommand
+	var after string
+	pages := 0
+	for pages < m.cfg.BackfillMaxPages {
+		resp, err := m.fetchBackfillPage(ctx, logger, queue, after)
+		if err != nil {
+			return jobs, pages, err
+		}
+		if !resp.OrganizationExists() {
+			return nil, pages, m.invalidOrganization()
+		}
+		pages++
+		page := resp.CommandJobs()
+		backfillPagesCounter.Inc()
+		backfillJobsCounter.Add(float64(len(page)))
+		jobsPerQueryHistogram.Observe(float64(len(page)))
+		jobs = append(jobs, page...)
+
+		if after = resp.NextPageCursor(); after == "" {
+			break
+		}
+		if m.capacity != nil && len(jobs) >= m.capacity.AvailableTokens() {
+			break
+		}
+	}
+	return jobs, pages, nil
+}
+
+// fetchBackfillPage fetches the page of scheduled jobs after the cursor. If the
+// query fails, it retries the same page up to BackfillPageRetries times,
+// waiting PollInterval between attempts, so that a brief failure part way
+// through doesn't lose the pages already fetched.
+func (m *Monitor) fetchBackfillPage(ctx context.Context, logger *zap.Logger, queue, after string) (jobResp, error) {
+	for attempt := 0; ; attempt++ {
+		resp, err := m.getScheduledCommandJobs(ctx, queue, m.cfg.BackfillPageSize, after)
+		if err == nil || attempt >= m.cfg.BackfillPageRetries || ctx.Err() != nil {
+			return resp, err
+		}
+		m.queryFailed(logger, err)
+		pageRetriesCounter.Inc()
+		logger.Info("retrying page of scheduled jobs",
+			zap.String("after", after),
+			zap.Int("attempt", attempt+1),
+			zap.Int("max_attempts", m.cfg.BackfillPageRetries),
+		)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(m.cfg.PollInterval):
+		}
+	}
+}
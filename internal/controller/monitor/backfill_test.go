@@ -0,0 +1,234 @@
+package monitor
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap/zaptest"
+)
+
+type fixedCapacity int
+
+func (c fixedCapacity) AvailableTokens() int { return int(c) }
+
+// backfillServer serves pages of scheduled jobs: "a" and "b", then after
+// cursor "c1", "c". The first failures queries for the second page fail. It
+// records the first and after variables of each query.
+type backfillServer struct {
+	noOrg    bool
+	failures int
+
+	mu      sync.Mutex
+	queries []string
+}
+
+func (s *backfillServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Variables struct {
+			First int     `json:"first"`
+			After *string `json:"after"`
+		} `json:"variables"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	after := "<none>"
+	if req.Variables.After != nil {
+		after = *req.Variables.After
+	}
+	s.mu.Lock()
+	s.queries = append(s.queries, fmt.Sprintf("first=%d after=%s", req.Variables.First, after))
+	fail := after != "<none>" && s.failures > 0
+	if fail {
+		s.failures--
+	}
+	s.mu.Unlock()
+	if fail {
+		http.Error(w, "try again", http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	switch {
+	case s.noOrg:
+		fmt.Fprint(w, `{"data":{"organization":{"id":null}}}`)
+	case after == "<none>":
+		fmt.Fprint(w, backfillPage(`"c1"`, true, "a", "b"))
+	default:
+		fmt.Fprint(w, backfillPage(`null`, false, "c"))
+	}
+}
+
+func backfillPage(endCursor string, hasNextPage bool, uuids ...string) string {
+	var edges []string
+	for _, uuid := range uuids {
+		edges = append(edges, fmt.Sprintf(`{"node":{"__typename":"JobTypeCommand","uuid":%q}}`, uuid))
+	}
+	return fmt.Sprintf(
+		`{"data":{"organization":{"id":"T3Jn","jobs":{"count":3,"edges":[%s],"pageInfo":{"endCursor":%s,"hasNextPage":%t}}}}}`,
+		strings.Join(edges, ","), endCursor, hasNextPage,
+	)
+}
+
+// counter returns the value of the counter with the name in reg.
+func counter(t *testing.T, reg *prometheus.Registry, name string) float64 {
+	t.Helper()
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("reg.Gather() error = %v", err)
+	}
+	for _, mf := range families {
+		if mf.GetName() == name {
+			return mf.GetMetric()[0].GetCounter().GetValue()
+		}
+	}
+	return 0
+}
+
+func TestFetchBackfill(t *testing.T) {
+
+	tests := []struct {
+		name        string
+		maxPages    int
+		retries     int
+		failures    int
+		capacity    Capacity
+		noOrg       bool
+		wantUUIDs   []string
+		wantPages   int
+		wantQueries []string
+		wantErr     error
+		wantAnyErr  bool
+		wantRetries float64
+	}{
+		{
+			name:        "one page",
+			maxPages:    1,
+			wantUUIDs:   []string{"a", "b"},
+			wantPages:   1,
+			wantQueries: []string{"first=500 after=<none>"},
+		},
+		{
+			name:        "all pages",
+			maxPages:    5,
+			wantUUIDs:   []string{"a", "b", "c"},
+			wantPages:   2,
+			wantQueries: []string{"first=500 after=<none>", "first=500 after=c1"},
+		},
+		{
+			name:        "enough for capacity",
+			maxPages:    5,
+			capacity:    fixedCapacity(2),
+			wantUUIDs:   []string{"a", "b"},
+			wantPages:   1,
+			wantQueries: []string{"first=500 after=<none>"},
+		},
+		{
+			name:        "more capacity",
+			maxPages:    5,
+			capacity:    fixedCapacity(3),
+			wantUUIDs:   []string{"a", "b", "c"},
+			wantPages:   2,
+			wantQueries: []string{"first=500 after=<none>", "first=500 after=c1"},
+		},
+		{
+			name:        "no organization",
+			maxPages:    5,
+			noOrg:       true,
+			wantQueries: []string{"first=500 after=<none>"},
+			wantErr:     errInvalidOrganization,
+		},
+		{
+			name:        "page retried from the last cursor",
+			maxPages:    5,
+			retries:     2,
+			failures:    2,
+			wantUUIDs:   []string{"a", "b", "c"},
+			wantPages:   2,
+			wantQueries: []string{"first=500 after=<none>", "first=500 after=c1", "first=500 after=c1", "first=500 after=c1"},
+			wantRetries: 2,
+		},
+		{
+			name:        "out of retries",
+			maxPages:    5,
+			retries:     1,
+			failures:    2,
+			wantUUIDs:   []string{"a", "b"},
+			wantPages:   1,
+			wantQueries: []string{"first=500 after=<none>", "first=500 after=c1", "first=500 after=c1"},
+			wantAnyErr:  true,
+			wantRetries: 1,
+		},
+		{
+			name:        "no retries",
+			maxPages:    5,
+			failures:    1,
+			wantUUIDs:   []string{"a", "b"},
+			wantPages:   1,
+			wantQueries: []string{"first=500 after=<none>", "first=500 after=c1"},
+			wantAnyErr:  true,
+		},
+	}
+	reg, err := registerMetrics()
+	if err != nil {
+		t.Fatalf("metrics.Register(reg, nil) = %v", err)
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			srv := &backfillServer{noOrg: test.noOrg, failures: test.failures}
+			server := httptest.NewServer(srv)
+			defer server.Close()
+
+			m, err := New(zaptest.NewLogger(t), nil, Config{
+				GraphQLEndpoint:     server.URL,
+				Token:               "bkua_secret",
+				Org:                 "my-org",
+				BackfillMaxPages:    test.maxPages,
+				BackfillPageRetries: test.retries,
+			})
+			if err != nil {
+				t.Fatalf("New(...) error = %v", err)
+			}
+			if test.capacity != nil {
+				m.SetCapacity(test.capacity)
+			}
+
+			retriesBefore := counter(t, reg, "monitor_page_retries_total")
+			jobs, pages, err := m.fetchBackfill(context.Background(), zaptest.NewLogger(t), "kubernetes")
+			if test.wantAnyErr {
+				if err == nil {
+					t.Errorf("m.fetchBackfill(ctx, logger, kubernetes) error = nil, want an error")
+				}
+			} else if !errors.Is(err, test.wantErr) {
+				t.Errorf("m.fetchBackfill(ctx, logger, kubernetes) error = %v, want %v", err, test.wantErr)
+			}
+			var uuids []string
+			for _, job := range jobs {
+				uuids = append(uuids, job.Uuid)
+			}
+			if diff := cmp.Diff(uuids, test.wantUUIDs); diff != "" {
+				t.Errorf("m.fetchBackfill(ctx, logger, kubernetes) jobs diff (-got +want):\n%s", diff)
+			}
+			if pages != test.wantPages {
+				t.Errorf("m.fetchBackfill(ctx, logger, kubernetes) pages = %d, want %d", pages, test.wantPages)
+			}
+			if diff := cmp.Diff(srv.queries, test.wantQueries); diff != "" {
+				t.Errorf("queries diff (-got +want):\n%s", diff)
+			}
+			retriesAfter := counter(t, reg, "monitor_page_retries_total")
+			if got := retriesAfter - retriesBefore; got != test.wantRetries {
+				t.Errorf("monitor_page_retries_total increased by %v, want %v", got, test.wantRetries)
+			}
+		})
+	}
+}
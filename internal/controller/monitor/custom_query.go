@@ -0,0 +1,144 @@
+package monitor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+
+	"github.com/Khan/genqlient/graphql"
+	"github.com/buildkite/agent-stack-k8s/v2/api"
+	"github.com/vektah/gqlparser/v2/ast"
+	"github.com/vektah/gqlparser/v2/parser"
+)
+
+// Variables that the monitor supplies to a custom jobs query.
+const (
+	customQuerySlugVar            = "slug"
+	customQueryAgentQueryRulesVar = "agentQueryRules"
+	customQueryClusterVar         = "cluster"
+)
+
+// validateCustomQuery checks that the custom jobs query is a single GraphQL
+// query operation, and that every variable it declares will be supplied,
+// either by the monitor or by vars.
+func validateCustomQuery(query string, vars map[string]any) error {
+	doc, err := parser.ParseQuery(&ast.Source{Name: "custom jobs query", Input: query})
+	if err != nil {
+		return fmt.Errorf("parsing custom jobs query: %w", err)
+	}
+	if len(doc.Operations) != 1 {
+		return fmt.Errorf("custom jobs query must contain exactly 1 operation, found %d", len(doc.Operations))
+	}
+	op := doc.Operations[0]
+	if op.Operation != ast.Query {
+		return fmt.Errorf("custom jobs query must be a query operation, found a %s", op.Operation)
+	}
+
+	var errs []error
+	for _, name := range []string{customQuerySlugVar, customQueryAgentQueryRulesVar, customQueryClusterVar} {
+		if _, ok := vars[name]; ok {
+			errs = append(errs, fmt.Errorf("custom jobs query variable %q is supplied by the controller and cannot be overridden", name))
+		}
+	}
+	if op.VariableDefinitions.ForName(customQuerySlugVar) == nil {
+		errs = append(errs, fmt.Errorf("custom jobs query must declare the $%s variable (the organization slug)", customQuerySlugVar))
+	}
+	for _, def := range op.VariableDefinitions {
+		switch def.Variable {
+		case customQuerySlugVar, customQueryAgentQueryRulesVar, customQueryClusterVar:
+			continue
+		}
+		if _, ok := vars[def.Variable]; !ok && def.Type.NonNull && def.DefaultValue == nil {
+			errs = append(errs, fmt.Errorf("custom jobs query declares required variable $%s, but no value is configured", def.Variable))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// customJobResp is the response to a custom jobs query. Its shape must match
+// the built-in queries, at least as far as organization.id and
+// organization.jobs.edges[].node.
+type customJobResp struct {
+	Organization *struct {
+		Id   *string `json:"id"`
+		Jobs *struct {
+			Edges []struct {
+				Node *struct {
+					Typename string `json:"__typename"`
+					api.CommandJob
+				} `json:"node"`
+			} `json:"edges"`
+		} `json:"jobs"`
+	} `json:"organization"`
+}
+
+func (r *customJobResp) OrganizationExists() bool {
+	return r.Organization != nil && r.Organization.Id != nil
+}
+
+func (r *customJobResp) CommandJobs() []*api.JobJobTypeCommand {
+	jobs := make([]*api.JobJobTypeCommand, 0, len(r.Organization.Jobs.Edges))
+	for _, edge := range r.Organization.Jobs.Edges {
+		jobs = append(jobs, &api.JobJobTypeCommand{CommandJob: edge.Node.CommandJob})
+	}
+	return jobs
+}
+
+// NextPageCursor returns "", since custom jobs queries are not paginated.
+func (r *customJobResp) NextPageCursor() string {
+	return ""
+}
+
+// validate checks the response has the shape the monitor expects.
+func (r *customJobResp) validate() error {
+	if r.Organization == nil {
+		return errors.New("custom jobs query response has no organization")
+	}
+	if r.Organization.Id == nil {
+		// The organization doesn't exist, which is reported separately.
+		return nil
+	}
+	if r.Organization.Jobs == nil {
+		return errors.New("custom jobs query response has no organization.jobs")
+	}
+	for i, edge := range r.Organization.Jobs.Edges {
+		switch {
+		case edge.Node == nil:
+			return fmt.Errorf("custom jobs query response has no organization.jobs.edges[%d].node", i)
+		case edge.Node.Typename != "" && edge.Node.Typename != "JobTypeCommand":
+			return fmt.Errorf("custom jobs query response organization.jobs.edges[%d].node is a %s, not a JobTypeCommand", i, edge.Node.Typename)
+		case edge.Node.Uuid == "":
+			return fmt.Errorf("custom jobs query response has no organization.jobs.edges[%d].node.uuid", i)
+		}
+	}
+	return nil
+}
+
+// getCustomQueryCommandJobs runs the custom jobs query.
+func (m *Monitor) getCustomQueryCommandJobs(ctx context.Context, queue string) (jobResp, error) {
+	vars := maps.Clone(m.cfg.CustomQueryVariables)
+	if vars == nil {
+		vars = make(map[string]any)
+	}
+	vars[customQuerySlugVar] = m.cfg.Org
+	if queue != "" {
+		vars[customQueryAgentQueryRulesVar] = []string{"queue=" + queue}
+	}
+	if m.cfg.ClusterUUID != "" {
+		vars[customQueryClusterVar] = encodeClusterGraphQLID(m.cfg.ClusterUUID)
+	}
+
+	var data customJobResp
+	req := &graphql.Request{
+		Query:     m.cfg.CustomQuery,
+		Variables: vars,
+	}
+	if err := m.gql.MakeRequest(ctx, req, &graphql.Response{Data: &data}); err != nil {
+		return nil, err
+	}
+	if err := data.validate(); err != nil {
+		return nil, err
+	}
+	return &data, nil
+}
@@ -0,0 +1,63 @@
+package monitor
+
+import (
+	"testing"
+)
+
+func TestValidateCustomQuery(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		query   string
+		vars    map[string]any
+		wantErr bool
+	}{
+		{
+			name:  "valid",
+			query: `query Jobs($slug: ID!, $agentQueryRules: [String!], $state: [JobStates!]!) { organization(slug: $slug) { id } }`,
+			vars:  map[string]any{"state": []string{"SCHEDULED"}},
+		},
+		{
+			name:    "syntax error",
+			query:   `query Jobs($slug: ID!) { organization(slug: $slug) { id }`,
+			wantErr: true,
+		},
+		{
+			name:    "mutation",
+			query:   `mutation Jobs($slug: ID!) { organization(slug: $slug) { id } }`,
+			wantErr: true,
+		},
+		{
+			name:    "two operations",
+			query:   `query A($slug: ID!) { organization(slug: $slug) { id } } query B($slug: ID!) { organization(slug: $slug) { id } }`,
+			wantErr: true,
+		},
+		{
+			name:    "missing slug",
+			query:   `query Jobs { organization(slug: "foo") { id } }`,
+			wantErr: true,
+		},
+		{
+			name:    "overrides built-in variable",
+			query:   `query Jobs($slug: ID!) { organization(slug: $slug) { id } }`,
+			vars:    map[string]any{"slug": "other-org"},
+			wantErr: true,
+		},
+		{
+			name:    "required variable not configured",
+			query:   `query Jobs($slug: ID!, $state: [JobStates!]!) { organization(slug: $slug) { id } }`,
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			err := validateCustomQuery(test.query, test.vars)
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Errorf("validateCustomQuery(%q, %v) error = %v, want error = %t", test.query, test.vars, err, test.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package monitor
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultErrorBufferSize is the number of errors kept if ErrorBufferSize is
+// not set.
+const defaultErrorBufferSize = 50
+
+// tokenPattern matches things that look like Buildkite API or agent tokens,
+// or bearer credentials.
+var tokenPattern = regexp.MustCompile(`\bbk[a-z]{2}_[A-Za-z0-9]+|(?i)(bearer|token)\s+\S+`)
+
+// recentError is an error recorded in an errorRing.
+type recentError struct {
+	Time    time.Time `json:"time"`
+	Source  string    `json:"source"`
+	UUID    string    `json:"uuid,omitempty"`
+	Message string    `json:"message"`
+}
+
+// errorRing keeps the most recent errors, with tokens redacted, and serves
+// them as JSON.
+type errorRing struct {
+	// secrets are redacted from messages, in addition to anything matching
+	// tokenPattern.
+	secrets []string
+
+	mu      sync.Mutex
+	entries []recentError
+	next    int
+	full    bool
+}
+
+func newErrorRing(size int, secrets ...string) *errorRing {
+	if size <= 0 {
+		size = defaultErrorBufferSize
+	}
+	var nonEmpty []string
+	for _, s := range secrets {
+		if s != "" {
+			nonEmpty = append(nonEmpty, s)
+		}
+	}
+	return &errorRing{
+		secrets: nonEmpty,
+		entries: make([]recentError, size),
+	}
+}
+
+// add records the error, replacing the oldest error if the buffer is full.
+func (r *errorRing) add(source, uuid string, err error) {
+	e := recentError{
+		Time:    time.Now(),
+		Source:  source,
+		UUID:    uuid,
+		Message: r.redact(err.Error()),
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries[r.next] = e
+	r.next = (r.next + 1) % len(r.entries)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// recent returns the recorded errors, oldest first.
+func (r *errorRing) recent() []recentError {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.full {
+		return append([]recentError{}, r.entries[:r.next]...)
+	}
+	return append(append([]recentError{}, r.entries[r.next:]...), r.entries[:r.next]...)
+}
+
+func (r *errorRing) redact(msg string) string {
+	for _, s := range r.secrets {
+		msg = strings.ReplaceAll(msg, s, "[REDACTED]")
+	}
+	return redactTokens(msg)
+}
+
+// redactTokens replaces anything in msg that looks like a token.
+func redactTokens(msg string) string {
+	return tokenPattern.ReplaceAllStringFunc(msg, func(match string) string {
+		// Keep the "Bearer" or "token" prefix, for context.
+		if i := strings.IndexAny(match, " \t"); i >= 0 {
+			return match[:i+1] + "[REDACTED]"
+		}
+		return "[REDACTED]"
+	})
+}
+
+// ServeHTTP serves the recorded errors as a JSON array, oldest first.
+func (r *errorRing) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(r.recent()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
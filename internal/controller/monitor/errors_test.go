@@ -0,0 +1,62 @@
+package monitor
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestErrorRing(t *testing.T) {
+	t.Parallel()
+
+	r := newErrorRing(3, "my-secret-token")
+	for i := range 5 {
+		r.add("query", "", fmt.Errorf("error %d", i))
+	}
+
+	var got []string
+	for _, e := range r.recent() {
+		got = append(got, e.Message)
+	}
+	if want := []string{"error 2", "error 3", "error 4"}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("r.recent() messages = %v, want %v", got, want)
+	}
+}
+
+func TestErrorRing_Redacts(t *testing.T) {
+	t.Parallel()
+
+	r := newErrorRing(10, "my-secret-token")
+	r.add("query", "", errors.New(`Post "https://graphql.buildkite.com/v1?t=my-secret-token": 401`))
+	r.add("handler", "abc", errors.New("agent token bkua_0123456789abcdef was rejected"))
+	r.add("query", "", errors.New("request had header Authorization: Bearer xyz123"))
+
+	for _, e := range r.recent() {
+		for _, secret := range []string{"my-secret-token", "bkua_0123456789abcdef", "xyz123"} {
+			if strings.Contains(e.Message, secret) {
+				t.Errorf("recorded message %q contains %q, want it redacted", e.Message, secret)
+			}
+		}
+	}
+}
+
+func TestErrorRing_ServeHTTP(t *testing.T) {
+	t.Parallel()
+
+	r := newErrorRing(10)
+	r.add("handler", "abc", errors.New("nope"))
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/debug/errors", nil))
+
+	var got []recentError
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("json.Unmarshal(%q) error = %v", rec.Body.String(), err)
+	}
+	if len(got) != 1 || got[0].Source != "handler" || got[0].UUID != "abc" || got[0].Message != "nope" {
+		t.Errorf("served errors = %+v, want one handler error for abc", got)
+	}
+}
@@ -0,0 +1,82 @@
+package monitor
+
+import (
+	"fmt"
+	"iter"
+	"maps"
+	"slices"
+	"sync/atomic"
+
+	"github.com/buildkite/agent-stack-k8s/v2/api"
+	"github.com/buildkite/agent-stack-k8s/v2/internal/controller/agenttags"
+	"go.uber.org/zap"
+)
+
+// filterSampler picks 1 in every n jobs that are filtered out by tags, to be
+// logged at info level. This gives concrete examples of mismatches without
+// the volume of debug logging.
+type filterSampler struct {
+	n     uint64
+	count atomic.Uint64
+}
+
+// tagParseErrorSampler picks the jobs with tags that can't be parsed to log.
+var tagParseErrorSampler = &filterSampler{n: 100}
+
+// newFilterSampler returns a filterSampler that samples 1 in n jobs, or nil
+// (which samples none) if n is not positive.
+func newFilterSampler(n int) *filterSampler {
+	if n <= 0 {
+		return nil
+	}
+	return &filterSampler{n: uint64(n)}
+}
+
+// sample reports whether the next filtered job should be logged. The first
+// job is always sampled.
+func (s *filterSampler) sample() bool {
+	if s == nil {
+		return false
+	}
+	return (s.count.Add(1)-1)%s.n == 0
+}
+
+// logFilteredJob logs the job's tags, the configured tags, and why they don't
+// match. Job tags come from pipeline YAML, so they are redacted.
+func (s *filterSampler) logFilteredJob(logger *zap.Logger, configuredTags []string, agentTags map[string]string, j *api.CommandJob) {
+	jobTags, _ := agenttags.TagMapFromTags(j.AgentQueryRules)
+	logger.Info("sampled job skipped because it did not match all tags",
+		zap.String("uuid", j.Uuid),
+		zap.Strings("job-tags", redactTags(j.AgentQueryRules)),
+		zap.Strings("agent-tags", configuredTags),
+		zap.Strings("mismatches", redactTags(tagMismatches(agenttags.WithoutControlTags(maps.All(jobTags)), agentTags))),
+		zap.Uint64("sample-rate", s.n),
+	)
+}
+
+// redactTags returns the tags with anything that looks like a token redacted,
+// for logging tags that may not have come from the expected place.
+func redactTags(tags []string) []string {
+	redacted := make([]string, len(tags))
+	for i, tag := range tags {
+		redacted[i] = redactTokens(tag)
+	}
+	return redacted
+}
+
+// tagMismatches describes each job tag that the agent tags don't satisfy (the
+// opposite of [agenttags.JobTagsMatchAgentTags]), sorted by key.
+func tagMismatches(jobTags iter.Seq2[string, string], agentTags map[string]string) []string {
+	var mismatches []string
+	for k, v := range jobTags {
+		agentTagValue, exists := agentTags[k]
+		switch {
+		case !exists:
+			mismatches = append(mismatches, fmt.Sprintf("%s=%s (agent has no %s tag)", k, v, k))
+		case v != "*" && v != agentTagValue:
+			mismatches = append(mismatches, fmt.Sprintf("%s=%s (agent has %s=%s)", k, v, k, agentTagValue))
+		}
+	}
+	slices.Sort(mismatches)
+	return mismatches
+}
@@ -0,0 +1,137 @@
+package monitor
+
+import (
+	"maps"
+	"strings"
+	"testing"
+
+	"github.com/buildkite/agent-stack-k8s/v2/api"
+	"github.com/google/go-cmp/cmp"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestFilterSampler(t *testing.T) {
+	t.Parallel()
+
+	s := newFilterSampler(3)
+	var got []bool
+	for range 7 {
+		got = append(got, s.sample())
+	}
+	want := []bool{true, false, false, true, false, false, true}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("sample() results diff (-got +want):\n%s", diff)
+	}
+
+	// A nil sampler (sampling disabled) samples nothing.
+	if newFilterSampler(0).sample() {
+		t.Error("newFilterSampler(0).sample() = true, want false")
+	}
+}
+
+func TestFilterSampler_LogFilteredJob(t *testing.T) {
+	t.Parallel()
+
+	core, logs := observer.New(zap.InfoLevel)
+	agentTags := map[string]string{"queue": "kubernetes", "os": "linux"}
+	job := &api.CommandJob{
+		Uuid:            "abc",
+		AgentQueryRules: []string{"queue=kubernetes", "os=windows"},
+	}
+	newFilterSampler(10).logFilteredJob(zap.New(core), []string{"queue=kubernetes", "os=linux"}, agentTags, job)
+
+	entries := logs.All()
+	if len(entries) != 1 {
+		t.Fatalf("len(logs.All()) = %d, want 1", len(entries))
+	}
+	fields := entries[0].ContextMap()
+	want := []any{"os=windows (agent has os=linux)"}
+	if diff := cmp.Diff(fields["mismatches"], want); diff != "" {
+		t.Errorf("mismatches diff (-got +want):\n%s", diff)
+	}
+	if got, want := fields["sample-rate"], uint64(10); got != want {
+		t.Errorf("sample-rate = %v, want %v", got, want)
+	}
+}
+
+func TestFilterSampler_LogFilteredJobRedactsTags(t *testing.T) {
+	t.Parallel()
+
+	core, logs := observer.New(zap.InfoLevel)
+	agentTags := map[string]string{"queue": "kubernetes"}
+	job := &api.CommandJob{
+		Uuid:            "abc",
+		AgentQueryRules: []string{"queue=kubernetes", "secret=bkua_abc123def"},
+	}
+	newFilterSampler(1).logFilteredJob(zap.New(core), []string{"queue=kubernetes"}, agentTags, job)
+
+	entries := logs.All()
+	if len(entries) != 1 {
+		t.Fatalf("len(logs.All()) = %d, want 1", len(entries))
+	}
+	fields := entries[0].ContextMap()
+	for _, key := range []string{"job-tags", "mismatches"} {
+		for _, v := range fields[key].([]any) {
+			if strings.Contains(v.(string), "bkua_abc123def") {
+				t.Errorf("%s contains the token: %q", key, v)
+			}
+		}
+	}
+	if diff := cmp.Diff(fields["job-tags"], []any{"queue=kubernetes", "secret=[REDACTED]"}); diff != "" {
+		t.Errorf("job-tags diff (-got +want):\n%s", diff)
+	}
+}
+
+func TestTagMismatches(t *testing.T) {
+	t.Parallel()
+
+	agentTags := map[string]string{"queue": "kubernetes", "os": "linux"}
+	jobTags := map[string]string{"queue": "other", "os": "*", "gpu": "true"}
+	got := tagMismatches(maps.All(jobTags), agentTags)
+	want := []string{
+		"gpu=true (agent has no gpu tag)",
+		"queue=other (agent has queue=kubernetes)",
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("tagMismatches diff (-got +want):\n%s", diff)
+	}
+}
+
+func TestJobMatchesTags_ParseErrors(t *testing.T) {
+	t.Parallel()
+
+	agentTags := map[string]string{"queue": "kubernetes"}
+	tests := []struct {
+		name          string
+		tags          []string
+		wantMatches   bool
+		wantTagsValid bool
+	}{
+		{name: "valid, matching", tags: []string{"queue=kubernetes"}, wantMatches: true, wantTagsValid: true},
+		{name: "valid, not matching", tags: []string{"queue=other"}, wantMatches: false, wantTagsValid: true},
+		{name: "malformed, not matching", tags: []string{"queue=other", "garbage"}, wantMatches: false, wantTagsValid: false},
+		// The malformed tag is ignored, and the rest match.
+		{name: "malformed, matching", tags: []string{"queue=kubernetes", "garbage"}, wantMatches: true, wantTagsValid: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			job := &api.CommandJob{Uuid: "abc", AgentQueryRules: test.tags}
+			matches, tagsValid := jobMatchesTags(zap.NewNop(), agentTags, job)
+			if matches != test.wantMatches || tagsValid != test.wantTagsValid {
+				t.Errorf("jobMatchesTags(%q) = %t, %t, want %t, %t", test.tags, matches, tagsValid, test.wantMatches, test.wantTagsValid)
+			}
+		})
+	}
+}
+
+func TestRedactTags(t *testing.T) {
+	t.Parallel()
+
+	got := redactTags([]string{"queue=kubernetes", "bkua_abc123def", "token abc123"})
+	want := []string{"queue=kubernetes", "[REDACTED]", "token [REDACTED]"}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("redactTags(...) diff (-got +want):\n%s", diff)
+	}
+}
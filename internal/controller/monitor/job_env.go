@@ -0,0 +1,37 @@
+package monitor
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/buildkite/agent-stack-k8s/v2/api"
+)
+
+// jobEnv returns the value of the variable in the job's env, or "" if it is
+// not set.
+func jobEnv(job *api.CommandJob, name string) string {
+	for _, kv := range job.Env {
+		if value, ok := strings.CutPrefix(kv, name+"="); ok {
+			return value
+		}
+	}
+	return ""
+}
+
+// jobBranch returns the branch of the job's build, or if the query didn't
+// fetch the build (e.g. a custom query), BUILDKITE_BRANCH from its env.
+func jobBranch(job *api.CommandJob) string {
+	if job.Build != nil {
+		return job.Build.Branch
+	}
+	return jobEnv(job, "BUILDKITE_BRANCH")
+}
+
+// jobAttempt returns "retry" if the job is a Buildkite retry of an earlier
+// job, according to BUILDKITE_RETRY_COUNT in its env, otherwise "first".
+func jobAttempt(job *api.CommandJob) string {
+	if n, err := strconv.Atoi(jobEnv(job, "BUILDKITE_RETRY_COUNT")); err == nil && n > 0 {
+		return "retry"
+	}
+	return "first"
+}
@@ -0,0 +1,69 @@
+package monitor
+
+import (
+	"testing"
+
+	"github.com/buildkite/agent-stack-k8s/v2/api"
+)
+
+func TestJobAttempt(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name string
+		env  []string
+		want string
+	}{
+		{name: "no retry count", env: []string{"BUILDKITE_PIPELINE_SLUG=app"}, want: "first"},
+		{name: "zero", env: []string{"BUILDKITE_RETRY_COUNT=0"}, want: "first"},
+		{name: "retried", env: []string{"BUILDKITE_RETRY_COUNT=2"}, want: "retry"},
+		{name: "not a number", env: []string{"BUILDKITE_RETRY_COUNT=lots"}, want: "first"},
+		// BUILDKITE_RETRY_COUNT_EXTRA isn't BUILDKITE_RETRY_COUNT.
+		{name: "longer name", env: []string{"BUILDKITE_RETRY_COUNT_EXTRA=1"}, want: "first"},
+	}
+	for _, test := range cases {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			if got := jobAttempt(&api.CommandJob{Env: test.env}); got != test.want {
+				t.Errorf("jobAttempt(job with env %q) = %q, want %q", test.env, got, test.want)
+			}
+		})
+	}
+}
+
+func TestJobBranch(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name string
+		job  *api.CommandJob
+		want string
+	}{
+		{
+			name: "from build",
+			job: &api.CommandJob{
+				Env:   []string{"BUILDKITE_BRANCH=from-env"},
+				Build: &api.CommandJobBuild{Branch: "someone:main"},
+			},
+			want: "someone:main",
+		},
+		{
+			name: "from env",
+			job:  &api.CommandJob{Env: []string{"BUILDKITE_BRANCH=release/1.2"}},
+			want: "release/1.2",
+		},
+		{
+			name: "unknown",
+			job:  &api.CommandJob{},
+			want: "",
+		},
+	}
+	for _, test := range cases {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			if got := jobBranch(test.job); got != test.want {
+				t.Errorf("jobBranch(job) = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,45 @@
+package monitor
+
+import "github.com/buildkite/agent-stack-k8s/v2/api"
+
+// unschedulableStates are the job states in which a job must not be scheduled
+// yet: it is waiting on a block or wait step, or on a concurrency group. The
+// built-in queries only fetch scheduled jobs, but a custom jobs query might
+// not filter by state.
+var unschedulableStates = map[api.JobStates]bool{
+	api.JobStatesBlocked:       true,
+	api.JobStatesBlockedFailed: true,
+	api.JobStatesWaiting:       true,
+	api.JobStatesWaitingFailed: true,
+	api.JobStatesLimiting:      true,
+	api.JobStatesLimited:       true,
+	api.JobStatesPending:       true,
+}
+
+// finishedStates are the job states in which a job has already finished, or
+// is finishing, so there is nothing left to schedule (e.g. it was cancelled
+// between being fetched by the query and the response being handled).
+var finishedStates = map[api.JobStates]bool{
+	api.JobStatesFinished:  true,
+	api.JobStatesCanceled:  true,
+	api.JobStatesCanceling: true,
+	api.JobStatesExpired:   true,
+	api.JobStatesTimedOut:  true,
+	api.JobStatesTimingOut: true,
+	api.JobStatesSkipped:   true,
+	api.JobStatesBroken:    true,
+}
+
+// jobBlocked reports whether the job is in a state where it can't be
+// scheduled yet. Jobs without a state (e.g. fetched by a custom query that
+// doesn't select it) are assumed to be schedulable.
+func jobBlocked(j *api.CommandJob) bool {
+	return unschedulableStates[j.State]
+}
+
+// jobAlreadyFinished reports whether the job has already finished (or is
+// finishing), so that scheduling it would be wasted work. Jobs without a state
+// are assumed not to have finished.
+func jobAlreadyFinished(j *api.CommandJob) bool {
+	return finishedStates[j.State]
+}
@@ -0,0 +1,67 @@
+package monitor
+
+import (
+	"testing"
+
+	"github.com/buildkite/agent-stack-k8s/v2/api"
+)
+
+func TestJobBlocked(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		state api.JobStates
+		want  bool
+	}{
+		// No state selected, e.g. by a custom query.
+		{state: "", want: false},
+		{state: api.JobStatesScheduled, want: false},
+		{state: api.JobStatesUnblocked, want: false},
+		{state: api.JobStatesBlocked, want: true},
+		{state: api.JobStatesBlockedFailed, want: true},
+		{state: api.JobStatesWaiting, want: true},
+		{state: api.JobStatesWaitingFailed, want: true},
+		{state: api.JobStatesLimiting, want: true},
+		{state: api.JobStatesLimited, want: true},
+		{state: api.JobStatesPending, want: true},
+	}
+	for _, test := range cases {
+		t.Run(string(test.state), func(t *testing.T) {
+			t.Parallel()
+			if got := jobBlocked(&api.CommandJob{State: test.state}); got != test.want {
+				t.Errorf("jobBlocked(job in state %q) = %t, want %t", test.state, got, test.want)
+			}
+		})
+	}
+}
+
+func TestJobAlreadyFinished(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		state api.JobStates
+		want  bool
+	}{
+		// No state selected, e.g. by a custom query.
+		{state: "", want: false},
+		{state: api.JobStatesScheduled, want: false},
+		{state: api.JobStatesBlocked, want: false},
+		{state: api.JobStatesRunning, want: false},
+		{state: api.JobStatesFinished, want: true},
+		{state: api.JobStatesCanceled, want: true},
+		{state: api.JobStatesCanceling, want: true},
+		{state: api.JobStatesExpired, want: true},
+		{state: api.JobStatesTimedOut, want: true},
+		{state: api.JobStatesTimingOut, want: true},
+		{state: api.JobStatesSkipped, want: true},
+		{state: api.JobStatesBroken, want: true},
+	}
+	for _, test := range cases {
+		t.Run(string(test.state), func(t *testing.T) {
+			t.Parallel()
+			if got := jobAlreadyFinished(&api.CommandJob{State: test.state}); got != test.want {
+				t.Errorf("jobAlreadyFinished(job in state %q) = %t, want %t", test.state, got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,179 @@
+package monitor
+
+import (
+	"context"
+	"time"
+
+	"github.com/buildkite/agent-stack-k8s/v2/internal/controller/metrics"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const promSubsystem = "monitor"
+
+var (
+	tokenValidGauge = metrics.Factory.NewGauge(prometheus.GaugeOpts{
+		Subsystem: promSubsystem,
+		Name:      "token_valid",
+		Help:      "Whether Buildkite accepted the token when it was last verified (1) or rejected it (0)",
+	})
+
+	jobsReservedTagCollisionCounter = metrics.Factory.NewCounter(prometheus.CounterOpts{
+		Subsystem: promSubsystem,
+		Name:      "jobs_reserved_tag_collision_total",
+		Help:      "Count of jobs whose tags include keys reserved for use by the controller",
+	})
+	jobsRequeuedCounter = metrics.Factory.NewCounter(prometheus.CounterOpts{
+		Subsystem: promSubsystem,
+		Name:      "jobs_requeued_total",
+		Help:      "Count of jobs that will be retried after the handler failed with a transient error",
+	})
+	jobQueryErrorsCounter = metrics.Factory.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: promSubsystem,
+		Name:      "job_query_errors_total",
+		Help:      "Count of queries for scheduled jobs that failed, by type of error (dns, tls, timeout, connection, http_4xx, http_5xx, graphql, or other)",
+	}, []string{"type"})
+	jobsPerQueryHistogram = metrics.Factory.NewHistogram(prometheus.HistogramOpts{
+		Subsystem: promSubsystem,
+		Name:      "jobs_per_query",
+		Help:      "Number of jobs returned by each successful query for scheduled jobs",
+		Buckets:   []float64{0, 1, 2, 5, 10, 20, 50, 100, 200, 500},
+	})
+	jobQueryDurationHistogram = metrics.NewDurationHistogram(prometheus.HistogramOpts{
+		Subsystem: promSubsystem,
+		Name:      "job_query_duration_seconds",
+		Help:      "Time taken by each query for scheduled jobs, including queries that failed",
+	})
+	queryResponseBytesHistogram = metrics.Factory.NewHistogram(prometheus.HistogramOpts{
+		Subsystem: promSubsystem,
+		Name:      "query_response_bytes",
+		Help:      "Size in bytes of each response body from the Buildkite GraphQL API (after any decompression)",
+		Buckets:   prometheus.ExponentialBuckets(256, 4, 10),
+	})
+	queryConnectionsCounter = metrics.Factory.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: promSubsystem,
+		Name:      "query_connections_total",
+		Help:      "Count of requests to the Buildkite GraphQL API, by whether they used a new connection (conn=new) or reused an idle one (conn=reused)",
+	}, []string{"conn"})
+	queryDNSLookupsCounter = metrics.Factory.NewCounter(prometheus.CounterOpts{
+		Subsystem: promSubsystem,
+		Name:      "query_dns_lookups_total",
+		Help:      "Count of DNS lookups made to open connections to the Buildkite GraphQL API",
+	})
+	effectiveFetchRateGauge = metrics.Factory.NewGauge(prometheus.GaugeOpts{
+		Subsystem: promSubsystem,
+		Name:      "effective_fetch_rate",
+		Help:      "Polls for scheduled jobs per second, taking into account slowing down while the limiter has no available tokens",
+	})
+	recordedJobsCounter = metrics.Factory.NewCounter(prometheus.CounterOpts{
+		Subsystem: promSubsystem,
+		Name:      "recorded_jobs_total",
+		Help:      "Count of fetched jobs written to the recording",
+	})
+	recordDroppedCounter = metrics.Factory.NewCounter(prometheus.CounterOpts{
+		Subsystem: promSubsystem,
+		Name:      "record_dropped_total",
+		Help:      "Count of fetched jobs that were not recorded, because the recording buffer was full or writing failed",
+	})
+	staleHookDroppedCounter = metrics.Factory.NewCounter(prometheus.CounterOpts{
+		Subsystem: promSubsystem,
+		Name:      "stale_hook_dropped_total",
+		Help:      "Count of stale jobs that the stale job hook was not called with, because its buffer was full",
+	})
+	configInfoGauge = metrics.Factory.NewGaugeVec(prometheus.GaugeOpts{
+		Subsystem: promSubsystem,
+		Name:      "config_info",
+		Help:      "Always 1. Labelled with the queue and agent tags the monitor is configured with (tags are sorted, comma-separated key=value pairs)",
+	}, []string{"queue", "tags"})
+	jobsReachedWorkerCounter = metrics.Factory.NewCounter(prometheus.CounterOpts{
+		Subsystem: promSubsystem,
+		Name:      "jobs_reached_worker_total",
+		Help:      "Count of jobs received by a job handler worker, before filtering by tags",
+	})
+	jobsScheduledCounter = metrics.Factory.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: promSubsystem,
+		Name:      "jobs_scheduled_total",
+		Help:      "Count of jobs successfully passed to the handler chain, by whether the job is a Buildkite retry (attempt=retry) or not (attempt=first)",
+	}, []string{"attempt"})
+	jobsFilteredOutCounter = metrics.Factory.NewCounter(prometheus.CounterOpts{
+		Subsystem: promSubsystem,
+		Name:      "jobs_filtered_out_total",
+		Help:      "Count of jobs skipped because they did not match all of the controller's tags (excluding jobs with tags that could not be parsed)",
+	})
+	jobsTagParseErrorsCounter = metrics.Factory.NewCounter(prometheus.CounterOpts{
+		Subsystem: promSubsystem,
+		Name:      "jobs_tag_parse_errors_total",
+		Help:      "Count of fetched jobs with tags that could not be parsed",
+	})
+	webhookEventsCounter = metrics.Factory.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: promSubsystem,
+		Name:      "webhook_events_total",
+		Help:      "Count of webhooks received, by result (accepted, ignored, invalid_signature, malformed, or dropped because too many were waiting)",
+	}, []string{"result"})
+	webhookFetchErrorsCounter = metrics.Factory.NewCounter(prometheus.CounterOpts{
+		Subsystem: promSubsystem,
+		Name:      "webhook_fetch_errors_total",
+		Help:      "Count of jobs received by webhook that could not be fetched from Buildkite",
+	})
+	webhookJobsNotScheduledCounter = metrics.Factory.NewCounter(prometheus.CounterOpts{
+		Subsystem: promSubsystem,
+		Name:      "webhook_jobs_not_scheduled_total",
+		Help:      "Count of jobs received by webhook that were no longer scheduled (or not command jobs) when fetched",
+	})
+	webhookJobsOtherClusterCounter = metrics.Factory.NewCounter(prometheus.CounterOpts{
+		Subsystem: promSubsystem,
+		Name:      "webhook_jobs_other_cluster_total",
+		Help:      "Count of jobs received by webhook that were skipped because they were not in the configured cluster (or were in a cluster, if none is configured)",
+	})
+	jobsBlockedSkippedCounter = metrics.Factory.NewCounter(prometheus.CounterOpts{
+		Subsystem: promSubsystem,
+		Name:      "jobs_blocked_skipped_total",
+		Help:      "Count of fetched jobs skipped because they were blocked or waiting (e.g. on a block step or a concurrency group), and not yet schedulable",
+	})
+	jobsAlreadyFinishedCounter = metrics.Factory.NewCounter(prometheus.CounterOpts{
+		Subsystem: promSubsystem,
+		Name:      "jobs_already_finished_total",
+		Help:      "Count of fetched jobs skipped because they had already finished, been cancelled, expired, or timed out by the time they were handled",
+	})
+	jobsBranchDeniedCounter = metrics.Factory.NewCounter(prometheus.CounterOpts{
+		Subsystem: promSubsystem,
+		Name:      "jobs_branch_denied_total",
+		Help:      "Count of jobs that matched the tags, but were skipped because their branch is not allowed by branch-filter",
+	})
+	backfillPagesCounter = metrics.Factory.NewCounter(prometheus.CounterOpts{
+		Subsystem: promSubsystem,
+		Name:      "backfill_pages_total",
+		Help:      "Count of pages of scheduled jobs fetched by the startup backfill",
+	})
+	pageRetriesCounter = metrics.Factory.NewCounter(prometheus.CounterOpts{
+		Subsystem: promSubsystem,
+		Name:      "page_retries_total",
+		Help:      "Count of times a page of scheduled jobs was retried after its query failed",
+	})
+	backfillJobsCounter = metrics.Factory.NewCounter(prometheus.CounterOpts{
+		Subsystem: promSubsystem,
+		Name:      "backfill_jobs_total",
+		Help:      "Count of scheduled jobs fetched by the startup backfill",
+	})
+)
+
+// RegisterMetrics registers the gauges that report on the monitor's state
+// (see [metrics.RegisterInstance]) until ctx is done.
+func (m *Monitor) RegisterMetrics(ctx context.Context) error {
+	return metrics.RegisterInstance(ctx,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Subsystem: promSubsystem,
+			Name:      "distinct_pipelines",
+			Help:      "Number of distinct pipelines that jobs were fetched for within the distinct pipelines window",
+		}, func() float64 {
+			return float64(m.pipelines.count(time.Now()))
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Subsystem: promSubsystem,
+			Name:      "filter_pass_ratio",
+			Help:      "Fraction of jobs fetched in the last 10 minutes that matched the controller's tags (NaN if no jobs were fetched). A drop to near 0 suggests the tags are misconfigured",
+		}, func() float64 {
+			return m.passRatio.ratio(time.Now())
+		}),
+	)
+}
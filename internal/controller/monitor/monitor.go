@@ -5,24 +5,42 @@ import (
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"io"
 	"maps"
 	"math/rand/v2"
+	"net/http"
 	"reflect"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/Khan/genqlient/graphql"
 	"github.com/buildkite/agent-stack-k8s/v2/api"
 	"github.com/buildkite/agent-stack-k8s/v2/internal/controller/agenttags"
+	"github.com/buildkite/agent-stack-k8s/v2/internal/controller/config"
+	"github.com/buildkite/agent-stack-k8s/v2/internal/controller/events"
+	"github.com/buildkite/agent-stack-k8s/v2/internal/controller/metrics"
 	"github.com/buildkite/agent-stack-k8s/v2/internal/controller/model"
 	"go.uber.org/zap"
 	"k8s.io/client-go/kubernetes"
 )
 
 type Monitor struct {
-	gql    graphql.Client
-	logger *zap.Logger
-	cfg    Config
+	gql          graphql.Client
+	logger       *zap.Logger
+	cfg          Config
+	requeuer     *requeuer
+	recentErrors *errorRing
+	throttle     *pollThrottle
+	recorder     *recorder
+	stale        *staleNotifier
+	pipelines    *pipelineSet
+	filtered     *filterSampler
+	passRatio    *passRatio
+	tokenCheck   tokenCheck
+	webhookJobs  chan webhookJob
+	capacity     Capacity
 }
 
 type Config struct {
@@ -36,10 +54,94 @@ type Config struct {
 	StaleJobDataTimeout    time.Duration
 	Org                    string
 	Tags                   []string
+
+	// CustomQuery, if set, replaces the built-in GraphQL query used to find
+	// scheduled jobs. CustomQueryVariables are passed to it alongside the
+	// slug, agentQueryRules and cluster variables set by the monitor.
+	CustomQuery          string
+	CustomQueryVariables map[string]any
+
+	// RequeueMaxAttempts is the number of times a job is retried after the
+	// handler fails with a transient error (e.g. the Kubernetes API server
+	// is briefly unavailable). 0 disables retries. RequeueBackoff is the
+	// delay before the first retry, which doubles for each later retry.
+	// After its backoff, a job is passed on with the next batch of jobs,
+	// behind them (RequeueOrderBack, the default) or in front of them
+	// (RequeueOrderFront).
+	RequeueMaxAttempts int
+	RequeueBackoff     time.Duration
+	RequeueOrder       string
+
+	// ErrorBufferSize is the number of recent query and handler errors kept
+	// for ErrorsHandler. If not set, 50 are kept.
+	ErrorBufferSize int
+
+	// Once the Capacity given to SetCapacity has had no available tokens for
+	// SaturatedPollThreshold, jobs are polled for no more often than every
+	// SaturatedPollInterval (10s if not set). 0 disables this.
+	SaturatedPollThreshold time.Duration
+	SaturatedPollInterval  time.Duration
+
+	// PipelinesWindow is how long a pipeline counts towards the
+	// distinct pipelines gauge after a job for it was last fetched. If 0,
+	// 24 hours is used.
+	PipelinesWindow time.Duration
+
+	// BackfillMaxPages, if positive, is the most pages of scheduled jobs
+	// fetched when the monitor starts, to catch up on jobs that were
+	// scheduled while the controller was not running, instead of the first
+	// poll. Each page has BackfillPageSize jobs (500 if not set, the most
+	// Buildkite allows). See backfill.
+	BackfillMaxPages int
+	BackfillPageSize int
+
+	// BackfillPageRetries is how many times a backfill page is retried (from
+	// the same cursor) after its query fails, before the backfill stops with
+	// the pages it already has.
+	BackfillPageRetries int
+
+	// TokenCheckInterval is how often the token is verified (see
+	// VerifyToken). If 0, 5 minutes is used.
+	TokenCheckInterval time.Duration
+
+	// WebhookSecret, if set, enables WebhookHandler, which receives
+	// job.scheduled webhooks signed with it, alongside polling. It can't be
+	// used with CustomQuery.
+	WebhookSecret string
+
+	// FilteredLogSampleRate, if positive, logs 1 in every
+	// FilteredLogSampleRate jobs that don't match the tags at info level,
+	// along with why they don't match.
+	FilteredLogSampleRate int
+
+	// RecordTo, if set, is where every fetched job that matches the tags is
+	// recorded, in the form read by ReadReplay. Jobs are written in the
+	// background, and dropped if writing falls behind.
+	RecordTo io.Writer
+
+	// Events, if set, records Kubernetes events for jobs that are filtered
+	// out or become stale.
+	Events *events.Recorder
+
+	// BranchFilter, if set, restricts the branches whose jobs are scheduled.
+	// Jobs on other branches are skipped (see jobBranch).
+	BranchFilter *config.BranchFilter
 }
 
 func New(logger *zap.Logger, k8s kubernetes.Interface, cfg Config) (*Monitor, error) {
-	graphqlClient := api.NewClient(cfg.Token, cfg.GraphQLEndpoint)
+	graphqlClient := api.NewClient(cfg.Token, cfg.GraphQLEndpoint, api.ClientOptions{
+		ObserveResponseSize: func(bytes int64) {
+			queryResponseBytesHistogram.Observe(float64(bytes))
+		},
+		ObserveConn: func(reused bool) {
+			if reused {
+				queryConnectionsCounter.WithLabelValues("reused").Inc()
+			} else {
+				queryConnectionsCounter.WithLabelValues("new").Inc()
+			}
+		},
+		ObserveDNSLookup: queryDNSLookupsCounter.Inc,
+	})
 
 	// Poll no more frequently than every 1s (please don't DoS us).
 	cfg.PollInterval = min(cfg.PollInterval, time.Second)
@@ -54,11 +156,76 @@ func New(logger *zap.Logger, k8s kubernetes.Interface, cfg Config) (*Monitor, er
 		cfg.JobCreationConcurrency = 5
 	}
 
-	return &Monitor{
-		gql:    graphqlClient,
-		logger: logger,
-		cfg:    cfg,
-	}, nil
+	if cfg.CustomQuery != "" {
+		if err := validateCustomQuery(cfg.CustomQuery, cfg.CustomQueryVariables); err != nil {
+			return nil, err
+		}
+		if cfg.WebhookSecret != "" {
+			return nil, errWebhookCustomQuery
+		}
+	}
+
+	m := &Monitor{
+		gql:          graphqlClient,
+		logger:       logger,
+		cfg:          cfg,
+		recentErrors: newErrorRing(cfg.ErrorBufferSize, cfg.Token),
+		filtered:     newFilterSampler(cfg.FilteredLogSampleRate),
+		passRatio:    &passRatio{},
+	}
+	if cfg.RequeueMaxAttempts > 0 {
+		// Default RequeueBackoff to 1s.
+		if cfg.RequeueBackoff <= 0 {
+			m.cfg.RequeueBackoff = time.Second
+		}
+		m.requeuer = newRequeuer(cfg.RequeueMaxAttempts, m.cfg.RequeueBackoff, cfg.RequeueOrder)
+	}
+	if cfg.RecordTo != nil {
+		m.recorder = newRecorder(logger.Named("recorder"), cfg.RecordTo)
+	}
+	if m.cfg.PipelinesWindow <= 0 {
+		m.cfg.PipelinesWindow = 24 * time.Hour
+	}
+	if m.cfg.BackfillPageSize <= 0 || m.cfg.BackfillPageSize > maxBackfillPageSize {
+		m.cfg.BackfillPageSize = maxBackfillPageSize
+	}
+	if cfg.WebhookSecret != "" {
+		m.webhookJobs = make(chan webhookJob, webhookQueueSize)
+	}
+	m.pipelines = newPipelineSet(m.cfg.PipelinesWindow)
+	return m, nil
+}
+
+// SetStaleHook sets a hook to be called with jobs that became stale before
+// they could be scheduled. It must be called before Start.
+func (m *Monitor) SetStaleHook(hook StaleHook) {
+	m.stale = newStaleNotifier(hook)
+}
+
+// SetCapacity sets the capacity that is checked to slow polling while there is
+// none (see Config.SaturatedPollThreshold), and to limit the startup backfill.
+// It must be called before Start.
+func (m *Monitor) SetCapacity(c Capacity) {
+	m.capacity = c
+	if m.cfg.SaturatedPollThreshold <= 0 {
+		return
+	}
+	slowInterval := m.cfg.SaturatedPollInterval
+	if slowInterval <= 0 {
+		slowInterval = 10 * time.Second
+	}
+	m.throttle = &pollThrottle{
+		capacity:     c,
+		interval:     m.cfg.PollInterval,
+		threshold:    m.cfg.SaturatedPollThreshold,
+		slowInterval: max(slowInterval, m.cfg.PollInterval),
+	}
+}
+
+// ErrorsHandler returns an HTTP handler that serves the most recent query and
+// handler errors as JSON, with tokens redacted.
+func (m *Monitor) ErrorsHandler() http.Handler {
+	return m.recentErrors
 }
 
 // jobResp is used to identify the response types from methods that call the GraphQL API
@@ -69,6 +236,7 @@ func New(logger *zap.Logger, k8s kubernetes.Interface, cfg Config) (*Monitor, er
 type jobResp interface {
 	OrganizationExists() bool
 	CommandJobs() []*api.JobJobTypeCommand
+	NextPageCursor() string
 }
 
 type unclusteredJobResp api.GetScheduledJobsResponse
@@ -85,6 +253,13 @@ func (r unclusteredJobResp) CommandJobs() []*api.JobJobTypeCommand {
 	return jobs
 }
 
+func (r unclusteredJobResp) NextPageCursor() string {
+	if !r.Organization.Jobs.PageInfo.HasNextPage {
+		return ""
+	}
+	return r.Organization.Jobs.PageInfo.EndCursor
+}
+
 type clusteredJobResp api.GetScheduledJobsClusteredResponse
 
 func (r clusteredJobResp) OrganizationExists() bool {
@@ -99,11 +274,40 @@ func (r clusteredJobResp) CommandJobs() []*api.JobJobTypeCommand {
 	return jobs
 }
 
-// getScheduledCommandJobs calls either the clustered or unclustered GraphQL API
-// methods, depending on if a cluster uuid was provided in the config
-func (m *Monitor) getScheduledCommandJobs(ctx context.Context, queue string) (jobResp, error) {
+func (r clusteredJobResp) NextPageCursor() string {
+	if !r.Organization.Jobs.PageInfo.HasNextPage {
+		return ""
+	}
+	return r.Organization.Jobs.PageInfo.EndCursor
+}
+
+// pollPageSize is the number of jobs fetched by each poll.
+const pollPageSize = 100
+
+// getScheduledCommandJobs queries for a page of up to first scheduled jobs,
+// starting after the cursor (or from the start if it is empty). Errors are
+// returned as a *QueryError.
+func (m *Monitor) getScheduledCommandJobs(ctx context.Context, queue string, first int, after string) (jobResp, error) {
+	start := time.Now()
+	resp, err := m.queryScheduledCommandJobs(ctx, queue, first, after)
+	metrics.ObserveDuration(ctx, jobQueryDurationHistogram, time.Since(start).Seconds())
+	if err != nil {
+		return nil, newQueryError(err)
+	}
+	return resp, nil
+}
+
+// queryScheduledCommandJobs calls the custom query if one is configured,
+// otherwise either the clustered or unclustered GraphQL API methods, depending
+// on if a cluster uuid was provided in the config. The custom query is not
+// paginated, so first and after are ignored for it.
+func (m *Monitor) queryScheduledCommandJobs(ctx context.Context, queue string, first int, after string) (jobResp, error) {
+	if m.cfg.CustomQuery != "" {
+		return m.getCustomQueryCommandJobs(ctx, queue)
+	}
+
 	if m.cfg.ClusterUUID == "" {
-		resp, err := api.GetScheduledJobs(ctx, m.gql, m.cfg.Org, []string{fmt.Sprintf("queue=%s", queue)})
+		resp, err := api.GetScheduledJobs(ctx, m.gql, m.cfg.Org, []string{fmt.Sprintf("queue=%s", queue)}, first, after)
 		return unclusteredJobResp(*resp), err
 	}
 
@@ -113,7 +317,7 @@ func (m *Monitor) getScheduledCommandJobs(ctx context.Context, queue string) (jo
 	}
 
 	resp, err := api.GetScheduledJobsClustered(
-		ctx, m.gql, m.cfg.Org, agentQueryRule, encodeClusterGraphQLID(m.cfg.ClusterUUID),
+		ctx, m.gql, m.cfg.Org, agentQueryRule, encodeClusterGraphQLID(m.cfg.ClusterUUID), first, after,
 	)
 	return clusteredJobResp(*resp), err
 }
@@ -134,6 +338,22 @@ func (m *Monitor) Start(ctx context.Context, handler model.JobHandler) <-chan er
 		return errs
 	}
 
+	configuredTags := slices.Sorted(maps.Keys(agentTags))
+	for i, k := range configuredTags {
+		configuredTags[i] = k + "=" + agentTags[k]
+	}
+	configInfoGauge.Reset()
+	configInfoGauge.WithLabelValues(queue, strings.Join(configuredTags, ",")).Set(1)
+
+	if m.recorder != nil {
+		go m.recorder.run(ctx.Done())
+	}
+	go m.stale.run(ctx)
+	go m.runTokenCheck(ctx)
+	if m.webhookJobs != nil {
+		go m.runWebhookJobs(ctx, logger.Named("webhook"), handler, agentTags)
+	}
+
 	go func() {
 		logger.Info("started")
 		defer logger.Info("stopped")
@@ -141,8 +361,17 @@ func (m *Monitor) Start(ctx context.Context, handler model.JobHandler) <-chan er
 		ticker := time.NewTicker(m.cfg.PollInterval)
 		defer ticker.Stop()
 
+		// Poll straight away, unless the backfill has just fetched the
+		// scheduled jobs.
 		first := make(chan struct{}, 1)
-		first <- struct{}{}
+		backfilled, err := m.backfill(ctx, logger, handler, agentTags, queue)
+		if err != nil {
+			errs <- err
+			return
+		}
+		if !backfilled {
+			first <- struct{}{}
+		}
 
 		for {
 			select {
@@ -152,36 +381,62 @@ func (m *Monitor) Start(ctx context.Context, handler model.JobHandler) <-chan er
 			case <-first:
 			}
 
-			resp, err := m.getScheduledCommandJobs(ctx, queue)
+			if m.throttle.skip(time.Now()) {
+				continue
+			}
+
+			resp, err := m.getScheduledCommandJobs(ctx, queue, pollPageSize, "")
+			fetchedAt := time.Now()
 			if err != nil {
 				// Avoid logging if the context is already closed.
 				if ctx.Err() != nil {
 					return
 				}
-				logger.Warn("failed to get scheduled command jobs", zap.Error(err))
+				m.queryFailed(logger, err)
 				continue
 			}
 
 			if !resp.OrganizationExists() {
-				errs <- fmt.Errorf("invalid organization: %q", m.cfg.Org)
+				errs <- m.invalidOrganization()
 				return
 			}
 
 			jobs := resp.CommandJobs()
-			if len(jobs) == 0 {
+			jobsPerQueryHistogram.Observe(float64(len(jobs)))
+			if len(jobs) == 0 && !m.requeuer.hasReady() {
 				continue
 			}
 
 			// The next handler should be the Limiter (except in some tests).
 			// Limiter handles deduplicating jobs before passing to the scheduler.
-			m.passJobsToNextHandler(ctx, logger, handler, agentTags, jobs)
+			m.passJobsToNextHandler(ctx, logger, handler, agentTags, jobs, fetchedAt)
 		}
 	}()
 
 	return errs
 }
 
-func (m *Monitor) passJobsToNextHandler(ctx context.Context, logger *zap.Logger, handler model.JobHandler, agentTags map[string]string, jobs []*api.JobJobTypeCommand) {
+// queryFailed counts and logs a failed query for scheduled jobs.
+func (m *Monitor) queryFailed(logger *zap.Logger, err error) {
+	var qe *QueryError
+	errType := QueryErrorOther
+	if errors.As(err, &qe) {
+		errType = qe.Type
+	}
+	jobQueryErrorsCounter.WithLabelValues(errType).Inc()
+	m.recentErrors.add("query", "", err)
+	logger.Warn("failed to get scheduled command jobs", zap.String("type", errType), zap.Error(err))
+}
+
+// errInvalidOrganization is returned (wrapped) when the organization doesn't
+// exist.
+var errInvalidOrganization = errors.New("invalid organization")
+
+func (m *Monitor) invalidOrganization() error {
+	return fmt.Errorf("%w: %q", errInvalidOrganization, m.cfg.Org)
+}
+
+func (m *Monitor) passJobsToNextHandler(ctx context.Context, logger *zap.Logger, handler model.JobHandler, agentTags map[string]string, jobs []*api.JobJobTypeCommand, fetchedAt time.Time) {
 	// A sneaky way to create a channel that is closed after a duration.
 	// Why not pass directly to handler.Handle? Because that might
 	// interrupt scheduling a pod, when all we want is to bound the
@@ -201,6 +456,11 @@ func (m *Monitor) passJobsToNextHandler(ctx context.Context, logger *zap.Logger,
 		jobs[i], jobs[j] = jobs[j], jobs[i]
 	})
 
+	// Jobs being retried after a transient error go in front of or behind
+	// the rest, depending on RequeueOrder. Workers take jobs in order, so
+	// with enough jobs, those at the back wait for those in front.
+	jobs = m.requeuer.merge(jobs)
+
 	// We also try to get more jobs to the API by processing them in parallel.
 	jobsCh := make(chan *api.JobJobTypeCommand)
 	defer close(jobsCh)
@@ -210,15 +470,19 @@ func (m *Monitor) passJobsToNextHandler(ctx context.Context, logger *zap.Logger,
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			jobHandlerWorker(ctx, staleCtx, logger, handler, agentTags, jobsCh)
+			m.jobHandlerWorker(ctx, staleCtx, logger, handler, agentTags, jobsCh, fetchedAt)
 		}()
 	}
 
-	for _, job := range jobs {
+	for i, job := range jobs {
 		select {
 		case <-ctx.Done():
 			return
 		case <-staleCtx.Done():
+			// Retries of the jobs that weren't passed on are over.
+			for _, j := range jobs[i:] {
+				m.requeuer.forget(j.Uuid)
+			}
 			return
 		case jobsCh <- job:
 		}
@@ -227,7 +491,7 @@ func (m *Monitor) passJobsToNextHandler(ctx context.Context, logger *zap.Logger,
 	wg.Wait()
 }
 
-func jobHandlerWorker(ctx, staleCtx context.Context, logger *zap.Logger, handler model.JobHandler, agentTags map[string]string, jobsCh <-chan *api.JobJobTypeCommand) {
+func (m *Monitor) jobHandlerWorker(ctx, staleCtx context.Context, logger *zap.Logger, handler model.JobHandler, agentTags map[string]string, jobsCh <-chan *api.JobJobTypeCommand, fetchedAt time.Time) {
 	for {
 		select {
 		case <-ctx.Done():
@@ -238,52 +502,193 @@ func jobHandlerWorker(ctx, staleCtx context.Context, logger *zap.Logger, handler
 			if j == nil {
 				return
 			}
-			jobTags, tagErrs := agenttags.TagMapFromTags(j.AgentQueryRules)
-			if len(tagErrs) != 0 {
-				logger.Warn("making a map of job tags", zap.Errors("err", tagErrs))
+			jobsReachedWorkerCounter.Inc()
+
+			// A job being retried that is skipped below won't be retried
+			// again.
+			if jobAlreadyFinished(&j.CommandJob) {
+				m.requeuer.forget(j.Uuid)
+				jobsAlreadyFinishedCounter.Inc()
+				logger.Debug("skipping job because it has already finished",
+					zap.String("uuid", j.Uuid),
+					zap.String("state", string(j.State)),
+				)
+				continue
 			}
 
-			// The api returns jobs that match ANY agent tags (the agent query rules)
-			// However, we can only acquire jobs that match ALL agent tags
-			if !agenttags.JobTagsMatchAgentTags(maps.All(jobTags), agentTags) {
-				logger.Debug("skipping job because it did not match all tags", zap.Any("job", j))
+			if jobBlocked(&j.CommandJob) {
+				m.requeuer.forget(j.Uuid)
+				jobsBlockedSkippedCounter.Inc()
+				logger.Debug("skipping job because it is not schedulable yet",
+					zap.String("uuid", j.Uuid),
+					zap.String("state", string(j.State)),
+				)
 				continue
 			}
 
-			job := model.Job{
-				CommandJob: &j.CommandJob,
-				StaleCh:    staleCtx.Done(),
+			matches, tagsValid := jobMatchesTags(logger, agentTags, &j.CommandJob)
+			m.passRatio.add(matches, fetchedAt)
+			if !matches {
+				m.requeuer.forget(j.Uuid)
+				// Jobs with tags that couldn't be parsed are counted in
+				// jobsTagParseErrorsCounter instead.
+				if tagsValid {
+					jobsFilteredOutCounter.Inc()
+				}
+				if m.filtered.sample() {
+					m.filtered.logFilteredJob(logger, m.cfg.Tags, agentTags, &j.CommandJob)
+				}
+				m.cfg.Events.FilteredOut(j.Uuid)
+				continue
+			}
+
+			if branch := jobBranch(&j.CommandJob); !m.cfg.BranchFilter.Allows(branch) {
+				m.requeuer.forget(j.Uuid)
+				jobsBranchDeniedCounter.Inc()
+				logger.Debug("skipping job because its branch is not allowed",
+					zap.String("uuid", j.Uuid),
+					zap.String("branch", branch),
+				)
+				continue
 			}
+			m.recorder.record(&j.CommandJob, fetchedAt)
+			m.pipelines.add(&j.CommandJob, fetchedAt)
+
+			if m.handleJob(ctx, staleCtx, logger, handler, j) {
+				return
+			}
+		}
+	}
+}
 
-			// The next handler should be the deduper (except in some tests).
-			// Deduper handles deduplicating jobs before passing to the scheduler.
-			logger.Debug("passing job to next handler",
-				zap.Stringer("handler", reflect.TypeOf(handler)),
+// jobMatchesTags reports whether the job can be run by an agent with the
+// agentTags, and whether all the job's tags could be parsed. Tags that can't
+// be parsed are ignored when matching.
+func jobMatchesTags(logger *zap.Logger, agentTags map[string]string, j *api.CommandJob) (matches, tagsValid bool) {
+	jobTags, tagErrs := agenttags.TagMapFromTags(j.AgentQueryRules)
+	tagsValid = len(tagErrs) == 0
+	if !tagsValid {
+		jobsTagParseErrorsCounter.Inc()
+		if tagParseErrorSampler.sample() {
+			logger.Warn("sampled job with tags that could not be parsed",
 				zap.String("uuid", j.Uuid),
+				zap.Strings("job-tags", redactTags(j.AgentQueryRules)),
+				zap.Errors("err", tagErrs),
+				zap.Uint64("sample-rate", tagParseErrorSampler.n),
 			)
-			// The next handler operates under the main ctx, but can optionally
-			// use staleCtx.Done() (stored in job) to skip work. (Only Limiter
-			// does this.)
-			switch err := handler.Handle(ctx, job); {
-			case errors.Is(err, model.ErrDuplicateJob):
-				// Job wasn't scheduled because it's already scheduled.
-
-			case errors.Is(err, model.ErrStaleJob):
-				// Job wasn't scheduled because the data has become stale.
-				// Staleness is set within this function, so we can return early.
-				return
+		}
+	}
 
-			case err != nil:
-				// Note: this check is for the original context, not staleCtx,
-				// in order to avoid the log when the context is cancelled
-				// (particularly during tests).
-				if ctx.Err() != nil {
-					return
-				}
-				logger.Error("failed to create job", zap.Error(err))
+	// Tags with reserved keys are almost certainly a mistake by the
+	// pipeline author, and can cause surprising behaviour.
+	if reserved := agenttags.ReservedKeys(maps.All(jobTags)); len(reserved) > 0 {
+		jobsReservedTagCollisionCounter.Inc()
+		logger.Warn("job tags contain keys reserved for use by the controller",
+			zap.String("uuid", j.Uuid),
+			zap.Strings("reserved-keys", reserved),
+		)
+	}
+
+	// The api returns jobs that match ANY agent tags (the agent query rules)
+	// However, we can only acquire jobs that match ALL agent tags.
+	// Control tags are for the controller, and are added to the tags
+	// of the agent that runs the job, so they aren't matched here.
+	if !agenttags.JobTagsMatchAgentTags(agenttags.WithoutControlTags(maps.All(jobTags)), agentTags) {
+		logger.Debug("skipping job because it did not match all tags", zap.Any("job", j))
+		return false, tagsValid
+	}
+	return true, tagsValid
+}
+
+// handleJob passes the job to the handler. It reports whether the job data has
+// become stale, in which case the caller should stop handling jobs.
+func (m *Monitor) handleJob(ctx, staleCtx context.Context, logger *zap.Logger, handler model.JobHandler, j *api.JobJobTypeCommand) bool {
+	job := model.Job{
+		CommandJob: &j.CommandJob,
+		StaleCh:    staleCtx.Done(),
+	}
+
+	// The next handler should be the router (except in some tests). Router
+	// passes the job to the handler chain for the job's queue, which ends
+	// with the deduper. Deduper handles deduplicating jobs before passing to
+	// the scheduler.
+	logger.Debug("passing job to next handler",
+		zap.Stringer("handler", reflect.TypeOf(handler)),
+		zap.String("uuid", j.Uuid),
+	)
+	// The next handler operates under the main ctx, but can optionally
+	// use staleCtx.Done() (stored in job) to skip work. (Only Limiter
+	// does this.)
+	err := handler.Handle(ctx, job)
+	if err == nil || !isTransient(err) {
+		m.requeuer.forget(j.Uuid)
+	}
+	switch {
+	case err == nil:
+		jobsScheduledCounter.WithLabelValues(jobAttempt(&j.CommandJob)).Inc()
+
+	case errors.Is(err, model.ErrDuplicateJob):
+		// Job wasn't scheduled because it's already scheduled.
+
+	case errors.Is(err, model.ErrQuotaExceeded):
+		// Job wasn't scheduled because a resource quota is full. It's
+		// fetched again by a later query.
+
+	case errors.Is(err, model.ErrDraining):
+		// Job wasn't scheduled because its queue is draining. It's fetched
+		// again by a later query.
+
+	case errors.Is(err, model.ErrCoolingDown):
+		// Job wasn't scheduled because its queue is cooling down after
+		// repeated failures. It's fetched again by a later query.
+
+	case errors.Is(err, model.ErrBranchDenied):
+		// Job wasn't scheduled because its queue's route doesn't allow its
+		// branch.
+
+	case errors.Is(err, model.ErrStaleJob):
+		// Job wasn't scheduled because the data has become stale.
+		// Staleness is set by the caller, so it can stop early.
+		m.stale.notify(job)
+		m.cfg.Events.Stale(j.Uuid)
+		return true
+
+	case err != nil:
+		// Note: this check is for the original context, not staleCtx,
+		// in order to avoid the log when the context is cancelled
+		// (particularly during tests).
+		if ctx.Err() != nil {
+			return true
+		}
+		m.recentErrors.add("handler", j.Uuid, err)
+		if isTransient(err) {
+			if delay, ok := m.requeuer.requeue(j.Uuid); ok {
+				jobsRequeuedCounter.Inc()
+				logger.Warn("failed to create job with a transient error, requeueing",
+					zap.String("uuid", j.Uuid),
+					zap.Duration("delay", delay),
+					zap.Error(err),
+				)
+				go m.retryJob(ctx, j, delay)
+				return false
 			}
 		}
+		logger.Error("failed to create job", zap.Error(err))
+	}
+	return false
+}
+
+// retryJob waits for delay, then adds the job to the retry queue, to be
+// passed to the handler again with the next batch of jobs.
+func (m *Monitor) retryJob(ctx context.Context, j *api.JobJobTypeCommand, delay time.Duration) {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return
+	case <-timer.C:
 	}
+	m.requeuer.enqueue(j)
 }
 
 func encodeClusterGraphQLID(clusterUUID string) string {
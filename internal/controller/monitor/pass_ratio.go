@@ -0,0 +1,72 @@
+package monitor
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// passRatioWindow is how far back the filter pass ratio looks.
+	passRatioWindow = 10 * time.Minute
+
+	// passRatioBuckets is the number of buckets the window is divided into.
+	// Jobs drop out of the window a bucket at a time.
+	passRatioBuckets = 10
+)
+
+// passRatio counts jobs that pass and fail the tag filter within a sliding
+// window, to report the fraction that pass.
+type passRatio struct {
+	mu      sync.Mutex
+	buckets [passRatioBuckets]passRatioBucket
+}
+
+type passRatioBucket struct {
+	// start is the start of the bucket's time slot.
+	start            time.Time
+	passed, filtered int
+}
+
+// add counts a job that passed (or was filtered out) at now.
+func (r *passRatio) add(passed bool, now time.Time) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	width := passRatioWindow / passRatioBuckets
+	start := now.Truncate(width)
+	b := &r.buckets[(start.UnixNano()/int64(width))%passRatioBuckets]
+	if !b.start.Equal(start) {
+		// The bucket is from an earlier time around the ring.
+		*b = passRatioBucket{start: start}
+	}
+	if passed {
+		b.passed++
+	} else {
+		b.filtered++
+	}
+}
+
+// ratio returns passed/(passed+filtered) for jobs within the window before
+// now, or NaN if there were none.
+func (r *passRatio) ratio(now time.Time) float64 {
+	if r == nil {
+		return math.NaN()
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var passed, total int
+	for _, b := range r.buckets {
+		if now.Sub(b.start) >= passRatioWindow {
+			continue
+		}
+		passed += b.passed
+		total += b.passed + b.filtered
+	}
+	if total == 0 {
+		return math.NaN()
+	}
+	return float64(passed) / float64(total)
+}
@@ -0,0 +1,79 @@
+package monitor
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zaptest"
+)
+
+func TestPassRatio(t *testing.T) {
+	t.Parallel()
+
+	start := time.Date(2024, 7, 1, 12, 0, 0, 0, time.UTC)
+	r := &passRatio{}
+	if got := r.ratio(start); !math.IsNaN(got) {
+		t.Errorf("r.ratio(start) with no jobs = %v, want NaN", got)
+	}
+
+	for range 3 {
+		r.add(true, start)
+	}
+	r.add(false, start.Add(5*time.Minute))
+	if got, want := r.ratio(start.Add(5*time.Minute)), 0.75; got != want {
+		t.Errorf("r.ratio(start+5m) = %v, want %v", got, want)
+	}
+
+	// The passed jobs drop out of the window after 10m, leaving only the
+	// filtered job.
+	if got, want := r.ratio(start.Add(11*time.Minute)), 0.0; got != want {
+		t.Errorf("r.ratio(start+11m) = %v, want %v", got, want)
+	}
+
+	// Buckets are reused around the ring.
+	r.add(true, start.Add(20*time.Minute))
+	if got, want := r.ratio(start.Add(20*time.Minute)), 1.0; got != want {
+		t.Errorf("r.ratio(start+20m) = %v, want %v", got, want)
+	}
+	if got := r.ratio(start.Add(time.Hour)); !math.IsNaN(got) {
+		t.Errorf("r.ratio(start+1h) = %v, want NaN", got)
+	}
+}
+
+func TestMonitor_RegisterMetricsPassRatio(t *testing.T) {
+	reg, err := registerMetrics()
+	if err != nil {
+		t.Fatalf("metrics.Register(reg, nil) = %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	registered, err := New(zaptest.NewLogger(t), nil, Config{Org: "my-org"})
+	if err != nil {
+		t.Fatalf("New(...) error = %v", err)
+	}
+	now := time.Now()
+	registered.passRatio.add(true, now)
+	registered.passRatio.add(false, now)
+	regCtx, unregister := context.WithCancel(ctx)
+	if err := registered.RegisterMetrics(regCtx); err != nil {
+		t.Fatalf("registered.RegisterMetrics(ctx) = %v", err)
+	}
+
+	// Creating another monitor (e.g. in another test) doesn't change what
+	// the gauge reports on.
+	other, err := New(zaptest.NewLogger(t), nil, Config{Org: "my-org"})
+	if err != nil {
+		t.Fatalf("New(...) error = %v", err)
+	}
+	other.passRatio.add(true, now)
+	if got, ok := gauge(t, reg, "monitor_filter_pass_ratio"); !ok || got != 0.5 {
+		t.Errorf("monitor_filter_pass_ratio = (%v, %t), want (0.5, true)", got, ok)
+	}
+
+	unregister()
+	waitUnregistered(t, reg, "monitor_filter_pass_ratio")
+}
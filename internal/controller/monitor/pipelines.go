@@ -0,0 +1,56 @@
+package monitor
+
+import (
+	"sync"
+	"time"
+
+	"github.com/buildkite/agent-stack-k8s/v2/api"
+)
+
+// pipelineSet is the set of pipelines that jobs have been fetched for within
+// a window of time.
+type pipelineSet struct {
+	window time.Duration
+
+	mu       sync.Mutex
+	lastSeen map[string]time.Time
+}
+
+func newPipelineSet(window time.Duration) *pipelineSet {
+	return &pipelineSet{
+		window:   window,
+		lastSeen: make(map[string]time.Time),
+	}
+}
+
+// add records that a job for the job's pipeline was seen at now.
+func (s *pipelineSet) add(job *api.CommandJob, now time.Time) {
+	slug := pipelineSlug(job)
+	if s == nil || slug == "" {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastSeen[slug] = now
+}
+
+// count returns the number of pipelines seen within the window before now,
+// forgetting those seen earlier.
+func (s *pipelineSet) count(now time.Time) int {
+	if s == nil {
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for slug, seen := range s.lastSeen {
+		if now.Sub(seen) > s.window {
+			delete(s.lastSeen, slug)
+		}
+	}
+	return len(s.lastSeen)
+}
+
+// pipelineSlug returns the slug of the job's pipeline, from its env.
+func pipelineSlug(job *api.CommandJob) string {
+	return jobEnv(job, "BUILDKITE_PIPELINE_SLUG")
+}
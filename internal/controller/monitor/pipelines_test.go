@@ -0,0 +1,119 @@
+package monitor
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent-stack-k8s/v2/api"
+	"github.com/buildkite/agent-stack-k8s/v2/internal/controller/metrics"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestPipelineSet(t *testing.T) {
+	t.Parallel()
+
+	job := func(slug string) *api.CommandJob {
+		return &api.CommandJob{Env: []string{"BUILDKITE_BUILD_NUMBER=1", "BUILDKITE_PIPELINE_SLUG=" + slug}}
+	}
+	start := time.Date(2024, 7, 1, 12, 0, 0, 0, time.UTC)
+	s := newPipelineSet(time.Hour)
+
+	s.add(job("app"), start)
+	s.add(job("app"), start.Add(10*time.Minute))
+	s.add(job("docs"), start.Add(20*time.Minute))
+	s.add(&api.CommandJob{}, start.Add(20*time.Minute)) // no slug
+	if got, want := s.count(start.Add(30*time.Minute)), 2; got != want {
+		t.Errorf("s.count(start+30m) = %d, want %d", got, want)
+	}
+
+	// app was last seen at 10m, so drops off after 70m. docs stays until 80m.
+	if got, want := s.count(start.Add(75*time.Minute)), 1; got != want {
+		t.Errorf("s.count(start+75m) = %d, want %d", got, want)
+	}
+	if got, want := s.count(start.Add(90*time.Minute)), 0; got != want {
+		t.Errorf("s.count(start+90m) = %d, want %d", got, want)
+	}
+
+	// A nil set counts nothing.
+	var none *pipelineSet
+	if got := none.count(start); got != 0 {
+		t.Errorf("(*pipelineSet)(nil).count(start) = %d, want 0", got)
+	}
+}
+
+// registerMetrics registers the metrics with a registry, the first time it's
+// called, since metrics.Register only has an effect once. Tests using it
+// shouldn't be parallel, so that other tests don't change the metrics.
+var registerMetrics = sync.OnceValues(func() (*prometheus.Registry, error) {
+	reg := prometheus.NewRegistry()
+	return reg, metrics.Register(reg, nil)
+})
+
+// gauge returns the value of the gauge with the name in reg, and whether it
+// is registered.
+func gauge(t *testing.T, reg *prometheus.Registry, name string) (float64, bool) {
+	t.Helper()
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("reg.Gather() error = %v", err)
+	}
+	for _, mf := range families {
+		if mf.GetName() == name {
+			return mf.GetMetric()[0].GetGauge().GetValue(), true
+		}
+	}
+	return 0, false
+}
+
+func TestMonitor_RegisterMetricsPipelines(t *testing.T) {
+	reg, err := registerMetrics()
+	if err != nil {
+		t.Fatalf("metrics.Register(reg, nil) = %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	registered, err := New(zaptest.NewLogger(t), nil, Config{Org: "my-org"})
+	if err != nil {
+		t.Fatalf("New(...) error = %v", err)
+	}
+	registered.pipelines.add(&api.CommandJob{Env: []string{"BUILDKITE_PIPELINE_SLUG=app"}}, time.Now())
+	regCtx, unregister := context.WithCancel(ctx)
+	if err := registered.RegisterMetrics(regCtx); err != nil {
+		t.Fatalf("registered.RegisterMetrics(ctx) = %v", err)
+	}
+
+	// Creating another monitor (e.g. in another test) doesn't change what
+	// the gauge reports on.
+	if _, err := New(zaptest.NewLogger(t), nil, Config{Org: "my-org"}); err != nil {
+		t.Fatalf("New(...) error = %v", err)
+	}
+	if got, ok := gauge(t, reg, "monitor_distinct_pipelines"); !ok || got != 1 {
+		t.Errorf("monitor_distinct_pipelines = (%v, %t), want (1, true)", got, ok)
+	}
+
+	// The gauge goes away with the monitor.
+	unregister()
+	waitUnregistered(t, reg, "monitor_distinct_pipelines")
+}
+
+// waitUnregistered waits for the gauge with the name to be unregistered from
+// reg, after the context given to RegisterMetrics is done.
+func waitUnregistered(t *testing.T, reg *prometheus.Registry, name string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, ok := gauge(t, reg, name); !ok {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s is still registered after ctx is done", name)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
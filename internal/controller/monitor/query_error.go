@@ -0,0 +1,98 @@
+package monitor
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/buildkite/agent-stack-k8s/v2/api"
+
+	"github.com/vektah/gqlparser/v2/gqlerror"
+)
+
+// Types of QueryError.
+const (
+	QueryErrorDNS        = "dns"
+	QueryErrorTLS        = "tls"
+	QueryErrorTimeout    = "timeout"
+	QueryErrorConnection = "connection"
+	QueryErrorHTTP4xx    = "http_4xx"
+	QueryErrorHTTP5xx    = "http_5xx"
+	QueryErrorGraphQL    = "graphql"
+	QueryErrorOther      = "other"
+)
+
+// QueryError is returned when a query for scheduled jobs fails. Type says
+// roughly what went wrong, e.g. to tell Buildkite being unavailable
+// (QueryErrorHTTP5xx) from the token being rejected (QueryErrorHTTP4xx with
+// StatusCode 401).
+type QueryError struct {
+	Type string
+
+	// StatusCode is the HTTP status code, for QueryErrorHTTP4xx and
+	// QueryErrorHTTP5xx.
+	StatusCode int
+
+	Err error
+}
+
+func (e *QueryError) Error() string {
+	return fmt.Sprintf("%s error: %v", e.Type, e.Err)
+}
+
+func (e *QueryError) Unwrap() error { return e.Err }
+
+// newQueryError classifies err by inspecting its chain.
+func newQueryError(err error) *QueryError {
+	qe := &QueryError{Type: QueryErrorOther, Err: err}
+
+	var (
+		httpErr    *api.HTTPError
+		gqlErrs    gqlerror.List
+		gqlErr     *gqlerror.Error
+		dnsErr     *net.DNSError
+		certErr    *tls.CertificateVerificationError
+		unknownCA  x509.UnknownAuthorityError
+		hostErr    x509.HostnameError
+		invalidErr x509.CertificateInvalidError
+		recordErr  tls.RecordHeaderError
+		alertErr   tls.AlertError
+		netErr     net.Error
+		opErr      *net.OpError
+	)
+	switch {
+	case errors.As(err, &httpErr):
+		qe.StatusCode = httpErr.StatusCode
+		switch {
+		case httpErr.StatusCode >= 500:
+			qe.Type = QueryErrorHTTP5xx
+		case httpErr.StatusCode >= 400:
+			qe.Type = QueryErrorHTTP4xx
+		}
+
+	case errors.As(err, &gqlErrs), errors.As(err, &gqlErr):
+		qe.Type = QueryErrorGraphQL
+
+	case errors.As(err, &dnsErr):
+		qe.Type = QueryErrorDNS
+
+	case errors.As(err, &certErr),
+		errors.As(err, &unknownCA),
+		errors.As(err, &hostErr),
+		errors.As(err, &invalidErr),
+		errors.As(err, &recordErr),
+		errors.As(err, &alertErr):
+		qe.Type = QueryErrorTLS
+
+	case errors.Is(err, context.DeadlineExceeded),
+		errors.As(err, &netErr) && netErr.Timeout():
+		qe.Type = QueryErrorTimeout
+
+	case errors.As(err, &opErr):
+		qe.Type = QueryErrorConnection
+	}
+	return qe
+}
@@ -0,0 +1,84 @@
+package monitor
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/url"
+	"testing"
+
+	"github.com/buildkite/agent-stack-k8s/v2/api"
+
+	"github.com/vektah/gqlparser/v2/gqlerror"
+)
+
+func TestNewQueryError(t *testing.T) {
+	t.Parallel()
+
+	urlErr := func(err error) error {
+		return &url.Error{Op: "Post", URL: "https://graphql.buildkite.com/v1", Err: err}
+	}
+	tests := []struct {
+		name       string
+		err        error
+		wantType   string
+		wantStatus int
+	}{
+		{
+			name:     "dns",
+			err:      urlErr(&net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", Name: "graphql.buildkite.com"}}),
+			wantType: QueryErrorDNS,
+		},
+		{
+			name:     "tls",
+			err:      urlErr(x509.UnknownAuthorityError{}),
+			wantType: QueryErrorTLS,
+		},
+		{
+			name:     "client timeout",
+			err:      urlErr(context.DeadlineExceeded),
+			wantType: QueryErrorTimeout,
+		},
+		{
+			name:     "connection refused",
+			err:      urlErr(&net.OpError{Op: "dial", Err: errors.New("connection refused")}),
+			wantType: QueryErrorConnection,
+		},
+		{
+			name:       "unauthorized",
+			err:        urlErr(&api.HTTPError{StatusCode: 401, Status: "401 Unauthorized"}),
+			wantType:   QueryErrorHTTP4xx,
+			wantStatus: 401,
+		},
+		{
+			name:       "bad gateway",
+			err:        urlErr(&api.HTTPError{StatusCode: 502, Status: "502 Bad Gateway"}),
+			wantType:   QueryErrorHTTP5xx,
+			wantStatus: 502,
+		},
+		{
+			name:     "graphql",
+			err:      gqlerror.List{{Message: "Field 'jobs' doesn't exist"}},
+			wantType: QueryErrorGraphQL,
+		},
+		{
+			name:     "other",
+			err:      errors.New("unexpected end of JSON input"),
+			wantType: QueryErrorOther,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			got := newQueryError(test.err)
+			if got.Type != test.wantType || got.StatusCode != test.wantStatus {
+				t.Errorf("newQueryError(%v) = {Type: %q, StatusCode: %d}, want {Type: %q, StatusCode: %d}",
+					test.err, got.Type, got.StatusCode, test.wantType, test.wantStatus)
+			}
+			if got.Unwrap() == nil || got.Unwrap().Error() != test.err.Error() {
+				t.Errorf("newQueryError(%v).Unwrap() = %v, want %v", test.err, got.Unwrap(), test.err)
+			}
+		})
+	}
+}
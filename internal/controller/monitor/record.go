@@ -0,0 +1,77 @@
+package monitor
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/buildkite/agent-stack-k8s/v2/api"
+
+	"go.uber.org/zap"
+)
+
+// recordBufferSize is the number of jobs that can be waiting to be written
+// before more are dropped.
+const recordBufferSize = 1000
+
+// recordedJob is a line in a recording. It can be read by ReadReplay.
+type recordedJob struct {
+	After     string         `json:"after"`
+	FetchedAt time.Time      `json:"fetchedAt"`
+	Job       api.CommandJob `json:"job"`
+}
+
+// recorder writes jobs to a recording in the background, so that recording
+// never slows down scheduling. If writing falls behind, jobs are dropped.
+type recorder struct {
+	logger *zap.Logger
+	w      io.Writer
+	jobs   chan recordedJob
+}
+
+func newRecorder(logger *zap.Logger, w io.Writer) *recorder {
+	return &recorder{
+		logger: logger,
+		w:      w,
+		jobs:   make(chan recordedJob, recordBufferSize),
+	}
+}
+
+// record queues the job to be written, without blocking. It drops the job if
+// the buffer is full.
+func (r *recorder) record(job *api.CommandJob, fetchedAt time.Time) {
+	if r == nil {
+		return
+	}
+	select {
+	case r.jobs <- recordedJob{FetchedAt: fetchedAt, Job: *job}:
+	default:
+		recordDroppedCounter.Inc()
+	}
+}
+
+// run writes queued jobs until done is closed. Each job's after is the time
+// since the previous job written was fetched.
+func (r *recorder) run(done <-chan struct{}) {
+	enc := json.NewEncoder(r.w)
+	var prev time.Time
+	for {
+		select {
+		case <-done:
+			return
+		case rj := <-r.jobs:
+			if !prev.IsZero() {
+				rj.After = rj.FetchedAt.Sub(prev).String()
+			} else {
+				rj.After = "0s"
+			}
+			prev = rj.FetchedAt
+			if err := enc.Encode(rj); err != nil {
+				recordDroppedCounter.Inc()
+				r.logger.Warn("failed to record job", zap.String("uuid", rj.Job.Uuid), zap.Error(err))
+				continue
+			}
+			recordedJobsCounter.Inc()
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package monitor
+
+import (
+	"bufio"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent-stack-k8s/v2/api"
+
+	"go.uber.org/zap/zaptest"
+)
+
+func TestRecorder_RoundTrip(t *testing.T) {
+	t.Parallel()
+
+	pr, pw := io.Pipe()
+	r := newRecorder(zaptest.NewLogger(t), pw)
+	done := make(chan struct{})
+	defer close(done)
+
+	start := time.Date(2024, 7, 1, 12, 0, 0, 0, time.UTC)
+	r.record(&api.CommandJob{Uuid: "job-1", AgentQueryRules: []string{"queue=kubernetes"}}, start)
+	r.record(&api.CommandJob{Uuid: "job-2"}, start.Add(250*time.Millisecond))
+	r.record(&api.CommandJob{Uuid: "job-3"}, start.Add(time.Second))
+	go r.run(done)
+
+	var lines []string
+	sc := bufio.NewScanner(pr)
+	for len(lines) < 3 && sc.Scan() {
+		lines = append(lines, sc.Text())
+	}
+	if err := sc.Err(); err != nil {
+		t.Fatalf("reading recording: %v", err)
+	}
+
+	events, err := ReadReplay(strings.NewReader(strings.Join(lines, "\n")))
+	if err != nil {
+		t.Fatalf("ReadReplay(recording) error = %v", err)
+	}
+	var got []string
+	for _, e := range events {
+		got = append(got, e.After.String()+" "+e.Job.Uuid)
+	}
+	want := []string{"0s job-1", "250ms job-2", "750ms job-3"}
+	if !slices.Equal(got, want) {
+		t.Errorf("ReadReplay(recording) = %v, want %v", got, want)
+	}
+	if !events[2].FetchedAt.Equal(start.Add(time.Second)) {
+		t.Errorf("events[2].FetchedAt = %v, want %v", events[2].FetchedAt, start.Add(time.Second))
+	}
+	if got, want := events[0].Job.AgentQueryRules, []string{"queue=kubernetes"}; !slices.Equal(got, want) {
+		t.Errorf("events[0].Job.AgentQueryRules = %v, want %v", got, want)
+	}
+}
+
+func TestRecorder_DropsWhenFull(t *testing.T) {
+	t.Parallel()
+
+	// Nothing is writing, so the buffer fills up and record must not block.
+	r := newRecorder(zaptest.NewLogger(t), io.Discard)
+	for range recordBufferSize + 10 {
+		r.record(&api.CommandJob{Uuid: "job"}, time.Now())
+	}
+	if got := len(r.jobs); got != recordBufferSize {
+		t.Errorf("len(r.jobs) = %d, want %d", got, recordBufferSize)
+	}
+}
@@ -0,0 +1,185 @@
+package monitor
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/buildkite/agent-stack-k8s/v2/api"
+	"github.com/buildkite/agent-stack-k8s/v2/internal/controller/agenttags"
+	"github.com/buildkite/agent-stack-k8s/v2/internal/controller/model"
+
+	"go.uber.org/zap"
+)
+
+// ReplayEvent is a job in a recording, and when to schedule it.
+type ReplayEvent struct {
+	// After is how long to wait after the previous event (or the start of
+	// the replay) before scheduling the job.
+	After time.Duration
+
+	// FetchedAt is when the job was fetched from Buildkite, for recordings
+	// made by the monitor. It is informational only.
+	FetchedAt time.Time
+
+	Job api.CommandJob
+}
+
+// UnmarshalJSON reads an event of the form
+// {"after": "500ms", "job": {"uuid": "...", "command": "...", "agentQueryRules": ["queue=kubernetes"]}}.
+func (e *ReplayEvent) UnmarshalJSON(b []byte) error {
+	var raw struct {
+		After     string         `json:"after"`
+		FetchedAt time.Time      `json:"fetchedAt"`
+		Job       api.CommandJob `json:"job"`
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&raw); err != nil {
+		return err
+	}
+	if raw.After != "" {
+		after, err := time.ParseDuration(raw.After)
+		if err != nil {
+			return fmt.Errorf("after: %w", err)
+		}
+		if after < 0 {
+			return fmt.Errorf("after must not be negative (got %s)", raw.After)
+		}
+		e.After = after
+	}
+	if raw.Job.Uuid == "" {
+		return errors.New("job.uuid must be set")
+	}
+	e.FetchedAt = raw.FetchedAt
+	e.Job = raw.Job
+	return nil
+}
+
+// ReadReplay reads a recording of jobs in NDJSON form, one ReplayEvent per
+// line. Blank lines and lines starting with # are ignored.
+func ReadReplay(r io.Reader) ([]ReplayEvent, error) {
+	var events []ReplayEvent
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for n := 1; scanner.Scan(); n++ {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		var e ReplayEvent
+		if err := json.Unmarshal(line, &e); err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		events = append(events, e)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// Replay schedules recorded jobs, instead of querying Buildkite for them. It
+// passes them to the same handler chain as Monitor, after the same filtering
+// by tags, so it can be used for load testing and reproducing incidents.
+type Replay struct {
+	logger              *zap.Logger
+	events              []ReplayEvent
+	tags                []string
+	staleJobDataTimeout time.Duration
+	stale               *staleNotifier
+}
+
+// NewReplay creates a Replay of the events for a controller with the agent
+// tags. Each job is considered stale after staleJobDataTimeout (10s if not
+// set), as if it had been returned by a query.
+func NewReplay(logger *zap.Logger, events []ReplayEvent, tags []string, staleJobDataTimeout time.Duration) *Replay {
+	if staleJobDataTimeout <= 0 {
+		staleJobDataTimeout = 10 * time.Second
+	}
+	return &Replay{
+		logger:              logger,
+		events:              events,
+		tags:                tags,
+		staleJobDataTimeout: staleJobDataTimeout,
+	}
+}
+
+// SetStaleHook sets a hook to be called with jobs that became stale before
+// they could be scheduled. It must be called before Start.
+func (r *Replay) SetStaleHook(hook StaleHook) {
+	r.stale = newStaleNotifier(hook)
+}
+
+// Start replays the events in the background, passing each job to the handler
+// at its time. Like Monitor.Start, it returns a channel for fatal errors.
+// Finishing the replay is not an error.
+func (r *Replay) Start(ctx context.Context, handler model.JobHandler) <-chan error {
+	errs := make(chan error, 1)
+
+	agentTags, tagErrs := agenttags.TagMapFromTags(r.tags)
+	if len(tagErrs) != 0 {
+		r.logger.Warn("making a map of agent tags", zap.Errors("err", tagErrs))
+	}
+	if _, ok := agentTags["queue"]; !ok {
+		errs <- errors.New("missing required tag: queue")
+		return errs
+	}
+
+	go r.stale.run(ctx)
+
+	go func() {
+		r.logger.Info("replay started", zap.Int("jobs", len(r.events)))
+
+		// Jobs are handled concurrently, so that a job waiting for the limiter
+		// doesn't hold up the jobs recorded after it.
+		var wg sync.WaitGroup
+		defer func() {
+			wg.Wait()
+			r.logger.Info("replay finished")
+		}()
+
+		for _, e := range r.events {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(e.After):
+			}
+
+			if matches, _ := jobMatchesTags(r.logger, agentTags, &e.Job); !matches {
+				continue
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				r.handle(ctx, handler, e.Job)
+			}()
+		}
+	}()
+
+	return errs
+}
+
+// handle passes the job to the handler, with the job becoming stale after the
+// stale job data timeout.
+func (r *Replay) handle(ctx context.Context, handler model.JobHandler, j api.CommandJob) {
+	staleCtx, cancel := context.WithTimeout(ctx, r.staleJobDataTimeout)
+	defer cancel()
+
+	job := model.Job{CommandJob: &j, StaleCh: staleCtx.Done()}
+	err := handler.Handle(ctx, job)
+	switch {
+	case err == nil, errors.Is(err, model.ErrDuplicateJob), errors.Is(err, model.ErrDraining), errors.Is(err, model.ErrCoolingDown), ctx.Err() != nil:
+	case errors.Is(err, model.ErrStaleJob):
+		r.logger.Warn("replayed job became stale before it was scheduled", zap.String("uuid", j.Uuid))
+		r.stale.notify(job)
+	default:
+		r.logger.Error("failed to create replayed job", zap.String("uuid", j.Uuid), zap.Error(err))
+	}
+}
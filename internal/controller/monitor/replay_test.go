@@ -0,0 +1,104 @@
+package monitor
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent-stack-k8s/v2/internal/controller/model"
+
+	"go.uber.org/zap/zaptest"
+)
+
+const recording = `
+# Two jobs for the kubernetes queue, and one for another queue.
+{"after": "10ms", "job": {"uuid": "job-1", "command": "echo one", "agentQueryRules": ["queue=kubernetes"]}}
+{"job": {"uuid": "job-2", "command": "echo two", "agentQueryRules": ["queue=other"]}}
+
+{"after": "50ms", "job": {"uuid": "job-3", "command": "echo three", "agentQueryRules": ["queue=kubernetes", "bk-spot=true"]}}
+`
+
+func TestReadReplay(t *testing.T) {
+	t.Parallel()
+
+	events, err := ReadReplay(strings.NewReader(recording))
+	if err != nil {
+		t.Fatalf("ReadReplay(recording) error = %v", err)
+	}
+	var got []string
+	for _, e := range events {
+		got = append(got, e.After.String()+" "+e.Job.Uuid)
+	}
+	want := []string{"10ms job-1", "0s job-2", "50ms job-3"}
+	if !slices.Equal(got, want) {
+		t.Errorf("ReadReplay(recording) = %v, want %v", got, want)
+	}
+}
+
+func TestReadReplay_Errors(t *testing.T) {
+	t.Parallel()
+
+	for _, input := range []string{
+		`{"job": {"command": "echo no uuid"}}`,
+		`{"after": "soon", "job": {"uuid": "job-1"}}`,
+		`{"after": "-1s", "job": {"uuid": "job-1"}}`,
+		`{"delay": "1s", "job": {"uuid": "job-1"}}`,
+		`not json`,
+	} {
+		if _, err := ReadReplay(strings.NewReader(input)); err == nil {
+			t.Errorf("ReadReplay(%q) error = nil, want an error", input)
+		}
+	}
+}
+
+type recordingHandler struct {
+	mu    sync.Mutex
+	uuids []string
+	done  chan struct{}
+}
+
+func (h *recordingHandler) Handle(_ context.Context, job model.Job) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.uuids = append(h.uuids, job.Uuid)
+	if len(h.uuids) == 2 {
+		close(h.done)
+	}
+	return nil
+}
+
+func TestReplay(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events, err := ReadReplay(strings.NewReader(recording))
+	if err != nil {
+		t.Fatalf("ReadReplay(recording) error = %v", err)
+	}
+	handler := &recordingHandler{done: make(chan struct{})}
+	replay := NewReplay(zaptest.NewLogger(t), events, []string{"queue=kubernetes"}, 0)
+	start := time.Now()
+	errs := replay.Start(ctx, handler)
+
+	select {
+	case err := <-errs:
+		t.Fatalf("replay.Start(ctx, handler) error = %v", err)
+	case <-handler.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for replayed jobs")
+	}
+	if elapsed := time.Since(start); elapsed < 60*time.Millisecond {
+		t.Errorf("replayed jobs in %v, want at least 60ms", elapsed)
+	}
+
+	handler.mu.Lock()
+	defer handler.mu.Unlock()
+	if want := []string{"job-1", "job-3"}; !slices.Equal(handler.uuids, want) {
+		t.Errorf("handled jobs = %v, want %v", handler.uuids, want)
+	}
+}
@@ -0,0 +1,206 @@
+package monitor
+
+import (
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/buildkite/agent-stack-k8s/v2/api"
+
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// maxPendingRequeues bounds the number of jobs waiting to be retried.
+const maxPendingRequeues = 100
+
+// maxRequeueBackoff bounds how long a job waits before it is retried, however
+// many times it has been retried already.
+const maxRequeueBackoff = 5 * time.Minute
+
+// requeueGrace is how long after its backoff a job's retries are still
+// tracked. A job that hasn't been retried by then (e.g. because it was skipped
+// or went stale once it was back in a batch) is forgotten, so that it doesn't
+// take up one of the maxPendingRequeues places for good.
+const requeueGrace = 5 * time.Minute
+
+// Values for Config.RequeueOrder.
+const (
+	// RequeueOrderBack retries jobs after the other jobs in the batch they
+	// are retried with, which is fairer to those jobs.
+	RequeueOrderBack = "back"
+
+	// RequeueOrderFront retries jobs before the other jobs in the batch they
+	// are retried with, which minimises the retried jobs' latency.
+	RequeueOrderFront = "front"
+)
+
+// requeuer tracks jobs that are waiting to be retried after a transient error.
+type requeuer struct {
+	maxAttempts int
+	backoff     time.Duration
+	front       bool
+
+	// now returns the current time (it is replaced in tests).
+	now func() time.Time
+
+	mu sync.Mutex
+
+	// Retries so far, by job UUID, for jobs that are being retried.
+	attempts map[string]requeueAttempts
+
+	// Jobs whose backoff has passed, in the order they became ready, waiting
+	// to be passed on with the next batch of jobs.
+	ready []*api.JobJobTypeCommand
+}
+
+// requeueAttempts is the retries of a job so far.
+type requeueAttempts struct {
+	// Number of retries.
+	n int
+
+	// When the job stops being tracked if it isn't retried again: the end of
+	// its latest backoff, plus requeueGrace.
+	expires time.Time
+}
+
+func newRequeuer(maxAttempts int, backoff time.Duration, order string) *requeuer {
+	return &requeuer{
+		maxAttempts: maxAttempts,
+		backoff:     backoff,
+		front:       order == RequeueOrderFront,
+		now:         time.Now,
+		attempts:    make(map[string]requeueAttempts),
+	}
+}
+
+// requeue records another retry of the job, and returns how long to wait
+// before retrying: the backoff, doubled for each earlier retry, up to
+// maxRequeueBackoff. It reports false if the job has used all its retries, or
+// too many jobs are already waiting to be retried.
+func (r *requeuer) requeue(uuid string) (time.Duration, bool) {
+	if r == nil {
+		return 0, false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.now()
+	for u, a := range r.attempts {
+		if now.After(a.expires) {
+			delete(r.attempts, u)
+		}
+	}
+	a, ok := r.attempts[uuid]
+	if !ok && len(r.attempts) >= maxPendingRequeues {
+		return 0, false
+	}
+	if a.n >= r.maxAttempts {
+		delete(r.attempts, uuid)
+		return 0, false
+	}
+	backoff := retryBackoff(r.backoff, a.n)
+	r.attempts[uuid] = requeueAttempts{n: a.n + 1, expires: now.Add(backoff + requeueGrace)}
+	return backoff, true
+}
+
+// retryBackoff returns the backoff doubled n times, up to maxRequeueBackoff.
+func retryBackoff(backoff time.Duration, n int) time.Duration {
+	for range n {
+		if backoff >= maxRequeueBackoff/2 {
+			// Stop before doubling overflows.
+			return maxRequeueBackoff
+		}
+		backoff *= 2
+	}
+	return min(backoff, maxRequeueBackoff)
+}
+
+// enqueue adds a job whose backoff has passed to the retry queue.
+func (r *requeuer) enqueue(j *api.JobJobTypeCommand) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ready = append(r.ready, j)
+}
+
+// hasReady reports whether any jobs are in the retry queue.
+func (r *requeuer) hasReady() bool {
+	if r == nil {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.ready) > 0
+}
+
+// merge empties the retry queue into the batch of jobs, in front of or behind
+// the other jobs in the batch. A retried job that is also in the batch is
+// only passed on once, using the batch's (fresher) data for it.
+func (r *requeuer) merge(jobs []*api.JobJobTypeCommand) []*api.JobJobTypeCommand {
+	if r == nil {
+		return jobs
+	}
+	r.mu.Lock()
+	ready := r.ready
+	r.ready = nil
+	r.mu.Unlock()
+	if len(ready) == 0 {
+		return jobs
+	}
+
+	fetched := make(map[string]*api.JobJobTypeCommand, len(jobs))
+	for _, j := range jobs {
+		fetched[j.Uuid] = j
+	}
+	retries := make([]*api.JobJobTypeCommand, 0, len(ready))
+	seen := make(map[string]bool, len(ready))
+	for _, j := range ready {
+		if seen[j.Uuid] {
+			continue
+		}
+		seen[j.Uuid] = true
+		if f, ok := fetched[j.Uuid]; ok {
+			j = f
+		}
+		retries = append(retries, j)
+	}
+	others := slices.DeleteFunc(slices.Clone(jobs), func(j *api.JobJobTypeCommand) bool {
+		return seen[j.Uuid]
+	})
+	if r.front {
+		return append(retries, others...)
+	}
+	return append(others, retries...)
+}
+
+// forget stops tracking retries of the job.
+func (r *requeuer) forget(uuid string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.attempts, uuid)
+}
+
+// isTransient reports whether err is likely to go away if the job is retried
+// soon, e.g. the Kubernetes API server was briefly unavailable or overloaded.
+func isTransient(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	if kerrors.IsInternalError(err) ||
+		kerrors.IsServerTimeout(err) ||
+		kerrors.IsTimeout(err) ||
+		kerrors.IsTooManyRequests(err) ||
+		kerrors.IsServiceUnavailable(err) ||
+		kerrors.IsUnexpectedServerError(err) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
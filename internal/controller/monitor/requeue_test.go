@@ -0,0 +1,204 @@
+package monitor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent-stack-k8s/v2/api"
+	"github.com/buildkite/agent-stack-k8s/v2/internal/controller/model"
+
+	"github.com/google/go-cmp/cmp"
+	"go.uber.org/zap/zaptest"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestRequeuer(t *testing.T) {
+	t.Parallel()
+
+	r := newRequeuer(3, time.Second, RequeueOrderBack)
+	for _, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second} {
+		got, ok := r.requeue("abc")
+		if !ok || got != want {
+			t.Errorf("r.requeue(abc) = (%v, %t), want (%v, true)", got, ok, want)
+		}
+	}
+	if got, ok := r.requeue("abc"); ok {
+		t.Errorf("r.requeue(abc) = (%v, true) after 3 attempts, want false", got)
+	}
+
+	// After a job is forgotten, it gets its retries back.
+	r.requeue("def")
+	r.forget("def")
+	if got, ok := r.requeue("def"); !ok || got != time.Second {
+		t.Errorf("r.requeue(def) = (%v, %t) after forget, want (1s, true)", got, ok)
+	}
+
+	// The backoff stops doubling at maxRequeueBackoff, rather than
+	// overflowing after many retries.
+	r = newRequeuer(100, time.Second, RequeueOrderBack)
+	var last time.Duration
+	for range 100 {
+		last, _ = r.requeue("ghi")
+	}
+	if last != maxRequeueBackoff {
+		t.Errorf("r.requeue(ghi) after 100 attempts = %v, want %v", last, maxRequeueBackoff)
+	}
+
+	// A nil requeuer never requeues.
+	var nilRequeuer *requeuer
+	if got, ok := nilRequeuer.requeue("abc"); ok {
+		t.Errorf("nilRequeuer.requeue(abc) = (%v, true), want false", got)
+	}
+}
+
+func TestRequeuerMerge(t *testing.T) {
+	t.Parallel()
+
+	job := func(uuid, state string) *api.JobJobTypeCommand {
+		return &api.JobJobTypeCommand{CommandJob: api.CommandJob{Uuid: uuid, State: api.JobStates(state)}}
+	}
+	uuids := func(jobs []*api.JobJobTypeCommand) []string {
+		var out []string
+		for _, j := range jobs {
+			out = append(out, j.Uuid+":"+string(j.State))
+		}
+		return out
+	}
+
+	tests := []struct {
+		order string
+		want  []string
+	}{
+		{order: RequeueOrderBack, want: []string{"a:fetched", "c:fetched", "r1:retry", "b:fetched", "r2:retry"}},
+		{order: RequeueOrderFront, want: []string{"r1:retry", "b:fetched", "r2:retry", "a:fetched", "c:fetched"}},
+	}
+	for _, test := range tests {
+		t.Run(test.order, func(t *testing.T) {
+			t.Parallel()
+			r := newRequeuer(3, time.Second, test.order)
+			if r.hasReady() {
+				t.Errorf("r.hasReady() = true before any jobs were enqueued")
+			}
+			r.enqueue(job("r1", "retry"))
+			r.enqueue(job("b", "retry"))
+			r.enqueue(job("r2", "retry"))
+			r.enqueue(job("r1", "retry"))
+			if !r.hasReady() {
+				t.Errorf("r.hasReady() = false after jobs were enqueued")
+			}
+
+			// b is also in the batch, so its fresher data is used, and it
+			// is only passed on once, in the retry's place.
+			batch := []*api.JobJobTypeCommand{job("a", "fetched"), job("b", "fetched"), job("c", "fetched")}
+			got := uuids(r.merge(batch))
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("r.merge(batch) diff (-want +got):\n%s", diff)
+			}
+			if got := uuids(batch); !slices.Equal(got, []string{"a:fetched", "b:fetched", "c:fetched"}) {
+				t.Errorf("r.merge(batch) changed batch to %v", got)
+			}
+			if r.hasReady() {
+				t.Errorf("r.hasReady() = true after merge")
+			}
+			if got := uuids(r.merge(batch)); !slices.Equal(got, []string{"a:fetched", "b:fetched", "c:fetched"}) {
+				t.Errorf("r.merge(batch) with no retries = %v, want the batch unchanged", got)
+			}
+		})
+	}
+}
+
+func TestIsTransient(t *testing.T) {
+	t.Parallel()
+
+	jobs := schema.GroupResource{Group: "batch", Resource: "jobs"}
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{err: nil, want: false},
+		{err: errors.New("nope"), want: false},
+		{err: context.Canceled, want: false},
+		{err: kerrors.NewInvalid(schema.GroupKind{Group: "batch", Kind: "Job"}, "abc", nil), want: false},
+		{err: kerrors.NewAlreadyExists(jobs, "abc"), want: false},
+		{err: kerrors.NewInternalError(errors.New("etcd is sad")), want: true},
+		{err: kerrors.NewServiceUnavailable("try later"), want: true},
+		{err: kerrors.NewTooManyRequests("slow down", 1), want: true},
+		{err: fmt.Errorf("failed to create job: %w", kerrors.NewServerTimeout(jobs, "create", 1)), want: true},
+	}
+	for _, test := range tests {
+		if got := isTransient(test.err); got != test.want {
+			t.Errorf("isTransient(%v) = %t, want %t", test.err, got, test.want)
+		}
+	}
+}
+
+func TestRequeuerExpiresAttempts(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	r := newRequeuer(3, time.Second, RequeueOrderBack)
+	r.now = func() time.Time { return now }
+
+	// Fill every place with jobs that are never retried.
+	for i := range maxPendingRequeues {
+		r.requeue(fmt.Sprintf("lost-%d", i))
+	}
+	if got, ok := r.requeue("new"); ok {
+		t.Fatalf("r.requeue(new) = (%v, true) with %d jobs pending, want false", got, maxPendingRequeues)
+	}
+
+	// Once their backoff and the grace period are over, they are forgotten.
+	now = now.Add(time.Second + requeueGrace + time.Millisecond)
+	if got, ok := r.requeue("new"); !ok || got != time.Second {
+		t.Errorf("r.requeue(new) = (%v, %t) after the others expired, want (1s, true)", got, ok)
+	}
+}
+
+func TestMonitor_SkippedRetriesAreForgotten(t *testing.T) {
+	t.Parallel()
+
+	m, err := New(zaptest.NewLogger(t), nil, Config{
+		Org:                 "my-org",
+		Tags:                []string{"queue=kubernetes"},
+		RequeueMaxAttempts:  3,
+		StaleJobDataTimeout: time.Second,
+	})
+	if err != nil {
+		t.Fatalf("New(...) error = %v", err)
+	}
+
+	// Fill every place with jobs being retried, which have finished by the
+	// time they are back in a batch, or no longer match the tags.
+	for i := range maxPendingRequeues {
+		uuid := fmt.Sprintf("skipped-%d", i)
+		if _, ok := m.requeuer.requeue(uuid); !ok {
+			t.Fatalf("m.requeuer.requeue(%s) = false, want true", uuid)
+		}
+		j := &api.JobJobTypeCommand{CommandJob: api.CommandJob{
+			Uuid:            uuid,
+			State:           api.JobStatesFinished,
+			AgentQueryRules: []string{"queue=kubernetes"},
+		}}
+		if i%2 == 1 {
+			j.State = api.JobStatesScheduled
+			j.AgentQueryRules = []string{"queue=elsewhere"}
+		}
+		m.requeuer.enqueue(j)
+	}
+
+	handler := &model.FakeScheduler{}
+	agentTags := map[string]string{"queue": "kubernetes"}
+	m.passJobsToNextHandler(context.Background(), zaptest.NewLogger(t), handler, agentTags, nil, time.Now())
+
+	if len(handler.Running) != 0 {
+		t.Errorf("handler.Running = %v, want none", handler.Running)
+	}
+	if got, ok := m.requeuer.requeue("new"); !ok || got != time.Second {
+		t.Errorf("m.requeuer.requeue(new) = (%v, %t) after skipping retried jobs, want (1s, true)", got, ok)
+	}
+}
@@ -0,0 +1,62 @@
+package monitor
+
+import (
+	"context"
+
+	"github.com/buildkite/agent-stack-k8s/v2/internal/controller/model"
+)
+
+// staleHookBufferSize is the number of stale jobs that can be waiting for the
+// hook before more are dropped.
+const staleHookBufferSize = 100
+
+// StaleHook is called with each job that wasn't scheduled because its data
+// became stale (i.e. the handler returned [model.ErrStaleJob]), for example
+// to annotate the job's build. A job that is still waiting is fetched again on
+// the next poll, so the hook can be called many times for the same job.
+type StaleHook func(ctx context.Context, job model.Job)
+
+// staleNotifier calls a StaleHook in the background, so that a slow hook
+// never holds up handling jobs. If the hook falls behind, jobs are dropped.
+type staleNotifier struct {
+	hook StaleHook
+	jobs chan model.Job
+}
+
+func newStaleNotifier(hook StaleHook) *staleNotifier {
+	if hook == nil {
+		return nil
+	}
+	return &staleNotifier{
+		hook: hook,
+		jobs: make(chan model.Job, staleHookBufferSize),
+	}
+}
+
+// notify queues the job for the hook, without blocking. It drops the job if
+// the buffer is full.
+func (n *staleNotifier) notify(job model.Job) {
+	if n == nil {
+		return
+	}
+	select {
+	case n.jobs <- job:
+	default:
+		staleHookDroppedCounter.Inc()
+	}
+}
+
+// run calls the hook with queued jobs until ctx is done.
+func (n *staleNotifier) run(ctx context.Context) {
+	if n == nil {
+		return
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case job := <-n.jobs:
+			n.hook(ctx, job)
+		}
+	}
+}
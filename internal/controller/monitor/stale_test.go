@@ -0,0 +1,71 @@
+package monitor
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent-stack-k8s/v2/internal/controller/model"
+
+	"go.uber.org/zap/zaptest"
+)
+
+// staleHandler waits for each job to become stale.
+type staleHandler struct{}
+
+func (staleHandler) Handle(ctx context.Context, job model.Job) error {
+	select {
+	case <-job.StaleCh:
+		return model.ErrStaleJob
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func TestReplay_StaleHook(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events, err := ReadReplay(strings.NewReader(`{"job": {"uuid": "job-1", "agentQueryRules": ["queue=kubernetes"]}}`))
+	if err != nil {
+		t.Fatalf("ReadReplay(recording) error = %v", err)
+	}
+	replay := NewReplay(zaptest.NewLogger(t), events, []string{"queue=kubernetes"}, 10*time.Millisecond)
+	stale := make(chan string, 1)
+	replay.SetStaleHook(func(_ context.Context, job model.Job) {
+		stale <- job.Uuid
+	})
+	errs := replay.Start(ctx, staleHandler{})
+
+	select {
+	case err := <-errs:
+		t.Fatalf("replay.Start(ctx, staleHandler{}) error = %v", err)
+	case got := <-stale:
+		if got != "job-1" {
+			t.Errorf("stale hook called with job %q, want job-1", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the stale hook")
+	}
+}
+
+func TestStaleNotifier_DoesNotBlock(t *testing.T) {
+	t.Parallel()
+
+	// Nothing is running the hook, so the buffer fills up and notify must
+	// not block.
+	n := newStaleNotifier(func(context.Context, model.Job) {})
+	for range staleHookBufferSize + 10 {
+		n.notify(model.Job{})
+	}
+	if got := len(n.jobs); got != staleHookBufferSize {
+		t.Errorf("len(n.jobs) = %d, want %d", got, staleHookBufferSize)
+	}
+
+	// A nil notifier (no hook) does nothing.
+	var none *staleNotifier
+	none.notify(model.Job{})
+}
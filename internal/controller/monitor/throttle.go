@@ -0,0 +1,52 @@
+package monitor
+
+import "time"
+
+// Capacity reports how many more jobs can be scheduled right now. It is
+// implemented by [limiter.MaxInFlight].
+type Capacity interface {
+	AvailableTokens() int
+}
+
+// pollThrottle slows polling for jobs while there has been no capacity to
+// schedule them for a while, since any jobs found would only wait for
+// capacity (using API quota for nothing).
+type pollThrottle struct {
+	capacity Capacity
+
+	// interval is the normal poll interval. Once there has been no capacity
+	// for threshold, polls happen no more often than every slowInterval.
+	interval     time.Duration
+	threshold    time.Duration
+	slowInterval time.Duration
+
+	saturatedSince time.Time
+	lastPoll       time.Time
+}
+
+// skip reports whether to skip the poll due at now. It is called at the
+// normal poll interval, so polling speeds up again within one interval of
+// capacity becoming available.
+func (t *pollThrottle) skip(now time.Time) bool {
+	if t == nil || t.capacity == nil || t.threshold <= 0 {
+		return false
+	}
+	if t.capacity.AvailableTokens() > 0 {
+		t.saturatedSince = time.Time{}
+	} else if t.saturatedSince.IsZero() {
+		t.saturatedSince = now
+	}
+
+	slow := !t.saturatedSince.IsZero() && now.Sub(t.saturatedSince) >= t.threshold
+	if !slow {
+		effectiveFetchRateGauge.Set(1 / t.interval.Seconds())
+		t.lastPoll = now
+		return false
+	}
+	effectiveFetchRateGauge.Set(1 / t.slowInterval.Seconds())
+	if now.Sub(t.lastPoll) < t.slowInterval {
+		return true
+	}
+	t.lastPoll = now
+	return false
+}
@@ -0,0 +1,72 @@
+package monitor
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+type fakeCapacity int
+
+func (c *fakeCapacity) AvailableTokens() int { return int(*c) }
+
+func TestPollThrottle(t *testing.T) {
+	t.Parallel()
+
+	capacity := fakeCapacity(1)
+	throttle := &pollThrottle{
+		capacity:     &capacity,
+		interval:     time.Second,
+		threshold:    5 * time.Second,
+		slowInterval: 10 * time.Second,
+	}
+	start := time.Now()
+	at := func(seconds int) time.Time { return start.Add(time.Duration(seconds) * time.Second) }
+
+	// Polls happen every second while there is capacity, and for a while
+	// after there is none.
+	for s := range 3 {
+		if throttle.skip(at(s)) {
+			t.Errorf("with capacity: throttle.skip(%ds) = true, want false", s)
+		}
+	}
+	capacity = 0
+	for s := 3; s < 8; s++ {
+		if throttle.skip(at(s)) {
+			t.Errorf("saturated below threshold: throttle.skip(%ds) = true, want false", s)
+		}
+	}
+
+	// Once saturated for the threshold, polls happen every 10s.
+	var polled []int
+	for s := 8; s < 30; s++ {
+		if !throttle.skip(at(s)) {
+			polled = append(polled, s)
+		}
+	}
+	if want := []int{17, 27}; !slices.Equal(polled, want) {
+		t.Errorf("saturated: polled at %v, want %v", polled, want)
+	}
+
+	// Polling speeds up as soon as there is capacity again.
+	capacity = 2
+	if throttle.skip(at(30)) {
+		t.Error("after capacity returned: throttle.skip(30s) = true, want false")
+	}
+}
+
+func TestPollThrottle_Disabled(t *testing.T) {
+	t.Parallel()
+
+	capacity := fakeCapacity(0)
+	for _, throttle := range []*pollThrottle{
+		nil,
+		{capacity: &capacity, interval: time.Second},
+	} {
+		for s := range 20 {
+			if throttle.skip(time.Now().Add(time.Duration(s) * time.Second)) {
+				t.Fatalf("%+v.skip(%ds) = true, want false", throttle, s)
+			}
+		}
+	}
+}
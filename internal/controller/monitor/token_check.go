@@ -0,0 +1,113 @@
+package monitor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/buildkite/agent-stack-k8s/v2/api"
+	"go.uber.org/zap"
+)
+
+// ErrInvalidToken is returned (wrapped) by VerifyToken when Buildkite rejects
+// the token.
+var ErrInvalidToken = errors.New("buildkite token was rejected")
+
+// defaultTokenCheckInterval is how often the token is verified if
+// TokenCheckInterval is not set.
+const defaultTokenCheckInterval = 5 * time.Minute
+
+// tokenCheck records the result of the most recent token verification, and
+// serves it as a readiness check.
+type tokenCheck struct {
+	mu      sync.Mutex
+	checked bool
+	err     error // nil if the token is valid
+}
+
+// VerifyToken checks that the Buildkite token is valid by querying for the
+// organization. It returns an error wrapping ErrInvalidToken if Buildkite
+// responds with 401 Unauthorized or 403 Forbidden, and the query's error if it
+// fails for another reason (e.g. a network error), which says nothing about the
+// token. Only the former fails the readiness check.
+func (m *Monitor) VerifyToken(ctx context.Context) error {
+	_, err := api.GetOrganization(ctx, m.gql, m.cfg.Org)
+	var httpErr *api.HTTPError
+	switch {
+	case err == nil:
+		m.tokenCheck.set(nil)
+		tokenValidGauge.Set(1)
+		return nil
+
+	case errors.As(err, &httpErr) &&
+		(httpErr.StatusCode == http.StatusUnauthorized || httpErr.StatusCode == http.StatusForbidden):
+		err = fmt.Errorf("%w (%s): check that it is current and has the GraphQL scopes: %w", ErrInvalidToken, httpErr.Status, err)
+		m.tokenCheck.set(err)
+		tokenValidGauge.Set(0)
+		return err
+
+	default:
+		return err
+	}
+}
+
+// runTokenCheck verifies the token straight away, then every
+// TokenCheckInterval, until ctx is done.
+func (m *Monitor) runTokenCheck(ctx context.Context) {
+	interval := m.cfg.TokenCheckInterval
+	if interval <= 0 {
+		interval = defaultTokenCheckInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		err := m.VerifyToken(ctx)
+		switch {
+		case ctx.Err() != nil:
+			return
+		case errors.Is(err, ErrInvalidToken):
+			m.recentErrors.add("token", "", err)
+			m.logger.Error("Buildkite token is not valid, no jobs can be fetched", zap.Error(err))
+		case err != nil:
+			m.logger.Warn("could not verify Buildkite token", zap.Error(err))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ReadyHandler returns an HTTP handler that serves a readiness check. It
+// responds with 503 Service Unavailable if the most recent token verification
+// found that the token is not valid, and 200 OK otherwise.
+func (m *Monitor) ReadyHandler() http.Handler {
+	return &m.tokenCheck
+}
+
+func (c *tokenCheck) set(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checked = true
+	c.err = err
+}
+
+func (c *tokenCheck) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	c.mu.Lock()
+	checked, err := c.checked, c.err
+	c.mu.Unlock()
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	switch {
+	case !checked:
+		fmt.Fprintln(w, "ok (token not verified yet)")
+	case err != nil:
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, err.Error())
+	default:
+		fmt.Fprintln(w, "ok")
+	}
+}
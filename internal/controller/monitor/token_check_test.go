@@ -0,0 +1,64 @@
+package monitor
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.uber.org/zap/zaptest"
+)
+
+func TestVerifyToken(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name        string
+		status      int
+		wantErr     bool
+		wantInvalid bool
+		wantReady   int
+	}{
+		{name: "valid", status: http.StatusOK, wantReady: http.StatusOK},
+		{name: "unauthorized", status: http.StatusUnauthorized, wantErr: true, wantInvalid: true, wantReady: http.StatusServiceUnavailable},
+		{name: "forbidden", status: http.StatusForbidden, wantErr: true, wantInvalid: true, wantReady: http.StatusServiceUnavailable},
+		// A server error says nothing about the token.
+		{name: "server error", status: http.StatusInternalServerError, wantErr: true, wantReady: http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(test.status)
+				w.Write([]byte(`{"data":{"organization":{"id":"T3JnYW5pemF0aW9u"}}}`))
+			}))
+			defer server.Close()
+
+			m, err := New(zaptest.NewLogger(t), nil, Config{
+				GraphQLEndpoint: server.URL,
+				Token:           "bkua_secret",
+				Org:             "my-org",
+			})
+			if err != nil {
+				t.Fatalf("New(...) error = %v", err)
+			}
+
+			err = m.VerifyToken(context.Background())
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Errorf("m.VerifyToken(ctx) = %v, want error: %t", err, test.wantErr)
+			}
+			if got := errors.Is(err, ErrInvalidToken); got != test.wantInvalid {
+				t.Errorf("errors.Is(m.VerifyToken(ctx), ErrInvalidToken) = %t, want %t", got, test.wantInvalid)
+			}
+
+			rec := httptest.NewRecorder()
+			m.ReadyHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/readyz", nil))
+			if rec.Code != test.wantReady {
+				t.Errorf("/readyz status = %d, want %d (body %q)", rec.Code, test.wantReady, rec.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,242 @@
+package monitor
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/buildkite/agent-stack-k8s/v2/api"
+	"github.com/buildkite/agent-stack-k8s/v2/internal/controller/model"
+	"go.uber.org/zap"
+)
+
+const (
+	// webhookSignatureHeader is the header Buildkite signs webhooks with.
+	webhookSignatureHeader = "X-Buildkite-Signature"
+
+	// webhookMaxBodySize is the largest webhook body that is read.
+	webhookMaxBodySize = 1 << 20
+
+	// webhookMaxSkew is how far the signature's timestamp may be from now,
+	// to limit replays of captured webhooks.
+	webhookMaxSkew = 5 * time.Minute
+
+	// webhookQueueSize is the number of received jobs that can wait to be
+	// fetched. Jobs received while it is full are dropped, and left for
+	// polling to find.
+	webhookQueueSize = 100
+)
+
+// Values of the result label of monitor_webhook_events_total.
+const (
+	webhookResultAccepted         = "accepted"
+	webhookResultIgnored          = "ignored"
+	webhookResultInvalidSignature = "invalid_signature"
+	webhookResultMalformed        = "malformed"
+	webhookResultDropped          = "dropped"
+)
+
+var (
+	errWebhookNoSignature  = errors.New("missing signature")
+	errWebhookBadSignature = errors.New("signature does not match")
+
+	// errWebhookOtherCluster is returned by fetchWebhookJob for jobs that
+	// aren't in the cluster the monitor is configured with (or are in a
+	// cluster, if it isn't configured with one). Webhooks are sent for the
+	// whole organization, so these are jobs that polling wouldn't fetch.
+	errWebhookOtherCluster = errors.New("job is not in the configured cluster")
+
+	// errWebhookCustomQuery is returned by New if both WebhookSecret and
+	// CustomQuery are set.
+	errWebhookCustomQuery = errors.New("webhooks can't be received with a custom jobs query, since jobs received by webhook can't be checked against it")
+)
+
+// webhookJob is a job that Buildkite said was scheduled.
+type webhookJob struct {
+	jobUUID   string
+	buildUUID string
+}
+
+// webhookPayload is the part of a Buildkite webhook that the monitor reads.
+type webhookPayload struct {
+	Event string `json:"event"`
+	Job   struct {
+		ID string `json:"id"`
+	} `json:"job"`
+	Build struct {
+		ID string `json:"id"`
+	} `json:"build"`
+}
+
+// WebhookHandler returns an HTTP handler that receives Buildkite webhooks.
+// job.scheduled events are queued, and the jobs are fetched and passed to the
+// handler given to Start, in the same way as polled jobs (so they are
+// filtered, deduplicated and can become stale in the same way). Other events
+// are ignored. Webhooks must be signed with Config.WebhookSecret.
+func (m *Monitor) WebhookHandler() http.Handler {
+	return http.HandlerFunc(m.serveWebhook)
+}
+
+func (m *Monitor) serveWebhook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if m.webhookJobs == nil {
+		http.Error(w, "webhooks are not enabled", http.StatusNotFound)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, webhookMaxBodySize+1))
+	if err != nil || len(body) > webhookMaxBodySize {
+		webhookEventsCounter.WithLabelValues(webhookResultMalformed).Inc()
+		http.Error(w, "could not read body", http.StatusBadRequest)
+		return
+	}
+	if err := verifyWebhookSignature(m.cfg.WebhookSecret, r.Header.Get(webhookSignatureHeader), body, time.Now()); err != nil {
+		webhookEventsCounter.WithLabelValues(webhookResultInvalidSignature).Inc()
+		m.logger.Warn("rejected webhook with invalid signature",
+			zap.String("remote-addr", r.RemoteAddr),
+			zap.Error(err),
+		)
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	var payload webhookPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		webhookEventsCounter.WithLabelValues(webhookResultMalformed).Inc()
+		http.Error(w, "could not parse body", http.StatusBadRequest)
+		return
+	}
+	if payload.Event != "job.scheduled" {
+		// e.g. the ping sent when the webhook is set up.
+		webhookEventsCounter.WithLabelValues(webhookResultIgnored).Inc()
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if payload.Job.ID == "" || payload.Build.ID == "" {
+		webhookEventsCounter.WithLabelValues(webhookResultMalformed).Inc()
+		http.Error(w, "job.scheduled event without job and build IDs", http.StatusBadRequest)
+		return
+	}
+
+	select {
+	case m.webhookJobs <- webhookJob{jobUUID: payload.Job.ID, buildUUID: payload.Build.ID}:
+		webhookEventsCounter.WithLabelValues(webhookResultAccepted).Inc()
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		webhookEventsCounter.WithLabelValues(webhookResultDropped).Inc()
+		http.Error(w, "too many webhooks waiting", http.StatusServiceUnavailable)
+	}
+}
+
+// verifyWebhookSignature checks a Buildkite webhook signature header, of the
+// form "timestamp=<unix seconds>,signature=<hex HMAC-SHA256>", where the HMAC
+// is of "<timestamp>.<body>" keyed with the secret.
+func verifyWebhookSignature(secret, header string, body []byte, now time.Time) error {
+	if header == "" {
+		return errWebhookNoSignature
+	}
+	var timestamp, signature string
+	for _, part := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch key {
+		case "timestamp":
+			timestamp = value
+		case "signature":
+			signature = value
+		}
+	}
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid timestamp %q", timestamp)
+	}
+	if skew := now.Sub(time.Unix(unix, 0)).Abs(); skew > webhookMaxSkew {
+		return fmt.Errorf("timestamp is %v from now, more than %v", skew.Round(time.Second), webhookMaxSkew)
+	}
+	got, err := hex.DecodeString(signature)
+	if err != nil {
+		return errWebhookBadSignature
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	if !hmac.Equal(got, mac.Sum(nil)) {
+		return errWebhookBadSignature
+	}
+	return nil
+}
+
+// runWebhookJobs fetches each job received by webhook, and passes it to the
+// handler if it is still scheduled, until ctx is done.
+func (m *Monitor) runWebhookJobs(ctx context.Context, logger *zap.Logger, handler model.JobHandler, agentTags map[string]string) {
+	for {
+		var wj webhookJob
+		select {
+		case <-ctx.Done():
+			return
+		case wj = <-m.webhookJobs:
+		}
+
+		job, err := m.fetchWebhookJob(ctx, wj)
+		fetchedAt := time.Now()
+		switch {
+		case ctx.Err() != nil:
+			return
+		case errors.Is(err, errWebhookOtherCluster):
+			webhookJobsOtherClusterCounter.Inc()
+			logger.Debug("job received by webhook is not in the configured cluster", zap.String("uuid", wj.jobUUID))
+			continue
+		case err != nil:
+			webhookFetchErrorsCounter.Inc()
+			m.recentErrors.add("webhook", wj.jobUUID, err)
+			logger.Warn("failed to fetch job received by webhook",
+				zap.String("uuid", wj.jobUUID),
+				zap.String("build", wj.buildUUID),
+				zap.Error(err),
+			)
+			continue
+		case job == nil:
+			// Already picked up (e.g. by polling), or no longer scheduled.
+			webhookJobsNotScheduledCounter.Inc()
+			logger.Debug("job received by webhook is no longer scheduled", zap.String("uuid", wj.jobUUID))
+			continue
+		}
+		m.passJobsToNextHandler(ctx, logger, handler, agentTags, []*api.JobJobTypeCommand{job}, fetchedAt)
+	}
+}
+
+// fetchWebhookJob fetches the job by UUID (rather than through its build,
+// which only lists a build's first jobs), and returns it if it is a command
+// job that is still scheduled, or nil otherwise. It returns
+// errWebhookOtherCluster if the job isn't in the configured cluster, in the
+// same way that polling only fetches jobs in the cluster.
+func (m *Monitor) fetchWebhookJob(ctx context.Context, wj webhookJob) (*api.JobJobTypeCommand, error) {
+	resp, err := api.GetJob(ctx, m.gql, wj.jobUUID)
+	if err != nil {
+		return nil, err
+	}
+	job, ok := resp.Job.(*api.GetJobJobJobTypeCommand)
+	if !ok || job.State != api.JobStatesScheduled {
+		return nil, nil
+	}
+	var cluster string
+	if job.Cluster != nil {
+		cluster = job.Cluster.Uuid
+	}
+	if cluster != m.cfg.ClusterUUID {
+		return nil, fmt.Errorf("%w: job is in cluster %q", errWebhookOtherCluster, cluster)
+	}
+	return &job.JobJobTypeCommand, nil
+}
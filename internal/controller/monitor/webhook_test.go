@@ -0,0 +1,223 @@
+package monitor
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zaptest"
+)
+
+func signWebhook(secret string, ts time.Time, body string) string {
+	timestamp := fmt.Sprint(ts.Unix())
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "." + body))
+	return fmt.Sprintf("timestamp=%s,signature=%s", timestamp, hex.EncodeToString(mac.Sum(nil)))
+}
+
+func TestVerifyWebhookSignature(t *testing.T) {
+	t.Parallel()
+
+	now := time.Unix(1_700_000_000, 0)
+	body := []byte(`{"event":"ping"}`)
+
+	tests := []struct {
+		name    string
+		header  string
+		wantErr error // nil: any error, if wantOK is false
+		wantOK  bool
+	}{
+		{name: "valid", header: signWebhook("secret", now, string(body)), wantOK: true},
+		{name: "valid within skew", header: signWebhook("secret", now.Add(-4*time.Minute), string(body)), wantOK: true},
+		{name: "missing", header: "", wantErr: errWebhookNoSignature},
+		{name: "wrong secret", header: signWebhook("other", now, string(body)), wantErr: errWebhookBadSignature},
+		{name: "different body", header: signWebhook("secret", now, `{"event":"job.scheduled"}`), wantErr: errWebhookBadSignature},
+		{name: "bad hex", header: fmt.Sprintf("timestamp=%d,signature=zz", now.Unix()), wantErr: errWebhookBadSignature},
+		{name: "no timestamp", header: "signature=abcd"},
+		{name: "stale", header: signWebhook("secret", now.Add(-10*time.Minute), string(body))},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			err := verifyWebhookSignature("secret", test.header, body, now)
+			switch {
+			case test.wantOK:
+				if err != nil {
+					t.Errorf("verifyWebhookSignature(...) = %v, want nil", err)
+				}
+			case err == nil:
+				t.Errorf("verifyWebhookSignature(...) = nil, want error")
+			case test.wantErr != nil && !errors.Is(err, test.wantErr):
+				t.Errorf("verifyWebhookSignature(...) = %v, want %v", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestWebhookHandler(t *testing.T) {
+	t.Parallel()
+
+	const scheduled = `{"event":"job.scheduled","job":{"id":"job-uuid"},"build":{"id":"build-uuid"}}`
+
+	tests := []struct {
+		name       string
+		secret     string
+		method     string
+		body       string
+		signWith   string
+		wantStatus int
+		wantQueued bool
+	}{
+		{name: "accepted", secret: "s", method: "POST", body: scheduled, signWith: "s", wantStatus: http.StatusAccepted, wantQueued: true},
+		{name: "ping ignored", secret: "s", method: "POST", body: `{"event":"ping"}`, signWith: "s", wantStatus: http.StatusOK},
+		{name: "invalid signature", secret: "s", method: "POST", body: scheduled, signWith: "t", wantStatus: http.StatusUnauthorized},
+		{name: "malformed", secret: "s", method: "POST", body: `{`, signWith: "s", wantStatus: http.StatusBadRequest},
+		{name: "missing IDs", secret: "s", method: "POST", body: `{"event":"job.scheduled"}`, signWith: "s", wantStatus: http.StatusBadRequest},
+		{name: "GET", secret: "s", method: "GET", wantStatus: http.StatusMethodNotAllowed},
+		{name: "not enabled", method: "POST", body: scheduled, signWith: "s", wantStatus: http.StatusNotFound},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			m, err := New(zaptest.NewLogger(t), nil, Config{
+				Token:         "bkua_secret",
+				Org:           "my-org",
+				WebhookSecret: test.secret,
+			})
+			if err != nil {
+				t.Fatalf("New(...) error = %v", err)
+			}
+
+			req := httptest.NewRequest(test.method, "/webhook", strings.NewReader(test.body))
+			req.Header.Set(webhookSignatureHeader, signWebhook(test.signWith, time.Now(), test.body))
+			rec := httptest.NewRecorder()
+			m.WebhookHandler().ServeHTTP(rec, req)
+			if rec.Code != test.wantStatus {
+				t.Errorf("webhook status = %d, want %d (body %q)", rec.Code, test.wantStatus, rec.Body.String())
+			}
+
+			select {
+			case wj := <-m.webhookJobs:
+				if !test.wantQueued {
+					t.Errorf("webhook queued job %+v, want none", wj)
+				}
+				if want := (webhookJob{jobUUID: "job-uuid", buildUUID: "build-uuid"}); wj != want {
+					t.Errorf("queued job = %+v, want %+v", wj, want)
+				}
+			default:
+				if test.wantQueued {
+					t.Error("webhook queued no job, want one")
+				}
+			}
+		})
+	}
+}
+
+func TestFetchWebhookJob(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name        string
+		clusterUUID string
+		job         string
+		wantUUID    string
+		wantErrorIs error
+	}{
+		{name: "scheduled", job: `{"__typename":"JobTypeCommand","uuid":"job-uuid","state":"SCHEDULED"}`, wantUUID: "job-uuid"},
+		{name: "running", job: `{"__typename":"JobTypeCommand","uuid":"job-uuid","state":"RUNNING"}`},
+		{name: "not a command job", job: `{"__typename":"JobTypeWait"}`},
+		{name: "not found", job: `null`},
+		{
+			name:        "in the configured cluster",
+			clusterUUID: "my-cluster",
+			job:         `{"__typename":"JobTypeCommand","uuid":"job-uuid","state":"SCHEDULED","cluster":{"uuid":"my-cluster"}}`,
+			wantUUID:    "job-uuid",
+		},
+		{
+			name:        "in another cluster",
+			clusterUUID: "my-cluster",
+			job:         `{"__typename":"JobTypeCommand","uuid":"job-uuid","state":"SCHEDULED","cluster":{"uuid":"other-cluster"}}`,
+			wantErrorIs: errWebhookOtherCluster,
+		},
+		{
+			name:        "not in a cluster",
+			clusterUUID: "my-cluster",
+			job:         `{"__typename":"JobTypeCommand","uuid":"job-uuid","state":"SCHEDULED","cluster":null}`,
+			wantErrorIs: errWebhookOtherCluster,
+		},
+		{
+			name:        "in a cluster when none is configured",
+			job:         `{"__typename":"JobTypeCommand","uuid":"job-uuid","state":"SCHEDULED","cluster":{"uuid":"other-cluster"}}`,
+			wantErrorIs: errWebhookOtherCluster,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			// The job is fetched by UUID, whatever the size of its build.
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var req struct {
+					OperationName string            `json:"operationName"`
+					Variables     map[string]string `json:"variables"`
+				}
+				if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+					t.Errorf("decoding request: %v", err)
+				}
+				if req.OperationName != "GetJob" || req.Variables["uuid"] != "job-uuid" {
+					t.Errorf("request = %+v, want GetJob for job-uuid", req)
+				}
+				fmt.Fprintf(w, `{"data":{"job":%s}}`, test.job)
+			}))
+			defer server.Close()
+
+			m, err := New(zaptest.NewLogger(t), nil, Config{
+				GraphQLEndpoint: server.URL,
+				Token:           "bkua_secret",
+				Org:             "my-org",
+				ClusterUUID:     test.clusterUUID,
+			})
+			if err != nil {
+				t.Fatalf("New(...) error = %v", err)
+			}
+
+			job, err := m.fetchWebhookJob(context.Background(), webhookJob{jobUUID: "job-uuid", buildUUID: "build-uuid"})
+			if !errors.Is(err, test.wantErrorIs) {
+				t.Fatalf("m.fetchWebhookJob(ctx, job-uuid) error = %v, want %v", err, test.wantErrorIs)
+			}
+			var gotUUID string
+			if job != nil {
+				gotUUID = job.Uuid
+			}
+			if gotUUID != test.wantUUID {
+				t.Errorf("m.fetchWebhookJob(ctx, job-uuid) = job %q, want %q", gotUUID, test.wantUUID)
+			}
+		})
+	}
+}
+
+func TestNew_WebhookWithCustomQuery(t *testing.T) {
+	t.Parallel()
+
+	_, err := New(zaptest.NewLogger(t), nil, Config{
+		Token:                "bkua_secret",
+		Org:                  "my-org",
+		WebhookSecret:        "webhook-secret",
+		CustomQuery:          `query Jobs($slug: ID!, $agentQueryRules: [String!], $state: [JobStates!]!) { organization(slug: $slug) { id } }`,
+		CustomQueryVariables: map[string]any{"state": []string{"SCHEDULED"}},
+	})
+	if !errors.Is(err, errWebhookCustomQuery) {
+		t.Errorf("New(...) error = %v, want %v", err, errWebhookCustomQuery)
+	}
+}
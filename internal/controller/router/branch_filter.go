@@ -0,0 +1,77 @@
+package router
+
+import (
+	"context"
+	"reflect"
+	"strings"
+
+	"github.com/buildkite/agent-stack-k8s/v2/internal/controller/config"
+	"github.com/buildkite/agent-stack-k8s/v2/internal/controller/model"
+
+	"go.uber.org/zap"
+)
+
+// BranchFilter is a job handler that wraps another job handler (typically
+// Cooldown or Deduper) in a queue's handler chain. It passes on jobs whose
+// branch the queue's filter allows, and returns [model.ErrBranchDenied] for
+// the rest.
+type BranchFilter struct {
+	// Queue the filter belongs to, for metrics.
+	queue string
+
+	// Branches allowed in the queue.
+	filter *config.BranchFilter
+
+	// Next handler in the chain.
+	handler model.JobHandler
+
+	// Logs go here
+	logger *zap.Logger
+}
+
+// NewBranchFilter creates a BranchFilter for the queue.
+func NewBranchFilter(logger *zap.Logger, handler model.JobHandler, queue string, filter *config.BranchFilter) *BranchFilter {
+	return &BranchFilter{
+		queue:   queue,
+		filter:  filter,
+		handler: handler,
+		logger:  logger,
+	}
+}
+
+// Handle passes the job to the next handler if its branch is allowed.
+func (b *BranchFilter) Handle(ctx context.Context, job model.Job) error {
+	if branch := jobBranch(job); !b.filter.Allows(branch) {
+		branchDeniedCounter.WithLabelValues(b.queue).Inc()
+		b.logger.Debug("skipping job because its branch is not allowed in its queue",
+			zap.String("uuid", job.Uuid),
+			zap.String("queue", b.queue),
+			zap.String("branch", branch),
+		)
+		return model.ErrBranchDenied
+	}
+
+	b.logger.Debug("passing job to next handler",
+		zap.Stringer("handler", reflect.TypeOf(b.handler)),
+		zap.String("uuid", job.Uuid),
+	)
+	return b.handler.Handle(ctx, job)
+}
+
+// jobBranch returns the branch of the job's build, or if the query didn't
+// fetch the build (e.g. a custom query), BUILDKITE_BRANCH from its env, in the
+// same way as the monitor's branch filter.
+func jobBranch(job model.Job) string {
+	if job.CommandJob == nil {
+		return ""
+	}
+	if job.Build != nil {
+		return job.Build.Branch
+	}
+	for _, kv := range job.Env {
+		if value, ok := strings.CutPrefix(kv, "BUILDKITE_BRANCH="); ok {
+			return value
+		}
+	}
+	return ""
+}
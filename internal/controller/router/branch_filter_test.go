@@ -0,0 +1,69 @@
+package router_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/buildkite/agent-stack-k8s/v2/api"
+	"github.com/buildkite/agent-stack-k8s/v2/internal/controller/config"
+	"github.com/buildkite/agent-stack-k8s/v2/internal/controller/model"
+	"github.com/buildkite/agent-stack-k8s/v2/internal/controller/router"
+	"github.com/google/uuid"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestBranchFilter(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		build   *api.CommandJobBuild
+		env     []string
+		wantErr error
+	}{
+		{
+			name:  "allowed branch",
+			build: &api.CommandJobBuild{Branch: "main"},
+		},
+		{
+			name:    "denied branch",
+			build:   &api.CommandJobBuild{Branch: "feature/foo"},
+			wantErr: model.ErrBranchDenied,
+		},
+		{
+			name: "branch from env",
+			env:  []string{"BUILDKITE_BRANCH=release/1.0"},
+		},
+		{
+			name:    "unknown branch",
+			wantErr: model.ErrBranchDenied,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			handler := &model.FakeScheduler{}
+			filter := router.NewBranchFilter(zaptest.NewLogger(t), handler, "deploy", &config.BranchFilter{
+				Allow: []string{"main", "release/*"},
+			})
+			job := model.Job{CommandJob: &api.CommandJob{
+				Uuid:            uuid.New().String(),
+				AgentQueryRules: []string{"queue=deploy"},
+				Build:           test.build,
+				Env:             test.env,
+			}}
+			if err := filter.Handle(context.Background(), job); !errors.Is(err, test.wantErr) {
+				t.Errorf("filter.Handle(ctx, job) = %v, want %v", err, test.wantErr)
+			}
+			wantRunning := 0
+			if test.wantErr == nil {
+				wantRunning = 1
+			}
+			if got := len(handler.Running); got != wantRunning {
+				t.Errorf("len(handler.Running) = %d, want %d", got, wantRunning)
+			}
+		})
+	}
+}
@@ -0,0 +1,23 @@
+package router
+
+import (
+	"github.com/buildkite/agent-stack-k8s/v2/internal/controller/metrics"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const promSubsystem = "router"
+
+var (
+	jobsRoutedCounter = metrics.Factory.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: promSubsystem,
+		Name:      "jobs_routed_total",
+		Help:      "Count of jobs passed to a queue's handler chain, by route (the queue, or empty for jobs in queues without a route)",
+	}, []string{"route"})
+
+	branchDeniedCounter = metrics.Factory.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: promSubsystem,
+		Name:      "jobs_branch_denied_total",
+		Help:      "Count of jobs not passed on to be scheduled because their branch was not allowed by their queue's route",
+	}, []string{"queue"})
+)
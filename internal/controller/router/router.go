@@ -0,0 +1,84 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"reflect"
+	"slices"
+
+	"github.com/buildkite/agent-stack-k8s/v2/internal/controller/agenttags"
+	"github.com/buildkite/agent-stack-k8s/v2/internal/controller/model"
+
+	"go.uber.org/zap"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// Router is a job handler that passes each job to the handler chain
+// registered for the job's queue, or to a default handler chain if no chain is
+// registered for the queue.
+type Router struct {
+	// Handler chain for jobs in queues without a route.
+	defaultHandler model.JobHandler
+
+	// Handler chains, keyed by queue.
+	routes map[string]model.JobHandler
+
+	// Logs go here
+	logger *zap.Logger
+}
+
+// New creates a Router. It returns an error describing every problem with the
+// routes, if there are any.
+func New(logger *zap.Logger, defaultHandler model.JobHandler, routes map[string]model.JobHandler) (*Router, error) {
+	var errs []error
+	if defaultHandler == nil {
+		errs = append(errs, errors.New("default handler is nil"))
+	}
+	for _, queue := range slices.Sorted(maps.Keys(routes)) {
+		handler := routes[queue]
+		if queue == "" {
+			errs = append(errs, errors.New("route has an empty queue name"))
+		}
+		for _, msg := range validation.IsValidLabelValue(queue) {
+			errs = append(errs, fmt.Errorf("route for queue %q: %s", queue, msg))
+		}
+		if handler == nil {
+			errs = append(errs, fmt.Errorf("route for queue %q has a nil handler", queue))
+		}
+	}
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("invalid routes: %w", errors.Join(errs...))
+	}
+
+	return &Router{
+		defaultHandler: defaultHandler,
+		routes:         routes,
+		logger:         logger,
+	}, nil
+}
+
+// Handle passes the job to the handler chain for the job's queue.
+func (r *Router) Handle(ctx context.Context, job model.Job) error {
+	route, handler := r.HandlerFor(job)
+	jobsRoutedCounter.WithLabelValues(route).Inc()
+	r.logger.Debug("passing job to next handler",
+		zap.Stringer("handler", reflect.TypeOf(handler)),
+		zap.String("uuid", job.Uuid),
+		zap.String("route", route),
+	)
+	return handler.Handle(ctx, job)
+}
+
+// HandlerFor returns the route (the job's queue, or "" for the default chain)
+// and the handler chain that the job would be passed to.
+func (r *Router) HandlerFor(job model.Job) (string, model.JobHandler) {
+	// Tag parsing errors are logged by the monitor, so ignore them here.
+	tags, _ := agenttags.TagMapFromTags(job.AgentQueryRules)
+	queue := tags["queue"]
+	if handler, ok := r.routes[queue]; ok {
+		return queue, handler
+	}
+	return "", r.defaultHandler
+}
@@ -0,0 +1,90 @@
+package router_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/buildkite/agent-stack-k8s/v2/api"
+	"github.com/buildkite/agent-stack-k8s/v2/internal/controller/model"
+	"github.com/buildkite/agent-stack-k8s/v2/internal/controller/router"
+	"github.com/google/uuid"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestRouter_RoutesByQueue(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	defaultHandler := &model.FakeScheduler{}
+	deployHandler := &model.FakeScheduler{}
+	r, err := router.New(zaptest.NewLogger(t), defaultHandler, map[string]model.JobHandler{
+		"deploy": deployHandler,
+	})
+	if err != nil {
+		t.Fatalf("router.New(...) error = %v", err)
+	}
+
+	for _, rules := range [][]string{
+		{"queue=deploy"},
+		{"queue=deploy", "os=linux"},
+		{"queue=ci"},
+		{"os=linux"},
+		nil,
+	} {
+		job := model.Job{CommandJob: &api.CommandJob{
+			Uuid:            uuid.New().String(),
+			AgentQueryRules: rules,
+		}}
+		if err := r.Handle(ctx, job); err != nil {
+			t.Errorf("r.Handle(ctx, job with rules %q) = %v", rules, err)
+		}
+	}
+
+	if got, want := len(deployHandler.Running), 2; got != want {
+		t.Errorf("len(deployHandler.Running) = %d, want %d", got, want)
+	}
+	if got, want := len(defaultHandler.Running), 3; got != want {
+		t.Errorf("len(defaultHandler.Running) = %d, want %d", got, want)
+	}
+}
+
+func TestRouter_InvalidRoutes(t *testing.T) {
+	t.Parallel()
+
+	handler := &model.FakeScheduler{}
+	tests := []struct {
+		name           string
+		defaultHandler model.JobHandler
+		routes         map[string]model.JobHandler
+	}{
+		{
+			name:   "nil default",
+			routes: map[string]model.JobHandler{"deploy": handler},
+		},
+		{
+			name:           "empty queue",
+			defaultHandler: handler,
+			routes:         map[string]model.JobHandler{"": handler},
+		},
+		{
+			name:           "invalid queue",
+			defaultHandler: handler,
+			routes:         map[string]model.JobHandler{"deploy queue!": handler},
+		},
+		{
+			name:           "nil route handler",
+			defaultHandler: handler,
+			routes:         map[string]model.JobHandler{"deploy": nil},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			if _, err := router.New(zaptest.NewLogger(t), test.defaultHandler, test.routes); err == nil {
+				t.Errorf("router.New(...) error = nil, want an error")
+			}
+		})
+	}
+}
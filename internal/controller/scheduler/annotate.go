@@ -0,0 +1,62 @@
+package scheduler
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"time"
+
+	"github.com/buildkite/agent-stack-k8s/v2/api"
+
+	"go.uber.org/zap"
+	batchv1 "k8s.io/api/batch/v1"
+)
+
+const (
+	// annotationContext is the context of the build annotation that the
+	// Kubernetes jobs are listed in. Each job appends a line to it.
+	annotationContext = "agent-stack-k8s"
+
+	// annotateTimeout limits how long annotating a build can take.
+	annotateTimeout = 30 * time.Second
+)
+
+// annotateBuild appends a line to the Buildkite build's annotation, naming the
+// Kubernetes job created for the Buildkite job, and how to find its pod. It is
+// best-effort: failures are logged and counted, and don't affect the job.
+func (w *worker) annotateBuild(ctx context.Context, inputs buildInputs, kjob *batchv1.Job) {
+	buildID := inputs.envMap["BUILDKITE_BUILD_ID"]
+	if buildID == "" {
+		// Not a job we can annotate the build of (e.g. a replayed job).
+		return
+	}
+	label := inputs.envMap["BUILDKITE_LABEL"]
+	if label == "" {
+		label = inputs.uuid
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, annotateTimeout)
+	defer cancel()
+	_, err := api.BuildAnnotate(ctx, w.cfg.AnnotationClient, api.BuildAnnotateInput{
+		Append:  true,
+		BuildID: encodeBuildGraphQLID(buildID),
+		Body: fmt.Sprintf("* %s (job `%s`): Kubernetes job `%s` in namespace `%s`, see `kubectl get pods -n %s -l job-name=%s`\n",
+			label, inputs.uuid, kjob.Name, kjob.Namespace, kjob.Namespace, kjob.Name),
+		Context: annotationContext,
+		Style:   api.AnnotationStyleInfo,
+	})
+	if err != nil {
+		annotateErrorsCounter.Inc()
+		w.logger.Warn("failed to annotate build with the Kubernetes job name",
+			zap.String("uuid", inputs.uuid),
+			zap.String("build", buildID),
+			zap.String("name", kjob.Name),
+			zap.Error(err),
+		)
+	}
+}
+
+// encodeBuildGraphQLID returns the GraphQL ID of the build with the UUID.
+func encodeBuildGraphQLID(buildUUID string) string {
+	return base64.StdEncoding.EncodeToString([]byte("Build---" + buildUUID))
+}
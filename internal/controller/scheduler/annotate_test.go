@@ -0,0 +1,70 @@
+package scheduler_test
+
+import (
+	"context"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Khan/genqlient/graphql"
+	"github.com/buildkite/agent-stack-k8s/v2/api"
+	"github.com/buildkite/agent-stack-k8s/v2/internal/controller/model"
+	"github.com/buildkite/agent-stack-k8s/v2/internal/controller/scheduler"
+
+	"go.uber.org/zap/zaptest"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// requestRecorder is a graphql.Client that sends each request to a channel,
+// and responds with no data.
+type requestRecorder chan *graphql.Request
+
+func (r requestRecorder) MakeRequest(_ context.Context, req *graphql.Request, _ *graphql.Response) error {
+	r <- req
+	return nil
+}
+
+func TestHandleAnnotatesBuild(t *testing.T) {
+	t.Parallel()
+
+	requests := make(requestRecorder, 1)
+	worker := scheduler.New(zaptest.NewLogger(t), fake.NewClientset(), scheduler.Config{
+		Namespace:            "buildkite",
+		Image:                "buildkite/agent:latest",
+		AgentTokenSecretName: "bkcq_1234567890",
+		AnnotationClient:     requests,
+	})
+
+	job := model.Job{CommandJob: &api.CommandJob{
+		Uuid:            "abc",
+		Command:         "echo hello world",
+		AgentQueryRules: []string{"queue=kubernetes"},
+		Env:             []string{"BUILDKITE_BUILD_ID=build-uuid", "BUILDKITE_LABEL=:go: test"},
+	}}
+	if err := worker.Handle(context.Background(), job); err != nil {
+		t.Fatalf("worker.Handle(ctx, job) error = %v", err)
+	}
+
+	var req *graphql.Request
+	select {
+	case req = <-requests:
+	case <-time.After(5 * time.Second):
+		t.Fatal("build was not annotated")
+	}
+	if got, want := req.OpName, "BuildAnnotate"; got != want {
+		t.Errorf("req.OpName = %q, want %q", got, want)
+	}
+	input := req.Variables.(interface{ GetInput() api.BuildAnnotateInput }).GetInput()
+	if got, want := input.BuildID, base64.StdEncoding.EncodeToString([]byte("Build---build-uuid")); got != want {
+		t.Errorf("input.BuildID = %q, want %q", got, want)
+	}
+	if !input.Append {
+		t.Error("input.Append = false, want true")
+	}
+	for _, want := range []string{":go: test", "`abc`", "`buildkite`", "kubectl get pods -n buildkite -l job-name=buildkite-"} {
+		if !strings.Contains(input.Body, want) {
+			t.Errorf("input.Body = %q, want it to contain %q", input.Body, want)
+		}
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"slices"
 
 	"github.com/buildkite/agent-stack-k8s/v2/internal/version"
 
@@ -12,6 +13,7 @@ import (
 	"github.com/buildkite/agent/v3/logger"
 
 	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 )
@@ -65,6 +67,20 @@ func failJob(
 	return nil
 }
 
+// agentTokenSecretOf returns the name of the Secret that the pod's containers
+// get the agent token from, or "" if none do.
+func agentTokenSecretOf(pod *corev1.Pod) string {
+	for _, c := range slices.Concat(pod.Spec.InitContainers, pod.Spec.Containers) {
+		for _, env := range c.Env {
+			if env.Name != agentTokenKey || env.ValueFrom == nil || env.ValueFrom.SecretKeyRef == nil {
+				continue
+			}
+			return env.ValueFrom.SecretKeyRef.Name
+		}
+	}
+	return ""
+}
+
 // fetchAgentToken fetches the agent token from the agent token secret.
 func fetchAgentToken(ctx context.Context, logger *zap.Logger, k8sClient kubernetes.Interface, namespace, agentTokenSecretName string) (string, error) {
 	// Need to fetch the agent token ourselves.
@@ -0,0 +1,82 @@
+package scheduler
+
+import (
+	"github.com/buildkite/agent-stack-k8s/v2/internal/controller/metrics"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const promSubsystem = "scheduler"
+
+var (
+	priorityClassDeniedCounter = metrics.Factory.NewCounter(prometheus.CounterOpts{
+		Subsystem: promSubsystem,
+		Name:      "priority_class_denied_total",
+		Help:      "Count of priority classes selected by jobs (with the priority class tag, or the kubernetes plugin's podSpec or podSpecPatch) that were ignored because they are not in the allow-list",
+	})
+	createRetriesCounter = metrics.Factory.NewCounter(prometheus.CounterOpts{
+		Subsystem: promSubsystem,
+		Name:      "create_retries_total",
+		Help:      "Count of retried attempts to create a Kubernetes job after a conflict or timeout",
+	})
+	annotateErrorsCounter = metrics.Factory.NewCounter(prometheus.CounterOpts{
+		Subsystem: promSubsystem,
+		Name:      "build_annotation_errors_total",
+		Help:      "Count of failures to annotate a Buildkite build with the name of a Kubernetes job created for it",
+	})
+	createAlreadyExistsCounter = metrics.Factory.NewCounter(prometheus.CounterOpts{
+		Subsystem: promSubsystem,
+		Name:      "create_already_exists_total",
+		Help:      "Count of attempts to create a Kubernetes job that already existed",
+	})
+	handoffDurationHistogram = metrics.NewDurationHistogram(prometheus.HistogramOpts{
+		Subsystem: promSubsystem,
+		Name:      "handoff_duration_seconds",
+		Help:      "Time from a job taking a limiter token to the start of creating its Kubernetes job (only observed when there is a limiter)",
+	})
+	createDurationHistogram = metrics.NewDurationHistogram(prometheus.HistogramOpts{
+		Subsystem: promSubsystem,
+		Name:      "create_duration_seconds",
+		Help:      "Time taken to create a Kubernetes job, including retries",
+	})
+	createCallsCounter = metrics.Factory.NewCounter(prometheus.CounterOpts{
+		Subsystem: promSubsystem,
+		Name:      "create_calls_total",
+		Help:      "Count of calls to create Kubernetes jobs, including retries",
+	})
+	createThrottledCounter = metrics.Factory.NewCounter(prometheus.CounterOpts{
+		Subsystem: promSubsystem,
+		Name:      "create_throttled_total",
+		Help:      "Count of calls to create Kubernetes jobs that were delayed by the job-create-qps limit",
+	})
+	apiserverThrottledCounter = metrics.Factory.NewCounter(prometheus.CounterOpts{
+		Subsystem: promSubsystem,
+		Name:      "apiserver_throttled_total",
+		Help:      "Count of calls to create Kubernetes jobs that the apiserver rejected with 429 Too Many Requests",
+	})
+	createThrottleWaitHistogram = metrics.NewDurationHistogram(prometheus.HistogramOpts{
+		Subsystem: promSubsystem,
+		Name:      "create_throttle_wait_seconds",
+		Help:      "Time that delayed calls to create Kubernetes jobs waited for the job-create-qps limit",
+	})
+	quotaBlockedCounter = metrics.Factory.NewCounter(prometheus.CounterOpts{
+		Subsystem: promSubsystem,
+		Name:      "quota_blocked_total",
+		Help:      "Count of jobs that were not created because a resource quota did not have room for them",
+	})
+	runtimeDeniedCounter = metrics.Factory.NewCounter(prometheus.CounterOpts{
+		Subsystem: promSubsystem,
+		Name:      "runtime_denied_total",
+		Help:      "Count of jobs that were not scheduled because their runtime tag's value is not in the runtime classes",
+	})
+	resourceHintClampedCounter = metrics.Factory.NewCounter(prometheus.CounterOpts{
+		Subsystem: promSubsystem,
+		Name:      "resource_hints_clamped_total",
+		Help:      "Count of bk-cpu, bk-memory and bk-ephemeral-storage tag values that were outside the resource hint bounds, and were clamped",
+	})
+	imageDeniedCounter = metrics.Factory.NewCounter(prometheus.CounterOpts{
+		Subsystem: promSubsystem,
+		Name:      "image_denied_total",
+		Help:      "Count of jobs that were not scheduled because they use an image that is not in the allow-list",
+	})
+)
@@ -281,7 +281,12 @@ func (w *podWatcher) cancelImagePullBackOff(ctx context.Context, log *zap.Logger
 }
 
 func (w *podWatcher) failJob(ctx context.Context, log *zap.Logger, pod *corev1.Pod, jobUUID uuid.UUID, images map[string]struct{}) {
-	agentToken, err := fetchAgentToken(ctx, w.logger, w.k8s, w.cfg.Namespace, w.cfg.AgentTokenSecret)
+	// The pod's queue may use a different agent token secret to the default.
+	secret := agentTokenSecretOf(pod)
+	if secret == "" {
+		secret = w.cfg.AgentTokenSecret
+	}
+	agentToken, err := fetchAgentToken(ctx, w.logger, w.k8s, w.cfg.Namespace, secret)
 	if err != nil {
 		log.Error("Couldn't fetch agent token in order to fail the job", zap.Error(err))
 		return
@@ -0,0 +1,146 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/buildkite/agent-stack-k8s/v2/internal/controller/model"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// QuotaChecker checks the namespace's resource quotas before a job is
+// created, so that a job whose pod would be rejected by a quota isn't created
+// (where it would hold a limiter token without running).
+//
+// Only unscoped quotas are checked. Usage is as last reported by Kubernetes,
+// which lags behind pods that were just created, so the check can let some
+// jobs through that then wait for quota anyway.
+type QuotaChecker struct {
+	namespace string
+	lister    corelisters.ResourceQuotaLister
+}
+
+func NewQuotaChecker(namespace string) *QuotaChecker {
+	return &QuotaChecker{namespace: namespace}
+}
+
+// RegisterInformer registers the checker to watch resource quotas. The factory
+// must not filter by label, since quotas don't have the labels of job pods.
+func (q *QuotaChecker) RegisterInformer(ctx context.Context, factory informers.SharedInformerFactory) error {
+	informer := factory.Core().V1().ResourceQuotas()
+	q.lister = informer.Lister()
+	quotaInformer := informer.Informer()
+	go factory.Start(ctx.Done())
+
+	if !cache.WaitForCacheSync(ctx.Done(), quotaInformer.HasSynced) {
+		return fmt.Errorf("failed to sync informer cache")
+	}
+	return nil
+}
+
+// Check returns an error wrapping [model.ErrQuotaExceeded] if a quota doesn't
+// have room for a pod with the spec.
+func (q *QuotaChecker) Check(podSpec *corev1.PodSpec) error {
+	if q == nil || q.lister == nil {
+		return nil
+	}
+	quotas, err := q.lister.ResourceQuotas(q.namespace).List(labels.Everything())
+	if err != nil {
+		return fmt.Errorf("failed to list resource quotas: %w", err)
+	}
+	requests, limits := podResources(podSpec)
+
+	var errs []error
+	for _, quota := range quotas {
+		if len(quota.Spec.Scopes) > 0 || quota.Spec.ScopeSelector != nil {
+			continue
+		}
+		for name, hard := range quota.Spec.Hard {
+			need, ok := quotaNeed(name, requests, limits)
+			if !ok || need.IsZero() {
+				continue
+			}
+			total := quota.Status.Used[name]
+			total.Add(need)
+			if total.Cmp(hard) > 0 {
+				used := quota.Status.Used[name]
+				errs = append(errs, fmt.Errorf("%s: %s needs %s, but %s of %s is used",
+					quota.Name, name, need.String(), used.String(), hard.String()))
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%w: %w", model.ErrQuotaExceeded, errors.Join(errs...))
+	}
+	return nil
+}
+
+// quotaNeed returns how much of the quota resource a job needs. It reports
+// false for resources that don't apply to jobs (such as services).
+func quotaNeed(name corev1.ResourceName, requests, limits corev1.ResourceList) (resource.Quantity, bool) {
+	switch n := string(name); {
+	case name == corev1.ResourcePods, n == "count/pods", n == "count/jobs.batch":
+		return *resource.NewQuantity(1, resource.DecimalSI), true
+	case strings.HasPrefix(n, "requests."):
+		return requests[corev1.ResourceName(strings.TrimPrefix(n, "requests."))], true
+	case strings.HasPrefix(n, "limits."):
+		return limits[corev1.ResourceName(strings.TrimPrefix(n, "limits."))], true
+	case name == corev1.ResourceCPU, name == corev1.ResourceMemory, name == corev1.ResourceEphemeralStorage:
+		return requests[name], true
+	}
+	return resource.Quantity{}, false
+}
+
+// podResources returns the requests and limits of a pod with the spec, the
+// same way they are counted against quotas: the larger of the sum over the
+// containers, and each init container (which run one at a time), plus the
+// pod overhead. Sidecar init containers keep running, so are added to both.
+func podResources(podSpec *corev1.PodSpec) (requests, limits corev1.ResourceList) {
+	requests, limits = corev1.ResourceList{}, corev1.ResourceList{}
+	for _, c := range podSpec.Containers {
+		addResources(requests, c.Resources.Requests)
+		addResources(limits, c.Resources.Limits)
+	}
+	sidecarRequests, sidecarLimits := corev1.ResourceList{}, corev1.ResourceList{}
+	for _, c := range podSpec.InitContainers {
+		if c.RestartPolicy != nil && *c.RestartPolicy == corev1.ContainerRestartPolicyAlways {
+			addResources(requests, c.Resources.Requests)
+			addResources(limits, c.Resources.Limits)
+			addResources(sidecarRequests, c.Resources.Requests)
+			addResources(sidecarLimits, c.Resources.Limits)
+			continue
+		}
+		initRequests, initLimits := sidecarRequests.DeepCopy(), sidecarLimits.DeepCopy()
+		addResources(initRequests, c.Resources.Requests)
+		addResources(initLimits, c.Resources.Limits)
+		maxResources(requests, initRequests)
+		maxResources(limits, initLimits)
+	}
+	addResources(requests, podSpec.Overhead)
+	addResources(limits, podSpec.Overhead)
+	return requests, limits
+}
+
+func addResources(dst, src corev1.ResourceList) {
+	for name, q := range src {
+		sum := dst[name]
+		sum.Add(q)
+		dst[name] = sum
+	}
+}
+
+func maxResources(dst, src corev1.ResourceList) {
+	for name, q := range src {
+		if cur, ok := dst[name]; !ok || q.Cmp(cur) > 0 {
+			dst[name] = q.DeepCopy()
+		}
+	}
+}
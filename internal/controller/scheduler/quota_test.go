@@ -0,0 +1,117 @@
+package scheduler_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/buildkite/agent-stack-k8s/v2/internal/controller/model"
+	"github.com/buildkite/agent-stack-k8s/v2/internal/controller/scheduler"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/utils/ptr"
+)
+
+func TestQuotaChecker(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client := fake.NewClientset(
+		&corev1.ResourceQuota{
+			ObjectMeta: metav1.ObjectMeta{Name: "compute", Namespace: "buildkite"},
+			Spec: corev1.ResourceQuotaSpec{Hard: corev1.ResourceList{
+				corev1.ResourceRequestsCPU:  resource.MustParse("4"),
+				corev1.ResourceLimitsMemory: resource.MustParse("8Gi"),
+				corev1.ResourcePods:         resource.MustParse("10"),
+				corev1.ResourceServices:     resource.MustParse("0"),
+			}},
+			Status: corev1.ResourceQuotaStatus{Used: corev1.ResourceList{
+				corev1.ResourceRequestsCPU:  resource.MustParse("3"),
+				corev1.ResourceLimitsMemory: resource.MustParse("4Gi"),
+				corev1.ResourcePods:         resource.MustParse("3"),
+				corev1.ResourceServices:     resource.MustParse("0"),
+			}},
+		},
+		// Scoped quotas aren't checked.
+		&corev1.ResourceQuota{
+			ObjectMeta: metav1.ObjectMeta{Name: "best-effort", Namespace: "buildkite"},
+			Spec: corev1.ResourceQuotaSpec{
+				Hard:   corev1.ResourceList{corev1.ResourcePods: resource.MustParse("0")},
+				Scopes: []corev1.ResourceQuotaScope{corev1.ResourceQuotaScopeBestEffort},
+			},
+		},
+		// Nor are quotas in other namespaces.
+		&corev1.ResourceQuota{
+			ObjectMeta: metav1.ObjectMeta{Name: "compute", Namespace: "other"},
+			Spec:       corev1.ResourceQuotaSpec{Hard: corev1.ResourceList{corev1.ResourcePods: resource.MustParse("0")}},
+		},
+	)
+	quota := scheduler.NewQuotaChecker("buildkite")
+	factory := informers.NewSharedInformerFactoryWithOptions(client, 0, informers.WithNamespace("buildkite"))
+	if err := quota.RegisterInformer(ctx, factory); err != nil {
+		t.Fatalf("quota.RegisterInformer(ctx, factory) error = %v", err)
+	}
+
+	container := func(cpu, memory string) corev1.Container {
+		return corev1.Container{Resources: corev1.ResourceRequirements{
+			Requests: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse(cpu)},
+			Limits:   corev1.ResourceList{corev1.ResourceMemory: resource.MustParse(memory)},
+		}}
+	}
+	tests := []struct {
+		name    string
+		podSpec *corev1.PodSpec
+		wantErr bool
+	}{
+		{
+			name:    "fits",
+			podSpec: &corev1.PodSpec{Containers: []corev1.Container{container("500m", "1Gi"), container("500m", "1Gi")}},
+		},
+		{
+			name:    "too much cpu",
+			podSpec: &corev1.PodSpec{Containers: []corev1.Container{container("1", "1Gi"), container("500m", "1Gi")}},
+			wantErr: true,
+		},
+		{
+			name: "init container needs more than the containers",
+			podSpec: &corev1.PodSpec{
+				InitContainers: []corev1.Container{container("100m", "5Gi")},
+				Containers:     []corev1.Container{container("500m", "1Gi")},
+			},
+			wantErr: true,
+		},
+		{
+			name: "sidecar init container adds to the containers",
+			podSpec: &corev1.PodSpec{
+				InitContainers: []corev1.Container{func() corev1.Container {
+					c := container("600m", "1Gi")
+					c.RestartPolicy = ptr.To(corev1.ContainerRestartPolicyAlways)
+					return c
+				}()},
+				Containers: []corev1.Container{container("500m", "1Gi")},
+			},
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			err := quota.Check(test.podSpec)
+			if gotErr := errors.Is(err, model.ErrQuotaExceeded); gotErr != test.wantErr {
+				t.Errorf("quota.Check(podSpec) = %v, want ErrQuotaExceeded: %t", err, test.wantErr)
+			}
+		})
+	}
+
+	// A nil checker allows everything.
+	var none *scheduler.QuotaChecker
+	if err := none.Check(tests[1].podSpec); err != nil {
+		t.Errorf("(*QuotaChecker)(nil).Check(podSpec) = %v, want nil", err)
+	}
+}
@@ -2,29 +2,42 @@ package scheduler
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"maps"
+	"math/rand/v2"
 	"net/url"
+	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/buildkite/agent-stack-k8s/v2/api"
 	"github.com/buildkite/agent-stack-k8s/v2/internal/controller/agenttags"
 	"github.com/buildkite/agent-stack-k8s/v2/internal/controller/config"
+	"github.com/buildkite/agent-stack-k8s/v2/internal/controller/events"
+	"github.com/buildkite/agent-stack-k8s/v2/internal/controller/metrics"
 	"github.com/buildkite/agent-stack-k8s/v2/internal/controller/model"
 	"github.com/buildkite/agent-stack-k8s/v2/internal/version"
 
+	"github.com/Khan/genqlient/graphql"
 	"github.com/buildkite/agent/v3/clicommand"
 
 	"go.uber.org/zap"
+	"golang.org/x/time/rate"
 	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
 	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	"k8s.io/apimachinery/pkg/util/validation"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/utils/ptr"
 )
@@ -38,7 +51,22 @@ const (
 	CheckoutContainerName             = "checkout"
 )
 
-var errK8sPluginProhibited = errors.New("the kubernetes plugin is prohibited by this controller, but was configured on this job")
+const (
+	// createRetryBaseDelay is the delay before the first retry of a failed
+	// create call. It doubles for each later retry, up to createRetryMaxDelay.
+	createRetryBaseDelay = 250 * time.Millisecond
+	createRetryMaxDelay  = 5 * time.Second
+
+	// createThrottleMaxDelay caps how long create calls are held back after
+	// the apiserver asks for a delay with Retry-After.
+	createThrottleMaxDelay = 30 * time.Second
+)
+
+var (
+	errK8sPluginProhibited = errors.New("the kubernetes plugin is prohibited by this controller, but was configured on this job")
+	errImageNotAllowed     = errors.New("image is not in the allowed images configured for this controller")
+	errRuntimeNotAllowed   = errors.New("runtime is not in the runtime classes configured for this controller")
+)
 
 type Config struct {
 	Namespace              string
@@ -52,16 +80,93 @@ type Config struct {
 	DefaultCommandParams   *config.CommandParams
 	DefaultSidecarParams   *config.SidecarParams
 	DefaultMetadata        config.Metadata
+	DefaultPodParams       *config.PodParams
+	QueuePodParams         map[string]*config.PodParams
 	PodSpecPatch           *corev1.PodSpec
 	ProhibitK8sPlugin      bool
+	AllowedPriorityClasses []string
+	SpotParams             *config.SpotParams
+	TagVolumes             config.TagVolumes
+	PodTagLabels           config.PodTagLabels
+
+	// ControllerID, if set, is the value of the controller ID label on the
+	// Kubernetes jobs created.
+	ControllerID string
+
+	// ResourceHints bounds the CPU, memory and ephemeral storage that jobs may
+	// ask for with the bk-cpu, bk-memory and bk-ephemeral-storage tags.
+	ResourceHints *config.ResourceHints
+
+	// AgentCommandWrapper, if set, wraps the agent container's command.
+	AgentCommandWrapper config.AgentCommandWrapper
+
+	// JobFieldEnv maps Buildkite job fields to the names of environment
+	// variables set to their values on the agent container.
+	JobFieldEnv config.JobFieldEnv
+
+	// RuntimeClasses maps the values of the bk-runtime tag to the pod's
+	// runtimeClassName. Jobs with other values of the tag are not scheduled.
+	RuntimeClasses map[string]string
+
+	// AllowedImages, if not empty, restricts the images that the pod's
+	// containers may use. Entries ending in "*" match images by prefix,
+	// other entries must match exactly. Image is always allowed.
+	AllowedImages []string
+
+	// Finalizers are added to each Kubernetes job, so that another controller
+	// can act before it is deleted.
+	Finalizers []string
+
+	// WarmPool, if set, is asked for a warm pod to claim for each job. The
+	// job's pod prefers the node the warm pod was running on.
+	WarmPool WarmPool
+
+	// CreateRetries is the number of times to retry creating the Kubernetes
+	// job after a conflict or a timeout.
+	CreateRetries int
+
+	// GenerateJobNames, if set, creates Kubernetes jobs with a generated name
+	// (e.g. "buildkite-<uuid>-x7k2q") rather than a name derived from the
+	// Buildkite job UUID, so that a lingering job with the same name can't
+	// cause the create call to fail. Jobs are then found by their UUID label.
+	GenerateJobNames bool
+
+	// CreateQPS, if positive, limits the rate of calls to create Kubernetes
+	// jobs (including retries), so that bursts of jobs are spread out rather
+	// than being throttled by the API server. Up to CreateBurst calls (at
+	// least 1) can be made at once.
+	CreateQPS   float64
+	CreateBurst int
+
+	// Quota, if set, is checked before each job is created. Jobs that would
+	// exceed a quota aren't created.
+	Quota *QuotaChecker
+
+	// Events, if set, records Kubernetes events for jobs that are created or
+	// blocked by a quota.
+	Events *events.Recorder
+
+	// AnnotationClient, if set, is used to annotate each Buildkite build with
+	// the names of the Kubernetes jobs created for its jobs, in the background
+	// after each is created.
+	AnnotationClient graphql.Client
+}
+
+// WarmPool is implemented by [warmpool.Pool].
+type WarmPool interface {
+	Claim(ctx context.Context, queue, uuid string) (nodeName string, ok bool)
 }
 
 func New(logger *zap.Logger, client kubernetes.Interface, cfg Config) *worker {
-	return &worker{
+	w := &worker{
 		cfg:    cfg,
 		client: client,
 		logger: logger.Named("worker"),
 	}
+	if cfg.CreateQPS > 0 {
+		w.createLimiter = rate.NewLimiter(rate.Limit(cfg.CreateQPS), max(cfg.CreateBurst, 1))
+	}
+	return w
 }
 
 type KubernetesPlugin struct {
@@ -80,6 +185,14 @@ type worker struct {
 	cfg    Config
 	client kubernetes.Interface
 	logger *zap.Logger
+
+	// Paces create calls, if CreateQPS is set.
+	createLimiter *rate.Limiter
+
+	// Create calls wait until throttledUntil, after the apiserver throttled
+	// a create call and asked for a delay.
+	throttleMu     sync.Mutex
+	throttledUntil time.Time
 }
 
 func (w *worker) Handle(ctx context.Context, job model.Job) error {
@@ -107,33 +220,235 @@ func (w *worker) Handle(ctx context.Context, job model.Job) error {
 	}
 
 	kjob, err := w.Build(podSpec, false, inputs)
+	if errors.Is(err, errImageNotAllowed) || errors.Is(err, errRuntimeNotAllowed) {
+		logger.Warn("Job uses an image or runtime that is not allowed, failing job", zap.Error(err))
+		return w.failJob(ctx, inputs, fmt.Sprintf("agent-stack-k8s refused to schedule the job: %v", err))
+	}
 	if err != nil {
 		logger.Warn("Job definition error detected, failing job", zap.Error(err))
 		return w.failJob(ctx, inputs, fmt.Sprintf("agent-stack-k8s failed to build a podSpec for the job: %v", err))
 	}
 
-	err = w.createJob(ctx, kjob)
+	if err := w.cfg.Quota.Check(&kjob.Spec.Template.Spec); err != nil {
+		if errors.Is(err, model.ErrQuotaExceeded) {
+			quotaBlockedCounter.Inc()
+			w.cfg.Events.QuotaBlocked(job.Uuid, err)
+		}
+		logger.Info("not creating job, resource quota check failed", zap.Error(err))
+		return err
+	}
+
+	w.claimWarmPod(ctx, &kjob.Spec.Template.Spec, inputs)
+
+	// Time spent between the limiter and here (locking the job, building the
+	// pod spec, and so on) is separate from the time spent creating the job.
+	if !job.TokenAcquiredAt.IsZero() {
+		metrics.ObserveDuration(ctx, handoffDurationHistogram, time.Since(job.TokenAcquiredAt).Seconds())
+	}
+	start := time.Now()
+	created, err := w.createJob(ctx, kjob)
+	metrics.ObserveDuration(ctx, createDurationHistogram, time.Since(start).Seconds())
 	if kerrors.IsInvalid(err) {
 		logger.Warn("Job creation failed, failing job", zap.Error(err))
 		return w.failJob(ctx, inputs, fmt.Sprintf("Kubernetes rejected the podSpec built by agent-stack-k8s: %v", err))
 	}
+	if created != nil {
+		w.cfg.Events.Scheduled(created, job.Uuid)
+		if w.cfg.AnnotationClient != nil {
+			go w.annotateBuild(context.WithoutCancel(ctx), inputs, created)
+		}
+	}
 	return err
 }
 
-func (w *worker) createJob(ctx context.Context, kjob *batchv1.Job) error {
-	_, err := w.client.BatchV1().Jobs(w.cfg.Namespace).Create(ctx, kjob, metav1.CreateOptions{})
-	if err != nil {
-		return fmt.Errorf("failed to create job: %w", err)
+// createJob creates the Kubernetes job, retrying with jittered backoff if
+// the create call fails with a conflict or a timeout. If an unfinished job
+// already exists (e.g. an earlier attempt succeeded but its response was
+// lost), that is not an error, but no job is returned. If the existing job has
+// finished (e.g. it is waiting to be deleted after its TTL), it returns an
+// error wrapping [model.ErrDuplicateJob], so that the job's limiter token is
+// returned: the informer won't see that job finish again.
+func (w *worker) createJob(ctx context.Context, kjob *batchv1.Job) (*batchv1.Job, error) {
+	delay := createRetryBaseDelay
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 && kjob.GenerateName != "" {
+			// A generated name never already exists, so look for a job
+			// created by an earlier attempt by its UUID label instead.
+			existing, err := w.existingJob(ctx, kjob)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create job: %w", err)
+			}
+			if existing != nil {
+				return nil, w.alreadyExists(kjob, existing)
+			}
+		}
+		if err := w.waitToCreate(ctx); err != nil {
+			return nil, fmt.Errorf("failed to create job: %w", err)
+		}
+		createCallsCounter.Inc()
+		created, err := w.client.BatchV1().Jobs(w.cfg.Namespace).Create(ctx, kjob, metav1.CreateOptions{})
+		if kerrors.IsTooManyRequests(err) {
+			w.throttled(err)
+		}
+		switch {
+		case err == nil:
+			return created, nil
+
+		case kerrors.IsAlreadyExists(err):
+			existing, getErr := w.existingJob(ctx, kjob)
+			if getErr != nil || existing == nil {
+				// It couldn't be checked, or was deleted in the meantime.
+				return nil, fmt.Errorf("failed to create job: %w", errors.Join(err, getErr))
+			}
+			return nil, w.alreadyExists(kjob, existing)
+
+		case attempt >= w.cfg.CreateRetries || !retryableCreateError(err):
+			return nil, fmt.Errorf("failed to create job: %w", err)
+		}
+
+		createRetriesCounter.Inc()
+		w.logger.Debug("retrying job creation",
+			zap.String("name", kjob.Name),
+			zap.Int("attempt", attempt+1),
+			zap.Error(err),
+		)
+		// Full jitter: wait a random time up to the current delay.
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("failed to create job: %w", err)
+		case <-time.After(rand.N(delay)):
+		}
+		delay = min(2*delay, createRetryMaxDelay)
+	}
+}
+
+// existingJob returns the existing Kubernetes job for the Buildkite job, or
+// nil if there is none: the job with kjob's name, or if kjob has a generated
+// name, a job with its UUID label (preferring an unfinished one).
+func (w *worker) existingJob(ctx context.Context, kjob *batchv1.Job) (*batchv1.Job, error) {
+	jobs := w.client.BatchV1().Jobs(w.cfg.Namespace)
+	if kjob.GenerateName == "" {
+		existing, err := jobs.Get(ctx, kjob.Name, metav1.GetOptions{})
+		if kerrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return existing, err
+	}
+	list, err := jobs.List(ctx, metav1.ListOptions{
+		LabelSelector: labels.Set{config.UUIDLabel: kjob.Labels[config.UUIDLabel]}.String(),
+	})
+	if err != nil || len(list.Items) == 0 {
+		return nil, err
 	}
+	for i := range list.Items {
+		if !model.JobFinished(&list.Items[i]) {
+			return &list.Items[i], nil
+		}
+	}
+	return &list.Items[0], nil
+}
+
+// alreadyExists records that the Kubernetes job for kjob already exists, and
+// returns the error for createJob to return: nil if the existing job is
+// unfinished, otherwise an error wrapping [model.ErrDuplicateJob].
+func (w *worker) alreadyExists(kjob, existing *batchv1.Job) error {
+	createAlreadyExistsCounter.Inc()
+	log := w.logger.With(
+		zap.String("name", existing.Name),
+		zap.String("uuid", kjob.Labels[config.UUIDLabel]),
+	)
+	if model.JobFinished(existing) {
+		log.Warn("Kubernetes job already exists and has finished, not creating another until it is deleted")
+		return fmt.Errorf("failed to create job: %w: Kubernetes job %s has finished", model.ErrDuplicateJob, existing.Name)
+	}
+	log.Info("Kubernetes job already exists")
 	return nil
 }
 
+// throttled records that the apiserver rejected a create call with 429 Too
+// Many Requests (e.g. because of API Priority and Fairness). If the response
+// has a Retry-After, all create calls are held back for that long, up to
+// createThrottleMaxDelay.
+func (w *worker) throttled(err error) {
+	apiserverThrottledCounter.Inc()
+	seconds, ok := kerrors.SuggestsClientDelay(err)
+	if !ok || seconds <= 0 {
+		return
+	}
+	delay := min(time.Duration(seconds)*time.Second, createThrottleMaxDelay)
+	w.logger.Info("apiserver is throttling job creation, backing off", zap.Duration("retry-after", delay))
+	until := time.Now().Add(delay)
+	w.throttleMu.Lock()
+	defer w.throttleMu.Unlock()
+	if until.After(w.throttledUntil) {
+		w.throttledUntil = until
+	}
+}
+
+// waitForThrottle waits until the delay asked for by the apiserver when it
+// last throttled a create call has passed, or ctx is done.
+func (w *worker) waitForThrottle(ctx context.Context) error {
+	w.throttleMu.Lock()
+	delay := time.Until(w.throttledUntil)
+	w.throttleMu.Unlock()
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	case <-timer.C:
+		return nil
+	}
+}
+
+// waitToCreate waits until the apiserver's requested delay (if any) has passed
+// and createLimiter allows another create call, or ctx is done.
+func (w *worker) waitToCreate(ctx context.Context) error {
+	if err := w.waitForThrottle(ctx); err != nil {
+		return err
+	}
+	if w.createLimiter == nil {
+		return nil
+	}
+	r := w.createLimiter.Reserve()
+	delay := r.Delay()
+	if delay <= 0 {
+		return nil
+	}
+	createThrottledCounter.Inc()
+	createThrottleWaitHistogram.Observe(delay.Seconds())
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		r.Cancel()
+		return context.Cause(ctx)
+	case <-timer.C:
+		return nil
+	}
+}
+
+// retryableCreateError reports whether a failed create call is worth retrying
+// straight away.
+func retryableCreateError(err error) bool {
+	return kerrors.IsConflict(err) ||
+		kerrors.IsServerTimeout(err) ||
+		kerrors.IsTimeout(err) ||
+		kerrors.IsTooManyRequests(err)
+}
+
 // buildInputs contains the relevant components of a CommandJob needed for Build.
 type buildInputs struct {
 	// Taken from the job directly.
-	uuid            string
-	command         string
-	agentQueryRules []string
+	uuid             string
+	command          string
+	agentQueryRules  []string
+	clusterQueueUUID string
+	scheduledAt      time.Time
+	contentHash      string
 
 	// Involves some parsing of the job env / plugins map
 	envMap       map[string]string
@@ -146,8 +461,13 @@ func (w *worker) ParseJob(job *api.CommandJob) (buildInputs, error) {
 		uuid:            job.Uuid,
 		command:         job.Command,
 		agentQueryRules: job.AgentQueryRules,
+		scheduledAt:     job.ScheduledAt,
+		contentHash:     model.ContentHash(job),
 		envMap:          make(map[string]string),
 	}
+	if job.ClusterQueue != nil {
+		parsed.clusterQueueUUID = job.ClusterQueue.Uuid
+	}
 
 	for _, val := range job.Env {
 		parts := strings.SplitN(val, "=", 2)
@@ -203,11 +523,16 @@ func (w *worker) Build(podSpec *corev1.PodSpec, skipCheckout bool, inputs buildI
 
 	kjob := &batchv1.Job{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:        k8sJobName(inputs.uuid),
 			Labels:      make(map[string]string),
 			Annotations: make(map[string]string),
 		},
 	}
+	if w.cfg.GenerateJobNames {
+		kjob.GenerateName = k8sJobName(inputs.uuid) + "-"
+	} else {
+		kjob.Name = k8sJobName(inputs.uuid)
+	}
+	kjob.Finalizers = slices.Clone(w.cfg.Finalizers)
 
 	maps.Copy(kjob.Labels, w.cfg.DefaultMetadata.Labels)
 	maps.Copy(kjob.Annotations, w.cfg.DefaultMetadata.Annotations)
@@ -216,7 +541,26 @@ func (w *worker) Build(podSpec *corev1.PodSpec, skipCheckout bool, inputs buildI
 		maps.Copy(kjob.Annotations, inputs.k8sPlugin.Metadata.Annotations)
 	}
 
+	// The controller's informers only watch jobs and pods with the UUID label
+	// and a label for each of the controller's tags (see NewInformerFactory),
+	// so these labels must always be set, and not be overridden by metadata
+	// above. Otherwise the limiter and deduper would never see the job.
 	kjob.Labels[config.UUIDLabel] = inputs.uuid
+	if inputs.clusterQueueUUID != "" {
+		// Used by the limiter to apply per-queue limits.
+		kjob.Labels[config.ClusterQueueUUIDLabel] = inputs.clusterQueueUUID
+	}
+	if w.cfg.ControllerID != "" {
+		// Used by the limiter to count only this controller's jobs.
+		kjob.Labels[config.ControllerIDLabel] = w.cfg.ControllerID
+	}
+	// Record the UUID in an annotation too, under the same key as the label,
+	// for tools that only look at annotations.
+	kjob.Annotations[config.UUIDLabel] = inputs.uuid
+	// Used by the deduper to tell whether a duplicate of the job has
+	// different data.
+	kjob.Annotations[config.ContentHashAnnotation] = inputs.contentHash
+	kjob.Annotations[config.AgentTagsAnnotation] = strings.Join(inputs.agentQueryRules, ",")
 	tagLabels, errs := agenttags.LabelsFromTags(inputs.agentQueryRules)
 	if len(errs) > 0 {
 		w.logger.Warn("converting all tags to labels", zap.Errors("errs", errs))
@@ -236,10 +580,16 @@ func (w *worker) Build(podSpec *corev1.PodSpec, skipCheckout bool, inputs buildI
 	// Prevent k8s cluster autoscaler from terminating the job before it finishes to scale down cluster
 	kjob.Annotations["cluster-autoscaler.kubernetes.io/safe-to-evict"] = "false"
 
-	kjob.Spec.Template.Labels = kjob.Labels
-	kjob.Spec.Template.Annotations = kjob.Annotations
+	// Labels from pod-tag-labels are for selecting pods (e.g. by network
+	// policies), so they only go on the pod, and take precedence over
+	// labels from metadata.
+	kjob.Spec.Template.Labels = maps.Clone(kjob.Labels)
+	if len(w.cfg.PodTagLabels) > 0 {
+		tags, _ := agenttags.TagMapFromTags(inputs.agentQueryRules)
+		maps.Copy(kjob.Spec.Template.Labels, w.cfg.PodTagLabels.Labels(tags))
+	}
+	kjob.Spec.Template.Annotations = maps.Clone(kjob.Annotations)
 	kjob.Spec.BackoffLimit = ptr.To[int32](0)
-	kjob.Spec.Template.Spec.TerminationGracePeriodSeconds = ptr.To[int64](defaultTermGracePeriodSeconds)
 
 	// Shared among all containers that run buildkite-agent start or bootstrap.
 	env := []corev1.EnvVar{
@@ -255,7 +605,7 @@ func (w *worker) Build(podSpec *corev1.PodSpec, skipCheckout bool, inputs buildI
 			Name: agentTokenKey,
 			ValueFrom: &corev1.EnvVarSource{
 				SecretKeyRef: &corev1.SecretKeySelector{
-					LocalObjectReference: corev1.LocalObjectReference{Name: w.cfg.AgentTokenSecretName},
+					LocalObjectReference: corev1.LocalObjectReference{Name: w.agentTokenSecret(inputs.agentQueryRules)},
 					Key:                  agentTokenKey,
 				},
 			},
@@ -322,6 +672,17 @@ func (w *worker) Build(podSpec *corev1.PodSpec, skipCheckout bool, inputs buildI
 		volumeMounts = append(volumeMounts, inputs.k8sPlugin.ExtraVolumeMounts...)
 	}
 
+	tags, errs := agenttags.TagMapFromTags(inputs.agentQueryRules)
+	if len(errs) > 0 {
+		w.logger.Warn("errors parsing job tags", zap.String("job", inputs.uuid), zap.Errors("errors", errs))
+	}
+
+	// Add volumes selected by the job's tags to the shared mounts.
+	volumeMounts, err = w.cfg.TagVolumes.ApplyTo(podSpec, tags, volumeMounts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to add volumes for job tags: %w", err)
+	}
+
 	systemContainerCount := 0
 	if !skipCheckout {
 		systemContainerCount = 1
@@ -464,14 +825,31 @@ func (w *worker) Build(podSpec *corev1.PodSpec, skipCheckout bool, inputs buildI
 		}
 	}
 
+	// Pod params from the config, with those for the job's queue taking
+	// precedence over the defaults.
+	podParams := w.podParams(tags["queue"])
+	podParams.ApplySecurityContextTo(podSpec)
+
+	// Annotations from the pod params (e.g. to turn off service mesh sidecar
+	// injection) don't replace those from the plugin.
+	var pluginAnnotations map[string]string
+	if inputs.k8sPlugin != nil {
+		pluginAnnotations = inputs.k8sPlugin.Metadata.Annotations
+	}
+	podParams.ApplyPodAnnotationsTo(kjob.Spec.Template.Annotations, pluginAnnotations)
+
+	// Sidecars from the pod params run after those from the plugin. Like
+	// plugin sidecars, they aren't managed by the agent, and are stopped by
+	// the job's deadline once the agent finishes.
+	for _, c := range podParams.SidecarContainers(volumeMounts) {
+		w.cfg.DefaultSidecarParams.ApplyTo(&c)
+		podSpec.Containers = append(podSpec.Containers, c)
+	}
+
 	agentTags := map[string]string{
 		"k8s:agent-stack-version": version.Version(),
 	}
 
-	tags, errs := agenttags.TagMapFromTags(inputs.agentQueryRules)
-	if len(errs) > 0 {
-		w.logger.Warn("errors parsing job tags", zap.String("job", inputs.uuid), zap.Errors("errors", errs))
-	}
 	maps.Copy(agentTags, tags)
 
 	// Agent server container
@@ -527,6 +905,17 @@ func (w *worker) Build(podSpec *corev1.PodSpec, skipCheckout bool, inputs buildI
 
 	w.cfg.AgentConfig.ApplyToAgentStart(&agentContainer)
 	agentContainer.Env = append(agentContainer.Env, env...)
+	for _, ev := range w.jobFieldEnv(inputs, tags) {
+		// Variables set by the controller take precedence.
+		if !slices.ContainsFunc(agentContainer.Env, func(e corev1.EnvVar) bool { return e.Name == ev.Name }) {
+			agentContainer.Env = append(agentContainer.Env, ev)
+		}
+	}
+	podParams.ApplyAgentEnvTo(&agentContainer)
+	podParams.ApplyAgentLifecycleTo(&agentContainer)
+	if err := w.wrapAgentCommand(&agentContainer, inputs); err != nil {
+		return nil, err
+	}
 	podSpec.Containers = append(podSpec.Containers, agentContainer)
 
 	if !skipCheckout {
@@ -535,6 +924,11 @@ func (w *worker) Build(podSpec *corev1.PodSpec, skipCheckout bool, inputs buildI
 		)
 	}
 
+	// Init containers from the pod params run before those in the given
+	// podSpec, and share the workspace volume so they can prepare files for
+	// the other containers.
+	podParams.ApplyInitContainersTo(podSpec, volumeMounts)
+
 	// Init containers. These run in order before the regular containers.
 	// We run some init containers before any specified in the given podSpec.
 	//
@@ -642,6 +1036,13 @@ func (w *worker) Build(podSpec *corev1.PodSpec, skipCheckout bool, inputs buildI
 
 	podSpec.InitContainers = append(initContainers, podSpec.InitContainers...)
 
+	podParams.ApplyTo(podSpec)
+	podParams.ApplyMaxPodsPerNodeTo(podSpec, kjob.Spec.Template.Labels)
+	w.applySpotTag(podSpec, inputs.uuid, tags)
+	if podSpec.TerminationGracePeriodSeconds == nil {
+		podSpec.TerminationGracePeriodSeconds = ptr.To[int64](defaultTermGracePeriodSeconds)
+	}
+
 	// Only attempt the job once.
 	podSpec.RestartPolicy = corev1.RestartPolicyNever
 
@@ -666,6 +1067,33 @@ func (w *worker) Build(podSpec *corev1.PodSpec, skipCheckout bool, inputs buildI
 		w.logger.Debug("Applied podSpec patch from k8s plugin", zap.Any("patched", patched))
 	}
 
+	// The priority class is checked after the patches, so that a job can't
+	// escalate its priority with the plugin's podSpec or podSpecPatch.
+	var configuredPriorityClass string
+	if podParams != nil {
+		configuredPriorityClass = podParams.PriorityClassName
+	}
+	if w.cfg.PodSpecPatch != nil && w.cfg.PodSpecPatch.PriorityClassName != "" {
+		configuredPriorityClass = w.cfg.PodSpecPatch.PriorityClassName
+	}
+	w.applyPriorityClassTag(podSpec, inputs.uuid, tags, configuredPriorityClass)
+
+	// Resource hints are applied after the patches, so that they take
+	// precedence over resources set by them (e.g. defaults in pod-spec-patch).
+	w.applyResourceHintTags(podSpec, inputs.uuid, tags)
+
+	// The runtime is applied after the patches, so that a job that selects a
+	// runtime (e.g. a sandbox for untrusted code) can't patch it away.
+	if err := w.applyRuntimeTag(podSpec, inputs.uuid, inputs.agentQueryRules); err != nil {
+		runtimeDeniedCounter.Inc()
+		return nil, err
+	}
+
+	if err := w.checkImagesAllowed(podSpec); err != nil {
+		imageDeniedCounter.Inc()
+		return nil, err
+	}
+
 	kjob.Spec.Template.Spec = *podSpec
 
 	return kjob, nil
@@ -751,7 +1179,9 @@ func (w *worker) createCheckoutContainer(
 	checkoutContainer.Env = append(checkoutContainer.Env, env...)
 
 	podUser, podGroup := int64(0), int64(0)
+	nonRoot := false
 	if podSpec.SecurityContext != nil {
+		nonRoot = ptr.Deref(podSpec.SecurityContext.RunAsNonRoot, false)
 		if podSpec.SecurityContext.RunAsUser != nil {
 			podUser = *(podSpec.SecurityContext.RunAsUser)
 		}
@@ -811,6 +1241,18 @@ func (w *worker) createCheckoutContainer(
 	// we will create a buildkite-agent user/group in the checkout container as needed and switch
 	// to it. The created user/group will have the uid/gid specified in the pod's security context.
 	switch {
+	case nonRoot:
+		// The pod must not run as root, so there's no chance to create the
+		// user. Check out directly as the pod's user, with the workspace as
+		// the home directory for git's global config.
+		checkoutContainer.SecurityContext = nil
+		checkoutContainer.Env = append(checkoutContainer.Env, corev1.EnvVar{Name: "HOME", Value: "/workspace"})
+		checkoutContainer.Command = []string{"ash", "-c"}
+		checkoutContainer.Args = []string{fmt.Sprintf(`set -exufo pipefail
+%s
+buildkite-agent-entrypoint bootstrap`,
+			gitConfigCmd)}
+
 	case podUser != 0 && podGroup != 0:
 		// The checkout container needs to be run as root to create the user. After that, it switches to the user.
 		checkoutContainer.SecurityContext = &corev1.SecurityContext{
@@ -863,7 +1305,7 @@ buildkite-agent-entrypoint bootstrap`,
 // failJob fails the job in Buildkite.
 func (w *worker) failJob(ctx context.Context, inputs buildInputs, message string) error {
 	// Need to fetch the agent token ourselves.
-	agentToken, err := fetchAgentToken(ctx, w.logger, w.client, w.cfg.Namespace, w.cfg.AgentTokenSecretName)
+	agentToken, err := fetchAgentToken(ctx, w.logger, w.client, w.cfg.Namespace, w.agentTokenSecret(inputs.agentQueryRules))
 	if err != nil {
 		w.logger.Error("fetching agent token from secret", zap.Error(err))
 		return err
@@ -873,6 +1315,303 @@ func (w *worker) failJob(ctx context.Context, inputs buildInputs, message string
 	return failJob(ctx, w.logger, agentToken, inputs.uuid, inputs.agentQueryRules, message, opts...)
 }
 
+// applyPriorityClassTag sets the pod's priorityClassName from the job's
+// priority class tag, if the tag is present and its value is allowed.
+// Otherwise, if the job's podSpec or podSpecPatch from the plugin changed the
+// priorityClassName from the configured one (from the pod params or
+// pod-spec-patch) to one that isn't allowed, it is reset to the configured one.
+func (w *worker) applyPriorityClassTag(podSpec *corev1.PodSpec, uuid string, tags map[string]string, configured string) {
+	if priorityClass, ok := tags[agenttags.PriorityClassTag]; ok {
+		if slices.Contains(w.cfg.AllowedPriorityClasses, priorityClass) {
+			podSpec.PriorityClassName = priorityClass
+			return
+		}
+		priorityClassDeniedCounter.Inc()
+		w.logger.Warn("ignoring priority class tag with a value that is not allowed",
+			zap.String("job", uuid),
+			zap.String("priority-class", priorityClass),
+			zap.Strings("allowed-priority-classes", w.cfg.AllowedPriorityClasses),
+		)
+	}
+	priorityClass := podSpec.PriorityClassName
+	if priorityClass == configured || slices.Contains(w.cfg.AllowedPriorityClasses, priorityClass) {
+		return
+	}
+	priorityClassDeniedCounter.Inc()
+	w.logger.Warn("resetting priority class set by the job's pod spec to a value that is not allowed",
+		zap.String("job", uuid),
+		zap.String("priority-class", priorityClass),
+		zap.String("configured-priority-class", configured),
+		zap.Strings("allowed-priority-classes", w.cfg.AllowedPriorityClasses),
+	)
+	podSpec.PriorityClassName = configured
+}
+
+// applyRuntimeTag sets the pod's runtimeClassName from the job's runtime tag,
+// if the tag is present. It returns an error wrapping errRuntimeNotAllowed if
+// the tag's value isn't in RuntimeClasses: the job may need the runtime to be
+// run safely, so it isn't run with the default runtime instead.
+func (w *worker) applyRuntimeTag(podSpec *corev1.PodSpec, uuid string, agentQueryRules []string) error {
+	tags, _ := agenttags.TagMapFromTags(agentQueryRules)
+	runtime, ok := tags[agenttags.RuntimeTag]
+	if !ok {
+		return nil
+	}
+	runtimeClass, ok := w.cfg.RuntimeClasses[runtime]
+	if !ok {
+		w.logger.Warn("refusing job with a runtime tag value that is not allowed",
+			zap.String("job", uuid),
+			zap.String("runtime", runtime),
+			zap.Strings("allowed-runtimes", slices.Sorted(maps.Keys(w.cfg.RuntimeClasses))),
+		)
+		return fmt.Errorf("%w: %s", errRuntimeNotAllowed, runtime)
+	}
+	podSpec.RuntimeClassName = &runtimeClass
+	return nil
+}
+
+// safeWrapperValue matches values that can be used in AgentCommandWrapper
+// templates (which are often shell commands) without quoting.
+var safeWrapperValue = regexp.MustCompile(`^[A-Za-z0-9._-]*$`)
+
+// wrapAgentCommand wraps the agent container's command (buildkite-agent start,
+// which is the image's entrypoint with the container's args) with
+// AgentCommandWrapper, if it is set.
+func (w *worker) wrapAgentCommand(agentContainer *corev1.Container, inputs buildInputs) error {
+	if len(w.cfg.AgentCommandWrapper) == 0 {
+		return nil
+	}
+	vars := config.AgentCommandWrapperVars{
+		JobUUID:  inputs.uuid,
+		Pipeline: inputs.envMap["BUILDKITE_PIPELINE_SLUG"],
+	}
+	if !safeWrapperValue.MatchString(vars.Pipeline) {
+		w.logger.Warn("pipeline slug has unexpected characters, not passing it to the agent command wrapper",
+			zap.String("job", inputs.uuid),
+			zap.String("pipeline", vars.Pipeline),
+		)
+		vars.Pipeline = ""
+	}
+	cmd, err := w.cfg.AgentCommandWrapper.Render(vars)
+	if err != nil {
+		return fmt.Errorf("failed to render agent command wrapper: %w", err)
+	}
+	agentContainer.Command = cmd
+	agentContainer.Args = append([]string{"buildkite-agent"}, agentContainer.Args...)
+	return nil
+}
+
+// jobFieldEnv returns the variables for the job's fields in JobFieldEnv, sorted
+// by name. Fields the job doesn't have (e.g. a tag that it doesn't have) are
+// skipped.
+func (w *worker) jobFieldEnv(inputs buildInputs, tags map[string]string) []corev1.EnvVar {
+	var env []corev1.EnvVar
+	for field, name := range w.cfg.JobFieldEnv {
+		var value string
+		var ok bool
+		switch field {
+		case config.JobFieldUUID:
+			value, ok = inputs.uuid, true
+		case config.JobFieldCommand:
+			value, ok = inputs.command, true
+		case config.JobFieldScheduledAt:
+			value, ok = inputs.scheduledAt.UTC().Format(time.RFC3339), !inputs.scheduledAt.IsZero()
+		case config.JobFieldClusterQueueUUID:
+			value, ok = inputs.clusterQueueUUID, inputs.clusterQueueUUID != ""
+		default:
+			if key, isTag := strings.CutPrefix(field, config.JobFieldTagPrefix); isTag {
+				value, ok = tags[key]
+			} else if key, isEnv := strings.CutPrefix(field, config.JobFieldEnvPrefix); isEnv {
+				value, ok = inputs.envMap[key]
+			}
+		}
+		if !ok {
+			w.logger.Debug("job does not have field for job field env",
+				zap.String("job", inputs.uuid),
+				zap.String("field", field),
+			)
+			continue
+		}
+		env = append(env, corev1.EnvVar{Name: name, Value: value})
+	}
+	slices.SortFunc(env, func(a, b corev1.EnvVar) int { return strings.Compare(a.Name, b.Name) })
+	return env
+}
+
+// applyResourceHintTags sets the requests and limits of the pod's first
+// container (the job's first command container) from the job's bk-cpu,
+// bk-memory and bk-ephemeral-storage tags. Values outside the bounds in
+// ResourceHints are clamped to them. Tags that can't be parsed, or for
+// resources without bounds, are ignored. Jobs without a tag get the bounds'
+// default, if set, unless the container already requests the resource.
+func (w *worker) applyResourceHintTags(podSpec *corev1.PodSpec, uuid string, tags map[string]string) {
+	if len(podSpec.Containers) == 0 {
+		return
+	}
+	var hints config.ResourceHints
+	if w.cfg.ResourceHints != nil {
+		hints = *w.cfg.ResourceHints
+	}
+	ctr := &podSpec.Containers[0]
+	for _, h := range []struct {
+		tag    string
+		name   corev1.ResourceName
+		bounds *config.ResourceBounds
+	}{
+		{tag: agenttags.CPUTag, name: corev1.ResourceCPU, bounds: hints.CPU},
+		{tag: agenttags.MemoryTag, name: corev1.ResourceMemory, bounds: hints.Memory},
+		{tag: agenttags.EphemeralStorageTag, name: corev1.ResourceEphemeralStorage, bounds: hints.EphemeralStorage},
+	} {
+		value, ok := tags[h.tag]
+		if !ok {
+			if h.bounds != nil && h.bounds.Default != nil {
+				if _, set := ctr.Resources.Requests[h.name]; !set {
+					setResource(ctr, h.name, h.bounds.Default.DeepCopy())
+				}
+			}
+			continue
+		}
+		logger := w.logger.With(zap.String("job", uuid), zap.String("tag", h.tag), zap.String("value", value))
+		if h.bounds == nil {
+			logger.Warn("ignoring resource hint tag, as there are no resource hint bounds for it")
+			continue
+		}
+		q, err := resource.ParseQuantity(value)
+		if err != nil || q.Sign() <= 0 {
+			logger.Warn("ignoring resource hint tag with a value that is not a positive quantity")
+			continue
+		}
+		if clamped, changed := h.bounds.Clamp(q); changed {
+			resourceHintClampedCounter.Inc()
+			logger.Warn("clamped resource hint tag value to the resource hint bounds",
+				zap.String("min", h.bounds.Min.String()),
+				zap.String("max", h.bounds.Max.String()),
+				zap.String("clamped", clamped.String()),
+			)
+			q = clamped
+		}
+		setResource(ctr, h.name, q)
+	}
+}
+
+// setResource sets both the request and the limit of the container for the
+// resource.
+func setResource(ctr *corev1.Container, name corev1.ResourceName, q resource.Quantity) {
+	if ctr.Resources.Requests == nil {
+		ctr.Resources.Requests = make(corev1.ResourceList)
+	}
+	if ctr.Resources.Limits == nil {
+		ctr.Resources.Limits = make(corev1.ResourceList)
+	}
+	ctr.Resources.Requests[name] = q
+	ctr.Resources.Limits[name] = q
+}
+
+// applySpotTag applies the spot params to the pod spec if the job has the
+// spot tag.
+func (w *worker) applySpotTag(podSpec *corev1.PodSpec, uuid string, tags map[string]string) {
+	value, ok := tags[agenttags.SpotTag]
+	if !ok {
+		return
+	}
+	spot, err := strconv.ParseBool(value)
+	if err != nil {
+		w.logger.Warn("ignoring spot tag with a value that is not a boolean",
+			zap.String("job", uuid),
+			zap.String("spot", value),
+		)
+		return
+	}
+	w.cfg.SpotParams.ApplyTo(podSpec, spot)
+}
+
+// checkImagesAllowed returns an error wrapping errImageNotAllowed if any
+// container in the pod spec uses an image that isn't allowed.
+func (w *worker) checkImagesAllowed(podSpec *corev1.PodSpec) error {
+	if len(w.cfg.AllowedImages) == 0 {
+		return nil
+	}
+	var denied []string
+	for _, c := range slices.Concat(podSpec.InitContainers, podSpec.Containers) {
+		if !w.imageAllowed(c.Image) && !slices.Contains(denied, c.Image) {
+			denied = append(denied, c.Image)
+		}
+	}
+	if len(denied) > 0 {
+		return fmt.Errorf("%w: %s", errImageNotAllowed, strings.Join(denied, ", "))
+	}
+	return nil
+}
+
+// imageAllowed reports whether the image matches the allowed images.
+func (w *worker) imageAllowed(image string) bool {
+	if image == w.cfg.Image {
+		return true
+	}
+	for _, allowed := range w.cfg.AllowedImages {
+		if prefix, ok := strings.CutSuffix(allowed, "*"); ok {
+			if strings.HasPrefix(image, prefix) {
+				return true
+			}
+			continue
+		}
+		if image == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// claimWarmPod claims a warm pod for the job's queue, if there is a warm pool,
+// and makes the pod prefer the node the warm pod was running on.
+func (w *worker) claimWarmPod(ctx context.Context, podSpec *corev1.PodSpec, inputs buildInputs) {
+	if w.cfg.WarmPool == nil {
+		return
+	}
+	tags, _ := agenttags.TagMapFromTags(inputs.agentQueryRules)
+	nodeName, ok := w.cfg.WarmPool.Claim(ctx, tags["queue"], inputs.uuid)
+	if !ok {
+		return
+	}
+	w.logger.Debug("claimed warm pod", zap.String("uuid", inputs.uuid), zap.String("node", nodeName))
+
+	if podSpec.Affinity == nil {
+		podSpec.Affinity = &corev1.Affinity{}
+	}
+	if podSpec.Affinity.NodeAffinity == nil {
+		podSpec.Affinity.NodeAffinity = &corev1.NodeAffinity{}
+	}
+	na := podSpec.Affinity.NodeAffinity
+	na.PreferredDuringSchedulingIgnoredDuringExecution = append(na.PreferredDuringSchedulingIgnoredDuringExecution,
+		corev1.PreferredSchedulingTerm{
+			Weight: 100,
+			Preference: corev1.NodeSelectorTerm{
+				MatchFields: []corev1.NodeSelectorRequirement{{
+					Key:      "metadata.name",
+					Operator: corev1.NodeSelectorOpIn,
+					Values:   []string{nodeName},
+				}},
+			},
+		},
+	)
+}
+
+// podParams returns the pod params that apply to jobs in the queue.
+func (w *worker) podParams(queue string) *config.PodParams {
+	return w.cfg.DefaultPodParams.WithOverrides(w.cfg.QueuePodParams[queue])
+}
+
+// agentTokenSecret returns the name of the Secret holding the agent token for
+// jobs with the agent query rules: that from the pod params for the job's
+// queue, or else AgentTokenSecretName.
+func (w *worker) agentTokenSecret(agentQueryRules []string) string {
+	tags, _ := agenttags.TagMapFromTags(agentQueryRules)
+	if pp := w.podParams(tags["queue"]); pp != nil && pp.AgentTokenSecret != "" {
+		return pp.AgentTokenSecret
+	}
+	return w.cfg.AgentTokenSecretName
+}
+
 func (w *worker) jobURL(jobUUID string, buildURL string) (string, error) {
 	u, err := url.Parse(buildURL)
 	if err != nil {
@@ -882,8 +1621,24 @@ func (w *worker) jobURL(jobUUID string, buildURL string) (string, error) {
 	return u.String(), nil
 }
 
+// maxJobNameLength is the maximum length of a Kubernetes Job name. Job names
+// are DNS subdomains, but the Job controller copies the name into a label on
+// each pod, so in practice it is limited to the length of a label value.
+const maxJobNameLength = validation.LabelValueMaxLength
+
+// k8sJobName returns the name of the Kubernetes Job for the Buildkite job.
+// For a real job UUID, the name is 46 characters, well within the limit.
+// Truncating longer names, and appending a hash of the full name so that they
+// remain unique and deterministic, is only a guard against malformed UUIDs.
 func k8sJobName(jobUUID string) string {
-	return fmt.Sprintf("buildkite-%s", jobUUID)
+	name := fmt.Sprintf("buildkite-%s", jobUUID)
+	if len(name) <= maxJobNameLength {
+		return name
+	}
+	sum := sha256.Sum256([]byte(name))
+	suffix := "-" + hex.EncodeToString(sum[:])[:10]
+	prefix := strings.TrimRight(name[:maxJobNameLength-len(suffix)], "-.")
+	return prefix + suffix
 }
 
 // Format each agentTag as key=value and join with ,
@@ -1,17 +1,34 @@
 package scheduler_test
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"slices"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/buildkite/agent-stack-k8s/v2/api"
+	"github.com/buildkite/agent-stack-k8s/v2/internal/controller/config"
+	"github.com/buildkite/agent-stack-k8s/v2/internal/controller/model"
 	"github.com/buildkite/agent-stack-k8s/v2/internal/controller/scheduler"
 	"github.com/google/go-cmp/cmp"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"go.uber.org/zap/zaptest"
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/utils/ptr"
 	"sigs.k8s.io/yaml"
 )
 
@@ -405,6 +422,1543 @@ func TestBuildSkipCheckout(t *testing.T) {
 	}
 }
 
+func TestBuildServiceAccountForQueue(t *testing.T) {
+	t.Parallel()
+
+	worker := scheduler.New(
+		zaptest.NewLogger(t),
+		nil,
+		scheduler.Config{
+			Namespace:            "buildkite",
+			Image:                "buildkite/agent:latest",
+			AgentTokenSecretName: "bkcq_1234567890",
+			DefaultPodParams: &config.PodParams{
+				ServiceAccountName: "default-sa",
+			},
+			QueuePodParams: map[string]*config.PodParams{
+				"deploy": {ServiceAccountName: "deploy-sa"},
+			},
+		},
+	)
+
+	cases := []struct {
+		name    string
+		queue   string
+		podSpec *corev1.PodSpec
+		want    string
+	}{
+		{
+			name:    "mapped queue",
+			queue:   "deploy",
+			podSpec: &corev1.PodSpec{},
+			want:    "deploy-sa",
+		},
+		{
+			name:    "unmapped queue",
+			queue:   "test",
+			podSpec: &corev1.PodSpec{},
+			want:    "default-sa",
+		},
+		{
+			name:    "set by plugin podSpec",
+			queue:   "deploy",
+			podSpec: &corev1.PodSpec{ServiceAccountName: "plugin-sa"},
+			want:    "plugin-sa",
+		},
+	}
+
+	for _, test := range cases {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			job := &api.CommandJob{
+				Uuid:            "abc",
+				Command:         "echo hello world",
+				AgentQueryRules: []string{"queue=" + test.queue},
+			}
+			inputs, err := worker.ParseJob(job)
+			require.NoError(t, err)
+			kjob, err := worker.Build(test.podSpec, false, inputs)
+			require.NoError(t, err)
+
+			if got := kjob.Spec.Template.Spec.ServiceAccountName; got != test.want {
+				t.Errorf("kjob.Spec.Template.Spec.ServiceAccountName = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestBuildAgentTokenSecretForQueue(t *testing.T) {
+	t.Parallel()
+
+	worker := scheduler.New(
+		zaptest.NewLogger(t),
+		nil,
+		scheduler.Config{
+			Namespace:            "buildkite",
+			Image:                "buildkite/agent:latest",
+			AgentTokenSecretName: "default-token",
+			QueuePodParams: map[string]*config.PodParams{
+				"team-a": {AgentTokenSecret: "team-a-token"},
+				"team-b": {ServiceAccountName: "team-b-sa"},
+			},
+		},
+	)
+
+	cases := []struct {
+		queue string
+		want  string
+	}{
+		{queue: "team-a", want: "team-a-token"},
+		{queue: "team-b", want: "default-token"},
+		{queue: "unmapped", want: "default-token"},
+	}
+
+	for _, test := range cases {
+		t.Run(test.queue, func(t *testing.T) {
+			t.Parallel()
+			job := &api.CommandJob{
+				Uuid:            "abc",
+				Command:         "echo hello world",
+				AgentQueryRules: []string{"queue=" + test.queue},
+			}
+			inputs, err := worker.ParseJob(job)
+			require.NoError(t, err)
+			kjob, err := worker.Build(&corev1.PodSpec{}, false, inputs)
+			require.NoError(t, err)
+
+			podSpec := kjob.Spec.Template.Spec
+			found := 0
+			for _, c := range slices.Concat(podSpec.InitContainers, podSpec.Containers) {
+				for _, env := range c.Env {
+					if env.Name != "BUILDKITE_AGENT_TOKEN" {
+						continue
+					}
+					found++
+					if got := env.ValueFrom.SecretKeyRef.Name; got != test.want {
+						t.Errorf("container %q BUILDKITE_AGENT_TOKEN secret = %q, want %q", c.Name, got, test.want)
+					}
+				}
+			}
+			if found == 0 {
+				t.Error("no container has BUILDKITE_AGENT_TOKEN")
+			}
+		})
+	}
+}
+
+func TestBuildTopologySpreadConstraints(t *testing.T) {
+	t.Parallel()
+
+	spread := func(topologyKey, queue string) corev1.TopologySpreadConstraint {
+		return corev1.TopologySpreadConstraint{
+			MaxSkew:           1,
+			TopologyKey:       topologyKey,
+			WhenUnsatisfiable: corev1.ScheduleAnyway,
+			LabelSelector:     &metav1.LabelSelector{MatchLabels: map[string]string{"tag.buildkite.com/queue": queue}},
+		}
+	}
+	worker := scheduler.New(
+		zaptest.NewLogger(t),
+		nil,
+		scheduler.Config{
+			Namespace:            "buildkite",
+			Image:                "buildkite/agent:latest",
+			AgentTokenSecretName: "bkcq_1234567890",
+			DefaultPodParams: &config.PodParams{
+				TopologySpreadConstraints: []corev1.TopologySpreadConstraint{spread("topology.kubernetes.io/zone", "default")},
+			},
+			QueuePodParams: map[string]*config.PodParams{
+				"deploy": {
+					TopologySpreadConstraints: []corev1.TopologySpreadConstraint{spread("kubernetes.io/hostname", "deploy")},
+				},
+			},
+		},
+	)
+
+	cases := []struct {
+		name    string
+		queue   string
+		podSpec *corev1.PodSpec
+		want    []corev1.TopologySpreadConstraint
+	}{
+		{
+			name:    "mapped queue replaces default",
+			queue:   "deploy",
+			podSpec: &corev1.PodSpec{},
+			want:    []corev1.TopologySpreadConstraint{spread("kubernetes.io/hostname", "deploy")},
+		},
+		{
+			name:    "unmapped queue",
+			queue:   "default",
+			podSpec: &corev1.PodSpec{},
+			want:    []corev1.TopologySpreadConstraint{spread("topology.kubernetes.io/zone", "default")},
+		},
+		{
+			name:  "set by plugin podSpec",
+			queue: "deploy",
+			podSpec: &corev1.PodSpec{
+				TopologySpreadConstraints: []corev1.TopologySpreadConstraint{spread("example.com/rack", "deploy")},
+			},
+			want: []corev1.TopologySpreadConstraint{spread("example.com/rack", "deploy")},
+		},
+	}
+
+	for _, test := range cases {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			inputs, err := worker.ParseJob(&api.CommandJob{
+				Uuid:            "abc",
+				Command:         "echo hello world",
+				AgentQueryRules: []string{"queue=" + test.queue},
+			})
+			require.NoError(t, err)
+			kjob, err := worker.Build(test.podSpec, false, inputs)
+			require.NoError(t, err)
+
+			if diff := cmp.Diff(kjob.Spec.Template.Spec.TopologySpreadConstraints, test.want); diff != "" {
+				t.Errorf("kjob.Spec.Template.Spec.TopologySpreadConstraints diff (-got +want):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestBuildMaxPodsPerNode(t *testing.T) {
+	t.Parallel()
+
+	allJobPods := metav1.LabelSelectorRequirement{Key: config.UUIDLabel, Operator: metav1.LabelSelectorOpExists}
+	worker := scheduler.New(
+		zaptest.NewLogger(t),
+		nil,
+		scheduler.Config{
+			Namespace:            "buildkite",
+			Image:                "buildkite/agent:latest",
+			AgentTokenSecretName: "bkcq_1234567890",
+			DefaultPodParams:     &config.PodParams{MaxPodsPerNode: 1},
+			QueuePodParams: map[string]*config.PodParams{
+				"heavy": {MaxPodsPerNode: 3, MaxPodsPerNodeScope: config.MaxPodsPerNodeScopeQueue},
+			},
+		},
+	)
+
+	cases := []struct {
+		name         string
+		queue        string
+		wantAffinity *corev1.Affinity
+		wantSpread   []corev1.TopologySpreadConstraint
+	}{
+		{
+			name:  "default limit of 1 uses anti-affinity",
+			queue: "default",
+			wantAffinity: &corev1.Affinity{
+				PodAntiAffinity: &corev1.PodAntiAffinity{
+					RequiredDuringSchedulingIgnoredDuringExecution: []corev1.PodAffinityTerm{{
+						LabelSelector: &metav1.LabelSelector{
+							MatchExpressions: []metav1.LabelSelectorRequirement{allJobPods},
+						},
+						TopologyKey: corev1.LabelHostname,
+					}},
+				},
+			},
+		},
+		{
+			name:  "queue limit of 3 uses a topology spread",
+			queue: "heavy",
+			wantSpread: []corev1.TopologySpreadConstraint{{
+				MaxSkew:           3,
+				TopologyKey:       corev1.LabelHostname,
+				WhenUnsatisfiable: corev1.DoNotSchedule,
+				LabelSelector: &metav1.LabelSelector{
+					MatchLabels:      map[string]string{config.QueueTagLabel: "heavy"},
+					MatchExpressions: []metav1.LabelSelectorRequirement{allJobPods},
+				},
+			}},
+		},
+	}
+
+	for _, test := range cases {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			inputs, err := worker.ParseJob(&api.CommandJob{
+				Uuid:            "abc",
+				Command:         "echo hello world",
+				AgentQueryRules: []string{"queue=" + test.queue},
+			})
+			require.NoError(t, err)
+			kjob, err := worker.Build(&corev1.PodSpec{}, false, inputs)
+			require.NoError(t, err)
+
+			podSpec := kjob.Spec.Template.Spec
+			if diff := cmp.Diff(podSpec.Affinity, test.wantAffinity); diff != "" {
+				t.Errorf("kjob.Spec.Template.Spec.Affinity diff (-got +want):\n%s", diff)
+			}
+			if diff := cmp.Diff(podSpec.TopologySpreadConstraints, test.wantSpread); diff != "" {
+				t.Errorf("kjob.Spec.Template.Spec.TopologySpreadConstraints diff (-got +want):\n%s", diff)
+			}
+		})
+	}
+}
+
+// The limiter counts Kubernetes jobs, which is only the same as counting pods
+// while each job runs exactly one pod.
+func TestBuildOnePodPerJob(t *testing.T) {
+	t.Parallel()
+
+	worker := scheduler.New(
+		zaptest.NewLogger(t),
+		nil,
+		scheduler.Config{
+			Namespace:            "buildkite",
+			Image:                "buildkite/agent:latest",
+			AgentTokenSecretName: "bkcq_1234567890",
+		},
+	)
+	inputs, err := worker.ParseJob(&api.CommandJob{
+		Uuid:            "abc",
+		Command:         "echo hello world",
+		AgentQueryRules: []string{"queue=kubernetes"},
+	})
+	require.NoError(t, err)
+	kjob, err := worker.Build(&corev1.PodSpec{}, false, inputs)
+	require.NoError(t, err)
+
+	if got := ptr.Deref(kjob.Spec.Parallelism, 1); got != 1 {
+		t.Errorf("kjob.Spec.Parallelism = %d, want 1", got)
+	}
+	if got := ptr.Deref(kjob.Spec.Completions, 1); got != 1 {
+		t.Errorf("kjob.Spec.Completions = %d, want 1", got)
+	}
+	if got := ptr.Deref(kjob.Spec.BackoffLimit, 6); got != 0 {
+		t.Errorf("kjob.Spec.BackoffLimit = %d, want 0", got)
+	}
+	if got := kjob.Spec.Template.Spec.RestartPolicy; got != corev1.RestartPolicyNever {
+		t.Errorf("kjob.Spec.Template.Spec.RestartPolicy = %q, want %q", got, corev1.RestartPolicyNever)
+	}
+}
+
+func TestBuildControllerID(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		controllerID string
+		wantLabel    bool
+	}{
+		{controllerID: "", wantLabel: false},
+		{controllerID: "ci-main", wantLabel: true},
+	} {
+		worker := scheduler.New(
+			zaptest.NewLogger(t),
+			nil,
+			scheduler.Config{
+				Namespace:            "buildkite",
+				Image:                "buildkite/agent:latest",
+				AgentTokenSecretName: "bkcq_1234567890",
+				ControllerID:         test.controllerID,
+			},
+		)
+		inputs, err := worker.ParseJob(&api.CommandJob{
+			Uuid:            "abc",
+			Command:         "echo hello world",
+			AgentQueryRules: []string{"queue=kubernetes"},
+		})
+		require.NoError(t, err)
+		kjob, err := worker.Build(&corev1.PodSpec{}, false, inputs)
+		require.NoError(t, err)
+
+		got, ok := kjob.Labels[config.ControllerIDLabel]
+		if ok != test.wantLabel || got != test.controllerID {
+			t.Errorf("ControllerID %q: kjob.Labels[%q] = %q, %t, want %q, %t", test.controllerID, config.ControllerIDLabel, got, ok, test.controllerID, test.wantLabel)
+		}
+	}
+}
+
+func TestBuildGenerateJobNames(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		generate         bool
+		wantName         string
+		wantGenerateName string
+	}{
+		{generate: false, wantName: "buildkite-abc"},
+		{generate: true, wantGenerateName: "buildkite-abc-"},
+	} {
+		worker := scheduler.New(
+			zaptest.NewLogger(t),
+			nil,
+			scheduler.Config{
+				Namespace:            "buildkite",
+				Image:                "buildkite/agent:latest",
+				AgentTokenSecretName: "bkcq_1234567890",
+				GenerateJobNames:     test.generate,
+			},
+		)
+		inputs, err := worker.ParseJob(&api.CommandJob{
+			Uuid:            "abc",
+			Command:         "echo hello world",
+			AgentQueryRules: []string{"queue=kubernetes"},
+		})
+		require.NoError(t, err)
+		kjob, err := worker.Build(&corev1.PodSpec{}, false, inputs)
+		require.NoError(t, err)
+
+		if kjob.Name != test.wantName || kjob.GenerateName != test.wantGenerateName {
+			t.Errorf("GenerateJobNames %t: kjob name, generateName = %q, %q, want %q, %q", test.generate, kjob.Name, kjob.GenerateName, test.wantName, test.wantGenerateName)
+		}
+		if got := kjob.Labels[config.UUIDLabel]; got != "abc" {
+			t.Errorf("GenerateJobNames %t: kjob.Labels[%q] = %q, want %q", test.generate, config.UUIDLabel, got, "abc")
+		}
+	}
+}
+
+func TestBuildFinalizers(t *testing.T) {
+	t.Parallel()
+
+	finalizers := []string{"example.com/archive-logs"}
+	worker := scheduler.New(
+		zaptest.NewLogger(t),
+		nil,
+		scheduler.Config{
+			Namespace:            "buildkite",
+			Image:                "buildkite/agent:latest",
+			AgentTokenSecretName: "bkcq_1234567890",
+			Finalizers:           finalizers,
+		},
+	)
+	inputs, err := worker.ParseJob(&api.CommandJob{
+		Uuid:            "abc",
+		Command:         "echo hello world",
+		AgentQueryRules: []string{"queue=kubernetes"},
+	})
+	require.NoError(t, err)
+	kjob, err := worker.Build(&corev1.PodSpec{}, false, inputs)
+	require.NoError(t, err)
+
+	if diff := cmp.Diff(finalizers, kjob.Finalizers); diff != "" {
+		t.Errorf("kjob.Finalizers diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestBuildAgentEnv(t *testing.T) {
+	t.Parallel()
+
+	worker := scheduler.New(
+		zaptest.NewLogger(t),
+		nil,
+		scheduler.Config{
+			Namespace:            "buildkite",
+			Image:                "buildkite/agent:latest",
+			AgentTokenSecretName: "bkcq_1234567890",
+			DefaultPodParams: &config.PodParams{
+				AgentEnv: []corev1.EnvVar{
+					{Name: "HTTPS_PROXY", Value: "http://proxy.internal:3128"},
+					{Name: "NO_PROXY", Value: ".svc"},
+					{Name: "BUILDKITE_AGENT_TAGS", Value: "clobbered=true"},
+					{Name: "BUILDKITE_AGENT_ACQUIRE_JOB", Value: "someone-elses-job"},
+				},
+			},
+			QueuePodParams: map[string]*config.PodParams{
+				"egress": {
+					AgentEnv: []corev1.EnvVar{
+						{Name: "HTTPS_PROXY", Value: "http://egress.internal:3128"},
+					},
+				},
+			},
+		},
+	)
+	inputs, err := worker.ParseJob(&api.CommandJob{
+		Uuid:            "abc",
+		Command:         "echo hello world",
+		AgentQueryRules: []string{"queue=egress"},
+	})
+	require.NoError(t, err)
+	kjob, err := worker.Build(&corev1.PodSpec{}, false, inputs)
+	require.NoError(t, err)
+
+	agent := findContainer(t, kjob.Spec.Template.Spec.Containers, scheduler.AgentContainerName)
+	got := make(map[string][]string)
+	for _, ev := range agent.Env {
+		got[ev.Name] = append(got[ev.Name], ev.Value)
+	}
+	want := map[string][]string{
+		// The queue's value replaces the default.
+		"HTTPS_PROXY": {"http://egress.internal:3128"},
+		"NO_PROXY":    {".svc"},
+		// Variables set by the controller are not clobbered.
+		"BUILDKITE_AGENT_ACQUIRE_JOB": {"abc"},
+	}
+	for name, values := range want {
+		if diff := cmp.Diff(got[name], values); diff != "" {
+			t.Errorf("agent container env %s diff (-got +want):\n%s", name, diff)
+		}
+	}
+	if tags := got["BUILDKITE_AGENT_TAGS"]; len(tags) != 1 || !strings.Contains(tags[0], "queue=egress") {
+		t.Errorf("agent container env BUILDKITE_AGENT_TAGS = %q, want one value with queue=egress", tags)
+	}
+}
+
+func TestBuildJobFieldEnv(t *testing.T) {
+	t.Parallel()
+
+	worker := scheduler.New(
+		zaptest.NewLogger(t),
+		nil,
+		scheduler.Config{
+			Namespace:            "buildkite",
+			Image:                "buildkite/agent:latest",
+			AgentTokenSecretName: "bkcq_1234567890",
+			JobFieldEnv: config.JobFieldEnv{
+				"uuid":                   "JOB_UUID",
+				"scheduledAt":            "JOB_SCHEDULED_AT",
+				"clusterQueue.uuid":      "JOB_CLUSTER_QUEUE",
+				"tag.queue":              "JOB_QUEUE",
+				"tag.missing":            "JOB_MISSING_TAG",
+				"env.BUILDKITE_BUILD_ID": "BUILD_ID",
+				"env.MISSING":            "JOB_MISSING_ENV",
+				"command":                "BUILDKITE_AGENT_ACQUIRE_JOB",
+			},
+		},
+	)
+
+	cases := []struct {
+		name string
+		job  *api.CommandJob
+		want map[string][]string
+	}{
+		{
+			name: "all fields",
+			job: &api.CommandJob{
+				Uuid:            "abc",
+				Command:         "echo hello world",
+				AgentQueryRules: []string{"queue=kubernetes"},
+				ScheduledAt:     time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+				ClusterQueue:    &api.CommandJobClusterQueue{Uuid: "cq-1"},
+				Env:             []string{"BUILDKITE_BUILD_ID=build-1"},
+			},
+			want: map[string][]string{
+				"JOB_UUID":          {"abc"},
+				"JOB_SCHEDULED_AT":  {"2024-05-01T12:00:00Z"},
+				"JOB_CLUSTER_QUEUE": {"cq-1"},
+				"JOB_QUEUE":         {"kubernetes"},
+				"BUILD_ID":          {"build-1"},
+				// Variables set by the controller are not clobbered.
+				"BUILDKITE_AGENT_ACQUIRE_JOB": {"abc"},
+			},
+		},
+		{
+			name: "missing fields",
+			job: &api.CommandJob{
+				Uuid:            "abc",
+				Command:         "echo hello world",
+				AgentQueryRules: []string{"queue=kubernetes"},
+			},
+			want: map[string][]string{
+				"JOB_UUID":  {"abc"},
+				"JOB_QUEUE": {"kubernetes"},
+			},
+		},
+	}
+
+	for _, test := range cases {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			inputs, err := worker.ParseJob(test.job)
+			require.NoError(t, err)
+			kjob, err := worker.Build(&corev1.PodSpec{}, false, inputs)
+			require.NoError(t, err)
+
+			agent := findContainer(t, kjob.Spec.Template.Spec.Containers, scheduler.AgentContainerName)
+			got := make(map[string][]string)
+			for _, ev := range agent.Env {
+				got[ev.Name] = append(got[ev.Name], ev.Value)
+			}
+			for name, values := range test.want {
+				if diff := cmp.Diff(got[name], values); diff != "" {
+					t.Errorf("agent container env %s diff (-got +want):\n%s", name, diff)
+				}
+			}
+			for _, name := range []string{"JOB_MISSING_TAG", "JOB_MISSING_ENV", "JOB_SCHEDULED_AT", "JOB_CLUSTER_QUEUE", "BUILD_ID"} {
+				if _, want := test.want[name]; !want && got[name] != nil {
+					t.Errorf("agent container env %s = %q, want unset", name, got[name])
+				}
+			}
+		})
+	}
+}
+
+func TestBuildAgentCommandWrapper(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name        string
+		wrapper     config.AgentCommandWrapper
+		pipeline    string
+		wantCommand []string
+		wantArgs    []string
+	}{
+		{
+			name:     "no wrapper",
+			pipeline: "my-pipeline",
+			wantArgs: []string{"start"},
+		},
+		{
+			name:        "wrapper",
+			wrapper:     config.AgentCommandWrapper{"/bin/sh", "-c", `"$@" 2>&1 | ship-logs --job {{.JobUUID}} --pipeline {{.Pipeline}}`, "--"},
+			pipeline:    "my-pipeline",
+			wantCommand: []string{"/bin/sh", "-c", `"$@" 2>&1 | ship-logs --job abc --pipeline my-pipeline`, "--"},
+			wantArgs:    []string{"buildkite-agent", "start"},
+		},
+		{
+			name:        "unsafe pipeline",
+			wrapper:     config.AgentCommandWrapper{"ship-logs", "--pipeline={{.Pipeline}}", "--"},
+			pipeline:    "x; rm -rf /",
+			wantCommand: []string{"ship-logs", "--pipeline=", "--"},
+			wantArgs:    []string{"buildkite-agent", "start"},
+		},
+	}
+
+	for _, test := range cases {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			worker := scheduler.New(
+				zaptest.NewLogger(t),
+				nil,
+				scheduler.Config{
+					Namespace:            "buildkite",
+					Image:                "buildkite/agent:latest",
+					AgentTokenSecretName: "bkcq_1234567890",
+					AgentCommandWrapper:  test.wrapper,
+				},
+			)
+			inputs, err := worker.ParseJob(&api.CommandJob{
+				Uuid:            "abc",
+				Command:         "echo hello world",
+				AgentQueryRules: []string{"queue=kubernetes"},
+				Env:             []string{"BUILDKITE_PIPELINE_SLUG=" + test.pipeline},
+			})
+			require.NoError(t, err)
+			kjob, err := worker.Build(&corev1.PodSpec{}, false, inputs)
+			require.NoError(t, err)
+
+			agent := findContainer(t, kjob.Spec.Template.Spec.Containers, scheduler.AgentContainerName)
+			if diff := cmp.Diff(agent.Command, test.wantCommand); diff != "" {
+				t.Errorf("agent container command diff (-got +want):\n%s", diff)
+			}
+			if diff := cmp.Diff(agent.Args, test.wantArgs); diff != "" {
+				t.Errorf("agent container args diff (-got +want):\n%s", diff)
+			}
+
+			// Command containers are not wrapped.
+			command := findContainer(t, kjob.Spec.Template.Spec.Containers, "container-0")
+			if diff := cmp.Diff(command.Command, []string{"/workspace/tini-static"}); diff != "" {
+				t.Errorf("command container command diff (-got +want):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestBuildSecurityContext(t *testing.T) {
+	t.Parallel()
+
+	worker := scheduler.New(
+		zaptest.NewLogger(t),
+		nil,
+		scheduler.Config{
+			Namespace:            "buildkite",
+			Image:                "buildkite/agent:latest",
+			AgentTokenSecretName: "bkcq_1234567890",
+			DefaultPodParams: &config.PodParams{
+				SecurityProfile: config.SecurityProfileRestricted,
+				SecurityContext: &corev1.PodSecurityContext{RunAsUser: ptr.To[int64](1000)},
+			},
+			QueuePodParams: map[string]*config.PodParams{
+				"privileged": {
+					SecurityProfile:          config.SecurityProfileNone,
+					SecurityContext:          &corev1.PodSecurityContext{},
+					ContainerSecurityContext: &corev1.SecurityContext{Privileged: ptr.To(true)},
+				},
+			},
+		},
+	)
+
+	build := func(queue string) corev1.PodSpec {
+		t.Helper()
+		inputs, err := worker.ParseJob(&api.CommandJob{
+			Uuid:            "abc",
+			Command:         "echo hello world",
+			AgentQueryRules: []string{"queue=" + queue},
+		})
+		require.NoError(t, err)
+		kjob, err := worker.Build(&corev1.PodSpec{}, false, inputs)
+		require.NoError(t, err)
+		return kjob.Spec.Template.Spec
+	}
+
+	podSpec := build("default")
+	wantPod := &corev1.PodSecurityContext{
+		RunAsUser:      ptr.To[int64](1000),
+		RunAsNonRoot:   ptr.To(true),
+		SeccompProfile: &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeRuntimeDefault},
+	}
+	if diff := cmp.Diff(podSpec.SecurityContext, wantPod); diff != "" {
+		t.Errorf("podSpec.SecurityContext diff (-got +want):\n%s", diff)
+	}
+	wantContainer := &corev1.SecurityContext{
+		AllowPrivilegeEscalation: ptr.To(false),
+		Capabilities:             &corev1.Capabilities{Drop: []corev1.Capability{"ALL"}},
+	}
+	for _, c := range slices.Concat(podSpec.InitContainers, podSpec.Containers) {
+		if diff := cmp.Diff(c.SecurityContext, wantContainer); diff != "" {
+			t.Errorf("container %q SecurityContext diff (-got +want):\n%s", c.Name, diff)
+		}
+		// Checkout can't switch from root to the pod's user.
+		if c.Name == scheduler.CheckoutContainerName && slices.ContainsFunc(c.Args, func(arg string) bool {
+			return strings.Contains(arg, "adduser")
+		}) {
+			t.Errorf("checkout container args = %q, want no adduser", c.Args)
+		}
+	}
+
+	// The queue's params replace the restricted profile.
+	podSpec = build("privileged")
+	if diff := cmp.Diff(podSpec.SecurityContext, &corev1.PodSecurityContext{}); diff != "" {
+		t.Errorf("podSpec.SecurityContext diff (-got +want):\n%s", diff)
+	}
+	for _, c := range podSpec.Containers {
+		if !ptr.Deref(c.SecurityContext.Privileged, false) {
+			t.Errorf("container %q SecurityContext.Privileged = %v, want true", c.Name, c.SecurityContext.Privileged)
+		}
+	}
+}
+
+func TestBuildInitContainers(t *testing.T) {
+	t.Parallel()
+
+	job := &api.CommandJob{
+		Uuid:            "abc",
+		Command:         "echo hello world",
+		AgentQueryRules: []string{"queue=deploy"},
+	}
+
+	worker := scheduler.New(
+		zaptest.NewLogger(t),
+		nil,
+		scheduler.Config{
+			Namespace:            "buildkite",
+			Image:                "buildkite/agent:latest",
+			AgentTokenSecretName: "bkcq_1234567890",
+			DefaultPodParams: &config.PodParams{
+				InitContainers: []corev1.Container{
+					{Name: "prepare", Image: "buildkite/agent:latest"},
+				},
+			},
+			QueuePodParams: map[string]*config.PodParams{
+				"deploy": {
+					InitContainers: []corev1.Container{{
+						Name:  "deploy-prepare",
+						Image: "alpine:latest",
+						VolumeMounts: []corev1.VolumeMount{
+							{Name: "cache", MountPath: "/workspace"},
+						},
+					}},
+				},
+			},
+		},
+	)
+	inputs, err := worker.ParseJob(job)
+	require.NoError(t, err)
+	podSpec := &corev1.PodSpec{
+		InitContainers: []corev1.Container{
+			{Name: "plugin-init", Image: "alpine:latest"},
+		},
+	}
+	kjob, err := worker.Build(podSpec, false, inputs)
+	require.NoError(t, err)
+
+	var gotNames []string
+	for _, c := range kjob.Spec.Template.Spec.InitContainers {
+		if c.Name == scheduler.CopyAgentContainerName || strings.HasPrefix(c.Name, scheduler.ImagePullCheckContainerNamePrefix) {
+			continue
+		}
+		gotNames = append(gotNames, c.Name)
+	}
+	wantNames := []string{"prepare", "deploy-prepare", "plugin-init"}
+	if diff := cmp.Diff(gotNames, wantNames); diff != "" {
+		t.Errorf("init container names diff (-got +want):\n%s", diff)
+	}
+
+	// The workspace volume should be shared with the init containers from the
+	// config, unless they already have something mounted there.
+	prepare := findContainer(t, kjob.Spec.Template.Spec.InitContainers, "prepare")
+	wantMounts := []corev1.VolumeMount{{Name: "workspace", MountPath: "/workspace"}}
+	if diff := cmp.Diff(prepare.VolumeMounts, wantMounts); diff != "" {
+		t.Errorf("prepare.VolumeMounts diff (-got +want):\n%s", diff)
+	}
+	deployPrepare := findContainer(t, kjob.Spec.Template.Spec.InitContainers, "deploy-prepare")
+	wantMounts = []corev1.VolumeMount{{Name: "cache", MountPath: "/workspace"}}
+	if diff := cmp.Diff(deployPrepare.VolumeMounts, wantMounts); diff != "" {
+		t.Errorf("deploy-prepare.VolumeMounts diff (-got +want):\n%s", diff)
+	}
+}
+
+func TestBuildSidecars(t *testing.T) {
+	t.Parallel()
+
+	pluginsYAML := `- github.com/buildkite-plugins/kubernetes-buildkite-plugin:
+    sidecars:
+    - image: redis:7`
+
+	pluginsJSON, err := yaml.YAMLToJSONStrict([]byte(pluginsYAML))
+	require.NoError(t, err)
+
+	job := &api.CommandJob{
+		Uuid:            "abc",
+		Command:         "echo hello world",
+		Env:             []string{fmt.Sprintf("BUILDKITE_PLUGINS=%s", pluginsJSON)},
+		AgentQueryRules: []string{"queue=integration"},
+	}
+
+	sidecarEnvFrom := []corev1.EnvFromSource{{
+		SecretRef: &corev1.SecretEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "sidecar-secrets"}},
+	}}
+	worker := scheduler.New(
+		zaptest.NewLogger(t),
+		nil,
+		scheduler.Config{
+			Namespace:            "buildkite",
+			Image:                "buildkite/agent:latest",
+			AgentTokenSecretName: "bkcq_1234567890",
+			DefaultSidecarParams: &config.SidecarParams{EnvFrom: sidecarEnvFrom},
+			DefaultPodParams: &config.PodParams{
+				Sidecars: []corev1.Container{{Name: "proxy", Image: "envoyproxy/envoy:v1.31"}},
+			},
+			QueuePodParams: map[string]*config.PodParams{
+				"integration": {
+					Sidecars: []corev1.Container{{
+						Name:  "postgres",
+						Image: "postgres:16",
+						VolumeMounts: []corev1.VolumeMount{
+							{Name: "pgdata", MountPath: "/workspace"},
+						},
+					}},
+				},
+			},
+		},
+	)
+	inputs, err := worker.ParseJob(job)
+	require.NoError(t, err)
+	kjob, err := worker.Build(&corev1.PodSpec{}, false, inputs)
+	require.NoError(t, err)
+
+	podSpec := kjob.Spec.Template.Spec
+	var gotNames []string
+	for _, c := range podSpec.Containers {
+		gotNames = append(gotNames, c.Name)
+	}
+	wantNames := []string{"container-0", "sidecar-0", "proxy", "postgres", scheduler.AgentContainerName, scheduler.CheckoutContainerName}
+	if diff := cmp.Diff(gotNames, wantNames); diff != "" {
+		t.Errorf("container names diff (-got +want):\n%s", diff)
+	}
+
+	// Config sidecars share the workspace volume, unless they already have
+	// something mounted there, and get the default sidecar params.
+	proxy := findContainer(t, podSpec.Containers, "proxy")
+	wantMounts := []corev1.VolumeMount{{Name: "workspace", MountPath: "/workspace"}}
+	if diff := cmp.Diff(proxy.VolumeMounts, wantMounts); diff != "" {
+		t.Errorf("proxy.VolumeMounts diff (-got +want):\n%s", diff)
+	}
+	if diff := cmp.Diff(proxy.EnvFrom, sidecarEnvFrom); diff != "" {
+		t.Errorf("proxy.EnvFrom diff (-got +want):\n%s", diff)
+	}
+	postgres := findContainer(t, podSpec.Containers, "postgres")
+	wantMounts = []corev1.VolumeMount{{Name: "pgdata", MountPath: "/workspace"}}
+	if diff := cmp.Diff(postgres.VolumeMounts, wantMounts); diff != "" {
+		t.Errorf("postgres.VolumeMounts diff (-got +want):\n%s", diff)
+	}
+
+	// Images for sidecars are checked before the job starts, like other images.
+	var pullChecks []string
+	for _, c := range podSpec.InitContainers {
+		if strings.HasPrefix(c.Name, scheduler.ImagePullCheckContainerNamePrefix) {
+			pullChecks = append(pullChecks, c.Image)
+		}
+	}
+	for _, image := range []string{"envoyproxy/envoy:v1.31", "postgres:16"} {
+		if !slices.Contains(pullChecks, image) {
+			t.Errorf("image pull check init containers %v do not include %q", pullChecks, image)
+		}
+	}
+}
+
+func TestBuildLongJobName(t *testing.T) {
+	t.Parallel()
+
+	worker := scheduler.New(
+		zaptest.NewLogger(t),
+		nil,
+		scheduler.Config{
+			Namespace:            "buildkite",
+			Image:                "buildkite/agent:latest",
+			AgentTokenSecretName: "bkcq_1234567890",
+		},
+	)
+
+	build := func(uuid string) *batchv1.Job {
+		t.Helper()
+		inputs, err := worker.ParseJob(&api.CommandJob{
+			Uuid:            uuid,
+			Command:         "echo hello world",
+			AgentQueryRules: []string{"queue=kubernetes"},
+		})
+		require.NoError(t, err)
+		kjob, err := worker.Build(&corev1.PodSpec{}, false, inputs)
+		require.NoError(t, err)
+		return kjob
+	}
+
+	long := strings.Repeat("0190d4c6-6b0f-4a3c-8f4e-", 10)
+	names := make(map[string]string)
+	for _, uuid := range []string{
+		"0190d4c6-6b0f-4a3c-8f4e-3a1f2b7c9d01",
+		long + "a",
+		long + "b",
+		strings.Repeat("-", 100),
+	} {
+		kjob := build(uuid)
+		if got := len(kjob.Name); got > 63 {
+			t.Errorf("len(kjob.Name) = %d, want <= 63 (name: %q)", got, kjob.Name)
+		}
+		if errs := validation.IsDNS1123Subdomain(kjob.Name); len(errs) > 0 {
+			t.Errorf("kjob.Name = %q is not a valid name: %v", kjob.Name, errs)
+		}
+		if got := build(uuid).Name; got != kjob.Name {
+			t.Errorf("second build: kjob.Name = %q, want %q", got, kjob.Name)
+		}
+		if got := kjob.Annotations[config.UUIDLabel]; got != uuid {
+			t.Errorf("kjob.Annotations[%q] = %q, want %q", config.UUIDLabel, got, uuid)
+		}
+		if prev, ok := names[kjob.Name]; ok {
+			t.Errorf("uuids %q and %q both produced kjob.Name = %q", prev, uuid, kjob.Name)
+		}
+		names[kjob.Name] = uuid
+	}
+}
+
+func TestBuildPriorityClass(t *testing.T) {
+	t.Parallel()
+
+	worker := scheduler.New(
+		zaptest.NewLogger(t),
+		nil,
+		scheduler.Config{
+			Namespace:            "buildkite",
+			Image:                "buildkite/agent:latest",
+			AgentTokenSecretName: "bkcq_1234567890",
+			DefaultPodParams: &config.PodParams{
+				PriorityClassName: "normal",
+			},
+			AllowedPriorityClasses: []string{"high", "low"},
+		},
+	)
+
+	cases := []struct {
+		name    string
+		tags    []string
+		plugins string
+		podSpec *corev1.PodSpec
+		want    string
+	}{
+		{
+			name: "no tag",
+			tags: []string{"queue=kubernetes"},
+			want: "normal",
+		},
+		{
+			name: "allowed",
+			tags: []string{"queue=kubernetes", "bk-priority-class=high"},
+			want: "high",
+		},
+		{
+			name: "not allowed",
+			tags: []string{"queue=kubernetes", "bk-priority-class=system-cluster-critical"},
+			want: "normal",
+		},
+		{
+			name: "allowed, patched by the job",
+			tags: []string{"queue=kubernetes"},
+			plugins: `- github.com/buildkite-plugins/kubernetes-buildkite-plugin:
+    podSpecPatch:
+      priorityClassName: low`,
+			want: "low",
+		},
+		{
+			name: "not allowed, patched by the job",
+			tags: []string{"queue=kubernetes"},
+			plugins: `- github.com/buildkite-plugins/kubernetes-buildkite-plugin:
+    podSpecPatch:
+      priorityClassName: system-cluster-critical`,
+			want: "normal",
+		},
+		{
+			name: "not allowed, patched by the job over an allowed tag",
+			tags: []string{"queue=kubernetes", "bk-priority-class=high"},
+			plugins: `- github.com/buildkite-plugins/kubernetes-buildkite-plugin:
+    podSpecPatch:
+      priorityClassName: system-cluster-critical`,
+			want: "high",
+		},
+		{
+			name:    "not allowed, in the job's podSpec",
+			tags:    []string{"queue=kubernetes"},
+			podSpec: &corev1.PodSpec{PriorityClassName: "system-cluster-critical"},
+			want:    "normal",
+		},
+	}
+
+	for _, test := range cases {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			job := &api.CommandJob{
+				Uuid:            "abc",
+				Command:         "echo hello world",
+				AgentQueryRules: test.tags,
+			}
+			if test.plugins != "" {
+				pluginsJSON, err := yaml.YAMLToJSONStrict([]byte(test.plugins))
+				require.NoError(t, err)
+				job.Env = []string{fmt.Sprintf("BUILDKITE_PLUGINS=%s", pluginsJSON)}
+			}
+			inputs, err := worker.ParseJob(job)
+			require.NoError(t, err)
+			podSpec := &corev1.PodSpec{}
+			if test.podSpec != nil {
+				podSpec = test.podSpec
+			}
+			kjob, err := worker.Build(podSpec, false, inputs)
+			require.NoError(t, err)
+
+			if got := kjob.Spec.Template.Spec.PriorityClassName; got != test.want {
+				t.Errorf("kjob.Spec.Template.Spec.PriorityClassName = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestBuildRuntimeClass(t *testing.T) {
+	t.Parallel()
+
+	worker := scheduler.New(
+		zaptest.NewLogger(t),
+		nil,
+		scheduler.Config{
+			Namespace:            "buildkite",
+			Image:                "buildkite/agent:latest",
+			AgentTokenSecretName: "bkcq_1234567890",
+			RuntimeClasses:       map[string]string{"gvisor": "gvisor-runsc"},
+		},
+	)
+
+	cases := []struct {
+		name    string
+		tags    []string
+		plugins string
+		want    *string
+		wantErr bool
+	}{
+		{
+			name: "no tag",
+			tags: []string{"queue=kubernetes"},
+			want: nil,
+		},
+		{
+			name: "allowed",
+			tags: []string{"queue=kubernetes", "bk-runtime=gvisor"},
+			want: ptr.To("gvisor-runsc"),
+		},
+		{
+			name: "allowed, patched by the job",
+			tags: []string{"queue=kubernetes", "bk-runtime=gvisor"},
+			plugins: `- github.com/buildkite-plugins/kubernetes-buildkite-plugin:
+    podSpecPatch:
+      runtimeClassName: runc`,
+			want: ptr.To("gvisor-runsc"),
+		},
+		{
+			name:    "not allowed",
+			tags:    []string{"queue=kubernetes", "bk-runtime=kata"},
+			wantErr: true,
+		},
+	}
+
+	for _, test := range cases {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			job := &api.CommandJob{
+				Uuid:            "abc",
+				Command:         "echo hello world",
+				AgentQueryRules: test.tags,
+			}
+			if test.plugins != "" {
+				pluginsJSON, err := yaml.YAMLToJSONStrict([]byte(test.plugins))
+				require.NoError(t, err)
+				job.Env = []string{fmt.Sprintf("BUILDKITE_PLUGINS=%s", pluginsJSON)}
+			}
+			inputs, err := worker.ParseJob(job)
+			require.NoError(t, err)
+			kjob, err := worker.Build(&corev1.PodSpec{}, false, inputs)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("worker.Build(...) error = nil, want an error")
+				}
+				return
+			}
+			require.NoError(t, err)
+
+			if diff := cmp.Diff(kjob.Spec.Template.Spec.RuntimeClassName, test.want); diff != "" {
+				t.Errorf("kjob.Spec.Template.Spec.RuntimeClassName diff (-got +want):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestBuildResourceHints(t *testing.T) {
+	t.Parallel()
+
+	worker := scheduler.New(
+		zaptest.NewLogger(t),
+		nil,
+		scheduler.Config{
+			Namespace:            "buildkite",
+			Image:                "buildkite/agent:latest",
+			AgentTokenSecretName: "bkcq_1234567890",
+			ResourceHints: &config.ResourceHints{
+				CPU: &config.ResourceBounds{
+					Min: resource.MustParse("500m"),
+					Max: resource.MustParse("4"),
+				},
+				Memory: &config.ResourceBounds{
+					Max: resource.MustParse("16Gi"),
+				},
+				EphemeralStorage: &config.ResourceBounds{
+					Max:     resource.MustParse("100Gi"),
+					Default: ptr.To(resource.MustParse("10Gi")),
+				},
+			},
+			PodSpecPatch: &corev1.PodSpec{
+				Containers: []corev1.Container{{
+					Name: "container-0",
+					Resources: corev1.ResourceRequirements{
+						Requests: corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("1Gi")},
+					},
+				}},
+			},
+		},
+	)
+
+	cases := []struct {
+		name string
+		tags []string
+		want corev1.ResourceList
+	}{
+		{
+			name: "no tags",
+			tags: []string{"queue=kubernetes"},
+			want: corev1.ResourceList{
+				corev1.ResourceMemory:           resource.MustParse("1Gi"),
+				corev1.ResourceEphemeralStorage: resource.MustParse("10Gi"),
+			},
+		},
+		{
+			name: "within bounds",
+			tags: []string{"queue=kubernetes", "bk-cpu=2", "bk-memory=4Gi"},
+			want: corev1.ResourceList{
+				corev1.ResourceCPU:              resource.MustParse("2"),
+				corev1.ResourceMemory:           resource.MustParse("4Gi"),
+				corev1.ResourceEphemeralStorage: resource.MustParse("10Gi"),
+			},
+		},
+		{
+			name: "clamped",
+			tags: []string{"queue=kubernetes", "bk-cpu=100m", "bk-memory=64Gi"},
+			want: corev1.ResourceList{
+				corev1.ResourceCPU:              resource.MustParse("500m"),
+				corev1.ResourceMemory:           resource.MustParse("16Gi"),
+				corev1.ResourceEphemeralStorage: resource.MustParse("10Gi"),
+			},
+		},
+		{
+			name: "ephemeral storage",
+			tags: []string{"queue=kubernetes", "bk-ephemeral-storage=20Gi"},
+			want: corev1.ResourceList{
+				corev1.ResourceMemory:           resource.MustParse("1Gi"),
+				corev1.ResourceEphemeralStorage: resource.MustParse("20Gi"),
+			},
+		},
+		{
+			name: "ephemeral storage clamped",
+			tags: []string{"queue=kubernetes", "bk-ephemeral-storage=1Ti"},
+			want: corev1.ResourceList{
+				corev1.ResourceMemory:           resource.MustParse("1Gi"),
+				corev1.ResourceEphemeralStorage: resource.MustParse("100Gi"),
+			},
+		},
+		{
+			name: "not a quantity",
+			tags: []string{"queue=kubernetes", "bk-cpu=lots"},
+			want: corev1.ResourceList{
+				corev1.ResourceMemory:           resource.MustParse("1Gi"),
+				corev1.ResourceEphemeralStorage: resource.MustParse("10Gi"),
+			},
+		},
+	}
+
+	for _, test := range cases {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			inputs, err := worker.ParseJob(&api.CommandJob{
+				Uuid:            "abc",
+				Command:         "echo hello world",
+				AgentQueryRules: test.tags,
+			})
+			require.NoError(t, err)
+			kjob, err := worker.Build(&corev1.PodSpec{}, false, inputs)
+			require.NoError(t, err)
+
+			ctr := kjob.Spec.Template.Spec.Containers[0]
+			if diff := cmp.Diff(ctr.Resources.Requests, test.want, cmpQuantity); diff != "" {
+				t.Errorf("container-0 requests diff (-got +want):\n%s", diff)
+			}
+		})
+	}
+}
+
+// cmpQuantity compares quantities by value rather than representation.
+var cmpQuantity = cmp.Comparer(func(a, b resource.Quantity) bool { return a.Cmp(b) == 0 })
+
+func TestBuildSpotTag(t *testing.T) {
+	t.Parallel()
+
+	spotToleration := corev1.Toleration{
+		Key:      "cloud.google.com/gke-spot",
+		Operator: corev1.TolerationOpEqual,
+		Value:    "true",
+		Effect:   corev1.TaintEffectNoSchedule,
+	}
+	worker := scheduler.New(
+		zaptest.NewLogger(t),
+		nil,
+		scheduler.Config{
+			Namespace:            "buildkite",
+			Image:                "buildkite/agent:latest",
+			AgentTokenSecretName: "bkcq_1234567890",
+			SpotParams: &config.SpotParams{
+				Tolerations:  []corev1.Toleration{spotToleration},
+				NodeSelector: map[string]string{"cloud.google.com/gke-spot": "true"},
+			},
+		},
+	)
+
+	// The plugin podSpec requires either of two zones.
+	zoneTerm := func(zone string) corev1.NodeSelectorTerm {
+		return corev1.NodeSelectorTerm{MatchExpressions: []corev1.NodeSelectorRequirement{{
+			Key:      "topology.kubernetes.io/zone",
+			Operator: corev1.NodeSelectorOpIn,
+			Values:   []string{zone},
+		}}}
+	}
+	pluginPodSpec := func() *corev1.PodSpec {
+		return &corev1.PodSpec{
+			Affinity: &corev1.Affinity{NodeAffinity: &corev1.NodeAffinity{
+				RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{
+					NodeSelectorTerms: []corev1.NodeSelectorTerm{zoneTerm("a"), zoneTerm("b")},
+				},
+			}},
+		}
+	}
+	notSpot := corev1.NodeSelectorRequirement{
+		Key:      "cloud.google.com/gke-spot",
+		Operator: corev1.NodeSelectorOpNotIn,
+		Values:   []string{"true"},
+	}
+
+	build := func(t *testing.T, tags []string) corev1.PodSpec {
+		t.Helper()
+		inputs, err := worker.ParseJob(&api.CommandJob{
+			Uuid:            "abc",
+			Command:         "echo hello world",
+			AgentQueryRules: tags,
+		})
+		require.NoError(t, err)
+		kjob, err := worker.Build(pluginPodSpec(), false, inputs)
+		require.NoError(t, err)
+		return kjob.Spec.Template.Spec
+	}
+
+	t.Run("spot", func(t *testing.T) {
+		t.Parallel()
+		podSpec := build(t, []string{"queue=kubernetes", "bk-spot=true"})
+		if diff := cmp.Diff(podSpec.Tolerations, []corev1.Toleration{spotToleration}); diff != "" {
+			t.Errorf("podSpec.Tolerations diff (-got +want):\n%s", diff)
+		}
+		if diff := cmp.Diff(podSpec.NodeSelector, map[string]string{"cloud.google.com/gke-spot": "true"}); diff != "" {
+			t.Errorf("podSpec.NodeSelector diff (-got +want):\n%s", diff)
+		}
+		if diff := cmp.Diff(podSpec.Affinity, pluginPodSpec().Affinity); diff != "" {
+			t.Errorf("podSpec.Affinity diff (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("critical", func(t *testing.T) {
+		t.Parallel()
+		podSpec := build(t, []string{"queue=kubernetes", "bk-spot=false"})
+		if len(podSpec.Tolerations) != 0 || len(podSpec.NodeSelector) != 0 {
+			t.Errorf("podSpec.Tolerations, podSpec.NodeSelector = %v, %v, want empty", podSpec.Tolerations, podSpec.NodeSelector)
+		}
+		// Each zone term should also require a non-spot node.
+		wantTerms := []corev1.NodeSelectorTerm{zoneTerm("a"), zoneTerm("b")}
+		for i := range wantTerms {
+			wantTerms[i].MatchExpressions = append(wantTerms[i].MatchExpressions, notSpot)
+		}
+		gotTerms := podSpec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms
+		if diff := cmp.Diff(gotTerms, wantTerms); diff != "" {
+			t.Errorf("required node selector terms diff (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("untagged", func(t *testing.T) {
+		t.Parallel()
+		podSpec := build(t, []string{"queue=kubernetes"})
+		if len(podSpec.Tolerations) != 0 || len(podSpec.NodeSelector) != 0 {
+			t.Errorf("podSpec.Tolerations, podSpec.NodeSelector = %v, %v, want empty", podSpec.Tolerations, podSpec.NodeSelector)
+		}
+		if diff := cmp.Diff(podSpec.Affinity, pluginPodSpec().Affinity); diff != "" {
+			t.Errorf("podSpec.Affinity diff (-got +want):\n%s", diff)
+		}
+	})
+}
+
+func TestBuildTerminationGracePeriod(t *testing.T) {
+	t.Parallel()
+
+	configured := scheduler.Config{
+		Namespace:            "buildkite",
+		Image:                "buildkite/agent:latest",
+		AgentTokenSecretName: "bkcq_1234567890",
+		DefaultPodParams: &config.PodParams{
+			TerminationGracePeriodSeconds: ptr.To[int64](120),
+		},
+		QueuePodParams: map[string]*config.PodParams{
+			"artifacts": {TerminationGracePeriodSeconds: ptr.To[int64](600)},
+		},
+	}
+	unconfigured := scheduler.Config{
+		Namespace:            "buildkite",
+		Image:                "buildkite/agent:latest",
+		AgentTokenSecretName: "bkcq_1234567890",
+	}
+
+	cases := []struct {
+		name    string
+		cfg     scheduler.Config
+		queue   string
+		podSpec *corev1.PodSpec
+		want    int64
+	}{
+		{
+			name:    "built-in default",
+			cfg:     unconfigured,
+			queue:   "kubernetes",
+			podSpec: &corev1.PodSpec{},
+			want:    60,
+		},
+		{
+			name:    "configured default",
+			cfg:     configured,
+			queue:   "kubernetes",
+			podSpec: &corev1.PodSpec{},
+			want:    120,
+		},
+		{
+			name:    "configured for queue",
+			cfg:     configured,
+			queue:   "artifacts",
+			podSpec: &corev1.PodSpec{},
+			want:    600,
+		},
+		{
+			name:    "set by plugin podSpec",
+			cfg:     configured,
+			queue:   "artifacts",
+			podSpec: &corev1.PodSpec{TerminationGracePeriodSeconds: ptr.To[int64](5)},
+			want:    5,
+		},
+	}
+
+	for _, test := range cases {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			worker := scheduler.New(zaptest.NewLogger(t), nil, test.cfg)
+			inputs, err := worker.ParseJob(&api.CommandJob{
+				Uuid:            "abc",
+				Command:         "echo hello world",
+				AgentQueryRules: []string{"queue=" + test.queue},
+			})
+			require.NoError(t, err)
+			kjob, err := worker.Build(test.podSpec, false, inputs)
+			require.NoError(t, err)
+
+			got := kjob.Spec.Template.Spec.TerminationGracePeriodSeconds
+			if got == nil || *got != test.want {
+				t.Errorf("kjob.Spec.Template.Spec.TerminationGracePeriodSeconds = %v, want %d", got, test.want)
+			}
+		})
+	}
+}
+
+func TestBuildTagVolumes(t *testing.T) {
+	t.Parallel()
+
+	goCache := corev1.Volume{
+		Name: "go-build-cache",
+		VolumeSource: corev1.VolumeSource{
+			PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: "go-build-cache"},
+		},
+	}
+	worker := scheduler.New(
+		zaptest.NewLogger(t),
+		nil,
+		scheduler.Config{
+			Namespace:            "buildkite",
+			Image:                "buildkite/agent:latest",
+			AgentTokenSecretName: "bkcq_1234567890",
+			TagVolumes: config.TagVolumes{
+				"bk-cache=go": {
+					Volume:      goCache,
+					VolumeMount: corev1.VolumeMount{MountPath: "/cache/go"},
+				},
+			},
+		},
+	)
+
+	build := func(t *testing.T, podSpec *corev1.PodSpec, tags []string) (*batchv1.Job, error) {
+		t.Helper()
+		inputs, err := worker.ParseJob(&api.CommandJob{
+			Uuid:            "abc",
+			Command:         "echo hello world",
+			AgentQueryRules: tags,
+		})
+		require.NoError(t, err)
+		return worker.Build(podSpec, false, inputs)
+	}
+
+	t.Run("tagged", func(t *testing.T) {
+		t.Parallel()
+		kjob, err := build(t, &corev1.PodSpec{}, []string{"queue=kubernetes", "bk-cache=go"})
+		require.NoError(t, err)
+		podSpec := kjob.Spec.Template.Spec
+		if !slices.ContainsFunc(podSpec.Volumes, func(v corev1.Volume) bool { return v.Name == goCache.Name }) {
+			t.Errorf("podSpec.Volumes = %v, want it to contain %q", podSpec.Volumes, goCache.Name)
+		}
+		for _, name := range []string{"container-0", "checkout"} {
+			c := findContainer(t, podSpec.Containers, name)
+			want := corev1.VolumeMount{Name: goCache.Name, MountPath: "/cache/go"}
+			if !slices.Contains(c.VolumeMounts, want) {
+				t.Errorf("container %q VolumeMounts = %v, want it to contain %v", name, c.VolumeMounts, want)
+			}
+		}
+	})
+
+	t.Run("other value", func(t *testing.T) {
+		t.Parallel()
+		kjob, err := build(t, &corev1.PodSpec{}, []string{"queue=kubernetes", "bk-cache=npm"})
+		require.NoError(t, err)
+		if slices.ContainsFunc(kjob.Spec.Template.Spec.Volumes, func(v corev1.Volume) bool { return v.Name == goCache.Name }) {
+			t.Errorf("podSpec.Volumes = %v, want it not to contain %q", kjob.Spec.Template.Spec.Volumes, goCache.Name)
+		}
+	})
+
+	t.Run("mount path collision", func(t *testing.T) {
+		t.Parallel()
+		podSpec := &corev1.PodSpec{
+			Containers: []corev1.Container{{
+				Image:        "golang:latest",
+				Command:      []string{"go test ./..."},
+				VolumeMounts: []corev1.VolumeMount{{Name: "my-cache", MountPath: "/cache/go/"}},
+			}},
+		}
+		_, err := build(t, podSpec, []string{"queue=kubernetes", "bk-cache=go"})
+		if err == nil || !strings.Contains(err.Error(), `mount path "/cache/go" is already used by volume "my-cache"`) {
+			t.Errorf("worker.Build(...) error = %v, want a mount path collision error", err)
+		}
+	})
+}
+
+func TestBuildAllowedImages(t *testing.T) {
+	t.Parallel()
+
+	worker := scheduler.New(
+		zaptest.NewLogger(t),
+		nil,
+		scheduler.Config{
+			Namespace:            "buildkite",
+			Image:                "buildkite/agent:latest",
+			AgentTokenSecretName: "bkcq_1234567890",
+			AllowedImages:        []string{"registry.example.com/*", "alpine:3.20"},
+		},
+	)
+
+	tests := []struct {
+		name       string
+		images     []string
+		wantDenied []string
+	}{
+		{
+			name:   "prefix match",
+			images: []string{"registry.example.com/golang:1.23"},
+		},
+		{
+			name:   "exact match",
+			images: []string{"alpine:3.20"},
+		},
+		{
+			name:   "controller image",
+			images: []string{"buildkite/agent:latest"},
+		},
+		{
+			name:       "not allowed",
+			images:     []string{"registry.example.com/golang:1.23", "alpine:latest", "evil.example.com/registry.example.com/x"},
+			wantDenied: []string{"alpine:latest", "evil.example.com/registry.example.com/x"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			inputs, err := worker.ParseJob(&api.CommandJob{
+				Uuid:            "abc",
+				AgentQueryRules: []string{"queue=kubernetes"},
+			})
+			require.NoError(t, err)
+
+			podSpec := &corev1.PodSpec{}
+			for _, image := range test.images {
+				podSpec.Containers = append(podSpec.Containers, corev1.Container{
+					Image:   image,
+					Command: []string{"echo hello world"},
+				})
+			}
+			_, err = worker.Build(podSpec, false, inputs)
+			if len(test.wantDenied) == 0 {
+				require.NoError(t, err)
+				return
+			}
+			require.ErrorContains(t, err, "image is not in the allowed images")
+			for _, image := range test.wantDenied {
+				require.ErrorContains(t, err, image)
+			}
+		})
+	}
+}
+
 func TestFailureJobs(t *testing.T) {
 	t.Parallel()
 	pluginsJSON, err := json.Marshal([]map[string]any{
@@ -469,3 +2023,557 @@ func findEnv(t *testing.T, envs []corev1.EnvVar, name string) *corev1.EnvVar {
 
 	return nil
 }
+
+func TestHandleRetriesCreate(t *testing.T) {
+	t.Parallel()
+
+	lingering := func(finished bool) *batchv1.Job {
+		job := &batchv1.Job{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "buildkite-abc",
+				Namespace: "buildkite",
+				Labels:    map[string]string{config.UUIDLabel: "abc"},
+			},
+		}
+		if finished {
+			job.Status.Conditions = []batchv1.JobCondition{{Type: batchv1.JobComplete, Status: corev1.ConditionTrue}}
+		}
+		return job
+	}
+
+	tests := []struct {
+		name      string
+		retries   int
+		existing  *batchv1.Job
+		errs      []error
+		wantErr   bool
+		wantErrIs error
+		wantN     int
+	}{
+		{
+			name:    "timeout then success",
+			retries: 3,
+			errs:    []error{kerrors.NewServerTimeout(batchv1.Resource("jobs"), "create", 1)},
+			wantN:   2,
+		},
+		{
+			name:    "conflicts exhaust retries",
+			retries: 2,
+			errs: []error{
+				kerrors.NewConflict(batchv1.Resource("jobs"), "job", errors.New("conflict")),
+				kerrors.NewConflict(batchv1.Resource("jobs"), "job", errors.New("conflict")),
+				kerrors.NewConflict(batchv1.Resource("jobs"), "job", errors.New("conflict")),
+			},
+			wantErr: true,
+			wantN:   3,
+		},
+		{
+			name:    "throttled then success",
+			retries: 3,
+			errs:    []error{kerrors.NewTooManyRequests("slow down", 0)},
+			wantN:   2,
+		},
+		{
+			name:     "already exists is not an error",
+			retries:  3,
+			existing: lingering(false),
+			errs:     []error{kerrors.NewAlreadyExists(batchv1.Resource("jobs"), "job")},
+			wantN:    1,
+		},
+		{
+			// The token must be returned, since the informer won't see the
+			// lingering job finish again.
+			name:      "already exists but finished",
+			retries:   3,
+			existing:  lingering(true),
+			errs:      []error{kerrors.NewAlreadyExists(batchv1.Resource("jobs"), "job")},
+			wantErr:   true,
+			wantErrIs: model.ErrDuplicateJob,
+			wantN:     1,
+		},
+		{
+			name:    "already exists but deleted since",
+			retries: 3,
+			errs:    []error{kerrors.NewAlreadyExists(batchv1.Resource("jobs"), "job")},
+			wantErr: true,
+			wantN:   1,
+		},
+		{
+			name:    "other errors are not retried",
+			retries: 3,
+			errs:    []error{kerrors.NewForbidden(batchv1.Resource("jobs"), "job", errors.New("no"))},
+			wantErr: true,
+			wantN:   1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			client := fake.NewSimpleClientset()
+			if test.existing != nil {
+				client = fake.NewSimpleClientset(test.existing)
+			}
+			n := 0
+			client.PrependReactor("create", "jobs", func(k8stesting.Action) (bool, runtime.Object, error) {
+				n++
+				if n <= len(test.errs) {
+					return true, nil, test.errs[n-1]
+				}
+				return false, nil, nil
+			})
+
+			worker := scheduler.New(zaptest.NewLogger(t), client, scheduler.Config{
+				Namespace:     "buildkite",
+				Image:         "buildkite/agent:latest",
+				CreateRetries: test.retries,
+			})
+			err := worker.Handle(context.Background(), model.Job{CommandJob: &api.CommandJob{
+				Uuid:            "abc",
+				Command:         "echo hello world",
+				AgentQueryRules: []string{"queue=kubernetes"},
+			}})
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Errorf("worker.Handle(ctx, job) error = %v, want error: %t", err, test.wantErr)
+			}
+			if test.wantErrIs != nil && !errors.Is(err, test.wantErrIs) {
+				t.Errorf("worker.Handle(ctx, job) error = %v, want %v", err, test.wantErrIs)
+			}
+			if n != test.wantN {
+				t.Errorf("create calls = %d, want %d", n, test.wantN)
+			}
+		})
+	}
+}
+
+func TestHandleRespectsRetryAfter(t *testing.T) {
+	t.Parallel()
+
+	client := fake.NewSimpleClientset()
+	var calls []time.Time
+	client.PrependReactor("create", "jobs", func(k8stesting.Action) (bool, runtime.Object, error) {
+		calls = append(calls, time.Now())
+		if len(calls) == 1 {
+			return true, nil, kerrors.NewTooManyRequests("the server is overloaded", 1)
+		}
+		return false, nil, nil
+	})
+
+	worker := scheduler.New(zaptest.NewLogger(t), client, scheduler.Config{
+		Namespace:     "buildkite",
+		Image:         "buildkite/agent:latest",
+		CreateRetries: 3,
+	})
+	job := func(uuid string) model.Job {
+		return model.Job{CommandJob: &api.CommandJob{
+			Uuid:            uuid,
+			Command:         "echo hello world",
+			AgentQueryRules: []string{"queue=kubernetes"},
+		}}
+	}
+	if err := worker.Handle(context.Background(), job("abc")); err != nil {
+		t.Fatalf("worker.Handle(ctx, job abc) error = %v", err)
+	}
+	if got, want := len(calls), 2; got != want {
+		t.Fatalf("create calls = %d, want %d", got, want)
+	}
+	if gap := calls[1].Sub(calls[0]); gap < 900*time.Millisecond {
+		t.Errorf("retry after a 429 with Retry-After: 1 came %v after the first call, want at least 1s", gap)
+	}
+
+	// Without retries, the 429 is returned, but the next job is still held
+	// back until the delay has passed.
+	calls = nil
+	worker = scheduler.New(zaptest.NewLogger(t), client, scheduler.Config{
+		Namespace: "buildkite",
+		Image:     "buildkite/agent:latest",
+	})
+	if err := worker.Handle(context.Background(), job("def")); !kerrors.IsTooManyRequests(err) {
+		t.Fatalf("worker.Handle(ctx, job def) error = %v, want a 429", err)
+	}
+	if err := worker.Handle(context.Background(), job("ghi")); err != nil {
+		t.Errorf("worker.Handle(ctx, job ghi) error = %v", err)
+	}
+	if got, want := len(calls), 2; got != want {
+		t.Fatalf("create calls = %d, want %d", got, want)
+	}
+	if gap := calls[1].Sub(calls[0]); gap < 900*time.Millisecond {
+		t.Errorf("create call for another job came %v after a 429 with Retry-After: 1, want at least 1s", gap)
+	}
+}
+
+func TestHandlePacesCreate(t *testing.T) {
+	t.Parallel()
+
+	client := fake.NewSimpleClientset()
+	worker := scheduler.New(zaptest.NewLogger(t), client, scheduler.Config{
+		Namespace:   "buildkite",
+		Image:       "buildkite/agent:latest",
+		CreateQPS:   20,
+		CreateBurst: 1,
+	})
+
+	start := time.Now()
+	for _, uuid := range []string{"abc", "def", "ghi"} {
+		err := worker.Handle(context.Background(), model.Job{CommandJob: &api.CommandJob{
+			Uuid:            uuid,
+			Command:         "echo hello world",
+			AgentQueryRules: []string{"queue=kubernetes"},
+		}})
+		if err != nil {
+			t.Fatalf("worker.Handle(ctx, job %s) error = %v", uuid, err)
+		}
+	}
+	// The first create uses the burst, and the other two wait 50ms each.
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Errorf("3 creates at 20 QPS with burst 1 took %v, want at least 100ms", elapsed)
+	}
+}
+
+func TestHandleCreateWaitInterrupted(t *testing.T) {
+	t.Parallel()
+
+	client := fake.NewSimpleClientset()
+	worker := scheduler.New(zaptest.NewLogger(t), client, scheduler.Config{
+		Namespace:   "buildkite",
+		Image:       "buildkite/agent:latest",
+		CreateQPS:   0.001,
+		CreateBurst: 1,
+	})
+	job := func(uuid string) model.Job {
+		return model.Job{CommandJob: &api.CommandJob{
+			Uuid:            uuid,
+			Command:         "echo hello world",
+			AgentQueryRules: []string{"queue=kubernetes"},
+		}}
+	}
+	if err := worker.Handle(context.Background(), job("abc")); err != nil {
+		t.Fatalf("worker.Handle(ctx, job abc) error = %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := worker.Handle(ctx, job("def")); err == nil {
+		t.Errorf("worker.Handle(ctx, job def) error = nil, want an error once ctx is done")
+	}
+	jobs, err := client.BatchV1().Jobs("buildkite").List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("client.BatchV1().Jobs(buildkite).List() error = %v", err)
+	}
+	if got := len(jobs.Items); got != 1 {
+		t.Errorf("len(jobs.Items) = %d, want 1", got)
+	}
+}
+
+func TestHandleRetriesCreateWithGeneratedName(t *testing.T) {
+	t.Parallel()
+
+	// A job created by an earlier attempt, whose response was lost.
+	client := fake.NewSimpleClientset(&batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "buildkite-abc-x7k2q",
+			Namespace: "buildkite",
+			Labels:    map[string]string{config.UUIDLabel: "abc"},
+		},
+	})
+	n := 0
+	client.PrependReactor("create", "jobs", func(k8stesting.Action) (bool, runtime.Object, error) {
+		n++
+		return true, nil, kerrors.NewServerTimeout(batchv1.Resource("jobs"), "create", 1)
+	})
+
+	worker := scheduler.New(zaptest.NewLogger(t), client, scheduler.Config{
+		Namespace:        "buildkite",
+		Image:            "buildkite/agent:latest",
+		CreateRetries:    3,
+		GenerateJobNames: true,
+	})
+	err := worker.Handle(context.Background(), model.Job{CommandJob: &api.CommandJob{
+		Uuid:            "abc",
+		Command:         "echo hello world",
+		AgentQueryRules: []string{"queue=kubernetes"},
+	}})
+	if err != nil {
+		t.Errorf("worker.Handle(ctx, job) error = %v", err)
+	}
+	if n != 1 {
+		t.Errorf("create calls = %d, want 1", n)
+	}
+}
+
+func TestBuildAgentLifecycle(t *testing.T) {
+	t.Parallel()
+
+	defaultPreStop := &corev1.LifecycleHandler{
+		Exec: &corev1.ExecAction{Command: []string{"/bin/sh", "-c", "flush-logs"}},
+	}
+	queuePreStop := &corev1.LifecycleHandler{
+		Sleep: &corev1.SleepAction{Seconds: 5},
+	}
+	postStart := &corev1.LifecycleHandler{
+		HTTPGet: &corev1.HTTPGetAction{Path: "/started", Port: intstr.FromInt32(8080)},
+	}
+
+	worker := scheduler.New(
+		zaptest.NewLogger(t),
+		nil,
+		scheduler.Config{
+			Namespace: "buildkite",
+			Image:     "buildkite/agent:latest",
+			DefaultPodParams: &config.PodParams{
+				AgentLifecycle: &corev1.Lifecycle{
+					PostStart: postStart,
+					PreStop:   defaultPreStop,
+				},
+			},
+			QueuePodParams: map[string]*config.PodParams{
+				"slow": {AgentLifecycle: &corev1.Lifecycle{PreStop: queuePreStop}},
+			},
+		},
+	)
+
+	cases := []struct {
+		queue string
+		want  *corev1.Lifecycle
+	}{
+		{queue: "default", want: &corev1.Lifecycle{PostStart: postStart, PreStop: defaultPreStop}},
+		{queue: "slow", want: &corev1.Lifecycle{PostStart: postStart, PreStop: queuePreStop}},
+	}
+
+	for _, test := range cases {
+		t.Run(test.queue, func(t *testing.T) {
+			t.Parallel()
+			job := &api.CommandJob{
+				Uuid:            "abc",
+				Command:         "echo hello world",
+				AgentQueryRules: []string{"queue=" + test.queue},
+			}
+			inputs, err := worker.ParseJob(job)
+			require.NoError(t, err)
+			kjob, err := worker.Build(&corev1.PodSpec{}, false, inputs)
+			require.NoError(t, err)
+
+			agent := findContainer(t, kjob.Spec.Template.Spec.Containers, scheduler.AgentContainerName)
+			if diff := cmp.Diff(test.want, agent.Lifecycle); diff != "" {
+				t.Errorf("agent container Lifecycle diff (-want +got):\n%s", diff)
+			}
+			for _, c := range kjob.Spec.Template.Spec.Containers {
+				if c.Name != scheduler.AgentContainerName && c.Lifecycle != nil {
+					t.Errorf("container %q Lifecycle = %v, want nil", c.Name, c.Lifecycle)
+				}
+			}
+		})
+	}
+}
+
+func TestBuildPodTagLabels(t *testing.T) {
+	t.Parallel()
+
+	worker := scheduler.New(
+		zaptest.NewLogger(t),
+		nil,
+		scheduler.Config{
+			Namespace: "buildkite",
+			Image:     "buildkite/agent:latest",
+			DefaultMetadata: config.Metadata{
+				Labels: map[string]string{"example.com/team": "from-metadata"},
+			},
+			PodTagLabels: config.PodTagLabels{
+				"team":    "example.com/team",
+				"missing": "example.com/missing",
+			},
+		},
+	)
+
+	job := &api.CommandJob{
+		Uuid:            "abc",
+		Command:         "echo hello world",
+		AgentQueryRules: []string{"queue=default", "team=Platform Eng"},
+	}
+	inputs, err := worker.ParseJob(job)
+	require.NoError(t, err)
+	kjob, err := worker.Build(&corev1.PodSpec{}, false, inputs)
+	require.NoError(t, err)
+
+	podLabels := kjob.Spec.Template.Labels
+	assert.Equal(t, "Platform-Eng", podLabels["example.com/team"])
+	assert.NotContains(t, podLabels, "example.com/missing")
+	// The controller's labels are still on the pod.
+	assert.Equal(t, "abc", podLabels[config.UUIDLabel])
+	assert.Equal(t, "default", podLabels[config.QueueTagLabel])
+
+	// The Kubernetes job keeps the label from metadata.
+	assert.Equal(t, "from-metadata", kjob.Labels["example.com/team"])
+}
+
+func TestBuildPodAnnotations(t *testing.T) {
+	t.Parallel()
+
+	worker := scheduler.New(
+		zaptest.NewLogger(t),
+		nil,
+		scheduler.Config{
+			Namespace: "buildkite",
+			Image:     "buildkite/agent:latest",
+			DefaultMetadata: config.Metadata{
+				Annotations: map[string]string{"linkerd.io/inject": "enabled"},
+			},
+			DefaultPodParams: &config.PodParams{
+				PodAnnotations: map[string]string{
+					"sidecar.istio.io/inject": "false",
+					"linkerd.io/inject":       "disabled",
+				},
+			},
+			QueuePodParams: map[string]*config.PodParams{
+				"mesh": {PodAnnotations: map[string]string{"sidecar.istio.io/inject": "true"}},
+			},
+		},
+	)
+
+	cases := []struct {
+		name    string
+		queue   string
+		plugin  *scheduler.KubernetesPlugin
+		wantPod map[string]string
+	}{
+		{
+			name:  "default",
+			queue: "default",
+			wantPod: map[string]string{
+				"sidecar.istio.io/inject": "false",
+				"linkerd.io/inject":       "disabled",
+			},
+		},
+		{
+			name:  "queue override",
+			queue: "mesh",
+			wantPod: map[string]string{
+				"sidecar.istio.io/inject": "true",
+				"linkerd.io/inject":       "disabled",
+			},
+		},
+		{
+			name:  "plugin metadata",
+			queue: "default",
+			plugin: &scheduler.KubernetesPlugin{
+				Metadata: config.Metadata{
+					Annotations: map[string]string{"sidecar.istio.io/inject": "true"},
+				},
+			},
+			wantPod: map[string]string{
+				"sidecar.istio.io/inject": "true",
+				"linkerd.io/inject":       "disabled",
+			},
+		},
+	}
+
+	for _, test := range cases {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			job := &api.CommandJob{
+				Uuid:            "abc",
+				Command:         "echo hello world",
+				AgentQueryRules: []string{"queue=" + test.queue},
+			}
+			if test.plugin != nil {
+				pluginsJSON, err := json.Marshal([]map[string]any{
+					{"github.com/buildkite-plugins/kubernetes-buildkite-plugin": test.plugin},
+				})
+				require.NoError(t, err)
+				job.Env = []string{fmt.Sprintf("BUILDKITE_PLUGINS=%s", pluginsJSON)}
+			}
+			inputs, err := worker.ParseJob(job)
+			require.NoError(t, err)
+			kjob, err := worker.Build(&corev1.PodSpec{}, false, inputs)
+			require.NoError(t, err)
+
+			for k, want := range test.wantPod {
+				assert.Equal(t, want, kjob.Spec.Template.Annotations[k], "pod annotation %q", k)
+			}
+			// Pod annotations only go on the pod.
+			if test.plugin == nil {
+				assert.NotContains(t, kjob.Annotations, "sidecar.istio.io/inject")
+			}
+			assert.Equal(t, "enabled", kjob.Annotations["linkerd.io/inject"])
+			assert.Equal(t, "abc", kjob.Spec.Template.Annotations[config.UUIDLabel])
+			assert.Equal(t, model.ContentHash(job), kjob.Annotations[config.ContentHashAnnotation])
+			assert.Equal(t, "queue="+test.queue, kjob.Annotations[config.AgentTagsAnnotation])
+		})
+	}
+}
+
+func TestBuildSchedulingGates(t *testing.T) {
+	t.Parallel()
+
+	worker := scheduler.New(
+		zaptest.NewLogger(t),
+		nil,
+		scheduler.Config{
+			Namespace: "buildkite",
+			Image:     "buildkite/agent:latest",
+			DefaultPodParams: &config.PodParams{
+				SchedulingGates: []corev1.PodSchedulingGate{{Name: "example.com/audit"}},
+			},
+			QueuePodParams: map[string]*config.PodParams{
+				"reserved": {SchedulingGates: []corev1.PodSchedulingGate{{Name: "example.com/quota-reservation"}}},
+			},
+		},
+	)
+
+	cases := []struct {
+		name    string
+		queue   string
+		podSpec *corev1.PodSpec
+		want    []corev1.PodSchedulingGate
+	}{
+		{
+			name:  "default",
+			queue: "default",
+			want:  []corev1.PodSchedulingGate{{Name: "example.com/audit"}},
+		},
+		{
+			name:  "queue",
+			queue: "reserved",
+			want: []corev1.PodSchedulingGate{
+				{Name: "example.com/audit"},
+				{Name: "example.com/quota-reservation"},
+			},
+		},
+		{
+			name:  "plugin gates kept",
+			queue: "reserved",
+			podSpec: &corev1.PodSpec{SchedulingGates: []corev1.PodSchedulingGate{
+				{Name: "example.com/quota-reservation"},
+				{Name: "example.com/approval"},
+			}},
+			want: []corev1.PodSchedulingGate{
+				{Name: "example.com/quota-reservation"},
+				{Name: "example.com/approval"},
+				{Name: "example.com/audit"},
+			},
+		},
+	}
+
+	for _, test := range cases {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			inputs, err := worker.ParseJob(&api.CommandJob{
+				Uuid:            "abc",
+				Command:         "echo hello world",
+				AgentQueryRules: []string{"queue=" + test.queue},
+			})
+			require.NoError(t, err)
+			podSpec := test.podSpec
+			if podSpec == nil {
+				podSpec = &corev1.PodSpec{}
+			}
+			kjob, err := worker.Build(podSpec, false, inputs)
+			require.NoError(t, err)
+
+			if diff := cmp.Diff(test.want, kjob.Spec.Template.Spec.SchedulingGates); diff != "" {
+				t.Errorf("pod scheduling gates diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
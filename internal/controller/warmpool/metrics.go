@@ -0,0 +1,32 @@
+package warmpool
+
+import (
+	"github.com/buildkite/agent-stack-k8s/v2/internal/controller/metrics"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const promSubsystem = "warmpool"
+
+var (
+	targetSizeGauge = metrics.Factory.NewGaugeVec(prometheus.GaugeOpts{
+		Subsystem: promSubsystem,
+		Name:      "target_size",
+		Help:      "Configured number of warm pods to keep for each queue",
+	}, []string{"queue"})
+	idlePodsGauge = metrics.Factory.NewGaugeVec(prometheus.GaugeOpts{
+		Subsystem: promSubsystem,
+		Name:      "idle_pods",
+		Help:      "Number of warm pods that are running and available to be claimed, as of the last refill",
+	}, []string{"queue"})
+	hitsCounter = metrics.Factory.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: promSubsystem,
+		Name:      "hits_total",
+		Help:      "Count of jobs that claimed a warm pod",
+	}, []string{"queue"})
+	missesCounter = metrics.Factory.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: promSubsystem,
+		Name:      "misses_total",
+		Help:      "Count of jobs in queues with a warm pool that found no warm pod to claim",
+	}, []string{"queue"})
+)
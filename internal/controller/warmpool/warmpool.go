@@ -0,0 +1,314 @@
+package warmpool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/buildkite/agent-stack-k8s/v2/internal/controller/config"
+
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/utils/ptr"
+)
+
+const (
+	// refillInterval is how often the pool checks for missing warm pods.
+	refillInterval = 5 * time.Second
+
+	// claimBindTimeout is the longest that a claimed warm pod is counted
+	// towards the pool while waiting for the pod of the job that claimed it
+	// to be bound to a node (e.g. if the job's pod is never created).
+	claimBindTimeout = 2 * time.Minute
+)
+
+// Pool keeps a number of idle "warm" pods running for each configured queue.
+// Warm pods run the agent image, so a node that runs one has the image pulled
+// and capacity reserved for a job. When a job for the queue is scheduled, it
+// claims a warm pod, which deletes the pod to free the capacity and tells the
+// scheduler which node the job's pod should prefer.
+//
+// Warm pods don't have a job UUID label, so they aren't seen by the limiter
+// and don't consume tokens.
+type Pool struct {
+	logger *zap.Logger
+	client kubernetes.Interface
+	cfg    Config
+
+	// claims are the warm pods that have been claimed, by queue, until the
+	// pods of the jobs that claimed them are bound to a node. Until then,
+	// they still count towards the pool, so that a replacement warm pod
+	// doesn't take the capacity the job's pod was meant to get.
+	claimsMu sync.Mutex
+	claims   map[string][]claim
+}
+
+// claim is a warm pod claimed by a job.
+type claim struct {
+	uuid string
+	at   time.Time
+}
+
+// Config configures a Pool.
+type Config struct {
+	Namespace string
+	Image     string
+
+	// Sizes is the number of warm pods to keep, by queue. Queues must be
+	// valid label values.
+	Sizes map[string]int
+
+	// Warm pods are built with the pod params for their queue that affect
+	// admission and placement, so that they are admitted and placed like the
+	// queue's job pods (see applyPodParams).
+	DefaultPodParams *config.PodParams
+	QueuePodParams   map[string]*config.PodParams
+
+	// Warm pods request the default of each bounded resource, which is what
+	// a job without resource hint tags gets, so that they reserve about as
+	// much capacity as the job that claims them needs.
+	ResourceHints *config.ResourceHints
+}
+
+// New creates a Pool.
+func New(logger *zap.Logger, client kubernetes.Interface, cfg Config) (*Pool, error) {
+	var errs []error
+	for queue, size := range cfg.Sizes {
+		if size < 0 {
+			errs = append(errs, fmt.Errorf("warm pool size for queue %q is negative (%d)", queue, size))
+		}
+		for _, msg := range validation.IsValidLabelValue(queue) {
+			errs = append(errs, fmt.Errorf("warm pool queue %q is not a valid label value: %s", queue, msg))
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	cfg.Sizes = maps.Clone(cfg.Sizes)
+	return &Pool{
+		logger: logger,
+		client: client,
+		cfg:    cfg,
+		claims: make(map[string][]claim),
+	}, nil
+}
+
+// Run keeps the warm pools filled until ctx is done.
+func (p *Pool) Run(ctx context.Context) {
+	for queue, size := range p.cfg.Sizes {
+		targetSizeGauge.WithLabelValues(queue).Set(float64(size))
+	}
+	ticker := time.NewTicker(refillInterval)
+	defer ticker.Stop()
+	for {
+		for _, queue := range slices.Sorted(maps.Keys(p.cfg.Sizes)) {
+			if err := p.refill(ctx, queue); err != nil && ctx.Err() == nil {
+				p.logger.Warn("refilling warm pool", zap.String("queue", queue), zap.Error(err))
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Claim deletes a running warm pod for the queue for the job with the UUID,
+// and returns the name of the node it was running on. It reports false if the
+// queue has no warm pool, or no warm pod is available.
+func (p *Pool) Claim(ctx context.Context, queue, uuid string) (string, bool) {
+	if p.cfg.Sizes[queue] == 0 {
+		return "", false
+	}
+	pods, err := p.listPods(ctx, queue)
+	if err != nil {
+		p.logger.Warn("listing warm pods", zap.String("queue", queue), zap.Error(err))
+		missesCounter.WithLabelValues(queue).Inc()
+		return "", false
+	}
+	for _, pod := range pods {
+		if !idle(&pod) {
+			continue
+		}
+		// The precondition ensures that if several workers race to claim the
+		// same pod, only one succeeds.
+		err := p.client.CoreV1().Pods(p.cfg.Namespace).Delete(ctx, pod.Name, metav1.DeleteOptions{
+			Preconditions:      metav1.NewUIDPreconditions(string(pod.UID)),
+			GracePeriodSeconds: ptr.To[int64](0),
+		})
+		if kerrors.IsNotFound(err) || kerrors.IsConflict(err) {
+			continue
+		}
+		if err != nil {
+			p.logger.Warn("deleting warm pod", zap.String("pod", pod.Name), zap.Error(err))
+			continue
+		}
+		p.claimsMu.Lock()
+		p.claims[queue] = append(p.claims[queue], claim{uuid: uuid, at: time.Now()})
+		p.claimsMu.Unlock()
+		hitsCounter.WithLabelValues(queue).Inc()
+		return pod.Spec.NodeName, true
+	}
+	missesCounter.WithLabelValues(queue).Inc()
+	return "", false
+}
+
+// refill deletes finished warm pods for the queue, and creates pods until
+// there are enough.
+func (p *Pool) refill(ctx context.Context, queue string) error {
+	pods, err := p.listPods(ctx, queue)
+	if err != nil {
+		return err
+	}
+	live, idleCount := 0, 0
+	for _, pod := range pods {
+		switch {
+		case pod.DeletionTimestamp != nil:
+			// Going away; don't count it.
+		case pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed:
+			if err := p.client.CoreV1().Pods(p.cfg.Namespace).Delete(ctx, pod.Name, metav1.DeleteOptions{}); err != nil && !kerrors.IsNotFound(err) {
+				return fmt.Errorf("deleting finished warm pod %s: %w", pod.Name, err)
+			}
+		default:
+			live++
+			if idle(&pod) {
+				idleCount++
+			}
+		}
+	}
+	idlePodsGauge.WithLabelValues(queue).Set(float64(idleCount))
+
+	claimed, err := p.unboundClaims(ctx, queue)
+	if err != nil {
+		return err
+	}
+	for range p.cfg.Sizes[queue] - live - claimed {
+		if _, err := p.client.CoreV1().Pods(p.cfg.Namespace).Create(ctx, p.warmPod(queue), metav1.CreateOptions{}); err != nil {
+			return fmt.Errorf("creating warm pod: %w", err)
+		}
+	}
+	return nil
+}
+
+// unboundClaims returns the number of claims for the queue whose job's pod
+// hasn't been bound to a node yet, forgetting the rest.
+func (p *Pool) unboundClaims(ctx context.Context, queue string) (int, error) {
+	p.claimsMu.Lock()
+	claims := p.claims[queue]
+	p.claimsMu.Unlock()
+
+	var unbound []claim
+	for _, c := range claims {
+		if time.Since(c.at) > claimBindTimeout {
+			continue
+		}
+		list, err := p.client.CoreV1().Pods(p.cfg.Namespace).List(ctx, metav1.ListOptions{
+			LabelSelector: labels.Set{config.UUIDLabel: c.uuid}.String(),
+		})
+		if err != nil {
+			return 0, err
+		}
+		if !slices.ContainsFunc(list.Items, func(pod corev1.Pod) bool { return pod.Spec.NodeName != "" }) {
+			unbound = append(unbound, c)
+		}
+	}
+
+	// Claims made while checking are kept for the next refill.
+	p.claimsMu.Lock()
+	defer p.claimsMu.Unlock()
+	p.claims[queue] = append(unbound, p.claims[queue][len(claims):]...)
+	return len(unbound), nil
+}
+
+func (p *Pool) listPods(ctx context.Context, queue string) ([]corev1.Pod, error) {
+	selector := labels.SelectorFromSet(labels.Set{config.WarmPoolQueueLabel: queue})
+	list, err := p.client.CoreV1().Pods(p.cfg.Namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: selector.String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+// warmPod returns a new warm pod for the queue.
+func (p *Pool) warmPod(queue string) *corev1.Pod {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: "buildkite-warm-pool-",
+			Labels:       map[string]string{config.WarmPoolQueueLabel: queue},
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{
+				Name:            "warm",
+				Image:           p.cfg.Image,
+				ImagePullPolicy: corev1.PullIfNotPresent,
+				Command:         []string{"sleep", "2147483647"},
+				Resources:       p.resources(),
+			}},
+			RestartPolicy:                 corev1.RestartPolicyNever,
+			TerminationGracePeriodSeconds: ptr.To[int64](0),
+		},
+	}
+	p.applyPodParams(&pod.Spec, queue)
+	return pod
+}
+
+// applyPodParams applies the queue's pod params that affect how the pod is
+// admitted and placed (its service account, priority class, topology spread
+// constraints and security contexts), so that warm pods land where the
+// queue's job pods would. The rest only make sense for job pods. In
+// particular, a warm pod with the scheduling gates would never get a node.
+func (p *Pool) applyPodParams(podSpec *corev1.PodSpec, queue string) {
+	pp := p.cfg.DefaultPodParams.WithOverrides(p.cfg.QueuePodParams[queue])
+	if pp == nil {
+		return
+	}
+	placement := &config.PodParams{
+		ServiceAccountName:        pp.ServiceAccountName,
+		PriorityClassName:         pp.PriorityClassName,
+		TopologySpreadConstraints: pp.TopologySpreadConstraints,
+		SecurityContext:           pp.SecurityContext,
+		ContainerSecurityContext:  pp.ContainerSecurityContext,
+		SecurityProfile:           pp.SecurityProfile,
+	}
+	placement.ApplySecurityContextTo(podSpec)
+	placement.ApplyTo(podSpec)
+}
+
+// resources returns the resource requests of warm pods.
+func (p *Pool) resources() corev1.ResourceRequirements {
+	hints := p.cfg.ResourceHints
+	if hints == nil {
+		return corev1.ResourceRequirements{}
+	}
+	requests := make(corev1.ResourceList)
+	for name, bounds := range map[corev1.ResourceName]*config.ResourceBounds{
+		corev1.ResourceCPU:              hints.CPU,
+		corev1.ResourceMemory:           hints.Memory,
+		corev1.ResourceEphemeralStorage: hints.EphemeralStorage,
+	} {
+		if bounds != nil && bounds.Default != nil {
+			requests[name] = bounds.Default.DeepCopy()
+		}
+	}
+	if len(requests) == 0 {
+		return corev1.ResourceRequirements{}
+	}
+	return corev1.ResourceRequirements{Requests: requests}
+}
+
+// idle reports whether the pod is running on a node and not being deleted.
+func idle(pod *corev1.Pod) bool {
+	return pod.DeletionTimestamp == nil && pod.Spec.NodeName != "" && pod.Status.Phase == corev1.PodRunning
+}
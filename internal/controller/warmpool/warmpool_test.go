@@ -0,0 +1,289 @@
+package warmpool_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent-stack-k8s/v2/internal/controller/config"
+	"github.com/buildkite/agent-stack-k8s/v2/internal/controller/warmpool"
+	"github.com/google/go-cmp/cmp"
+	"go.uber.org/zap/zaptest"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/utils/ptr"
+)
+
+// fakeClientset returns a fake clientset that fills in the names of pods
+// created with generateName, which the fake doesn't do itself.
+func fakeClientset() *fake.Clientset {
+	client := fake.NewClientset()
+	var n atomic.Int64
+	client.PrependReactor("create", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		pod := action.(k8stesting.CreateAction).GetObject().(*corev1.Pod)
+		if pod.Name == "" {
+			pod.Name = fmt.Sprintf("%s%d", pod.GenerateName, n.Add(1))
+		}
+		return false, nil, nil
+	})
+	return client
+}
+
+func TestPool(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client := fakeClientset()
+	pool, err := warmpool.New(zaptest.NewLogger(t), client, warmpool.Config{
+		Namespace: "buildkite",
+		Image:     "buildkite/agent:latest",
+		Sizes:     map[string]int{"default": 2},
+	})
+	if err != nil {
+		t.Fatalf("warmpool.New(...) error = %v", err)
+	}
+
+	// Nothing has been created yet.
+	if node, ok := pool.Claim(ctx, "default", "job-1"); ok {
+		t.Errorf("pool.Claim(ctx, default, job-1) = (%q, true), want false before the pool is filled", node)
+	}
+
+	runCtx, stopRun := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		pool.Run(runCtx)
+		close(done)
+	}()
+	pods := waitForPods(t, ctx, client, 2)
+	stopRun()
+	<-done
+
+	// Pods that aren't running yet can't be claimed.
+	if node, ok := pool.Claim(ctx, "default", "job-1"); ok {
+		t.Errorf("pool.Claim(ctx, default, job-1) = (%q, true), want false while pods are pending", node)
+	}
+
+	running := pods[0]
+	running.Spec.NodeName = "node-a"
+	running.Status.Phase = corev1.PodRunning
+	if _, err := client.CoreV1().Pods("buildkite").Update(ctx, &running, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("updating pod: %v", err)
+	}
+
+	node, ok := pool.Claim(ctx, "default", "job-1")
+	if !ok || node != "node-a" {
+		t.Errorf("pool.Claim(ctx, default, job-1) = (%q, %t), want (node-a, true)", node, ok)
+	}
+	if _, err := client.CoreV1().Pods("buildkite").Get(ctx, running.Name, metav1.GetOptions{}); err == nil {
+		t.Errorf("claimed pod %s still exists, want it deleted", running.Name)
+	}
+
+	// Queues without a warm pool never get a warm pod.
+	if node, ok := pool.Claim(ctx, "other", "job-2"); ok {
+		t.Errorf("pool.Claim(ctx, other, job-2) = (%q, true), want false", node)
+	}
+}
+
+func TestNew_InvalidQueue(t *testing.T) {
+	t.Parallel()
+
+	for _, sizes := range []map[string]int{
+		{"not a label value!": 1},
+		{"default": -1},
+	} {
+		cfg := warmpool.Config{Namespace: "buildkite", Image: "buildkite/agent:latest", Sizes: sizes}
+		if _, err := warmpool.New(zaptest.NewLogger(t), fake.NewClientset(), cfg); err == nil {
+			t.Errorf("warmpool.New(..., %v) error = nil, want an error", sizes)
+		}
+	}
+}
+
+func TestPool_PodParamsAndResources(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client := fakeClientset()
+	pool, err := warmpool.New(zaptest.NewLogger(t), client, warmpool.Config{
+		Namespace: "buildkite",
+		Image:     "buildkite/agent:latest",
+		Sizes:     map[string]int{"restricted": 1},
+		DefaultPodParams: &config.PodParams{
+			ServiceAccountName: "buildkite-jobs",
+			PriorityClassName:  "ci",
+			SchedulingGates:    []corev1.PodSchedulingGate{{Name: "example.com/quota-reservation"}},
+			AgentEnv:           []corev1.EnvVar{{Name: "FOO", Value: "bar"}},
+		},
+		QueuePodParams: map[string]*config.PodParams{
+			"restricted": {SecurityProfile: config.SecurityProfileRestricted},
+		},
+		ResourceHints: &config.ResourceHints{
+			CPU: &config.ResourceBounds{
+				Max:     resource.MustParse("4"),
+				Default: ptr.To(resource.MustParse("500m")),
+			},
+			Memory: &config.ResourceBounds{Max: resource.MustParse("8Gi")},
+		},
+	})
+	if err != nil {
+		t.Fatalf("warmpool.New(...) error = %v", err)
+	}
+
+	runCtx, stopRun := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		pool.Run(runCtx)
+		close(done)
+	}()
+	pod := waitForPods(t, ctx, client, 1)[0]
+	stopRun()
+	<-done
+
+	if got, want := pod.Spec.ServiceAccountName, "buildkite-jobs"; got != want {
+		t.Errorf("pod.Spec.ServiceAccountName = %q, want %q", got, want)
+	}
+	if got, want := pod.Spec.PriorityClassName, "ci"; got != want {
+		t.Errorf("pod.Spec.PriorityClassName = %q, want %q", got, want)
+	}
+	// A gated warm pod would never be placed on a node.
+	if gates := pod.Spec.SchedulingGates; len(gates) != 0 {
+		t.Errorf("pod.Spec.SchedulingGates = %v, want none", gates)
+	}
+	if psc := pod.Spec.SecurityContext; psc == nil || !ptr.Deref(psc.RunAsNonRoot, false) {
+		t.Errorf("pod.Spec.SecurityContext = %v, want runAsNonRoot: true", psc)
+	}
+	ctr := pod.Spec.Containers[0]
+	if csc := ctr.SecurityContext; csc == nil || ptr.Deref(csc.AllowPrivilegeEscalation, true) {
+		t.Errorf("container SecurityContext = %v, want allowPrivilegeEscalation: false", csc)
+	}
+	wantRequests := corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("500m")}
+	if diff := cmp.Diff(wantRequests, ctr.Resources.Requests); diff != "" {
+		t.Errorf("container Resources.Requests diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestPool_ClaimedPodReplacedOnceJobPodIsBound(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client := fakeClientset()
+	pool, err := warmpool.New(zaptest.NewLogger(t), client, warmpool.Config{
+		Namespace: "buildkite",
+		Image:     "buildkite/agent:latest",
+		Sizes:     map[string]int{"default": 1},
+	})
+	if err != nil {
+		t.Fatalf("warmpool.New(...) error = %v", err)
+	}
+	// run runs the pool until it has checked whether the job's pod is bound,
+	// and returns the pods in the namespace.
+	run := func() []corev1.Pod {
+		t.Helper()
+		client.ClearActions()
+		runCtx, stopRun := context.WithCancel(ctx)
+		done := make(chan struct{})
+		go func() {
+			pool.Run(runCtx)
+			close(done)
+		}()
+		deadline := time.Now().Add(5 * time.Second)
+		for !checkedJobPod(client) {
+			if time.Now().After(deadline) {
+				t.Fatal("the pool didn't check whether the job's pod is bound")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		stopRun()
+		<-done
+		list, err := client.CoreV1().Pods("buildkite").List(ctx, metav1.ListOptions{})
+		if err != nil {
+			t.Fatalf("listing pods: %v", err)
+		}
+		return list.Items
+	}
+
+	runCtx, stopRun := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		pool.Run(runCtx)
+		close(done)
+	}()
+	warm := waitForPods(t, ctx, client, 1)[0]
+	stopRun()
+	<-done
+	warm.Spec.NodeName = "node-a"
+	warm.Status.Phase = corev1.PodRunning
+	if _, err := client.CoreV1().Pods("buildkite").Update(ctx, &warm, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("updating pod: %v", err)
+	}
+	if _, ok := pool.Claim(ctx, "default", "job-1"); !ok {
+		t.Fatal("pool.Claim(ctx, default, job-1) = false, want true")
+	}
+
+	// The job's pod hasn't been bound to the warm pod's node yet, so the
+	// warm pod isn't replaced.
+	jobPod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "buildkite-job-1",
+			Namespace: "buildkite",
+			Labels:    map[string]string{config.UUIDLabel: "job-1"},
+		},
+	}
+	if _, err := client.CoreV1().Pods("buildkite").Create(ctx, jobPod, metav1.CreateOptions{}); err != nil {
+		t.Fatalf("creating job pod: %v", err)
+	}
+	if pods := run(); len(pods) != 1 {
+		t.Errorf("got %d pods before the job's pod was bound, want only the job's pod", len(pods))
+	}
+
+	// Once it is, the warm pod is replaced.
+	jobPod.Spec.NodeName = "node-a"
+	if _, err := client.CoreV1().Pods("buildkite").Update(ctx, jobPod, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("updating job pod: %v", err)
+	}
+	if pods := run(); len(pods) != 2 {
+		t.Errorf("got %d pods after the job's pod was bound, want the job's pod and a new warm pod", len(pods))
+	}
+}
+
+// checkedJobPod reports whether the client was asked to list pods by job UUID.
+func checkedJobPod(client *fake.Clientset) bool {
+	for _, action := range client.Actions() {
+		list, ok := action.(k8stesting.ListAction)
+		if ok && list.GetResource().Resource == "pods" && strings.Contains(list.GetListRestrictions().Labels.String(), config.UUIDLabel) {
+			return true
+		}
+	}
+	return false
+}
+
+// waitForPods waits until there are n pods in the namespace, and returns them.
+func waitForPods(t *testing.T, ctx context.Context, client *fake.Clientset, n int) []corev1.Pod {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		list, err := client.CoreV1().Pods("buildkite").List(ctx, metav1.ListOptions{})
+		if err != nil {
+			t.Fatalf("listing pods: %v", err)
+		}
+		if len(list.Items) == n {
+			return list.Items
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d pods, want %d", len(list.Items), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}